@@ -3,11 +3,13 @@ package handle
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/Trinoooo/eggie_kv/consts"
@@ -33,6 +35,22 @@ func (c *ClientWrapper) HandleInput(input string) {
 		c.Get(args)
 	case "set":
 		c.Set(args)
+	case "del":
+		c.Delete(args)
+	case "scan":
+		c.Scan(args)
+	case "ttl":
+		c.TTL(args)
+	case "persist":
+		c.Persist(args)
+	case "cas":
+		c.CompareAndSwap(args)
+	case "setnx":
+		c.SetNX(args)
+	case "incr":
+		c.IncrBy(consts.OperatorTypeIncr, args)
+	case "decr":
+		c.IncrBy(consts.OperatorTypeDecr, args)
 	default:
 		log.Println("error occur when parse form input, errs: Unspported command type ", cmd)
 		return
@@ -65,6 +83,35 @@ func (c *ClientWrapper) Set(args []string) {
 		Key:           []byte(args[0]),
 		Value:         []byte(args[1]),
 	}
+	// set <key> <value> [ttl]，ttl 单位秒，带 ttl 时发送 SetEx：| ttl 8字节 | value |
+	if len(args) > 2 {
+		ttl, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || ttl <= 0 {
+			log.Println("error occur when parse set ttl, errs: ", err)
+			return
+		}
+		value := make([]byte, 8, 8+len(args[1]))
+		binary.BigEndian.PutUint64(value, uint64(ttl))
+		kvReq.OperationType = consts.OperatorTypeSetEx
+		kvReq.Value = append(value, args[1]...)
+	}
+
+	kvResp, ok := c.cmdPost(kvReq)
+	if !ok {
+		return
+	}
+	log.Printf("# %s\n", string(kvResp.Data))
+}
+
+func (c *ClientWrapper) Delete(args []string) {
+	if len(args) <= 0 {
+		log.Println("error occur when marshal del command")
+		return
+	}
+	kvReq := &consts.KvRequest{
+		OperationType: consts.OperatorTypeDelete,
+		Key:           []byte(args[0]),
+	}
 
 	kvResp, ok := c.cmdPost(kvReq)
 	if !ok {
@@ -73,6 +120,194 @@ func (c *ClientWrapper) Set(args []string) {
 	log.Printf("# %s\n", string(kvResp.Data))
 }
 
+func (c *ClientWrapper) Scan(args []string) {
+	if len(args) <= 0 {
+		log.Println("error occur when marshal scan command")
+		return
+	}
+	kvReq := &consts.KvRequest{
+		OperationType: consts.OperatorTypeScan,
+		Key:           []byte(args[0]),
+	}
+	if len(args) > 1 {
+		limit, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			log.Println("error occur when parse scan limit, errs: ", err)
+			return
+		}
+		kvReq.Value = make([]byte, 8)
+		binary.BigEndian.PutUint64(kvReq.Value, limit)
+	}
+
+	kvResp, ok := c.cmdPost(kvReq)
+	if !ok {
+		return
+	}
+	pairs, ok := decodePairs(kvResp.Data)
+	if !ok {
+		log.Println("error occur when decode scan pairs")
+		return
+	}
+	for _, pair := range pairs {
+		log.Printf("# %s: %s\n", pair[0], pair[1])
+	}
+}
+
+// decodePairs 解析 scan 返回的键值对：| 键值对数量 8字节 | key 长度 8字节 | key | value 长度 8字节 | value | ...
+func decodePairs(raw []byte) ([][2][]byte, bool) {
+	readBytes := func() ([]byte, bool) {
+		if len(raw) < 8 {
+			return nil, false
+		}
+		length := binary.BigEndian.Uint64(raw)
+		raw = raw[8:]
+		if uint64(len(raw)) < length {
+			return nil, false
+		}
+		data := raw[:length]
+		raw = raw[length:]
+		return data, true
+	}
+
+	if len(raw) < 8 {
+		return nil, false
+	}
+	count := binary.BigEndian.Uint64(raw)
+	raw = raw[8:]
+
+	var pairs [][2][]byte
+	for i := uint64(0); i < count; i++ {
+		key, ok := readBytes()
+		if !ok {
+			return nil, false
+		}
+		value, ok := readBytes()
+		if !ok {
+			return nil, false
+		}
+		pairs = append(pairs, [2][]byte{key, value})
+	}
+	return pairs, len(raw) == 0
+}
+
+func (c *ClientWrapper) TTL(args []string) {
+	if len(args) <= 0 {
+		log.Println("error occur when marshal ttl command")
+		return
+	}
+	kvReq := &consts.KvRequest{
+		OperationType: consts.OperatorTypeTTL,
+		Key:           []byte(args[0]),
+	}
+
+	kvResp, ok := c.cmdPost(kvReq)
+	if !ok {
+		return
+	}
+	// 返回8字节的剩余毫秒数，没有过期时间时是-1
+	if len(kvResp.Data) != 8 {
+		log.Printf("# %s\n", string(kvResp.Data))
+		return
+	}
+	ms := int64(binary.BigEndian.Uint64(kvResp.Data))
+	if ms < 0 {
+		log.Println("# no ttl")
+		return
+	}
+	log.Printf("# %dms\n", ms)
+}
+
+func (c *ClientWrapper) Persist(args []string) {
+	if len(args) <= 0 {
+		log.Println("error occur when marshal persist command")
+		return
+	}
+	kvReq := &consts.KvRequest{
+		OperationType: consts.OperatorTypePersist,
+		Key:           []byte(args[0]),
+	}
+
+	kvResp, ok := c.cmdPost(kvReq)
+	if !ok {
+		return
+	}
+	log.Printf("# %s\n", string(kvResp.Data))
+}
+
+// CompareAndSwap cas <key> <expected> <value>
+// 期望值与新的 value 编码在 Value 中：| 期望值长度 8字节 | 期望值 | 新的 value |
+func (c *ClientWrapper) CompareAndSwap(args []string) {
+	if len(args) < 3 {
+		log.Println("error occur when marshal cas command")
+		return
+	}
+	value := make([]byte, 8, 8+len(args[1])+len(args[2]))
+	binary.BigEndian.PutUint64(value, uint64(len(args[1])))
+	value = append(value, args[1]...)
+	value = append(value, args[2]...)
+	kvReq := &consts.KvRequest{
+		OperationType: consts.OperatorTypeCAS,
+		Key:           []byte(args[0]),
+		Value:         value,
+	}
+
+	kvResp, ok := c.cmdPost(kvReq)
+	if !ok {
+		return
+	}
+	log.Printf("# %v\n", len(kvResp.Data) == 1 && kvResp.Data[0] == 1)
+}
+
+// SetNX setnx <key> <value>
+func (c *ClientWrapper) SetNX(args []string) {
+	if len(args) < 2 {
+		log.Println("error occur when marshal setnx command")
+		return
+	}
+	kvReq := &consts.KvRequest{
+		OperationType: consts.OperatorTypeSetNX,
+		Key:           []byte(args[0]),
+		Value:         []byte(args[1]),
+	}
+
+	kvResp, ok := c.cmdPost(kvReq)
+	if !ok {
+		return
+	}
+	log.Printf("# %v\n", len(kvResp.Data) == 1 && kvResp.Data[0] == 1)
+}
+
+// IncrBy incr|decr <key> [delta]，不指定 delta 时是1
+func (c *ClientWrapper) IncrBy(opType consts.OperatorType, args []string) {
+	if len(args) <= 0 {
+		log.Println("error occur when marshal incr command")
+		return
+	}
+	kvReq := &consts.KvRequest{
+		OperationType: opType,
+		Key:           []byte(args[0]),
+	}
+	if len(args) > 1 {
+		delta, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			log.Println("error occur when parse incr delta, errs: ", err)
+			return
+		}
+		kvReq.Value = make([]byte, 8)
+		binary.BigEndian.PutUint64(kvReq.Value, uint64(delta))
+	}
+
+	kvResp, ok := c.cmdPost(kvReq)
+	if !ok {
+		return
+	}
+	if len(kvResp.Data) != 8 {
+		log.Printf("# %s\n", string(kvResp.Data))
+		return
+	}
+	log.Printf("# %d\n", int64(binary.BigEndian.Uint64(kvResp.Data)))
+}
+
 func (c *ClientWrapper) cmdPost(kvReq *consts.KvRequest) (*consts.KvResponse, bool) {
 	reqBytes, err := json.Marshal(kvReq)
 	if err != nil {
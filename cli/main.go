@@ -111,6 +111,22 @@ func (wrapper *CliWrapper) withAction() {
 				readline.PcItem("GET"),
 				readline.PcItem("set"),
 				readline.PcItem("SET"),
+				readline.PcItem("del"),
+				readline.PcItem("DEL"),
+				readline.PcItem("scan"),
+				readline.PcItem("SCAN"),
+				readline.PcItem("ttl"),
+				readline.PcItem("TTL"),
+				readline.PcItem("persist"),
+				readline.PcItem("PERSIST"),
+				readline.PcItem("cas"),
+				readline.PcItem("CAS"),
+				readline.PcItem("setnx"),
+				readline.PcItem("SETNX"),
+				readline.PcItem("incr"),
+				readline.PcItem("INCR"),
+				readline.PcItem("decr"),
+				readline.PcItem("DECR"),
 			),
 			HistoryFile: fmt.Sprintf("/tmp/eggie_kv/cli/cmd_history_%s", time.Now().Format("20060102")),
 		})
@@ -31,9 +31,19 @@ VERSION:
 type OperatorType int64
 
 const (
-	OperatorTypeUnknown OperatorType = 0
-	OperatorTypeGet     OperatorType = 1
-	OperatorTypeSet     OperatorType = 2
+	OperatorTypeUnknown  OperatorType = 0
+	OperatorTypeGet      OperatorType = 1
+	OperatorTypeSet      OperatorType = 2
+	OperatorTypeDelete   OperatorType = 3
+	OperatorTypeMultiSet OperatorType = 4
+	OperatorTypeScan     OperatorType = 5
+	OperatorTypeTTL      OperatorType = 6
+	OperatorTypePersist  OperatorType = 7
+	OperatorTypeSetEx    OperatorType = 8
+	OperatorTypeCAS      OperatorType = 9
+	OperatorTypeSetNX    OperatorType = 10
+	OperatorTypeIncr     OperatorType = 11
+	OperatorTypeDecr     OperatorType = 12
 )
 
 type KvRequest struct {
@@ -26,4 +26,50 @@ var (
 
 const (
 	Ragdoll = "ragdoll"
+	Lsm     = "lsm"
+	Memory  = "memory"
+)
+
+// ragdoll 配置项
+const (
+	RagdollWalDir                 = "ragdoll.wal_dir"                   // 预写日志目录
+	RagdollDataDir                = "ragdoll.data_dir"                  // 数据文件目录
+	RagdollDataFileCapacity       = "ragdoll.data_file_capacity"        // 单个数据文件最大容量，单位字节
+	RagdollCheckpointThreshold    = "ragdoll.checkpoint_threshold"      // 预写日志中积累的日志数量达到阈值后触发 checkpoint
+	RagdollMergeDeadRatio         = "ragdoll.merge_dead_ratio"          // 数据文件中失效数据占比达到阈值后触发 merge
+	RagdollMergeInterval          = "ragdoll.merge_interval"            // 定期触发 merge 的周期，0表示不定期触发
+	RagdollWalSyncMode            = "ragdoll.wal_sync_mode"             // 预写日志持久化模式，取值见 wal.SyncMode
+	RagdollWalRecoveryMode        = "ragdoll.wal_recovery_mode"         // 预写日志损坏时的恢复模式，取值见 wal.RecoveryMode
+	RagdollGroupCommitSize        = "ragdoll.group_commit_size"         // 一次合并写入 wal 的最大 task 数量，1表示不合并
+	RagdollExpireInterval         = "ragdoll.expire_interval"           // 主动过期的周期，0表示只在读取时惰性过期
+	RagdollCacheCapacity          = "ragdoll.cache_capacity"            // value 缓存容量，单位字节，0表示不缓存
+	RagdollCacheShards            = "ragdoll.cache_shards"              // value 缓存分片数量
+	RagdollCachePolicy            = "ragdoll.cache_policy"              // value 缓存淘汰策略，取值为 lru、lfu、2q
+	RagdollCompression            = "ragdoll.compression"               // value 以及 wal 日志的压缩算法，取值为 none、snappy、zstd
+	RagdollCompressionThreshold   = "ragdoll.compression_threshold"     // 小于该长度的 value、日志不压缩，单位字节
+	RagdollEncryptionKey          = "ragdoll.encryption_key"            // value 以及 wal 日志的加密密钥来源，env:变量名 或者密钥文件路径，为空时不加密
+	RagdollEncryptionRetiredKeys  = "ragdoll.encryption_retired_keys"   // 轮换之前使用的旧密钥来源列表，用于读取还没有重新加密的数据
+	RagdollBloomFalsePositiveRate = "ragdoll.bloom_false_positive_rate" // merge 生成的数据文件布隆过滤器的误判率
+)
+
+// lsm 配置项
+const (
+	LsmWalDir                 = "lsm.wal_dir"                   // 预写日志目录
+	LsmDataDir                = "lsm.data_dir"                  // SSTable 以及 manifest 文件目录
+	LsmWalSyncMode            = "lsm.wal_sync_mode"             // 预写日志持久化模式，取值见 wal.SyncMode
+	LsmMemtableSize           = "lsm.memtable_size"             // memtable 达到该大小后 flush 为 L0 的 SSTable，单位字节
+	LsmBlockSize              = "lsm.block_size"                // SSTable 数据块大小，单位字节
+	LsmTableSize              = "lsm.table_size"                // compaction 输出的单个 SSTable 最大大小，单位字节
+	LsmL0CompactionTrigger    = "lsm.l0_compaction_trigger"     // L0 的 SSTable 数量达到阈值后触发 compaction
+	LsmLevelBaseSize          = "lsm.level_base_size"           // L1 的总大小上限，单位字节
+	LsmLevelSizeMultiplier    = "lsm.level_size_multiplier"     // 相邻两层总大小上限的倍数
+	LsmBloomFalsePositiveRate = "lsm.bloom_false_positive_rate" // SSTable 布隆过滤器的误判率
+	LsmBlockCacheCapacity     = "lsm.block_cache_capacity"      // 数据块缓存容量，单位字节，0表示不缓存
+)
+
+// memory 配置项
+const (
+	MemoryShards         = "memory.shards"          // 分片数量
+	MemoryExpireInterval = "memory.expire_interval" // 主动过期的周期，0表示只在读取时惰性过期
+	MemorySnapshotPath   = "memory.snapshot_path"   // 快照文件路径，启动时加载、关闭时写入，空字符串表示不写快照
 )
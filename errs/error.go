@@ -84,6 +84,16 @@ const (
 	WriteSocketErrCode             = 100037
 	UnexpectHandlerErrCode         = 100038
 	TaskNotFinishErrCode           = 100039
+	DeleteErrCode                  = 100040
+	TxnConflictErrCode             = 100041
+	TxnFinishedErrCode             = 100042
+	NotIntegerErrCode              = 100043
+	InvalidKeyErrCode              = 100044
+	KeyNotFoundErrCode             = 100045
+	UnsupportedFormatErrCode       = 100046
+	SubscriberLaggedErrCode        = 100047
+	SubscriptionClosedErrCode      = 100048
+	TooManyWatchersErrCode         = 100049
 )
 
 func NewUnknownErr() *KvErr {
@@ -249,3 +259,43 @@ func NewUnexpectHandler() *KvErr {
 func NewTaskNotFinishErr(taskKey string) *KvErr {
 	return &KvErr{msg: fmt.Sprintf("task %v not finish yet, try again.", taskKey), code: TaskNotFinishErrCode}
 }
+
+func NewDeleteErr() *KvErr {
+	return &KvErr{msg: "error occur when delete value", code: DeleteErrCode}
+}
+
+func NewTxnConflictErr() *KvErr {
+	return &KvErr{msg: "transaction conflict, try again", code: TxnConflictErrCode}
+}
+
+func NewTxnFinishedErr() *KvErr {
+	return &KvErr{msg: "transaction already committed or rolled back", code: TxnFinishedErrCode}
+}
+
+func NewNotIntegerErr() *KvErr {
+	return &KvErr{msg: "value is not an integer or out of range", code: NotIntegerErrCode}
+}
+
+func NewInvalidKeyErr() *KvErr {
+	return &KvErr{msg: "invalid encryption key", code: InvalidKeyErrCode}
+}
+
+func NewKeyNotFoundErr() *KvErr {
+	return &KvErr{msg: "encryption key not found", code: KeyNotFoundErrCode}
+}
+
+func NewUnsupportedFormatErr() *KvErr {
+	return &KvErr{msg: "unsupported file format", code: UnsupportedFormatErrCode}
+}
+
+func NewSubscriberLaggedErr() *KvErr {
+	return &KvErr{msg: "subscriber fell behind truncated log", code: SubscriberLaggedErrCode}
+}
+
+func NewSubscriptionClosedErr() *KvErr {
+	return &KvErr{msg: "subscription closed", code: SubscriptionClosedErrCode}
+}
+
+func NewTooManyWatchersErr() *KvErr {
+	return &KvErr{msg: "too many concurrent watchers", code: TooManyWatchersErrCode}
+}
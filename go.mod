@@ -4,7 +4,10 @@ go 1.19
 
 require (
 	github.com/bytedance/gopkg v0.0.0-20240507064146-197ded923ae3
+	github.com/bytedance/mockey v1.2.10
 	github.com/chzyer/readline v1.5.1
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.17.4
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.19.1
@@ -15,7 +18,6 @@ require (
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
-	github.com/bytedance/mockey v1.2.10 // indirect
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
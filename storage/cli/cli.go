@@ -4,12 +4,20 @@ import (
 	"fmt"
 	"github.com/Trinoooo/eggie_kv/consts"
 	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core"
+	"github.com/Trinoooo/eggie_kv/storage/core/compress"
+	"github.com/Trinoooo/eggie_kv/storage/core/encrypt"
+	"github.com/Trinoooo/eggie_kv/storage/core/lsm"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll"
 	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/wal"
 	"github.com/Trinoooo/eggie_kv/storage/server"
+	"github.com/spf13/viper"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 )
 
@@ -70,9 +78,112 @@ var (
 		Name:    "durable",
 		Aliases: []string{"d"},
 		Value:   false,
-		Usage:   "set this flag to make data durable.",
+		Usage:   "set this flag to make data durable, picks ragdoll when --core is not set, otherwise memory.",
 		EnvVars: []string{consts.Durable},
 	}
+	flagCore = &cli.StringFlag{
+		Name:  "core",
+		Usage: "storage engine, ragdoll, lsm and memory are available, decided by --durable by default.",
+		Action: func(context *cli.Context, name string) error {
+			if _, exist := core.BuilderMap[name]; !exist {
+				e := errs.NewInvalidParamErr()
+				logs.Error(e.Error(), zap.String(consts.LogFieldParams, "core"), zap.String(consts.LogFieldValue, name))
+				return e
+			}
+			return nil
+		},
+		EnvVars: []string{"EGGIE_KV_CORE"},
+	}
+	flagLsmWalDir = &cli.StringFlag{
+		Name:  "lsm-wal-dir",
+		Usage: "lsm write ahead log directory, only used with --core lsm.",
+	}
+	flagLsmDataDir = &cli.StringFlag{
+		Name:  "lsm-data-dir",
+		Usage: "lsm sstable and manifest directory, only used with --core lsm.",
+	}
+	flagLsmMemtableSize = &cli.Int64Flag{
+		Name:  "lsm-memtable-size",
+		Usage: "memtable size in bytes before flushing to an sstable, only used with --core lsm.",
+		Action: func(context *cli.Context, size int64) error {
+			if size <= 0 {
+				e := errs.NewInvalidParamErr()
+				logs.Error(e.Error(), zap.String(consts.LogFieldParams, "size"), zap.Int64(consts.LogFieldValue, size))
+				return e
+			}
+			return nil
+		},
+	}
+	flagLsmBlockCacheCapacity = &cli.Int64Flag{
+		Name:  "lsm-block-cache-capacity",
+		Usage: "sstable block cache capacity in bytes, 0 disables the cache, only used with --core lsm.",
+		Action: func(context *cli.Context, capacity int64) error {
+			if capacity < 0 {
+				e := errs.NewInvalidParamErr()
+				logs.Error(e.Error(), zap.String(consts.LogFieldParams, "capacity"), zap.Int64(consts.LogFieldValue, capacity))
+				return e
+			}
+			return nil
+		},
+	}
+	flagRagdollCompression = &cli.StringFlag{
+		Name:  "ragdoll-compression",
+		Usage: "value and wal compression codec, none, snappy and zstd are available, only used with ragdoll core.",
+		Action: func(context *cli.Context, name string) error {
+			if _, err := compress.ParseCodec(name); err != nil {
+				logs.Error(err.Error(), zap.String(consts.LogFieldParams, "compression"), zap.String(consts.LogFieldValue, name))
+				return err
+			}
+			return nil
+		},
+	}
+	flagRagdollCompressionThreshold = &cli.Int64Flag{
+		Name:  "ragdoll-compression-threshold",
+		Usage: "values and wal records shorter than this many bytes are not compressed, only used with ragdoll core.",
+		Action: func(context *cli.Context, threshold int64) error {
+			if threshold < 0 {
+				e := errs.NewInvalidParamErr()
+				logs.Error(e.Error(), zap.String(consts.LogFieldParams, "threshold"), zap.Int64(consts.LogFieldValue, threshold))
+				return e
+			}
+			return nil
+		},
+	}
+	flagRagdollKey = &cli.StringFlag{
+		Name:  "ragdoll-key",
+		Usage: "value and wal encryption key, env:NAME reads a hex encoded key from environment variable, otherwise a key file path, leave empty to disable encryption, only used with ragdoll core.",
+	}
+	flagRagdollRetiredKeys = &cli.StringSliceFlag{
+		Name:  "ragdoll-retired-key",
+		Usage: "encryption key used before rotation, can be set multiple times, only used with ragdoll core.",
+	}
+	flagMemorySnapshotPath = &cli.StringFlag{
+		Name:  "memory-snapshot-path",
+		Usage: "memory snapshot file, loaded on start and dumped on shutdown, only used with memory core.",
+	}
+	flagWalDir = &cli.StringFlag{
+		Name:  "wal-dir",
+		Value: filepath.Join(consts.BaseDir, consts.Ragdoll, "wal"),
+		Usage: "ragdoll write ahead log directory.",
+	}
+	flagDataDir = &cli.StringFlag{
+		Name:  "data-dir",
+		Value: filepath.Join(consts.BaseDir, consts.Ragdoll, "data"),
+		Usage: "ragdoll data file directory.",
+	}
+	flagEncryptionKey = &cli.StringFlag{
+		Name:     "key",
+		Usage:    "current encryption key, env:NAME reads a hex encoded key from environment variable, otherwise a key file path.",
+		Required: true,
+	}
+	flagWalKey = &cli.StringFlag{
+		Name:  "key",
+		Usage: "current encryption key, same as reencrypt, leave empty if wal is not encrypted.",
+	}
+	flagRetiredKeys = &cli.StringSliceFlag{
+		Name:  "retired-key",
+		Usage: "encryption key used before rotation, can be set multiple times.",
+	}
 )
 
 type Wrapper struct {
@@ -90,6 +201,7 @@ func NewWrapper() *Wrapper {
 	wrapper.modifyDefaultHelp()
 	wrapper.withFlags()
 	wrapper.withAction()
+	wrapper.withCommands()
 	wrapper.withAuthor()
 	return wrapper
 }
@@ -112,11 +224,81 @@ func (wrapper *Wrapper) withFlags() {
 		flagSegmentSize,
 		flagConnection,
 		flagDurable,
+		flagCore,
+		flagLsmWalDir,
+		flagLsmDataDir,
+		flagLsmMemtableSize,
+		flagLsmBlockCacheCapacity,
+		flagRagdollCompression,
+		flagRagdollCompressionThreshold,
+		flagRagdollKey,
+		flagRagdollRetiredKeys,
+		flagMemorySnapshotPath,
+	}
+}
+
+// coreConfig 根据命令行参数构造存储引擎配置，没有指定的参数使用存储引擎的默认值
+func coreConfig(ctx *cli.Context) *viper.Viper {
+	config := viper.New()
+	// 没有指定存储引擎时按是否需要持久化选择
+	switch {
+	case ctx.IsSet(flagCore.Name):
+		config.Set(consts.Core, ctx.String(flagCore.Name))
+	case ctx.Bool(flagDurable.Name):
+		config.Set(consts.Core, consts.Ragdoll)
+	default:
+		config.Set(consts.Core, consts.Memory)
+	}
+	if ctx.IsSet(flagLsmWalDir.Name) {
+		config.Set(consts.LsmWalDir, ctx.String(flagLsmWalDir.Name))
+	}
+	if ctx.IsSet(flagLsmDataDir.Name) {
+		config.Set(consts.LsmDataDir, ctx.String(flagLsmDataDir.Name))
+	}
+	if ctx.IsSet(flagLsmMemtableSize.Name) {
+		config.Set(consts.LsmMemtableSize, ctx.Int64(flagLsmMemtableSize.Name))
+	}
+	if ctx.IsSet(flagLsmBlockCacheCapacity.Name) {
+		config.Set(consts.LsmBlockCacheCapacity, ctx.Int64(flagLsmBlockCacheCapacity.Name))
+	}
+	if ctx.IsSet(flagRagdollCompression.Name) {
+		config.Set(consts.RagdollCompression, ctx.String(flagRagdollCompression.Name))
+	}
+	if ctx.IsSet(flagRagdollCompressionThreshold.Name) {
+		config.Set(consts.RagdollCompressionThreshold, ctx.Int64(flagRagdollCompressionThreshold.Name))
+	}
+	if ctx.IsSet(flagRagdollKey.Name) {
+		config.Set(consts.RagdollEncryptionKey, ctx.String(flagRagdollKey.Name))
+	}
+	if ctx.IsSet(flagRagdollRetiredKeys.Name) {
+		config.Set(consts.RagdollEncryptionRetiredKeys, ctx.StringSlice(flagRagdollRetiredKeys.Name))
 	}
+	if ctx.IsSet(flagMemorySnapshotPath.Name) {
+		config.Set(consts.MemorySnapshotPath, ctx.String(flagMemorySnapshotPath.Name))
+	}
+	return config
 }
 
 func (wrapper *Wrapper) withAction() {
 	wrapper.app.Action = func(ctx *cli.Context) error {
+		kv, err := core.New(coreConfig(ctx))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := kv.Close(); err != nil {
+				logs.Error(fmt.Sprintf("core close, err: %v", err))
+			}
+		}()
+		server.RegisterCore(kv)
+		// Watch 订阅存储引擎的预写日志，没有预写日志的存储引擎不支持 Watch
+		switch engine := kv.(type) {
+		case *ragdoll.KV:
+			server.RegisterWatchSource(engine.Wal)
+		case *lsm.DB:
+			server.RegisterWatchSource(engine.Wal)
+		}
+
 		srv, err := server.NewReactorServer([4]byte{127, 0, 0, 1}, 9999)
 		if err != nil {
 			return err
@@ -136,6 +318,66 @@ func (wrapper *Wrapper) withAction() {
 	}
 }
 
+func (wrapper *Wrapper) withCommands() {
+	wrapper.app.Commands = []*cli.Command{
+		{
+			Name:  "reencrypt",
+			Usage: "re-encrypt ragdoll data files and wal segments with the current key, server must be stopped.",
+			Flags: []cli.Flag{
+				flagWalDir,
+				flagDataDir,
+				flagEncryptionKey,
+				flagRetiredKeys,
+			},
+			Action: func(ctx *cli.Context) error {
+				config := viper.New()
+				config.Set(consts.RagdollWalDir, ctx.String(flagWalDir.Name))
+				config.Set(consts.RagdollDataDir, ctx.String(flagDataDir.Name))
+				config.Set(consts.RagdollEncryptionKey, ctx.String(flagEncryptionKey.Name))
+				config.Set(consts.RagdollEncryptionRetiredKeys, ctx.StringSlice(flagRetiredKeys.Name))
+				core, err := ragdoll.New(config)
+				if err != nil {
+					return err
+				}
+
+				kv := core.(*ragdoll.KV)
+				err = kv.ReEncrypt()
+				if e := kv.Close(); err == nil {
+					err = e
+				}
+				return err
+			},
+		},
+		{
+			Name:  "repair",
+			Usage: "repair corrupted ragdoll wal segments, damaged files are backed up to the quarantine directory, server must be stopped.",
+			Flags: []cli.Flag{
+				flagWalDir,
+				flagWalKey,
+				flagRetiredKeys,
+			},
+			Action: func(ctx *cli.Context) error {
+				keyring, err := encrypt.LoadKeyring(ctx.String(flagWalKey.Name), ctx.StringSlice(flagRetiredKeys.Name))
+				if err != nil {
+					return err
+				}
+
+				report, err := wal.Repair(ctx.String(flagWalDir.Name), wal.NewOptions().SetKeyring(keyring))
+				if err != nil {
+					return err
+				}
+				for _, bad := range report.BadBlocks {
+					fmt.Printf("corrupt: %s block #%d count %d offset %d size %d\n", bad.Path, bad.Index, bad.Count, bad.Offset, bad.Size)
+				}
+				for _, path := range report.Quarantined {
+					fmt.Printf("quarantined: %s\n", path)
+				}
+				return nil
+			},
+		},
+	}
+}
+
 func (wrapper *Wrapper) withAuthor() {
 	wrapper.app.Authors = []*cli.Author{
 		{
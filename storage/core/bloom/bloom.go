@@ -0,0 +1,153 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"math"
+	"sync/atomic"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+)
+
+const (
+	headerSize = 8 // headerSize 序列化结果头部长度：| 哈希函数数量 4字节 | 位数组长度 4字节 |
+	maxHashes  = 30
+)
+
+// Stats 布隆过滤器统计
+type Stats struct {
+	Negatives      int64 // Negatives 判断 key 不存在的次数，每次都省去了一次磁盘读取
+	Positives      int64 // Positives 判断 key 可能存在的次数
+	FalsePositives int64 // FalsePositives 判断 key 可能存在但实际不存在的次数，由调用方通过 RecordFalsePositive 记录
+}
+
+var total Stats // total 进程内全部布隆过滤器的统计，用于导出监控
+
+// TotalStats 返回进程内全部布隆过滤器的统计
+func TotalStats() Stats {
+	return Stats{
+		Negatives:      atomic.LoadInt64(&total.Negatives),
+		Positives:      atomic.LoadInt64(&total.Positives),
+		FalsePositives: atomic.LoadInt64(&total.FalsePositives),
+	}
+}
+
+// RecordFalsePositive 记录一次误判：MayContain 返回true，但读取数据之后发现 key 不存在
+func RecordFalsePositive() {
+	atomic.AddInt64(&total.FalsePositives, 1)
+}
+
+// Filter 布隆过滤器
+// 判断 key 不存在时一定不存在，判断 key 存在时有一定概率误判
+// 使用双重哈希 h1 + i*h2 模拟 k 个哈希函数，不保证并发安全，构建完成之后只读时可以并发调用 MayContain
+type Filter struct {
+	bits   []byte
+	hashes uint32
+}
+
+// New 按预计元素数量以及期望的误判率创建布隆过滤器
+//
+// 参数：
+//   - n 预计元素数量
+//   - fpr 期望的误判率，取值范围 (0, 1)
+func New(n int, fpr float64) (*Filter, error) {
+	if n < 0 || fpr <= 0 || fpr >= 1 {
+		return nil, errs.NewInvalidParamErr()
+	}
+	if n == 0 {
+		n = 1
+	}
+
+	// m = -n*ln(p) / ln2^2，k = m/n * ln2
+	m := int(math.Ceil(-float64(n) * math.Log(fpr) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	} else if k > maxHashes {
+		k = maxHashes
+	}
+	return &Filter{
+		bits:   make([]byte, (m+7)/8),
+		hashes: k,
+	}, nil
+}
+
+// hash FNV-1a 64位哈希，高低32位分别作为双重哈希的 h1、h2
+func hash(key []byte) (uint32, uint32) {
+	var h uint64 = 14695981039346656037
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	h1, h2 := uint32(h), uint32(h>>32)
+	// h2 为0时所有哈希函数的结果相同
+	if h2 == 0 {
+		h2 = 1
+	}
+	return h1, h2
+}
+
+// Add 添加 key
+func (f *Filter) Add(key []byte) {
+	nbits := uint32(len(f.bits) * 8)
+	h1, h2 := hash(key)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % nbits
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// MayContain 判断 key 是否可能存在，结果计入 TotalStats
+func (f *Filter) MayContain(key []byte) bool {
+	if f.mayContain(key) {
+		atomic.AddInt64(&total.Positives, 1)
+		return true
+	}
+	atomic.AddInt64(&total.Negatives, 1)
+	return false
+}
+
+func (f *Filter) mayContain(key []byte) bool {
+	nbits := uint32(len(f.bits) * 8)
+	if nbits == 0 {
+		return true
+	}
+	h1, h2 := hash(key)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % nbits
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Size 返回序列化结果的长度
+func (f *Filter) Size() int {
+	return headerSize + len(f.bits)
+}
+
+// Encode 序列化布隆过滤器
+// 结构：| 哈希函数数量 4字节 | 位数组长度 4字节 | 位数组 |
+func (f *Filter) Encode() []byte {
+	buf := make([]byte, headerSize+len(f.bits))
+	binary.BigEndian.PutUint32(buf, f.hashes)
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(f.bits)))
+	copy(buf[headerSize:], f.bits)
+	return buf
+}
+
+// Decode 反序列化布隆过滤器，是 Filter.Encode 的逆过程
+func Decode(raw []byte) (*Filter, error) {
+	if len(raw) < headerSize {
+		return nil, errs.NewCorruptErr()
+	}
+	hashes := binary.BigEndian.Uint32(raw)
+	length := binary.BigEndian.Uint32(raw[4:])
+	if hashes < 1 || hashes > maxHashes || uint64(len(raw)-headerSize) != uint64(length) {
+		return nil, errs.NewCorruptErr()
+	}
+	return &Filter{
+		bits:   append([]byte(nil), raw[headerSize:]...),
+		hashes: hashes,
+	}, nil
+}
@@ -0,0 +1,78 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestFilter_FalsePositiveRate 添加过的 key 一定存在，没有添加过的 key 误判率接近期望值，序列化后结果不变
+func TestFilter_FalsePositiveRate(t *testing.T) {
+	for _, fpr := range []float64{0.1, 0.01, 0.001} {
+		f, err := New(10000, fpr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10000; i++ {
+			f.Add([]byte(fmt.Sprintf("key%d", i)))
+		}
+
+		f, err = Decode(f.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10000; i++ {
+			if !f.MayContain([]byte(fmt.Sprintf("key%d", i))) {
+				t.Fatalf("expect key%d may contain", i)
+			}
+		}
+
+		var fp int
+		for i := 0; i < 100000; i++ {
+			if f.MayContain([]byte(fmt.Sprintf("other%d", i))) {
+				fp++
+			}
+		}
+		rate := float64(fp) / 100000
+		t.Logf("expect fpr %v, got %v, size %d bytes", fpr, rate, f.Size())
+		if rate > fpr*2 {
+			t.Errorf("expect fpr <= %v, got %v", fpr*2, rate)
+		}
+	}
+}
+
+// TestFilter_Invalid 非法参数以及损坏的序列化结果返回错误
+func TestFilter_Invalid(t *testing.T) {
+	for _, fpr := range []float64{0, 1, -0.1} {
+		if _, err := New(10, fpr); err == nil {
+			t.Errorf("expect error on fpr %v", fpr)
+		}
+	}
+	if _, err := Decode([]byte{0, 0, 0, 1}); err == nil {
+		t.Error("expect error on short raw")
+	}
+	f, _ := New(10, 0.01)
+	raw := f.Encode()
+	if _, err := Decode(raw[:len(raw)-1]); err == nil {
+		t.Error("expect error on truncated raw")
+	}
+}
+
+// TestTotalStats MayContain 的结果以及调用方记录的误判计入全局统计
+func TestTotalStats(t *testing.T) {
+	f, _ := New(100, 0.01)
+	f.Add([]byte("exist"))
+
+	before := TotalStats()
+	f.MayContain([]byte("exist"))
+	f.MayContain([]byte("exist"))
+	f.MayContain([]byte("not exist"))
+	RecordFalsePositive()
+	after := TotalStats()
+
+	if after.Positives-before.Positives < 2 || after.Positives-before.Positives+after.Negatives-before.Negatives != 3 {
+		t.Errorf("expect 3 lookups with at least 2 positives, got %+v -> %+v", before, after)
+	}
+	if after.FalsePositives-before.FalsePositives != 1 {
+		t.Errorf("expect 1 false positive, got %+v -> %+v", before, after)
+	}
+}
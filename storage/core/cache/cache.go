@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+)
+
+// Policy 淘汰策略
+type Policy int64
+
+const (
+	PolicyLRU Policy = iota // PolicyLRU 淘汰最近最少使用的 value
+	PolicyLFU               // PolicyLFU 淘汰访问次数最少的 value，访问次数相同时淘汰最久没有访问的
+	Policy2Q                // Policy2Q 首次访问的 value 先进入 FIFO 队列，再次访问才进入 LRU 队列，避免遍历冲掉热点数据
+)
+
+// ParsePolicy 解析配置中的淘汰策略名称，不区分大小写
+func ParsePolicy(name string) (Policy, error) {
+	switch strings.ToLower(name) {
+	case "lru":
+		return PolicyLRU, nil
+	case "lfu":
+		return PolicyLFU, nil
+	case "2q":
+		return Policy2Q, nil
+	default:
+		return 0, errs.NewInvalidParamErr()
+	}
+}
+
+// entryOverhead 每个缓存项除 key 与 value 之外的估算内存占用
+const entryOverhead = 64
+
+// entry 缓存项
+type entry struct {
+	key   string
+	value []byte
+	tag   any // tag 调用方附带的信息，例如 value 对应的 Record 位置
+}
+
+func (e *entry) size() int64 {
+	return int64(len(e.key) + len(e.value) + entryOverhead)
+}
+
+// policy 单个分片内的淘汰策略，不保证并发安全，由分片加锁保护
+type policy interface {
+	// get 查找缓存项并记录一次访问
+	get(key string) (*entry, bool)
+	// add 插入新的缓存项，调用方保证 key 不存在
+	add(e *entry)
+	// remove 删除缓存项，不存在时返回nil
+	remove(key string) *entry
+	// evict 选出并删除一个缓存项，为空时返回nil
+	evict() *entry
+}
+
+// Stats 缓存统计
+type Stats struct {
+	Hits      int64 // Hits 命中次数
+	Misses    int64 // Misses 未命中次数
+	Evictions int64 // Evictions 因为容量不足被淘汰的缓存项数量
+	Bytes     int64 // Bytes 当前占用的字节数
+}
+
+var total Stats // total 进程内全部缓存的统计，用于导出监控
+
+// TotalStats 返回进程内全部缓存的统计
+func TotalStats() Stats {
+	return Stats{
+		Hits:      atomic.LoadInt64(&total.Hits),
+		Misses:    atomic.LoadInt64(&total.Misses),
+		Evictions: atomic.LoadInt64(&total.Evictions),
+		Bytes:     atomic.LoadInt64(&total.Bytes),
+	}
+}
+
+// Cache 按字节数限制容量的分片缓存
+// key 按哈希分布到各个分片，每个分片独立加锁、独立淘汰，容量平均分配给各个分片
+type Cache struct {
+	shards []*shard
+	stats  Stats
+}
+
+type shard struct {
+	mu       sync.Mutex
+	policy   policy
+	size     int64
+	capacity int64
+}
+
+// New 创建缓存
+//
+// 参数：
+//   - capacity 全部分片的总容量，单位字节
+//   - shards 分片数量
+//   - p 淘汰策略
+func New(capacity int64, shards int, p Policy) (*Cache, error) {
+	if capacity <= 0 || shards <= 0 || int64(shards) > capacity {
+		return nil, errs.NewInvalidParamErr()
+	}
+
+	c := &Cache{shards: make([]*shard, shards)}
+	for i := range c.shards {
+		s := &shard{capacity: capacity / int64(shards)}
+		switch p {
+		case PolicyLRU:
+			s.policy = newLRU()
+		case PolicyLFU:
+			s.policy = newLFU()
+		case Policy2Q:
+			s.policy = new2Q(s.capacity)
+		default:
+			return nil, errs.NewInvalidParamErr()
+		}
+		c.shards[i] = s
+	}
+	return c, nil
+}
+
+// shard 按 FNV-1a 哈希选择分片
+func (c *Cache) shard(key string) *shard {
+	var h uint32 = 2166136261
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// Get 读取缓存，value 是缓存中的副本，调用方可以修改
+// tag 与写入时的 tag 不相等时认为缓存已经失效，同样返回未命中
+func (c *Cache) Get(key string, tag any) ([]byte, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	e, exist := s.policy.get(key)
+	if exist && e.tag == tag {
+		value := append([]byte(nil), e.value...)
+		s.mu.Unlock()
+		c.count(&c.stats.Hits, &total.Hits, 1)
+		return value, true
+	}
+	s.mu.Unlock()
+	c.count(&c.stats.Misses, &total.Misses, 1)
+	return nil, false
+}
+
+// Set 写入缓存，超过单个分片容量的 value 不会被缓存
+// 缓存持有 value 的副本，调用方之后可以修改 value
+func (c *Cache) Set(key string, value []byte, tag any) {
+	e := &entry{key: key, value: append([]byte(nil), value...), tag: tag}
+	s := c.shard(key)
+	if e.size() > s.capacity {
+		c.Remove(key)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delta := e.size()
+	if old := s.policy.remove(key); old != nil {
+		delta -= old.size()
+	}
+	s.policy.add(e)
+	s.size += delta
+
+	var evictions int64
+	for s.size > s.capacity {
+		victim := s.policy.evict()
+		if victim == nil {
+			break
+		}
+		s.size -= victim.size()
+		delta -= victim.size()
+		evictions++
+	}
+	c.count(&c.stats.Bytes, &total.Bytes, delta)
+	c.count(&c.stats.Evictions, &total.Evictions, evictions)
+}
+
+// Remove 删除缓存
+func (c *Cache) Remove(key string) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old := s.policy.remove(key); old != nil {
+		s.size -= old.size()
+		c.count(&c.stats.Bytes, &total.Bytes, -old.size())
+	}
+}
+
+// Stats 返回当前缓存的统计
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:      atomic.LoadInt64(&c.stats.Hits),
+		Misses:    atomic.LoadInt64(&c.stats.Misses),
+		Evictions: atomic.LoadInt64(&c.stats.Evictions),
+		Bytes:     atomic.LoadInt64(&c.stats.Bytes),
+	}
+}
+
+// count 同时更新当前缓存以及进程内全部缓存的统计
+func (c *Cache) count(local, global *int64, delta int64) {
+	if delta == 0 {
+		return
+	}
+	atomic.AddInt64(local, delta)
+	atomic.AddInt64(global, delta)
+}
+
+// Close 清空缓存，并从进程内全部缓存的统计中减去占用的字节数
+func (c *Cache) Close() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for e := s.policy.evict(); e != nil; e = s.policy.evict() {
+		}
+		c.count(&c.stats.Bytes, &total.Bytes, -s.size)
+		s.size = 0
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestCache_Capacity 写入超过容量的数据后占用的字节数不超过容量，tag 不一致时视为未命中
+func TestCache_Capacity(t *testing.T) {
+	for _, p := range []Policy{PolicyLRU, PolicyLFU, Policy2Q} {
+		c, err := New(16*1024, 4, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 1000; i++ {
+			c.Set(fmt.Sprintf("k%d", i), make([]byte, 100), i)
+		}
+		stats := c.Stats()
+		if stats.Bytes > 16*1024 || stats.Evictions == 0 {
+			t.Errorf("policy %d: expect bytes <= capacity and evictions > 0, got %+v", p, stats)
+		}
+
+		c.Set("k", []byte("v"), 1)
+		if value, ok := c.Get("k", 1); !ok || string(value) != "v" {
+			t.Errorf("policy %d: expect hit, got %s, %v", p, value, ok)
+		}
+		if _, ok := c.Get("k", 2); ok {
+			t.Errorf("policy %d: expect miss on tag mismatch", p)
+		}
+		c.Remove("k")
+		if _, ok := c.Get("k", 1); ok {
+			t.Errorf("policy %d: expect miss after remove", p)
+		}
+
+		// 超过单个分片容量的 value 不缓存
+		c.Set("large", make([]byte, 8*1024), 0)
+		if _, ok := c.Get("large", 0); ok {
+			t.Errorf("policy %d: expect large value not cached", p)
+		}
+
+		c.Close()
+		if c.Stats().Bytes != 0 {
+			t.Errorf("policy %d: expect 0 bytes after close, got %d", p, c.Stats().Bytes)
+		}
+	}
+}
+
+// TestCache_Policy 反复访问的热点数据在一次遍历之后仍然留在 LFU、2Q 缓存中，LRU 则会被冲掉
+func TestCache_Policy(t *testing.T) {
+	cases := []struct {
+		policy  Policy
+		survive bool
+	}{
+		{PolicyLRU, false},
+		{PolicyLFU, true},
+		{Policy2Q, true},
+	}
+	for _, c := range cases {
+		cache, err := New(32*1024, 1, c.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 热点数据：写入后被淘汰再写入，以及多次访问
+		hot := make([]string, 20)
+		for i := range hot {
+			hot[i] = fmt.Sprintf("hot%d", i)
+		}
+		for round := 0; round < 3; round++ {
+			for _, key := range hot {
+				if _, ok := cache.Get(key, nil); !ok {
+					cache.Set(key, make([]byte, 100), nil)
+				}
+			}
+			// 填满 in 队列，使热点数据进入 2Q 的 ghost 队列
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("warm%d-%d", round, i)
+				cache.Set(key, make([]byte, 100), nil)
+			}
+		}
+		for round := 0; round < 3; round++ {
+			for _, key := range hot {
+				if _, ok := cache.Get(key, nil); !ok {
+					cache.Set(key, make([]byte, 100), nil)
+				}
+			}
+		}
+
+		// 一次性遍历
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("scan%d", i)
+			if _, ok := cache.Get(key, nil); !ok {
+				cache.Set(key, make([]byte, 100), nil)
+			}
+		}
+
+		var hits int
+		for _, key := range hot {
+			if _, ok := cache.Get(key, nil); ok {
+				hits++
+			}
+		}
+		t.Logf("policy %d: %d/%d hot keys survive scan", c.policy, hits, len(hot))
+		if survive := hits == len(hot); survive != c.survive {
+			t.Errorf("policy %d: expect survive %v, got %d/%d hot keys", c.policy, c.survive, hits, len(hot))
+		}
+	}
+}
+
+// TestCache_Concurrent 并发读写不会破坏字节数统计
+func TestCache_Concurrent(t *testing.T) {
+	c, err := New(64*1024, 8, Policy2Q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				key := fmt.Sprintf("k%d", (i*j)%2000)
+				if _, ok := c.Get(key, nil); !ok {
+					c.Set(key, make([]byte, j%200), nil)
+				}
+				if j%10 == 0 {
+					c.Remove(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var size int64
+	for _, s := range c.shards {
+		size += s.size
+	}
+	stats := c.Stats()
+	if stats.Bytes != size || size > 64*1024 {
+		t.Errorf("expect bytes %d equal to shard size %d and <= capacity", stats.Bytes, size)
+	}
+	if stats.Hits == 0 || stats.Misses == 0 {
+		t.Errorf("expect both hits and misses, got %+v", stats)
+	}
+}
+
+// TestParsePolicy 解析淘汰策略名称
+func TestParsePolicy(t *testing.T) {
+	for name, expect := range map[string]Policy{"lru": PolicyLRU, "LFU": PolicyLFU, "2q": Policy2Q} {
+		p, err := ParsePolicy(name)
+		if err != nil || p != expect {
+			t.Errorf("expect %d, got %d, %v", expect, p, err)
+		}
+	}
+	if _, err := ParsePolicy("arc"); err == nil {
+		t.Error("expect error on unknown policy")
+	}
+}
@@ -0,0 +1,94 @@
+package cache
+
+import "container/heap"
+
+// lfuItem lfu 堆中的缓存项
+type lfuItem struct {
+	entry *entry
+	freq  int64 // freq 访问次数
+	tick  int64 // tick 最后一次访问的逻辑时间
+	index int   // index 在堆中的下标
+}
+
+// lfuHeap 按访问次数、最后一次访问时间排序的小顶堆
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// lfu 最不经常使用淘汰策略，访问次数相同时淘汰最久没有访问的缓存项
+type lfu struct {
+	heap lfuHeap
+	m    map[string]*lfuItem
+	tick int64
+}
+
+func newLFU() *lfu {
+	return &lfu{
+		m: make(map[string]*lfuItem),
+	}
+}
+
+func (l *lfu) get(key string) (*entry, bool) {
+	item, exist := l.m[key]
+	if !exist {
+		return nil, false
+	}
+	l.tick++
+	item.freq++
+	item.tick = l.tick
+	heap.Fix(&l.heap, item.index)
+	return item.entry, true
+}
+
+func (l *lfu) add(e *entry) {
+	l.tick++
+	item := &lfuItem{entry: e, freq: 1, tick: l.tick}
+	heap.Push(&l.heap, item)
+	l.m[e.key] = item
+}
+
+func (l *lfu) remove(key string) *entry {
+	item, exist := l.m[key]
+	if !exist {
+		return nil
+	}
+	heap.Remove(&l.heap, item.index)
+	delete(l.m, key)
+	return item.entry
+}
+
+func (l *lfu) evict() *entry {
+	if len(l.heap) == 0 {
+		return nil
+	}
+	item := heap.Pop(&l.heap).(*lfuItem)
+	delete(l.m, item.entry.key)
+	return item.entry
+}
@@ -0,0 +1,53 @@
+package cache
+
+import "container/list"
+
+// lru 最近最少使用淘汰策略，链表头部是最近访问的缓存项
+type lru struct {
+	list *list.List
+	m    map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{
+		list: list.New(),
+		m:    make(map[string]*list.Element),
+	}
+}
+
+func (l *lru) get(key string) (*entry, bool) {
+	elem, exist := l.m[key]
+	if !exist {
+		return nil, false
+	}
+	l.list.MoveToFront(elem)
+	return elem.Value.(*entry), true
+}
+
+func (l *lru) add(e *entry) {
+	l.m[e.key] = l.list.PushFront(e)
+}
+
+func (l *lru) remove(key string) *entry {
+	elem, exist := l.m[key]
+	if !exist {
+		return nil
+	}
+	delete(l.m, key)
+	return l.list.Remove(elem).(*entry)
+}
+
+func (l *lru) evict() *entry {
+	elem := l.list.Back()
+	if elem == nil {
+		return nil
+	}
+	e := l.list.Remove(elem).(*entry)
+	delete(l.m, e.key)
+	return e
+}
+
+// len 返回缓存项数量
+func (l *lru) len() int {
+	return l.list.Len()
+}
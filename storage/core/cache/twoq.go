@@ -0,0 +1,99 @@
+package cache
+
+import "container/list"
+
+const (
+	twoQInRatio    = 0.25 // twoQInRatio in 队列占分片容量的比例
+	twoQGhostRatio = 0.5  // twoQGhostRatio ghost 队列中 key 占分片容量的比例
+)
+
+// twoQ 2Q 淘汰策略
+// 首次写入的缓存项进入 FIFO 的 in 队列，在 in 队列中的访问不改变顺序；从 in 队列淘汰时只在 ghost 队列中保留 key。
+// 再次写入 ghost 队列中的 key 时说明它会被反复访问，进入 LRU 的 main 队列。
+// 一次性的遍历只会冲掉 in 队列，main 队列中的热点数据不受影响
+type twoQ struct {
+	in      *list.List               // in 首次写入的缓存项，FIFO
+	inM     map[string]*list.Element // inM in 队列索引
+	inSize  int64                    // inSize in 队列占用的字节数
+	inLimit int64                    // inLimit in 队列超过该大小时优先从 in 队列淘汰
+
+	main *lru // main 反复访问的缓存项，LRU
+
+	ghost      *list.List               // ghost 最近从 in 队列淘汰的 key，FIFO
+	ghostM     map[string]*list.Element // ghostM ghost 队列索引
+	ghostSize  int64                    // ghostSize ghost 队列占用的字节数
+	ghostLimit int64                    // ghostLimit ghost 队列占用的最大字节数
+}
+
+func new2Q(capacity int64) *twoQ {
+	return &twoQ{
+		in:         list.New(),
+		inM:        make(map[string]*list.Element),
+		inLimit:    int64(float64(capacity) * twoQInRatio),
+		main:       newLRU(),
+		ghost:      list.New(),
+		ghostM:     make(map[string]*list.Element),
+		ghostLimit: int64(float64(capacity) * twoQGhostRatio),
+	}
+}
+
+func (q *twoQ) get(key string) (*entry, bool) {
+	if elem, exist := q.inM[key]; exist {
+		return elem.Value.(*entry), true
+	}
+	return q.main.get(key)
+}
+
+func (q *twoQ) add(e *entry) {
+	if elem, exist := q.ghostM[e.key]; exist {
+		q.removeGhost(elem)
+		q.main.add(e)
+		return
+	}
+	q.inM[e.key] = q.in.PushFront(e)
+	q.inSize += e.size()
+}
+
+func (q *twoQ) remove(key string) *entry {
+	if elem, exist := q.inM[key]; exist {
+		delete(q.inM, key)
+		e := q.in.Remove(elem).(*entry)
+		q.inSize -= e.size()
+		return e
+	}
+	return q.main.remove(key)
+}
+
+func (q *twoQ) evict() *entry {
+	if q.inSize > q.inLimit || q.main.len() == 0 {
+		elem := q.in.Back()
+		if elem == nil {
+			return nil
+		}
+		e := q.in.Remove(elem).(*entry)
+		delete(q.inM, e.key)
+		q.inSize -= e.size()
+		q.addGhost(e.key)
+		return e
+	}
+	return q.main.evict()
+}
+
+// addGhost 记录从 in 队列淘汰的 key，超过容量时丢弃最早的 key
+func (q *twoQ) addGhost(key string) {
+	q.ghostM[key] = q.ghost.PushFront(key)
+	q.ghostSize += int64(len(key) + entryOverhead)
+	for q.ghostSize > q.ghostLimit {
+		elem := q.ghost.Back()
+		if elem == nil {
+			return
+		}
+		q.removeGhost(elem)
+	}
+}
+
+func (q *twoQ) removeGhost(elem *list.Element) {
+	key := q.ghost.Remove(elem).(string)
+	delete(q.ghostM, key)
+	q.ghostSize -= int64(len(key) + entryOverhead)
+}
@@ -1,10 +1,35 @@
 package core
 
 import (
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
 	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/Trinoooo/eggie_kv/storage/core/lsm"
+	"github.com/Trinoooo/eggie_kv/storage/core/memory"
 	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll"
+	"github.com/Trinoooo/eggie_kv/storage/logs"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
 )
 
 var BuilderMap = map[string]iface.Builder{
-	"ragdoll": ragdoll.New,
+	consts.Ragdoll: ragdoll.New,
+	consts.Lsm:     lsm.New,
+	consts.Memory:  memory.New,
+}
+
+// New 按配置项 consts.Core 选择存储引擎并创建，未配置时使用 ragdoll
+func New(config *viper.Viper) (iface.ICore, error) {
+	name := consts.Ragdoll
+	if config.IsSet(consts.Core) {
+		name = config.GetString(consts.Core)
+	}
+
+	builder, exist := BuilderMap[name]
+	if !exist {
+		e := errs.NewCoreNotFoundErr()
+		logs.Error(e.Error(), zap.String(consts.Core, name))
+		return nil, e
+	}
+	return builder(config)
 }
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/conformance"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/wal"
+	"github.com/spf13/viper"
+)
+
+// conformanceOptions 每个注册的引擎运行一致性测试时使用的配置
+// 新注册的引擎需要在这里添加配置，否则 TestBuilderMap_Conformance 失败
+var conformanceOptions = map[string]conformance.Options{
+	consts.Ragdoll: {
+		NewConfig: func(dir string) *viper.Viper {
+			config := viper.New()
+			config.Set(consts.RagdollWalDir, filepath.Join(dir, "wal"))
+			config.Set(consts.RagdollDataDir, filepath.Join(dir, "data"))
+			config.Set(consts.RagdollDataFileCapacity, 4*consts.MB)
+			config.Set(consts.RagdollCheckpointThreshold, 100)
+			config.Set(consts.RagdollCacheCapacity, consts.MB)
+			return config
+		},
+		Durable: true,
+		NewCrashConfig: func(dir string) *viper.Viper {
+			config := viper.New()
+			config.Set(consts.RagdollWalDir, filepath.Join(dir, "wal"))
+			config.Set(consts.RagdollDataDir, filepath.Join(dir, "data"))
+			config.Set(consts.RagdollCheckpointThreshold, 100)
+			config.Set(consts.RagdollWalSyncMode, int64(wal.FullManagedSync))
+			return config
+		},
+	},
+	consts.Lsm: {
+		NewConfig: func(dir string) *viper.Viper {
+			config := viper.New()
+			config.Set(consts.LsmWalDir, filepath.Join(dir, "wal"))
+			config.Set(consts.LsmDataDir, filepath.Join(dir, "data"))
+			config.Set(consts.LsmMemtableSize, 16*consts.KB)
+			config.Set(consts.LsmBlockSize, 512)
+			config.Set(consts.LsmTableSize, 32*consts.KB)
+			config.Set(consts.LsmL0CompactionTrigger, 2)
+			config.Set(consts.LsmLevelBaseSize, 64*consts.KB)
+			config.Set(consts.LsmBlockCacheCapacity, 256*consts.KB)
+			return config
+		},
+		Durable: true,
+		NewCrashConfig: func(dir string) *viper.Viper {
+			config := viper.New()
+			config.Set(consts.LsmWalDir, filepath.Join(dir, "wal"))
+			config.Set(consts.LsmDataDir, filepath.Join(dir, "data"))
+			config.Set(consts.LsmWalSyncMode, int64(wal.FullManagedSync))
+			return config
+		},
+	},
+	consts.Memory: {
+		NewConfig: func(dir string) *viper.Viper {
+			config := viper.New()
+			config.Set(consts.MemorySnapshotPath, filepath.Join(dir, "memory.snap"))
+			return config
+		},
+		Durable: true,
+	},
+}
+
+// TestBuilderMap_Conformance 每个注册的引擎都需要通过一致性测试
+func TestBuilderMap_Conformance(t *testing.T) {
+	for name, builder := range BuilderMap {
+		name, builder := name, builder
+		t.Run(name, func(t *testing.T) {
+			opts, exist := conformanceOptions[name]
+			if !exist {
+				t.Fatalf("engine %s has no conformance options", name)
+			}
+			conformance.Run(t, builder, opts)
+		})
+	}
+}
+
+// TestNew 按配置选择引擎，引擎不存在时返回错误
+func TestNew(t *testing.T) {
+	config := conformanceOptions[consts.Memory].NewConfig(t.TempDir())
+	config.Set(consts.Core, consts.Memory)
+	db, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Set(consts.Core, "unknown")
+	if _, err := New(config); errs.GetCode(err) != errs.CoreNotFoundErrCode {
+		t.Errorf("expect core not found, got %v", err)
+	}
+}
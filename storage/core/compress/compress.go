@@ -0,0 +1,112 @@
+package compress
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec 压缩算法，写入记录头部的标记位中，读取时据此解压
+// 记录头部只为压缩算法预留了两个bit，取值不能超过3
+type Codec uint8
+
+const (
+	None   Codec = iota // None 不压缩
+	Snappy              // Snappy 压缩速度快，压缩率一般
+	Zstd                // Zstd 压缩率高，速度略慢
+)
+
+// ParseCodec 解析配置中的压缩算法名称，空字符串表示不压缩
+func ParseCodec(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return None, nil
+	case "snappy":
+		return Snappy, nil
+	case "zstd":
+		return Zstd, nil
+	default:
+		return None, errs.NewInvalidParamErr()
+	}
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// initZstd 创建进程内共享的 zstd 编解码器
+// EncodeAll、DecodeAll 可以并发调用
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+}
+
+// Compressor 按配置压缩 value
+type Compressor struct {
+	codec     Codec // codec 压缩算法
+	threshold int   // threshold 小于该长度的 value 不压缩
+}
+
+// NewCompressor 创建压缩器，codec 为 None 时不压缩
+func NewCompressor(codec Codec, threshold int) *Compressor {
+	return &Compressor{
+		codec:     codec,
+		threshold: threshold,
+	}
+}
+
+// Compress 压缩 value，返回写入的数据以及实际使用的压缩算法
+// value 小于阈值、或者压缩后没有变小时原样返回，压缩算法为 None
+func (c *Compressor) Compress(value []byte) ([]byte, Codec) {
+	if c == nil || c.codec == None || len(value) < c.threshold {
+		return value, None
+	}
+
+	var compressed []byte
+	switch c.codec {
+	case Snappy:
+		compressed = snappy.Encode(nil, value)
+	case Zstd:
+		initZstd()
+		compressed = zstdEncoder.EncodeAll(value, nil)
+	default:
+		return value, None
+	}
+	if len(compressed) >= len(value) {
+		return value, None
+	}
+	return compressed, c.codec
+}
+
+// Decompress 按记录中的压缩算法解压数据，None 时原样返回
+//
+// 异常：
+//   - errs.NewCorruptErr 数据无法解压或者压缩算法未知
+func Decompress(codec Codec, raw []byte) ([]byte, error) {
+	switch codec {
+	case None:
+		return raw, nil
+	case Snappy:
+		value, err := snappy.Decode(nil, raw)
+		if err != nil {
+			return nil, errs.NewCorruptErr().WithErr(err)
+		}
+		return value, nil
+	case Zstd:
+		initZstd()
+		value, err := zstdDecoder.DecodeAll(raw, nil)
+		if err != nil {
+			return nil, errs.NewCorruptErr().WithErr(err)
+		}
+		return value, nil
+	default:
+		return nil, errs.NewCorruptErr()
+	}
+}
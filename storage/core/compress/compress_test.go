@@ -0,0 +1,38 @@
+package compress
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+)
+
+// TestCompressor 小于阈值或者压缩后没有变小的数据不压缩，压缩后的数据可以解压
+func TestCompressor(t *testing.T) {
+	large := []byte(strings.Repeat("eggie_kv", 128))
+	for _, codec := range []Codec{None, Snappy, Zstd} {
+		c := NewCompressor(codec, 64)
+		if raw, got := c.Compress([]byte("small")); got != None || string(raw) != "small" {
+			t.Errorf("codec %d: expect small value not compressed, got %d", codec, got)
+		}
+
+		raw, got := c.Compress(large)
+		if got != codec {
+			t.Errorf("codec %d: expect compressed, got %d", codec, got)
+		}
+		if codec != None && len(raw) >= len(large) {
+			t.Errorf("codec %d: expect smaller, got %d bytes", codec, len(raw))
+		}
+		value, err := Decompress(got, raw)
+		if err != nil || string(value) != string(large) {
+			t.Errorf("codec %d: decompress mismatch, %v", codec, err)
+		}
+	}
+
+	if _, err := Decompress(Zstd, []byte("not zstd")); errs.GetCode(err) != errs.CorruptErrCode {
+		t.Errorf("expect corrupt error, got %v", err)
+	}
+	if _, err := ParseCodec("lz4"); errs.GetCode(err) != errs.InvalidParamErrCode {
+		t.Errorf("expect invalid param error, got %v", err)
+	}
+}
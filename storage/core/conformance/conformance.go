@@ -0,0 +1,856 @@
+// Package conformance 存储引擎一致性测试
+// 任意 iface.Builder 都可以通过 Run 运行同一组测试，保证 core.BuilderMap 中的每个引擎行为一致
+package conformance
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/spf13/viper"
+)
+
+// Options 一致性测试配置
+type Options struct {
+	// NewConfig 返回数据全部放在 dir 中的配置，同一个配置关闭之后可以重新打开
+	NewConfig func(dir string) *viper.Viper
+	// Durable 关闭之后重新打开时数据是否仍然存在，为false时跳过重新打开相关的测试
+	Durable bool
+	// NewCrashConfig 返回写入在返回之前已经落盘的配置，没有调用 Close 就退出（崩溃）之后
+	// 已经返回的写入仍然存在；为nil时跳过崩溃恢复测试
+	NewCrashConfig func(dir string) *viper.Viper
+}
+
+// Run 对 builder 创建的引擎运行全部一致性测试，每个测试使用独立的目录
+func Run(t *testing.T, builder iface.Builder, opts Options) {
+	tests := []struct {
+		name    string
+		fn      func(t *testing.T, h *harness)
+		durable bool
+	}{
+		{"CRUD", testCRUD, false},
+		{"Overwrite", testOverwrite, false},
+		{"LargeValue", testLargeValue, false},
+		{"TTL", testTTL, false},
+		{"Atomic", testAtomic, false},
+		{"WriteBatch", testWriteBatch, false},
+		{"Iterator", testIterator, false},
+		{"Txn", testTxn, false},
+		{"Concurrent", testConcurrent, false},
+		{"Reopen", testReopen, true},
+		{"Crash", testCrash, true},
+		{"Model", testModel, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.durable && !opts.Durable {
+				t.Skip("engine is not durable")
+			}
+			h := &harness{
+				t:       t,
+				builder: builder,
+				config:  opts.NewConfig(t.TempDir()),
+				durable: opts.Durable,
+
+				newCrashConfig: opts.NewCrashConfig,
+			}
+			h.db = h.open()
+			defer func() {
+				if h.db != nil {
+					h.close()
+				}
+			}()
+			tt.fn(t, h)
+		})
+	}
+}
+
+// harness 一个测试使用的引擎实例以及配置
+type harness struct {
+	t       *testing.T
+	builder iface.Builder
+	config  *viper.Viper
+	durable bool
+	db      iface.ICore
+
+	newCrashConfig func(dir string) *viper.Viper
+}
+
+func (h *harness) open() iface.ICore {
+	h.t.Helper()
+	db, err := h.builder(h.config)
+	if err != nil {
+		h.t.Fatalf("open: %v", err)
+	}
+	return db
+}
+
+func (h *harness) close() {
+	h.t.Helper()
+	err := h.db.Close()
+	h.db = nil
+	if err != nil {
+		h.t.Fatalf("close: %v", err)
+	}
+}
+
+// reopen 关闭之后使用同一个配置重新打开
+func (h *harness) reopen() {
+	h.t.Helper()
+	h.close()
+	h.db = h.open()
+}
+
+// expect 检查 key 的 value，expect 为nil时检查 key 不存在
+func (h *harness) expect(key string, expect []byte) {
+	h.t.Helper()
+	value, err := h.db.Get(key)
+	if expect == nil {
+		if errs.GetCode(err) != errs.NotFoundErrCode {
+			h.t.Fatalf("%s: expect not found, got %q, %v", key, value, err)
+		}
+		return
+	}
+	if err != nil || !bytes.Equal(value, expect) {
+		h.t.Fatalf("%s: expect %q, got %q, %v", key, expect, value, err)
+	}
+}
+
+// keys 使用迭代器按遍历顺序读出全部 key 以及 value
+func (h *harness) keys(opts *iface.IteratorOptions) ([]string, [][]byte) {
+	h.t.Helper()
+	it, err := h.db.NewIterator(opts)
+	if err != nil {
+		h.t.Fatalf("new iterator: %v", err)
+	}
+	defer it.Close()
+
+	var keys []string
+	var values [][]byte
+	for ; it.Valid(); it.Next() {
+		value, err := it.Value()
+		if err != nil {
+			h.t.Fatalf("%s: iterator value: %v", it.Key(), err)
+		}
+		keys = append(keys, it.Key())
+		values = append(values, value)
+	}
+	return keys, values
+}
+
+// testCRUD 读取不存在的 key、写入、删除，删除不存在的 key 不返回错误
+func testCRUD(t *testing.T, h *harness) {
+	h.expect("missing", nil)
+	if err := h.db.Delete("missing"); err != nil {
+		t.Fatalf("delete missing key: %v", err)
+	}
+
+	if err := h.db.Set("k1", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.Set("k2", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	h.expect("k1", []byte("v1"))
+	h.expect("k2", []byte{})
+
+	if err := h.db.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	h.expect("k1", nil)
+	h.expect("k2", []byte{})
+
+	// 删除之后再次写入
+	if err := h.db.Set("k1", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	h.expect("k1", []byte("v2"))
+}
+
+// testOverwrite 同一个 key 多次写入，总是读到最后一次写入
+func testOverwrite(t *testing.T, h *harness) {
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10; j++ {
+			if err := h.db.Set(fmt.Sprintf("k%d", j), []byte(fmt.Sprintf("v%d-%d", j, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for j := 0; j < 10; j++ {
+		h.expect(fmt.Sprintf("k%d", j), []byte(fmt.Sprintf("v%d-99", j)))
+	}
+
+	// 覆盖为更短的 value
+	if err := h.db.Set("k0", []byte("s")); err != nil {
+		t.Fatal(err)
+	}
+	h.expect("k0", []byte("s"))
+	if h.durable {
+		h.reopen()
+		h.expect("k0", []byte("s"))
+		h.expect("k9", []byte("v9-99"))
+	}
+}
+
+// testLargeValue 写入、读取以及覆盖大 value
+func testLargeValue(t *testing.T, h *harness) {
+	r := rand.New(rand.NewSource(1))
+	values := make(map[string][]byte)
+	for i, size := range []int{64 << 10, 256 << 10, 1 << 20} {
+		value := make([]byte, size)
+		r.Read(value)
+		key := fmt.Sprintf("large%d", i)
+		values[key] = value
+		if err := h.db.Set(key, value); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+	}
+	for key, value := range values {
+		h.expect(key, value)
+	}
+
+	if err := h.db.Set("large0", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	values["large0"] = []byte("small")
+	if h.durable {
+		h.reopen()
+	}
+	for key, value := range values {
+		h.expect(key, value)
+	}
+}
+
+// testTTL 过期时间、Persist 以及非法的 ttl
+func testTTL(t *testing.T, h *harness) {
+	if err := h.db.SetWithTTL("short", []byte("v"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.SetWithTTL("long", []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.Set("plain", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.SetWithTTL("invalid", []byte("v"), 0); errs.GetCode(err) != errs.InvalidParamErrCode {
+		t.Errorf("expect invalid param on zero ttl, got %v", err)
+	}
+
+	if ttl, err := h.db.TTL("long"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("expect ttl in (0, 1h], got %v, %v", ttl, err)
+	}
+	if ttl, err := h.db.TTL("plain"); err != nil || ttl != iface.NoTTL {
+		t.Errorf("expect no ttl, got %v, %v", ttl, err)
+	}
+	if _, err := h.db.TTL("missing"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect ttl of missing key not found, got %v", err)
+	}
+	if err := h.db.Persist("long"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := h.db.TTL("long"); err != nil || ttl != iface.NoTTL {
+		t.Errorf("expect no ttl after persist, got %v, %v", ttl, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	h.expect("short", nil)
+	if err := h.db.Persist("short"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect persist expired key not found, got %v", err)
+	}
+	if h.durable {
+		h.reopen()
+		h.expect("short", nil)
+		if ttl, err := h.db.TTL("long"); err != nil || ttl != iface.NoTTL {
+			t.Errorf("expect no ttl after reopen, got %v, %v", ttl, err)
+		}
+	}
+}
+
+// testAtomic CompareAndSwap、SetNX、Incr、Decr
+func testAtomic(t *testing.T, h *harness) {
+	if ok, err := h.db.CompareAndSwap("k", []byte("v"), []byte("v1")); err != nil || ok {
+		t.Errorf("expect cas fail on missing key, got %v, %v", ok, err)
+	}
+	if ok, err := h.db.SetNX("k", []byte("v1")); err != nil || !ok {
+		t.Errorf("expect setnx ok, got %v, %v", ok, err)
+	}
+	if ok, err := h.db.SetNX("k", []byte("v2")); err != nil || ok {
+		t.Errorf("expect setnx fail on existing key, got %v, %v", ok, err)
+	}
+	if ok, err := h.db.CompareAndSwap("k", []byte("v2"), []byte("v3")); err != nil || ok {
+		t.Errorf("expect cas fail on mismatch, got %v, %v", ok, err)
+	}
+	if ok, err := h.db.CompareAndSwap("k", []byte("v1"), []byte("v3")); err != nil || !ok {
+		t.Errorf("expect cas ok, got %v, %v", ok, err)
+	}
+	h.expect("k", []byte("v3"))
+
+	if n, err := h.db.Incr("n", 5); err != nil || n != 5 {
+		t.Errorf("expect 5, got %d, %v", n, err)
+	}
+	if n, err := h.db.Decr("n", 7); err != nil || n != -2 {
+		t.Errorf("expect -2, got %d, %v", n, err)
+	}
+	h.expect("n", []byte("-2"))
+	if _, err := h.db.Incr("k", 1); errs.GetCode(err) != errs.NotIntegerErrCode {
+		t.Errorf("expect not integer error, got %v", err)
+	}
+	if err := h.db.Set("max", []byte(strconv.FormatInt(1<<62, 10))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.db.Incr("max", 1<<62); errs.GetCode(err) != errs.NotIntegerErrCode {
+		t.Errorf("expect overflow error, got %v", err)
+	}
+}
+
+// testWriteBatch batch 中的写入按顺序应用，包含非法操作时全部不生效
+func testWriteBatch(t *testing.T, h *harness) {
+	if err := h.db.Set("deleted", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	wb := iface.NewWriteBatch().
+		Set("a", []byte("1")).
+		Set("b", []byte("2")).
+		Set("a", []byte("3")).
+		Delete("deleted").
+		Set("c", []byte("4")).
+		Delete("c")
+	if err := h.db.WriteBatch(wb); err != nil {
+		t.Fatal(err)
+	}
+	h.expect("a", []byte("3"))
+	h.expect("b", []byte("2"))
+	h.expect("c", nil)
+	h.expect("deleted", nil)
+
+	invalid := iface.NewWriteBatch().Set("x", []byte("1"))
+	invalid.Ops = append(invalid.Ops, &iface.WriteOp{Type: -100, Key: "y"})
+	if err := h.db.WriteBatch(invalid); errs.GetCode(err) != errs.UnsupportedOperatorTypeErrCode {
+		t.Errorf("expect unsupported operator type, got %v", err)
+	}
+	h.expect("x", nil)
+
+	if err := h.db.WriteBatch(nil); err != nil {
+		t.Errorf("expect empty batch ok, got %v", err)
+	}
+	if h.durable {
+		h.reopen()
+		h.expect("a", []byte("3"))
+		h.expect("c", nil)
+		h.expect("deleted", nil)
+	}
+}
+
+// testIterator 正向、反向、上下界、前缀以及 Seek
+func testIterator(t *testing.T, h *harness) {
+	all := []string{"a", "a1", "a2", "b", "b1", "c"}
+	for _, key := range all {
+		if err := h.db.Set(key, []byte("v-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.db.Set("deleted", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		opts   *iface.IteratorOptions
+		expect []string
+	}{
+		{nil, all},
+		{&iface.IteratorOptions{Reverse: true}, []string{"c", "b1", "b", "a2", "a1", "a"}},
+		{&iface.IteratorOptions{LowerBound: "a1", UpperBound: "b1"}, []string{"a1", "a2", "b"}},
+		{&iface.IteratorOptions{LowerBound: "a1", UpperBound: "b1", Reverse: true}, []string{"b", "a2", "a1"}},
+		{&iface.IteratorOptions{Prefix: "a"}, []string{"a", "a1", "a2"}},
+		{&iface.IteratorOptions{Prefix: "b", Reverse: true}, []string{"b1", "b"}},
+		{&iface.IteratorOptions{Prefix: "z"}, nil},
+	}
+	for _, c := range cases {
+		keys, values := h.keys(c.opts)
+		if fmt.Sprint(keys) != fmt.Sprint(c.expect) {
+			t.Errorf("%+v: expect %v, got %v", c.opts, c.expect, keys)
+			continue
+		}
+		for i, key := range keys {
+			if string(values[i]) != "v-"+key {
+				t.Errorf("%s: expect value v-%s, got %s", key, key, values[i])
+			}
+		}
+	}
+
+	it, err := h.db.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Seek("a3")
+	if !it.Valid() || it.Key() != "b" {
+		t.Errorf("expect seek a3 to b, got %q", it.Key())
+	}
+	it.Seek("d")
+	if it.Valid() {
+		t.Errorf("expect seek past end invalid, got %q", it.Key())
+	}
+	_ = it.Close()
+
+	it, err = h.db.NewIterator(&iface.IteratorOptions{Reverse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Seek("a3")
+	if !it.Valid() || it.Key() != "a2" {
+		t.Errorf("expect reverse seek a3 to a2, got %q", it.Key())
+	}
+	_ = it.Close()
+}
+
+// testTxn 事务读到自己的写入，提交之前写入不可见，冲突时提交失败并且写入不生效
+func testTxn(t *testing.T, h *harness) {
+	if err := h.db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := h.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := txn.Get("a"); err != nil || string(value) != "1" {
+		t.Fatalf("expect 1, got %s, %v", value, err)
+	}
+	if err := txn.Set("b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := txn.Get("b"); err != nil || string(value) != "2" {
+		t.Errorf("expect read your writes, got %s, %v", value, err)
+	}
+	if _, err := txn.Get("a"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect deleted in txn, got %v", err)
+	}
+	h.expect("b", nil)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	h.expect("a", nil)
+	h.expect("b", []byte("2"))
+	if err := txn.Commit(); errs.GetCode(err) != errs.TxnFinishedErrCode {
+		t.Errorf("expect finished, got %v", err)
+	}
+
+	// 事务读过的 key 被其他写入修改
+	txn, err = h.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txn.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Set("c", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.Set("b", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); errs.GetCode(err) != errs.TxnConflictErrCode {
+		t.Errorf("expect conflict, got %v", err)
+	}
+	h.expect("c", nil)
+
+	// 回滚之后写入不生效
+	txn, err = h.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Set("d", []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Rollback(); err != nil {
+		t.Errorf("expect rollback twice ok, got %v", err)
+	}
+	h.expect("d", nil)
+}
+
+// testConcurrent 并发写入不同的 key、并发读取、并发 Incr 同一个 key 以及并发事务，配合 -race 检查数据竞争
+func testConcurrent(t *testing.T, h *harness) {
+	const workers, perWorker = 8, 100
+
+	var wg sync.WaitGroup
+	failed := make(chan error, workers*4)
+	for w := 0; w < workers; w++ {
+		w := w
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				key := fmt.Sprintf("w%d-%d", w, i)
+				if err := h.db.Set(key, []byte(key)); err != nil {
+					failed <- err
+					return
+				}
+				if i%10 == 0 {
+					if err := h.db.Delete(key); err != nil {
+						failed <- err
+						return
+					}
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				if _, err := h.db.Incr("counter", 1); err != nil {
+					failed <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				key := fmt.Sprintf("w%d-%d", (w+1)%workers, i)
+				value, err := h.db.Get(key)
+				if err != nil && errs.GetCode(err) != errs.NotFoundErrCode {
+					failed <- err
+					return
+				}
+				if err == nil && string(value) != key {
+					failed <- fmt.Errorf("%s: unexpect value %q", key, value)
+					return
+				}
+				if i%20 == 0 {
+					it, err := h.db.NewIterator(&iface.IteratorOptions{Prefix: "w"})
+					if err != nil {
+						failed <- err
+						return
+					}
+					for n := 0; it.Valid() && n < 10; n++ {
+						it.Next()
+					}
+					_ = it.Close()
+				}
+			}
+		}()
+	}
+
+	// 并发事务各自对 txn-counter 加一，冲突时重试
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				for {
+					err := incrInTxn(h.db, "txn-counter")
+					if err == nil {
+						break
+					}
+					if errs.GetCode(err) != errs.TxnConflictErrCode {
+						failed <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(failed)
+	for err := range failed {
+		t.Error(err)
+	}
+
+	for w := 0; w < workers; w++ {
+		for i := 0; i < perWorker; i++ {
+			key := fmt.Sprintf("w%d-%d", w, i)
+			if i%10 == 0 {
+				h.expect(key, nil)
+			} else {
+				h.expect(key, []byte(key))
+			}
+		}
+	}
+	h.expect("counter", []byte(strconv.Itoa(workers*perWorker)))
+	h.expect("txn-counter", []byte(strconv.Itoa(workers*10)))
+}
+
+// incrInTxn 在事务中读取 key 加一之后写回
+func incrInTxn(db iface.ICore, key string) error {
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var n int
+	value, err := txn.Get(key)
+	if err == nil {
+		n, err = strconv.Atoi(string(value))
+	}
+	if err != nil && errs.GetCode(err) != errs.NotFoundErrCode {
+		_ = txn.Rollback()
+		return err
+	}
+	err = txn.Set(key, []byte(strconv.Itoa(n+1)))
+	if err != nil {
+		_ = txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// testReopen 多次关闭之后重新打开，每次都能读到关闭之前的全部写入，重新打开之后可以继续写入
+func testReopen(t *testing.T, h *harness) {
+	model := make(map[string][]byte)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("k%03d", (round*70+i)%300)
+			value := []byte(fmt.Sprintf("%s-%d", key, round))
+			if err := h.db.Set(key, value); err != nil {
+				t.Fatal(err)
+			}
+			model[key] = value
+		}
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("k%03d", (round*31+i*7)%300)
+			if err := h.db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(model, key)
+		}
+
+		h.reopen()
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("k%03d", i)
+			h.expect(key, model[key])
+		}
+		keys, _ := h.keys(nil)
+		if len(keys) != len(model) {
+			t.Fatalf("round %d: expect %d keys after reopen, got %d", round, len(model), len(keys))
+		}
+	}
+}
+
+// testCrash 写入之后不调用 Close，直接复制数据目录模拟进程崩溃，从复制的目录打开时能读到全部已经返回的写入
+// 写入数量不超过 checkpoint、刷盘等后台任务的阈值，保证复制目录时引擎没有在修改文件，恢复时依赖回放预写日志
+func testCrash(t *testing.T, h *harness) {
+	if h.newCrashConfig == nil {
+		t.Skip("engine is not crash safe")
+	}
+	dir := t.TempDir()
+	db, err := h.builder(h.newCrashConfig(dir))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer db.Close()
+
+	model := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		model[key] = []byte(fmt.Sprintf("v%d", i))
+		if err := db.Set(key, model[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%02d", i*5)
+		if i%2 == 0 {
+			model[key] = []byte(fmt.Sprintf("overwrite%d", i))
+			err = db.Set(key, model[key])
+		} else {
+			delete(model, key)
+			err = db.Delete(key)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+	h.close()
+	h.config = h.newCrashConfig(crashed)
+	h.db = h.open()
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		h.expect(key, model[key])
+	}
+
+	// 恢复之后可以继续写入
+	if err := h.db.Set("after", []byte("crash")); err != nil {
+		t.Fatal(err)
+	}
+	h.reopen()
+	h.expect("after", []byte("crash"))
+}
+
+// copyDir 复制 src 目录下的全部文件到 dst
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+	if err != nil {
+		t.Fatalf("copy dir: %v", err)
+	}
+}
+
+// testModel 随机操作与内存中的模型对比，期间多次检查读取与迭代结果，持久化的引擎还会重新打开
+func testModel(t *testing.T, h *harness) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	r := rand.New(rand.NewSource(seed))
+
+	const keySpace = 200
+	model := make(map[string][]byte)
+	randomKey := func() string {
+		return fmt.Sprintf("key%03d", r.Intn(keySpace))
+	}
+	randomValue := func() []byte {
+		value := make([]byte, r.Intn(64))
+		r.Read(value)
+		return value
+	}
+
+	verify := func(step int) {
+		for i := 0; i < keySpace; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			value, err := h.db.Get(key)
+			expect, exist := model[key]
+			if !exist {
+				if errs.GetCode(err) != errs.NotFoundErrCode {
+					t.Fatalf("step %d, %s: expect not found, got %q, %v", step, key, value, err)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(value, expect) {
+				t.Fatalf("step %d, %s: expect %q, got %q, %v", step, key, expect, value, err)
+			}
+		}
+
+		expectKeys := make([]string, 0, len(model))
+		for key := range model {
+			expectKeys = append(expectKeys, key)
+		}
+		sort.Strings(expectKeys)
+		keys, values := h.keys(nil)
+		if fmt.Sprint(keys) != fmt.Sprint(expectKeys) {
+			t.Fatalf("step %d: iterate expect %v, got %v", step, expectKeys, keys)
+		}
+		for i, key := range keys {
+			if !bytes.Equal(values[i], model[key]) {
+				t.Fatalf("step %d, %s: iterate expect %q, got %q", step, key, model[key], values[i])
+			}
+		}
+	}
+
+	const steps = 3000
+	for step := 0; step < steps; step++ {
+		switch op := r.Intn(100); {
+		case op < 50:
+			key, value := randomKey(), randomValue()
+			if err := h.db.Set(key, value); err != nil {
+				t.Fatal(err)
+			}
+			model[key] = value
+		case op < 70:
+			key := randomKey()
+			if err := h.db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(model, key)
+		case op < 80:
+			wb := iface.NewWriteBatch()
+			pending := make(map[string][]byte)
+			deleted := make(map[string]bool)
+			for i := r.Intn(5) + 1; i > 0; i-- {
+				key := randomKey()
+				if r.Intn(3) == 0 {
+					wb.Delete(key)
+					deleted[key] = true
+					delete(pending, key)
+					continue
+				}
+				value := randomValue()
+				wb.Set(key, value)
+				pending[key] = value
+				delete(deleted, key)
+			}
+			if err := h.db.WriteBatch(wb); err != nil {
+				t.Fatal(err)
+			}
+			for key := range deleted {
+				delete(model, key)
+			}
+			for key, value := range pending {
+				model[key] = value
+			}
+		case op < 90:
+			key := randomKey()
+			current, exist := model[key]
+			expected := current
+			if r.Intn(2) == 0 {
+				expected = randomValue()
+			}
+			value := randomValue()
+			ok, err := h.db.CompareAndSwap(key, expected, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expectOk := exist && bytes.Equal(current, expected); ok != expectOk {
+				t.Fatalf("step %d, %s: expect cas %v, got %v", step, key, expectOk, ok)
+			}
+			if ok {
+				model[key] = value
+			}
+		default:
+			key, value := randomKey(), randomValue()
+			ok, err := h.db.SetNX(key, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, exist := model[key]; ok == exist {
+				t.Fatalf("step %d, %s: expect setnx %v, got %v", step, key, !exist, ok)
+			}
+			if ok {
+				model[key] = value
+			}
+		}
+
+		if (step+1)%500 == 0 {
+			verify(step)
+			if h.durable && (step+1)%1500 == 0 {
+				h.reopen()
+				verify(step)
+			}
+		}
+	}
+}
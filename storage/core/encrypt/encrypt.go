@@ -0,0 +1,202 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"strings"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+)
+
+const (
+	KeyIDSize   = 4  // KeyIDSize 密钥id长度，单位字节
+	nonceSize   = 12 // nonceSize AES-GCM 随机数长度，单位字节
+	tagSize     = 16 // tagSize AES-GCM 认证标签长度，单位字节
+	envPrefix   = "env:"
+	filePrefix  = "file:"
+	minKeyBytes = 16
+)
+
+// Overhead 使用 Key.Seal 加密之后数据增加的长度
+const Overhead = nonceSize + tagSize
+
+// Key AES-GCM 密钥
+// 密钥id由密钥内容的 sha256 摘要前4个字节得到，同一个密钥在不同进程中的id相同
+type Key struct {
+	id   uint32
+	aead cipher.AEAD
+}
+
+// NewKey 通过密钥内容创建 Key，密钥长度必须是16、24或者32字节，分别对应 AES-128、AES-192、AES-256
+//
+// 异常：
+//   - errs.NewInvalidKeyErr 密钥长度不合法
+func NewKey(material []byte) (*Key, error) {
+	block, err := aes.NewCipher(material)
+	if err != nil {
+		return nil, errs.NewInvalidKeyErr().WithErr(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errs.NewInvalidKeyErr().WithErr(err)
+	}
+	digest := sha256.Sum256(material)
+	return &Key{
+		id:   binary.BigEndian.Uint32(digest[:KeyIDSize]),
+		aead: aead,
+	}, nil
+}
+
+// LoadKey 从密钥来源加载 Key
+// source 以 env: 开头时从环境变量中读取十六进制编码的密钥，否则作为密钥文件路径（可以带 file: 前缀），
+// 密钥文件内容可以是原始字节，也可以是十六进制编码，能够按十六进制解码时优先按十六进制处理
+//
+// 异常：
+//   - errs.NewInvalidKeyErr 环境变量不存在或者密钥不合法
+//   - errs.NewReadFileErr 读取密钥文件失败
+func LoadKey(source string) (*Key, error) {
+	if name, ok := strings.CutPrefix(source, envPrefix); ok {
+		value, exist := os.LookupEnv(name)
+		if !exist {
+			return nil, errs.NewInvalidKeyErr()
+		}
+		material, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, errs.NewInvalidKeyErr().WithErr(err)
+		}
+		return NewKey(material)
+	}
+
+	raw, err := os.ReadFile(strings.TrimPrefix(source, filePrefix))
+	if err != nil {
+		return nil, errs.NewReadFileErr().WithErr(err)
+	}
+	// 十六进制编码的密钥文件末尾通常有换行
+	if material, err := hex.DecodeString(string(bytes.TrimSpace(raw))); err == nil && len(material) >= minKeyBytes {
+		return NewKey(material)
+	}
+	return NewKey(raw)
+}
+
+// ID 密钥id
+func (k *Key) ID() uint32 {
+	return k.id
+}
+
+// Seal 加密并认证 plaintext，aad 是只认证不加密的附加数据
+// 返回的结构：| nonce 12字节 | 密文 | tag 16字节 |
+func (k *Key) Seal(plaintext, aad []byte) []byte {
+	buf := make([]byte, nonceSize, nonceSize+len(plaintext)+tagSize)
+	// note：crypto/rand 读取失败意味着系统随机数不可用，没有办法继续安全地加密
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return k.aead.Seal(buf, buf, plaintext, aad)
+}
+
+// Open 解密 Seal 的结果，数据或者 aad 被篡改时返回错误
+//
+// 异常：
+//   - errs.NewFileIntegrityErr 数据被篡改、损坏，或者不是由该密钥加密
+func (k *Key) Open(sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, errs.NewFileIntegrityErr()
+	}
+	plaintext, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], aad)
+	if err != nil {
+		return nil, errs.NewFileIntegrityErr().WithErr(err)
+	}
+	return plaintext, nil
+}
+
+// Keyring 当前使用的密钥以及轮换前的旧密钥
+// 新数据总是使用 Active 加密，旧密钥只用于解密轮换之前写入的数据
+type Keyring struct {
+	active *Key
+	keys   map[uint32]*Key
+}
+
+// NewKeyring 创建 Keyring，retired 是轮换前的旧密钥
+func NewKeyring(active *Key, retired ...*Key) *Keyring {
+	kr := &Keyring{
+		active: active,
+		keys:   map[uint32]*Key{active.id: active},
+	}
+	for _, key := range retired {
+		if _, exist := kr.keys[key.id]; !exist {
+			kr.keys[key.id] = key
+		}
+	}
+	return kr
+}
+
+// LoadKeyring 从密钥来源加载 Keyring，active 为空时表示不加密，返回nil
+func LoadKeyring(active string, retired []string) (*Keyring, error) {
+	if active == "" {
+		return nil, nil
+	}
+	activeKey, err := LoadKey(active)
+	if err != nil {
+		return nil, err
+	}
+	retiredKeys := make([]*Key, 0, len(retired))
+	for _, source := range retired {
+		key, err := LoadKey(source)
+		if err != nil {
+			return nil, err
+		}
+		retiredKeys = append(retiredKeys, key)
+	}
+	return NewKeyring(activeKey, retiredKeys...), nil
+}
+
+// Active 当前用于加密的密钥
+func (kr *Keyring) Active() *Key {
+	return kr.active
+}
+
+// Key 按密钥id查找密钥
+//
+// 异常：
+//   - errs.NewKeyNotFoundErr 数据使用的密钥不在 Keyring 中，通常是轮换之后没有配置旧密钥
+func (kr *Keyring) Key(id uint32) (*Key, error) {
+	key, exist := kr.keys[id]
+	if !exist {
+		return nil, errs.NewKeyNotFoundErr()
+	}
+	return key, nil
+}
+
+// Seal 使用 Active 加密，结果中带有密钥id，可以脱离文件头独立解密
+// 返回的结构：| 密钥id 4字节 | nonce 12字节 | 密文 | tag 16字节 |
+func (kr *Keyring) Seal(plaintext, aad []byte) []byte {
+	id := make([]byte, KeyIDSize)
+	binary.BigEndian.PutUint32(id, kr.active.id)
+	return append(id, kr.active.Seal(plaintext, aad)...)
+}
+
+// Open 按结果中的密钥id解密 Keyring.Seal 的结果
+func (kr *Keyring) Open(sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < KeyIDSize {
+		return nil, errs.NewFileIntegrityErr()
+	}
+	key, err := kr.Key(binary.BigEndian.Uint32(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return key.Open(sealed[KeyIDSize:], aad)
+}
+
+// SealedKeyID 返回 Keyring.Seal 结果中的密钥id
+func SealedKeyID(sealed []byte) (uint32, bool) {
+	if len(sealed) < KeyIDSize {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(sealed), true
+}
@@ -0,0 +1,73 @@
+package encrypt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+)
+
+// TestLoadKey 从环境变量、原始字节以及十六进制编码的密钥文件中加载的同一个密钥id相同
+func TestLoadKey(t *testing.T) {
+	material := []byte("eggie_kv-test-key-0123456789abcd")
+	t.Setenv("EGGIE_KV_TEST_KEY", "65676769655f6b762d746573742d6b65792d3031323334353637383961626364")
+	dir := t.TempDir()
+	rawPath := filepath.Join(dir, "raw.key")
+	hexPath := filepath.Join(dir, "hex.key")
+	if err := os.WriteFile(rawPath, material, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hexPath, []byte("65676769655f6b762d746573742d6b65792d3031323334353637383961626364\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	expect, err := NewKey(material)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range []string{"env:EGGIE_KV_TEST_KEY", rawPath, "file:" + hexPath} {
+		key, err := LoadKey(source)
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		if key.ID() != expect.ID() {
+			t.Errorf("%s: expect key id %d, got %d", source, expect.ID(), key.ID())
+		}
+	}
+
+	if _, err := LoadKey("env:EGGIE_KV_TEST_KEY_NOT_EXIST"); errs.GetCode(err) != errs.InvalidKeyErrCode {
+		t.Errorf("expect invalid key error, got %v", err)
+	}
+	if _, err := NewKey([]byte("short")); errs.GetCode(err) != errs.InvalidKeyErrCode {
+		t.Errorf("expect invalid key error, got %v", err)
+	}
+}
+
+// TestKeyring 轮换之后旧密钥加密的数据仍然可以解密，篡改数据或者附加数据时解密失败
+func TestKeyring(t *testing.T) {
+	oldKey, _ := NewKey([]byte("0123456789abcdef"))
+	newKey, _ := NewKey([]byte("fedcba9876543210"))
+	aad := []byte("aad")
+
+	sealed := NewKeyring(oldKey).Seal([]byte("value"), aad)
+	if id, _ := SealedKeyID(sealed); id != oldKey.ID() {
+		t.Errorf("expect key id %d, got %d", oldKey.ID(), id)
+	}
+
+	keyring := NewKeyring(newKey, oldKey)
+	plaintext, err := keyring.Open(sealed, aad)
+	if err != nil || string(plaintext) != "value" {
+		t.Errorf("expect value, got %s, %v", plaintext, err)
+	}
+	if _, err := keyring.Open(sealed, []byte("other")); errs.GetCode(err) != errs.FileIntegrityErrCode {
+		t.Errorf("expect integrity error on aad mismatch, got %v", err)
+	}
+	sealed[len(sealed)-1] ^= 0xff
+	if _, err := keyring.Open(sealed, aad); errs.GetCode(err) != errs.FileIntegrityErrCode {
+		t.Errorf("expect integrity error on tampered data, got %v", err)
+	}
+	if _, err := NewKeyring(newKey).Open(sealed, aad); errs.GetCode(err) != errs.KeyNotFoundErrCode {
+		t.Errorf("expect key not found, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package format
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+)
+
+// Checksum 校验和算法，记录在文件头中，同一个文件中的 block、Record 使用同一种算法
+type Checksum uint8
+
+const (
+	MD5    Checksum = iota // MD5 没有文件头的旧格式使用的算法
+	CRC32C                 // CRC32C 新文件使用的算法，amd64、arm64 上有硬件指令加速
+)
+
+// SumSize 校验和字段长度，单位字节
+// 该字段按 MD5 的长度预留，CRC32C 只使用前4个字节，其余字节为0
+const SumSize = 16
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Sum 按顺序计算 parts 的校验和，写入 dst，dst 长度不能小于 SumSize
+// 分段传入避免调用方为了计算校验和拼接数据
+func (c Checksum) Sum(dst []byte, parts ...[]byte) {
+	switch c {
+	case CRC32C:
+		var crc uint32
+		for _, part := range parts {
+			crc = crc32.Update(crc, castagnoli, part)
+		}
+		binary.BigEndian.PutUint32(dst, crc)
+		for i := 4; i < SumSize; i++ {
+			dst[i] = 0
+		}
+	default:
+		h := md5.New()
+		for _, part := range parts {
+			h.Write(part)
+		}
+		h.Sum(dst[:0])
+	}
+}
+
+// Verify 校验 sum 是否是 parts 的校验和
+func (c Checksum) Verify(sum []byte, parts ...[]byte) bool {
+	var current [SumSize]byte
+	c.Sum(current[:], parts...)
+	return len(sum) >= SumSize && string(sum[:SumSize]) == string(current[:])
+}
+
+const (
+	// Version 当前的文件格式版本，没有文件头的旧格式视为版本0
+	Version uint8 = 1
+	// HeaderSize 文件头长度，单位字节
+	HeaderSize = 16
+	// MagicSize 文件头中 magic 长度，单位字节
+	MagicSize = 8
+
+	// 字段偏移量，单位字节
+	headerVersionOffset  = 8
+	headerChecksumOffset = 9
+	headerFlagOffset     = 10
+	headerKeyIDOffset    = 12
+)
+
+// HeaderFlagEncrypted 文件中的数据使用文件头中的密钥id对应的密钥加密
+const HeaderFlagEncrypted uint8 = 1
+
+// Header 文件头，位于 segment 文件、数据文件的开头
+// 存储结构：| magic 8字节 | 版本 1字节 | 校验和算法 1字节 | 标记位 1字节 | 保留 1字节 | 密钥id 4字节 |
+type Header struct {
+	Magic    string
+	Version  uint8
+	Checksum Checksum
+	Flag     uint8
+	KeyID    uint32 // KeyID 只有 Flag 中设置了 HeaderFlagEncrypted 时有意义
+}
+
+// NewHeader 创建当前版本的文件头，magic 长度必须是 MagicSize
+func NewHeader(magic string) *Header {
+	return &Header{
+		Magic:    magic,
+		Version:  Version,
+		Checksum: CRC32C,
+	}
+}
+
+// Encode 序列化文件头
+func (h *Header) Encode() []byte {
+	buf := make([]byte, HeaderSize)
+	copy(buf, h.Magic)
+	buf[headerVersionOffset] = h.Version
+	buf[headerChecksumOffset] = uint8(h.Checksum)
+	buf[headerFlagOffset] = h.Flag
+	binary.BigEndian.PutUint32(buf[headerKeyIDOffset:], h.KeyID)
+	return buf
+}
+
+// ParseHeader 解析 raw 开头的文件头，raw 不是以 magic 开头的完整文件头时返回nil，调用方按旧格式处理
+//
+// 异常：
+//   - errs.NewUnsupportedFormatErr 文件头的版本比当前版本新，或者校验和算法未知
+func ParseHeader(raw []byte, magic string) (*Header, error) {
+	return ParseVersionedHeader(raw, magic, Version)
+}
+
+// ParseVersionedHeader 与 ParseHeader 相同，maxVersion 是调用方支持的最新版本
+// 在 Version 的基础上单独演进格式的文件（例如 wal segment）使用自己的版本号
+func ParseVersionedHeader(raw []byte, magic string, maxVersion uint8) (*Header, error) {
+	if len(raw) < HeaderSize || string(raw[:MagicSize]) != magic {
+		return nil, nil
+	}
+	h := &Header{
+		Magic:    magic,
+		Version:  raw[headerVersionOffset],
+		Checksum: Checksum(raw[headerChecksumOffset]),
+		Flag:     raw[headerFlagOffset],
+		KeyID:    binary.BigEndian.Uint32(raw[headerKeyIDOffset:]),
+	}
+	if h.Version == 0 || h.Version > maxVersion || h.Checksum > CRC32C {
+		return nil, errs.NewUnsupportedFormatErr()
+	}
+	return h, nil
+}
+
+// IsTornHeader 判断不足一个文件头长度的 raw 是否是写到一半的文件头，即 raw 是 magic 的前缀
+func IsTornHeader(raw []byte, magic string) bool {
+	n := len(raw)
+	if n == 0 || n >= HeaderSize {
+		return false
+	}
+	if n > MagicSize {
+		n = MagicSize
+	}
+	return string(raw[:n]) == magic[:n]
+}
@@ -0,0 +1,81 @@
+package format
+
+import (
+	"crypto/md5"
+	"fmt"
+	"testing"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+)
+
+// TestChecksum 分段计算的校验和与整体计算一致，MD5 与旧格式兼容，数据被修改后校验失败
+func TestChecksum(t *testing.T) {
+	data, header := []byte("eggie_kv payload"), []byte("header")
+	for _, checksum := range []Checksum{MD5, CRC32C} {
+		sum := make([]byte, SumSize)
+		checksum.Sum(sum, data, header)
+		if !checksum.Verify(sum, append(append([]byte{}, data...), header...)) {
+			t.Errorf("checksum %d: expect verify ok", checksum)
+		}
+		if checksum.Verify(sum, data, []byte("Header")) {
+			t.Errorf("checksum %d: expect verify failed after tamper", checksum)
+		}
+	}
+
+	legacy := md5.Sum([]byte("eggie_kv payloadheader"))
+	if !MD5.Verify(legacy[:], data, header) {
+		t.Error("expect md5 compatible with legacy checksum")
+	}
+}
+
+// TestParseHeader 解析当前格式的文件头，旧格式返回nil，新版本返回错误
+func TestParseHeader(t *testing.T) {
+	header := NewHeader("EGGIETST")
+	header.Flag = HeaderFlagEncrypted
+	header.KeyID = 0xdeadbeef
+	raw := header.Encode()
+
+	parsed, err := ParseHeader(raw, "EGGIETST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != *header {
+		t.Errorf("expect %+v, got %+v", header, parsed)
+	}
+
+	parsed, err = ParseHeader(raw, "EGGIEOLD")
+	if err != nil || parsed != nil {
+		t.Errorf("expect legacy format, got %+v, %v", parsed, err)
+	}
+
+	raw[headerVersionOffset] = Version + 1
+	if _, err = ParseHeader(raw, "EGGIETST"); errs.GetCode(err) != errs.UnsupportedFormatErrCode {
+		t.Errorf("expect unsupported format, got %v", err)
+	}
+	// 单独演进版本的文件按调用方支持的最新版本校验
+	if parsed, err = ParseVersionedHeader(raw, "EGGIETST", Version+1); err != nil || parsed.Version != Version+1 {
+		t.Errorf("expect versioned header parsed, got %+v, %v", parsed, err)
+	}
+
+	if !IsTornHeader(raw[:5], "EGGIETST") || IsTornHeader([]byte("EGGIX"), "EGGIETST") || IsTornHeader(raw, "EGGIETST") {
+		t.Error("torn header mismatch")
+	}
+}
+
+// BenchmarkChecksum 对比 MD5 与 CRC32C 计算 block 校验和的耗时
+func BenchmarkChecksum(b *testing.B) {
+	header := make([]byte, 16)
+	for _, size := range []int{100, 4 * 1024, 64 * 1024} {
+		data := make([]byte, size)
+		for _, checksum := range []Checksum{MD5, CRC32C} {
+			name := map[Checksum]string{MD5: "md5", CRC32C: "crc32c"}[checksum]
+			b.Run(fmt.Sprintf("%s/%dB", name, size), func(b *testing.B) {
+				sum := make([]byte, SumSize)
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					checksum.Sum(sum, data, header)
+				}
+			})
+		}
+	}
+}
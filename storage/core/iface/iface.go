@@ -1,12 +1,101 @@
 package iface
 
 import (
+	"github.com/Trinoooo/eggie_kv/consts"
 	"github.com/spf13/viper"
+	"time"
 )
 
+// NoTTL key 没有设置过期时间时 TTL 的返回值
+const NoTTL time.Duration = -1
+
 type ICore interface {
 	Get(key string) ([]byte, error)
 	Set(key string, value []byte) error
+	// SetWithTTL 写入 key，ttl 之后 key 过期，过期之后的 key 视为不存在
+	SetWithTTL(key string, value []byte, ttl time.Duration) error
+	// TTL 返回 key 的剩余存活时间，没有设置过期时间时返回 NoTTL
+	TTL(key string) (time.Duration, error)
+	// Persist 去掉 key 的过期时间
+	Persist(key string) error
+	Delete(key string) error
+	// CompareAndSwap key 当前的 value 等于 expected 时写入 value，返回是否写入；key 不存在时不写入
+	CompareAndSwap(key string, expected, value []byte) (bool, error)
+	// SetNX key 不存在时写入 value，返回是否写入
+	SetNX(key string, value []byte) (bool, error)
+	// Incr 将 key 的 value 作为十进制 int64 加上 delta，返回相加之后的值；key 不存在时视为0
+	Incr(key string, delta int64) (int64, error)
+	// Decr 将 key 的 value 作为十进制 int64 减去 delta，返回相减之后的值；key 不存在时视为0
+	Decr(key string, delta int64) (int64, error)
+	// WriteBatch 原子地应用一组写入和删除，要么全部生效，要么全部不生效
+	WriteBatch(batch *WriteBatch) error
+	// NewIterator 创建按 key 字典序遍历的迭代器，使用完之后需要调用 Iterator.Close
+	NewIterator(opts *IteratorOptions) (Iterator, error)
+	// Begin 开始一个乐观事务，使用完之后需要调用 Txn.Commit 或 Txn.Rollback
+	Begin() (Txn, error)
+	Close() error
 }
 
 type Builder func(config *viper.Viper) (ICore, error)
+
+// WriteOp WriteBatch 中的一次写入或删除
+type WriteOp struct {
+	Type  consts.OperatorType // Type 只能是 consts.OperatorTypeSet 或 consts.OperatorTypeDelete
+	Key   string
+	Value []byte
+}
+
+// WriteBatch 一组需要原子应用的写入和删除，按添加顺序应用
+type WriteBatch struct {
+	Ops []*WriteOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Set 添加一次写入
+func (wb *WriteBatch) Set(key string, value []byte) *WriteBatch {
+	wb.Ops = append(wb.Ops, &WriteOp{Type: consts.OperatorTypeSet, Key: key, Value: value})
+	return wb
+}
+
+// Delete 添加一次删除
+func (wb *WriteBatch) Delete(key string) *WriteBatch {
+	wb.Ops = append(wb.Ops, &WriteOp{Type: consts.OperatorTypeDelete, Key: key})
+	return wb
+}
+
+// IteratorOptions 迭代器配置
+type IteratorOptions struct {
+	Reverse    bool   // Reverse 为true时按 key 从大到小遍历
+	LowerBound string // LowerBound 遍历范围下界（包含），空字符串表示没有下界
+	UpperBound string // UpperBound 遍历范围上界（不包含），空字符串表示没有上界
+	Prefix     string // Prefix 只遍历有该前缀的 key，与上下界同时设置时取交集
+}
+
+// Iterator 有序迭代器
+// 创建之后定位在遍历顺序的第一个 key 上，迭代过程中的写入可能可见也可能不可见
+type Iterator interface {
+	// Seek 正向遍历时定位到第一个大于等于 key 的 key，反向遍历时定位到最后一个小于等于 key 的 key
+	Seek(key string)
+	// Next 按遍历顺序移动到下一个 key
+	Next()
+	// Valid 判断迭代器是否定位在有效的 key 上
+	Valid() bool
+	Key() string
+	Value() ([]byte, error)
+	Close() error
+}
+
+// Txn 乐观事务
+// 事务中的读取能够读到事务中的写入，提交之前事务中的写入对外不可见；
+// 提交时读写过的 key 在事务开始之后被其他写入修改时返回 errs.NewTxnConflictErr
+type Txn interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Delete(key string) error
+	Commit() error
+	// Rollback 放弃事务中的全部写入，事务已经结束时什么都不做
+	Rollback() error
+}
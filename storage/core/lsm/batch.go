@@ -0,0 +1,125 @@
+package lsm
+
+import (
+	"encoding/binary"
+
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/lsm/logs"
+	"go.uber.org/zap"
+)
+
+// opTypeCheck 事务提交时检查 key 在事务开始之后没有被修改，不会写入 wal
+const opTypeCheck consts.OperatorType = -1
+
+// Op 一次写入请求中的操作
+type Op struct {
+	Type     consts.OperatorType
+	Key      string
+	Value    []byte
+	ExpireAt int64  // ExpireAt 过期时间，unix 纳秒时间戳，0表示永不过期
+	Expected []byte // Expected CompareAndSwap 期望的当前 value
+	Seq      uint64 // Seq 只用于 opTypeCheck，事务开始时的序列号
+}
+
+func NewOp(opType consts.OperatorType, key string, value []byte) *Op {
+	return &Op{
+		Type:  opType,
+		Key:   key,
+		Value: value,
+	}
+}
+
+// entry key 的一个版本，是 memtable、SSTable 中存储的基本单位
+// 删除以 deleted 为true的墓碑表示，墓碑会遮住更旧的版本，直到 compaction 到最底层才会被丢弃
+type entry struct {
+	key      string
+	value    []byte
+	expireAt int64  // expireAt 过期时间，unix 纳秒时间戳，0表示永不过期
+	seq      uint64 // seq 写入时的序列号，同一个 key 序列号大的版本更新
+	deleted  bool
+}
+
+func (e *entry) isExpired(now int64) bool {
+	return e.expireAt != 0 && e.expireAt <= now
+}
+
+// visible 判断 entry 对读取是否可见，墓碑以及过期的 entry 都视为 key 不存在
+func (e *entry) visible(now int64) bool {
+	return !e.deleted && !e.isExpired(now)
+}
+
+// 日志字段长度，单位字节
+const (
+	recordHeaderSize = 16 // recordHeaderSize | 序列号 8字节 | op数量 8字节 |
+	recordOpSize     = 17 // recordOpSize | 是否删除 1字节 | 过期时间 8字节 | key长度 4字节 | value长度 4字节 |
+)
+
+// encodeRecord 将一次原子写入编码为一条 wal 日志，全部写操作共享同一个序列号
+// 结构：| 序列号 8字节 | op数量 8字节 | op... |
+// op 结构：| 是否删除 1字节 | 过期时间 8字节 | key长度 4字节 | value长度 4字节 | key | value |
+func encodeRecord(seq uint64, entries []*entry) []byte {
+	size := recordHeaderSize
+	for _, e := range entries {
+		size += recordOpSize + len(e.key) + len(e.value)
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint64(buf, seq)
+	binary.BigEndian.PutUint64(buf[8:], uint64(len(entries)))
+	offset := recordHeaderSize
+	for _, e := range entries {
+		if e.deleted {
+			buf[offset] = 1
+		}
+		binary.BigEndian.PutUint64(buf[offset+1:], uint64(e.expireAt))
+		binary.BigEndian.PutUint32(buf[offset+9:], uint32(len(e.key)))
+		binary.BigEndian.PutUint32(buf[offset+13:], uint32(len(e.value)))
+		offset += recordOpSize
+		offset += copy(buf[offset:], e.key)
+		offset += copy(buf[offset:], e.value)
+	}
+	return buf
+}
+
+// decodeRecord 是 encodeRecord 的逆过程
+func decodeRecord(raw []byte) (uint64, []*entry, error) {
+	if len(raw) < recordHeaderSize {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error(), zap.Int("length", len(raw)))
+		return 0, nil, e
+	}
+
+	seq := binary.BigEndian.Uint64(raw)
+	count := binary.BigEndian.Uint64(raw[8:])
+	entries := make([]*entry, 0, count)
+	offset := recordHeaderSize
+	for i := uint64(0); i < count; i++ {
+		if len(raw)-offset < recordOpSize {
+			e := errs.NewCorruptErr()
+			logs.Error(e.Error(), zap.Uint64("seq", seq), zap.Uint64("op", i))
+			return 0, nil, e
+		}
+		e := &entry{
+			seq:      seq,
+			deleted:  raw[offset] == 1,
+			expireAt: int64(binary.BigEndian.Uint64(raw[offset+1:])),
+		}
+		keyLen := int(binary.BigEndian.Uint32(raw[offset+9:]))
+		valueLen := int(binary.BigEndian.Uint32(raw[offset+13:]))
+		offset += recordOpSize
+		if len(raw)-offset < keyLen+valueLen {
+			e := errs.NewCorruptErr()
+			logs.Error(e.Error(), zap.Uint64("seq", seq), zap.Uint64("op", i))
+			return 0, nil, e
+		}
+		e.key = string(raw[offset : offset+keyLen])
+		offset += keyLen
+		if !e.deleted {
+			e.value = append([]byte{}, raw[offset:offset+valueLen]...)
+		}
+		offset += valueLen
+		entries = append(entries, e)
+	}
+	return seq, entries, nil
+}
@@ -0,0 +1,318 @@
+package lsm
+
+import (
+	"container/heap"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/storage/core/lsm/logs"
+	"go.uber.org/zap"
+)
+
+// compaction 一次 compaction 的输入
+type compaction struct {
+	level    int      // level 输入所在的层，输出写到 level+1 层
+	inputs   []*table // inputs level 层参与 compaction 的 SSTable
+	overlaps []*table // overlaps level+1 层与 inputs key 范围重叠的 SSTable
+}
+
+// maybeCompact 通知 compaction 协程检查是否需要 compaction
+func (db *DB) maybeCompact() {
+	db.signal(db.compactSignal)
+}
+
+// compactLoop 后台 compaction 协程，每次通知后持续 compaction 直到没有需要 compaction 的层
+func (db *DB) compactLoop() {
+	defer db.background.Done()
+
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-db.compactSignal:
+		}
+
+		for {
+			compacted, err := db.compact()
+			if err != nil {
+				logs.Error(err.Error())
+				break
+			}
+			if !compacted {
+				break
+			}
+			select {
+			case <-db.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// compact 执行一次 compaction，返回是否有需要 compaction 的层
+// 同一时刻只能有一个 compaction，由 compaction 协程调用
+func (db *DB) compact() (bool, error) {
+	db.mu.RLock()
+	v := db.current
+	v.ref()
+	db.mu.RUnlock()
+	defer v.unref()
+
+	c := db.pickCompaction(v)
+	if c == nil {
+		return false, nil
+	}
+
+	start := time.Now()
+	edit := newVersionEdit()
+	for _, t := range c.inputs {
+		edit.removed[t.id] = struct{}{}
+	}
+	for _, t := range c.overlaps {
+		edit.removed[t.id] = struct{}{}
+	}
+
+	// 下一层没有重叠的 SSTable 时直接移动，不需要重写。L0 的 SSTable 之间可能重叠，只移动单个 SSTable
+	if len(c.inputs) == 1 && len(c.overlaps) == 0 {
+		edit.added[c.level+1] = c.inputs
+		err := db.logAndApply(edit, nil)
+		if err != nil {
+			return false, err
+		}
+		logs.Info("lsm compaction move", zap.Int("level", c.level), zap.Uint64("table", c.inputs[0].id))
+		return true, nil
+	}
+
+	outputs, err := db.mergeTables(v, c)
+	if err != nil {
+		return false, err
+	}
+	edit.added[c.level+1] = outputs
+	err = db.logAndApply(edit, nil)
+	if err != nil {
+		return false, err
+	}
+
+	var inputSize, outputSize int64
+	for _, t := range c.inputs {
+		inputSize += t.size
+	}
+	for _, t := range c.overlaps {
+		inputSize += t.size
+	}
+	for _, t := range outputs {
+		outputSize += t.size
+	}
+	logs.Info("lsm compaction finish",
+		zap.Int("level", c.level),
+		zap.Int("inputs", len(c.inputs)+len(c.overlaps)),
+		zap.Int("outputs", len(outputs)),
+		zap.Int64("inputSize", inputSize),
+		zap.Int64("outputSize", outputSize),
+		zap.Duration("cost", time.Since(start)),
+	)
+	return true, nil
+}
+
+// levelLimit 返回 level 层的总大小上限，L1 为 LsmLevelBaseSize，之后每层乘以 LsmLevelSizeMultiplier
+func (db *DB) levelLimit(level int) float64 {
+	return float64(db.Config.GetInt64(consts.LsmLevelBaseSize)) * math.Pow(db.Config.GetFloat64(consts.LsmLevelSizeMultiplier), float64(level-1))
+}
+
+// pickCompaction 选择需要 compaction 的层以及输入的 SSTable，不需要 compaction 时返回nil
+// L0 的 SSTable 数量达到阈值时优先合并全部 L0；否则选择总大小超过上限比例最大的层，
+// 从上一次 compaction 的位置开始轮流选择一个 SSTable，保证整层的 key 范围都会被合并到
+func (db *DB) pickCompaction(v *version) *compaction {
+	if len(v.levels[0]) >= db.Config.GetInt(consts.LsmL0CompactionTrigger) {
+		c := &compaction{level: 0, inputs: v.levels[0]}
+		smallest, largest := keyRange(c.inputs)
+		c.overlaps = overlappingTables(v.levels[1], smallest, largest)
+		return c
+	}
+
+	level, best := -1, 1.0
+	for l := 1; l < numLevels-1; l++ {
+		score := float64(v.levelSize(l)) / db.levelLimit(l)
+		if score > best {
+			level, best = l, score
+		}
+	}
+	if level == -1 {
+		return nil
+	}
+
+	tables := v.levels[level]
+	input := tables[0]
+	for _, t := range tables {
+		if t.smallest > db.compactPointer[level] {
+			input = t
+			break
+		}
+	}
+	db.compactPointer[level] = input.largest
+	return &compaction{
+		level:    level,
+		inputs:   []*table{input},
+		overlaps: overlappingTables(v.levels[level+1], input.smallest, input.largest),
+	}
+}
+
+// keyRange 返回一组 SSTable 的 key 范围
+func keyRange(tables []*table) (string, string) {
+	smallest, largest := tables[0].smallest, tables[0].largest
+	for _, t := range tables[1:] {
+		if t.smallest < smallest {
+			smallest = t.smallest
+		}
+		if t.largest > largest {
+			largest = t.largest
+		}
+	}
+	return smallest, largest
+}
+
+// overlappingTables 返回 key 范围与 [smallest, largest] 重叠的 SSTable
+func overlappingTables(tables []*table, smallest, largest string) []*table {
+	var overlaps []*table
+	for _, t := range tables {
+		if t.overlaps(smallest, largest) {
+			overlaps = append(overlaps, t)
+		}
+	}
+	return overlaps
+}
+
+// mergeItem 多路归并中每个输入的当前 entry
+type mergeItem struct {
+	entry *entry
+	it    *tableIterator
+}
+
+// mergeHeap 按 key 升序、序列号降序排列的小顶堆，同一个 key 最新的版本最先弹出
+type mergeHeap []*mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].entry.key != h[j].entry.key {
+		return h[i].entry.key < h[j].entry.key
+	}
+	return h[i].entry.seq > h[j].entry.seq
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(*mergeItem)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// mergeTables 多路归并 compaction 的输入，每个 key 只保留最新的版本，按 LsmTableSize 切分为多个 SSTable
+// 输出层以下没有 SSTable 包含该 key 时，墓碑以及已经过期的版本不再遮住任何旧版本，直接丢弃；
+// 但序列号大于进行中事务开始序列号的墓碑需要保留，事务提交时依赖它检查删除冲突
+func (db *DB) mergeTables(v *version, c *compaction) ([]*table, error) {
+	h := &mergeHeap{}
+	for _, t := range append(append([]*table{}, c.inputs...), c.overlaps...) {
+		it := newTableIterator(t)
+		e, ok, err := it.next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			heap.Push(h, &mergeItem{entry: e, it: it})
+		}
+	}
+
+	var outputs []*table
+	var w *tableWriter
+	var wID uint64
+	abort := func() {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range outputs {
+			atomic.StoreInt32(&t.obsolete, 1)
+			t.ref()
+			t.unref()
+		}
+	}
+	finish := func() error {
+		err := w.finish()
+		if err != nil {
+			return err
+		}
+		w = nil
+		t, err := openTable(db.dir, wID, db.blockCache)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	oldestTxnSeq := db.oldestTxnSeq()
+	outputLevel := c.level + 1
+	tableSize := db.Config.GetInt64(consts.LsmTableSize)
+	var lastKey string
+	var hasLast bool
+	for h.Len() > 0 {
+		item := (*h)[0]
+		e := item.entry
+		next, ok, err := item.it.next()
+		if err != nil {
+			abort()
+			return nil, err
+		}
+		if ok {
+			item.entry = next
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+
+		// 同一个 key 的旧版本
+		if hasLast && e.key == lastKey {
+			continue
+		}
+		lastKey, hasLast = e.key, true
+
+		if (e.deleted || e.isExpired(now)) && e.seq <= oldestTxnSeq && !v.overlapsBelow(outputLevel, e.key) {
+			continue
+		}
+
+		if w == nil {
+			wID = atomic.AddUint64(&db.nextFileID, 1) - 1
+			w, err = newTableWriter(tableFileName(db.dir, wID), db.Config.GetInt(consts.LsmBlockSize), db.Config.GetFloat64(consts.LsmBloomFalsePositiveRate))
+			if err != nil {
+				abort()
+				return nil, err
+			}
+		}
+		err = w.add(e)
+		if err == nil && w.size() >= tableSize {
+			err = finish()
+		}
+		if err != nil {
+			abort()
+			return nil, err
+		}
+	}
+
+	if w != nil {
+		err := finish()
+		if err != nil {
+			abort()
+			return nil, err
+		}
+	}
+	return outputs, nil
+}
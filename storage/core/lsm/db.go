@@ -0,0 +1,950 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/cache"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/Trinoooo/eggie_kv/storage/core/lsm/logs"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/wal"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const flushRetryInterval = time.Second // flushRetryInterval flush 失败之后重试的间隔
+
+// DB 基于 LSM-tree 的存储引擎
+// 写入先作为一条日志写入 wal，再应用到 memtable；memtable 写满后转为 immutable memtable，
+// 由后台协程 flush 为 L0 的 SSTable，flush 完成后截断对应的 wal 日志。
+// L0 的 SSTable 数量或者某一层的总大小超过阈值时，后台协程将其与下一层 key 范围重叠的 SSTable 合并（leveled compaction）。
+// 写入由写锁串行化，读取不经过写锁，按 memtable、immutable memtable、L0、L1... 的顺序读取最新版本
+type DB struct {
+	Config     *viper.Viper
+	Wal        *wal.Log
+	dir        string
+	blockCache *cache.Cache
+
+	writeMu sync.Mutex // writeMu 串行化写入
+	seq     uint64     // seq 最后一次写入的序列号，在写锁中修改，开始事务时原子读取
+	closed  bool
+
+	mu      sync.RWMutex // mu 保护 mem、imm、current
+	mem     *memtable
+	imm     *memtable  // imm 等待 flush 的 memtable，为nil时没有
+	current *version   // current 当前的 version，持有一个引用
+	flushed *sync.Cond // flushed imm flush 完成时通知等待的写入方
+
+	editMu      sync.Mutex // editMu 串行化 version 修改以及 manifest 写入
+	lastSeq     uint64     // lastSeq 已经持久化到 SSTable 的最大序列号
+	nextFileID  uint64     // nextFileID 下一个 SSTable 的 id，原子递增
+	walTruncate int64      // walTruncate 已经 flush 但还没有截断的 wal 日志数量，只在 flush 协程中访问
+
+	txnMu sync.Mutex
+	txns  map[uint64]int // txns 进行中的事务开始时的序列号以及事务数量
+
+	compactPointer [numLevels]string // compactPointer 每层上一次 compaction 的最大 key，只在 compaction 协程中访问
+	flushSignal    chan struct{}
+	compactSignal  chan struct{}
+	stop           chan struct{}  // stop 关闭时通知后台协程退出
+	background     sync.WaitGroup // background 等待 flush、compaction 协程退出
+}
+
+func New(config *viper.Viper) (iface.ICore, error) {
+	return Open(config)
+}
+
+// Open 打开 DB，加载 manifest 中记录的 SSTable，回放 wal 中还没有 flush 的写入
+func Open(config *viper.Viper) (*DB, error) {
+	if config == nil {
+		config = viper.New()
+	}
+	config.SetDefault(consts.LsmWalDir, filepath.Join(consts.BaseDir, consts.Lsm, "wal"))
+	config.SetDefault(consts.LsmDataDir, filepath.Join(consts.BaseDir, consts.Lsm, "data"))
+	config.SetDefault(consts.LsmWalSyncMode, int64(wal.FullManagedAsync))
+	config.SetDefault(consts.LsmMemtableSize, 4*consts.MB)
+	config.SetDefault(consts.LsmBlockSize, 4*consts.KB)
+	config.SetDefault(consts.LsmTableSize, 2*consts.MB)
+	config.SetDefault(consts.LsmL0CompactionTrigger, 4)
+	config.SetDefault(consts.LsmLevelBaseSize, 10*consts.MB)
+	config.SetDefault(consts.LsmLevelSizeMultiplier, 10)
+	config.SetDefault(consts.LsmBloomFalsePositiveRate, 0.01)
+	config.SetDefault(consts.LsmBlockCacheCapacity, 32*consts.MB)
+
+	dir := config.GetString(consts.LsmDataDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		e := errs.NewMkdirErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", dir))
+		return nil, e
+	}
+
+	db := &DB{
+		Config:        config,
+		dir:           dir,
+		mem:           newMemtable(),
+		txns:          make(map[uint64]int),
+		flushSignal:   make(chan struct{}, 1),
+		compactSignal: make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+	db.flushed = sync.NewCond(&db.mu)
+
+	if capacity := config.GetInt64(consts.LsmBlockCacheCapacity); capacity > 0 {
+		db.blockCache, err = cache.New(capacity, 16, cache.Policy2Q)
+		if err != nil {
+			logs.Error(err.Error(), zap.String(consts.LogFieldParams, consts.LsmBlockCacheCapacity), zap.Int64(consts.LogFieldValue, capacity))
+			return nil, err
+		}
+	}
+
+	err = db.loadVersion()
+	if err != nil {
+		db.closeBlockCache()
+		return nil, err
+	}
+
+	db.Wal, err = wal.NewLog(config.GetString(consts.LsmWalDir), wal.NewOptions().SetSyncMode(wal.SyncMode(config.GetInt64(consts.LsmWalSyncMode))))
+	if err == nil {
+		err = db.Wal.Open()
+	}
+	if err == nil {
+		err = db.recover()
+		if err != nil {
+			if e := db.Wal.Close(); e != nil {
+				logs.Error(e.Error())
+			}
+		}
+	}
+	if err != nil {
+		db.current.unref()
+		db.closeBlockCache()
+		return nil, err
+	}
+
+	db.background.Add(2)
+	go db.flushLoop()
+	go db.compactLoop()
+	db.maybeCompact()
+	return db, nil
+}
+
+// loadVersion 按 manifest 打开 SSTable 构建当前 version，删除不在 manifest 中的 SSTable
+// 这些 SSTable 是 flush、compaction 写到一半，或者写完但还没有记录到 manifest 时宕机留下的
+func (db *DB) loadVersion() error {
+	m, err := readManifest(db.dir)
+	if err != nil {
+		return err
+	}
+
+	live := make(map[uint64]struct{})
+	db.current = &version{refs: 1}
+	for level, ids := range m.Levels {
+		if level >= numLevels {
+			e := errs.NewCorruptErr()
+			logs.Error(e.Error(), zap.Int("levels", len(m.Levels)))
+			db.current.unref()
+			return e
+		}
+		for _, id := range ids {
+			t, err := openTable(db.dir, id, db.blockCache)
+			if err != nil {
+				db.current.unref()
+				return err
+			}
+			t.ref()
+			db.current.levels[level] = append(db.current.levels[level], t)
+			live[id] = struct{}{}
+		}
+	}
+	db.lastSeq = m.LastSeq
+	db.nextFileID = m.NextFileID
+
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		e := errs.NewWalkDirErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", db.dir))
+		db.current.unref()
+		return e
+	}
+	for _, entry := range entries {
+		name, isTable := strings.CutSuffix(entry.Name(), tableSuffix)
+		if !isTable {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, exist := live[id]; exist {
+			continue
+		}
+		if err := os.Remove(filepath.Join(db.dir, entry.Name())); err != nil {
+			logs.Warn(errs.NewRemoveFileErr().WithErr(err).Error(), zap.String("path", entry.Name()))
+		}
+		if id >= db.nextFileID {
+			db.nextFileID = id + 1
+		}
+	}
+	return nil
+}
+
+// recover 回放 wal 中还没有 flush 到 SSTable 的写入
+// 序列号不大于 manifest 中 LastSeq 的日志已经 flush，只是宕机前没来得及截断，直接截断
+func (db *DB) recover() error {
+	start := time.Now()
+	length, err := db.Wal.Len()
+	if err != nil {
+		return err
+	}
+	var blocks [][]byte
+	if length > 0 {
+		blocks, err = db.Wal.Read(length)
+		if err != nil {
+			return err
+		}
+	}
+
+	db.seq = db.lastSeq
+	var flushed int64
+	for _, block := range blocks {
+		seq, entries, err := decodeRecord(block)
+		if err != nil {
+			return err
+		}
+		if seq <= db.lastSeq {
+			flushed++
+			continue
+		}
+		for _, e := range entries {
+			db.mem.put(e)
+		}
+		db.mem.records++
+		db.seq = seq
+	}
+
+	if flushed > 0 {
+		err = db.Wal.Truncate(flushed)
+		if err != nil {
+			return err
+		}
+	}
+
+	logs.Info("lsm recover finish",
+		zap.Int64("records", length),
+		zap.Int64("flushed", flushed),
+		zap.Int("memtable", db.mem.len()),
+		zap.Uint64("seq", db.seq),
+		zap.Duration("cost", time.Since(start)),
+	)
+
+	// 此时后台协程还没有启动，不需要加锁
+	if db.mem.approximateSize() >= db.Config.GetInt64(consts.LsmMemtableSize) {
+		db.imm, db.mem = db.mem, newMemtable()
+		db.signal(db.flushSignal)
+	}
+	return nil
+}
+
+// signal 非阻塞地通知后台协程，后台协程正在执行时多余的通知会被合并
+func (db *DB) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// write 在写锁中提交一组 op
+// 先检查事务冲突，再将需要读取当前数据的 op 转换为 Set、Delete，全部写操作作为一条日志写入 wal 后应用到 memtable。
+// 返回需要回传给调用方的结果，例如 CompareAndSwap 是否写入、Incr 之后的值
+func (db *DB) write(ops []*Op) (map[*Op][]byte, error) {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	if db.closed {
+		e := errs.NewFileClosedErr()
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	err := db.check(ops)
+	if err != nil {
+		return nil, err
+	}
+	entries, values, err := db.resolve(ops)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return values, nil
+	}
+
+	seq := db.seq + 1
+	for _, e := range entries {
+		e.seq = seq
+	}
+	err = db.Wal.Write(encodeRecord(seq, entries))
+	if err != nil {
+		e := errs.NewSetErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+	atomic.StoreUint64(&db.seq, seq)
+
+	// 同一条日志中的写入对读取原子地可见
+	db.mu.Lock()
+	for _, e := range entries {
+		db.mem.put(e)
+	}
+	db.mem.records++
+	db.mu.Unlock()
+
+	db.makeRoomForWrite()
+	return values, nil
+}
+
+// makeRoomForWrite memtable 写满后转为 immutable memtable 并通知 flush 协程
+// 上一个 immutable memtable 还没有 flush 完成时等待，避免内存无限增长
+func (db *DB) makeRoomForWrite() {
+	if db.mem.approximateSize() < db.Config.GetInt64(consts.LsmMemtableSize) {
+		return
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for db.imm != nil {
+		db.flushed.Wait()
+	}
+	db.imm, db.mem = db.mem, newMemtable()
+	db.signal(db.flushSignal)
+}
+
+// check 检查事务读写的 key 在事务开始之后都没有被修改，否则返回 errs.NewTxnConflictErr
+func (db *DB) check(ops []*Op) error {
+	for _, op := range ops {
+		if op.Type != opTypeCheck {
+			continue
+		}
+		e, ok, err := db.lookup(op.Key)
+		if err != nil {
+			e := errs.NewGetErr().WithErr(err)
+			logs.Error(e.Error())
+			return e
+		}
+		if ok && e.seq > op.Seq {
+			e := errs.NewTxnConflictErr()
+			logs.Warn(e.Error(), zap.String("key", op.Key), zap.Uint64("seq", op.Seq))
+			return e
+		}
+	}
+	return nil
+}
+
+// resolve 将 op 转换为写入 wal 以及 memtable 的 entry，写入 wal 的日志不依赖回放时刻的数据与时间
+func (db *DB) resolve(ops []*Op) ([]*entry, map[*Op][]byte, error) {
+	entries := make([]*entry, 0, len(ops))
+	values := make(map[*Op][]byte)
+	// 同一组 op 中前面的写入还没有应用到 memtable，读取时需要先看前面的写入
+	written := make(map[string]*entry)
+	now := time.Now().UnixNano()
+	read := func(key string) ([]byte, int64, error) {
+		e, exist := written[key]
+		if !exist {
+			var err error
+			e, exist, err = db.lookup(key)
+			if err != nil {
+				e := errs.NewGetErr().WithErr(err)
+				logs.Error(e.Error())
+				return nil, 0, e
+			}
+		}
+		if !exist || !e.visible(now) {
+			return nil, 0, errs.NewNotFoundErr()
+		}
+		return e.value, e.expireAt, nil
+	}
+
+	for _, op := range ops {
+		var write *entry
+		switch op.Type {
+		case opTypeCheck:
+			continue
+		case consts.OperatorTypeSet:
+			write = &entry{key: op.Key, value: op.Value, expireAt: op.ExpireAt}
+		case consts.OperatorTypeDelete:
+			write = &entry{key: op.Key, deleted: true}
+		case consts.OperatorTypePersist:
+			value, expireAt, err := read(op.Key)
+			if err != nil {
+				return nil, nil, err
+			}
+			// 没有过期时间时不需要写入
+			if expireAt != 0 {
+				write = &entry{key: op.Key, value: value}
+			}
+		case consts.OperatorTypeCAS:
+			value, _, err := read(op.Key)
+			if err != nil && errs.GetCode(err) != errs.NotFoundErrCode {
+				return nil, nil, err
+			}
+			swapped := err == nil && bytes.Equal(value, op.Expected)
+			if swapped {
+				write = &entry{key: op.Key, value: op.Value}
+			}
+			values[op] = encodeBool(swapped)
+		case consts.OperatorTypeSetNX:
+			_, _, err := read(op.Key)
+			if err != nil && errs.GetCode(err) != errs.NotFoundErrCode {
+				return nil, nil, err
+			}
+			notExist := err != nil
+			if notExist {
+				write = &entry{key: op.Key, value: op.Value}
+			}
+			values[op] = encodeBool(notExist)
+		case consts.OperatorTypeIncr, consts.OperatorTypeDecr:
+			n, err := incr(op, read)
+			if err != nil {
+				return nil, nil, err
+			}
+			write = n
+			values[op] = n.value
+		default:
+			e := errs.NewUnsupportedOperatorTypeErr()
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "opType"), zap.Int64(consts.LogFieldValue, int64(op.Type)))
+			return nil, nil, e
+		}
+
+		if write != nil {
+			entries = append(entries, write)
+			written[write.key] = write
+		}
+	}
+	return entries, values, nil
+}
+
+// incr 计算 Incr、Decr 之后的值，转换为保留原有过期时间的写入
+// value 按十进制 int64 解析，key 不存在时视为0，溢出时返回 errs.NewNotIntegerErr
+func incr(op *Op, read func(key string) ([]byte, int64, error)) (*entry, error) {
+	if len(op.Value) != 8 {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "delta"), zap.Int(consts.LogFieldValue, len(op.Value)))
+		return nil, e
+	}
+	delta := int64(binary.BigEndian.Uint64(op.Value))
+
+	var n int64
+	value, expireAt, err := read(op.Key)
+	if err == nil {
+		n, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			e := errs.NewNotIntegerErr().WithErr(err)
+			logs.Error(e.Error())
+			return nil, e
+		}
+	} else if errs.GetCode(err) != errs.NotFoundErrCode {
+		return nil, err
+	}
+
+	if op.Type == consts.OperatorTypeDecr {
+		if delta == math.MinInt64 {
+			e := errs.NewNotIntegerErr()
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "delta"), zap.Int64(consts.LogFieldValue, delta))
+			return nil, e
+		}
+		delta = -delta
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		e := errs.NewNotIntegerErr()
+		logs.Error(e.Error(), zap.Int64("value", n), zap.Int64("delta", delta))
+		return nil, e
+	}
+
+	return &entry{key: op.Key, value: strconv.AppendInt(nil, n+delta, 10), expireAt: expireAt}, nil
+}
+
+// encodeBool 将 CompareAndSwap、SetNX 是否写入编码为结果
+func encodeBool(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// decodeBool 是 encodeBool 的逆过程
+func decodeBool(raw []byte) bool {
+	return len(raw) == 1 && raw[0] == 1
+}
+
+// lookup 读取 key 的最新版本，可能是墓碑或者已经过期
+func (db *DB) lookup(key string) (*entry, bool, error) {
+	db.mu.RLock()
+	if e, ok := db.mem.get(key); ok {
+		db.mu.RUnlock()
+		return e, true, nil
+	}
+	if db.imm != nil {
+		if e, ok := db.imm.get(key); ok {
+			db.mu.RUnlock()
+			return e, true, nil
+		}
+	}
+	v := db.current
+	v.ref()
+	db.mu.RUnlock()
+	defer v.unref()
+
+	return v.get(key)
+}
+
+// seek 在 memtable 以及全部 SSTable 中按 mode 查找离 key 最近的 key，不判断是否可见
+func (db *DB) seek(key string, mode seekMode) (string, bool, error) {
+	var best string
+	var found bool
+	consider := func(e *entry, ok bool) {
+		if ok && (!found || (mode.forward() && e.key < best) || (!mode.forward() && e.key > best)) {
+			best, found = e.key, true
+		}
+	}
+
+	db.mu.RLock()
+	consider(db.mem.seek(key, mode))
+	if db.imm != nil {
+		consider(db.imm.seek(key, mode))
+	}
+	v := db.current
+	v.ref()
+	db.mu.RUnlock()
+	defer v.unref()
+
+	e, ok, err := v.seek(key, mode)
+	if err != nil {
+		return "", false, err
+	}
+	consider(e, ok)
+	return best, found, nil
+}
+
+// last 查找最大的 key，不判断是否可见
+func (db *DB) last() (string, bool, error) {
+	db.mu.RLock()
+	var best string
+	var found bool
+	for _, m := range []*memtable{db.mem, db.imm} {
+		if m == nil {
+			continue
+		}
+		if e, ok := m.last(); ok && (!found || e.key > best) {
+			best, found = e.key, true
+		}
+	}
+	v := db.current
+	v.ref()
+	db.mu.RUnlock()
+	defer v.unref()
+
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			if !found || t.largest > best {
+				best, found = t.largest, true
+			}
+		}
+	}
+	return best, found, nil
+}
+
+// visible 判断 key 的最新版本是否可见
+func (db *DB) visible(key string) (bool, error) {
+	e, ok, err := db.lookup(key)
+	if err != nil {
+		return false, err
+	}
+	return ok && e.visible(time.Now().UnixNano()), nil
+}
+
+// flushLoop 后台 flush 协程，flush 失败时间隔 flushRetryInterval 重试
+func (db *DB) flushLoop() {
+	defer db.background.Done()
+
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-db.flushSignal:
+		}
+
+		for {
+			err := db.flush()
+			if err == nil {
+				break
+			}
+			logs.Error(err.Error())
+			select {
+			case <-db.stop:
+				return
+			case <-time.After(flushRetryInterval):
+			}
+		}
+	}
+}
+
+// flush 将 immutable memtable 写为 L0 的 SSTable，记录到 manifest 之后截断对应的 wal 日志
+func (db *DB) flush() error {
+	db.mu.RLock()
+	imm := db.imm
+	db.mu.RUnlock()
+	if imm == nil {
+		return nil
+	}
+
+	start := time.Now()
+	t, err := db.writeTable(imm.entries())
+	if err != nil {
+		return err
+	}
+
+	edit := newVersionEdit()
+	edit.added[0] = []*table{t}
+	edit.lastSeq = imm.maxSeq
+	err = db.logAndApply(edit, func() {
+		db.imm = nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logs.Info("lsm flush finish",
+		zap.Uint64("table", t.id),
+		zap.Int64("entries", t.count),
+		zap.Int64("size", t.size),
+		zap.Duration("cost", time.Since(start)),
+	)
+
+	// 截断失败不影响 flush 结果，重启时会跳过已经 flush 的日志
+	db.walTruncate += imm.records
+	err = db.Wal.Truncate(db.walTruncate)
+	if err != nil {
+		logs.Error(err.Error(), zap.Int64("truncate", db.walTruncate))
+	} else {
+		db.walTruncate = 0
+	}
+
+	db.maybeCompact()
+	return nil
+}
+
+// writeTable 将有序的 entry 写为一个新的 SSTable
+func (db *DB) writeTable(entries []*entry) (*table, error) {
+	id := atomic.AddUint64(&db.nextFileID, 1) - 1
+	w, err := newTableWriter(tableFileName(db.dir, id), db.Config.GetInt(consts.LsmBlockSize), db.Config.GetFloat64(consts.LsmBloomFalsePositiveRate))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		err = w.add(e)
+		if err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	err = w.finish()
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	return openTable(db.dir, id, db.blockCache)
+}
+
+// logAndApply 在当前 version 上应用 edit，写入 manifest 之后替换当前 version
+// install 在替换 version 的同一个临界区中执行，用于原子地移除已经 flush 的 immutable memtable
+func (db *DB) logAndApply(edit *versionEdit, install func()) error {
+	db.editMu.Lock()
+	defer db.editMu.Unlock()
+
+	next := db.current.apply(edit)
+	lastSeq := db.lastSeq
+	if edit.lastSeq > lastSeq {
+		lastSeq = edit.lastSeq
+	}
+	m := &manifest{
+		NextFileID: atomic.LoadUint64(&db.nextFileID),
+		LastSeq:    lastSeq,
+		Levels:     make([][]uint64, numLevels),
+	}
+	for level, tables := range next.levels {
+		m.Levels[level] = make([]uint64, 0, len(tables))
+		for _, t := range tables {
+			m.Levels[level] = append(m.Levels[level], t.id)
+		}
+	}
+
+	err := writeManifest(db.dir, m)
+	if err != nil {
+		// 新增的 SSTable 没有记录到 manifest，不再被引用时删除
+		for _, tables := range edit.added {
+			for _, t := range tables {
+				if _, removed := edit.removed[t.id]; !removed {
+					atomic.StoreInt32(&t.obsolete, 1)
+				}
+			}
+		}
+		next.unref()
+		return err
+	}
+	db.lastSeq = lastSeq
+
+	db.mu.Lock()
+	prev := db.current
+	db.current = next
+	if install != nil {
+		install()
+	}
+	db.flushed.Broadcast()
+	db.mu.Unlock()
+
+	// 移动到下一层的 SSTable 同时出现在 added 与 removed 中，不能删除
+	moved := make(map[uint64]struct{})
+	for _, tables := range edit.added {
+		for _, t := range tables {
+			moved[t.id] = struct{}{}
+		}
+	}
+	for _, tables := range prev.levels {
+		for _, t := range tables {
+			_, removed := edit.removed[t.id]
+			_, isMoved := moved[t.id]
+			if removed && !isMoved {
+				atomic.StoreInt32(&t.obsolete, 1)
+			}
+		}
+	}
+	prev.unref()
+	return nil
+}
+
+// beginTxn 记录事务开始时的序列号，compaction 不会丢弃序列号更大的墓碑，保证提交时能检查到删除
+func (db *DB) beginTxn() uint64 {
+	db.txnMu.Lock()
+	defer db.txnMu.Unlock()
+	seq := atomic.LoadUint64(&db.seq)
+	db.txns[seq]++
+	return seq
+}
+
+// endTxn 事务结束时移除 beginTxn 的记录
+func (db *DB) endTxn(seq uint64) {
+	db.txnMu.Lock()
+	defer db.txnMu.Unlock()
+	db.txns[seq]--
+	if db.txns[seq] == 0 {
+		delete(db.txns, seq)
+	}
+}
+
+// oldestTxnSeq 返回进行中的事务中最早的开始序列号，没有进行中的事务时返回 math.MaxUint64
+func (db *DB) oldestTxnSeq() uint64 {
+	db.txnMu.Lock()
+	defer db.txnMu.Unlock()
+	oldest := uint64(math.MaxUint64)
+	for seq := range db.txns {
+		if seq < oldest {
+			oldest = seq
+		}
+	}
+	return oldest
+}
+
+func (db *DB) Get(key string) ([]byte, error) {
+	e, ok, err := db.lookup(key)
+	if err != nil {
+		e := errs.NewGetErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+	if !ok || !e.visible(time.Now().UnixNano()) {
+		return nil, errs.NewNotFoundErr()
+	}
+	return e.value, nil
+}
+
+func (db *DB) Set(key string, value []byte) error {
+	_, err := db.write([]*Op{NewOp(consts.OperatorTypeSet, key, value)})
+	return err
+}
+
+// SetWithTTL 写入 key，ttl 之后 key 过期
+// 过期时间在写入时确定，作为绝对时间写入 wal 以及 SSTable
+func (db *DB) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "ttl"), zap.Duration(consts.LogFieldValue, ttl))
+		return e
+	}
+
+	op := NewOp(consts.OperatorTypeSet, key, value)
+	op.ExpireAt = time.Now().Add(ttl).UnixNano()
+	_, err := db.write([]*Op{op})
+	return err
+}
+
+// TTL 返回 key 的剩余存活时间，没有设置过期时间时返回 iface.NoTTL
+func (db *DB) TTL(key string) (time.Duration, error) {
+	e, ok, err := db.lookup(key)
+	if err != nil {
+		e := errs.NewGetErr().WithErr(err)
+		logs.Error(e.Error())
+		return 0, e
+	}
+	now := time.Now().UnixNano()
+	if !ok || !e.visible(now) {
+		return 0, errs.NewNotFoundErr()
+	}
+	if e.expireAt == 0 {
+		return iface.NoTTL, nil
+	}
+	return time.Duration(e.expireAt - now), nil
+}
+
+// Persist 去掉 key 的过期时间，key 不存在或者已经过期时返回 errs.NewNotFoundErr
+func (db *DB) Persist(key string) error {
+	_, err := db.write([]*Op{NewOp(consts.OperatorTypePersist, key, nil)})
+	return err
+}
+
+// Delete 删除 key，key 不存在时不返回错误
+func (db *DB) Delete(key string) error {
+	_, err := db.write([]*Op{NewOp(consts.OperatorTypeDelete, key, nil)})
+	return err
+}
+
+// CompareAndSwap key 当前的 value 等于 expected 时写入 value，返回是否写入
+// key 不存在或者已经过期时不写入。写入的 value 没有过期时间
+func (db *DB) CompareAndSwap(key string, expected, value []byte) (bool, error) {
+	op := NewOp(consts.OperatorTypeCAS, key, value)
+	op.Expected = expected
+	values, err := db.write([]*Op{op})
+	if err != nil {
+		return false, err
+	}
+	return decodeBool(values[op]), nil
+}
+
+// SetNX key 不存在或者已经过期时写入 value，返回是否写入
+func (db *DB) SetNX(key string, value []byte) (bool, error) {
+	op := NewOp(consts.OperatorTypeSetNX, key, value)
+	values, err := db.write([]*Op{op})
+	if err != nil {
+		return false, err
+	}
+	return decodeBool(values[op]), nil
+}
+
+// Incr 将 key 的 value 作为十进制 int64 加上 delta，返回相加之后的值
+// key 不存在时视为0，value 不是整数或者溢出时返回 errs.NewNotIntegerErr，key 原有的过期时间保持不变
+func (db *DB) Incr(key string, delta int64) (int64, error) {
+	return db.incrBy(consts.OperatorTypeIncr, key, delta)
+}
+
+// Decr 将 key 的 value 作为十进制 int64 减去 delta，返回相减之后的值，其他行为与 Incr 相同
+func (db *DB) Decr(key string, delta int64) (int64, error) {
+	return db.incrBy(consts.OperatorTypeDecr, key, delta)
+}
+
+func (db *DB) incrBy(opType consts.OperatorType, key string, delta int64) (int64, error) {
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, uint64(delta))
+	op := NewOp(opType, key, raw)
+	values, err := db.write([]*Op{op})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(values[op]), 10, 64)
+}
+
+// WriteBatch 原子地应用一组写入和删除
+// 整个 batch 作为一条日志写入 wal，重启回放时要么全部生效，要么全部不生效
+func (db *DB) WriteBatch(wb *iface.WriteBatch) error {
+	if wb == nil || len(wb.Ops) == 0 {
+		return nil
+	}
+
+	ops := make([]*Op, 0, len(wb.Ops))
+	for _, op := range wb.Ops {
+		if op.Type != consts.OperatorTypeSet && op.Type != consts.OperatorTypeDelete {
+			e := errs.NewUnsupportedOperatorTypeErr()
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "opType"), zap.Int64(consts.LogFieldValue, int64(op.Type)))
+			return e
+		}
+		ops = append(ops, NewOp(op.Type, op.Key, op.Value))
+	}
+	_, err := db.write(ops)
+	return err
+}
+
+// NewIterator 创建按 key 字典序遍历的迭代器
+func (db *DB) NewIterator(opts *iface.IteratorOptions) (iface.Iterator, error) {
+	return newIterator(db, opts)
+}
+
+// Begin 开始一个乐观事务，写入缓存在事务中直到提交
+func (db *DB) Begin() (iface.Txn, error) {
+	return newTxn(db), nil
+}
+
+// Flush 将当前 memtable flush 为 L0 的 SSTable，flush 完成后返回
+func (db *DB) Flush() error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+
+	db.mu.Lock()
+	for db.imm != nil {
+		db.flushed.Wait()
+	}
+	if db.mem.len() == 0 {
+		db.mu.Unlock()
+		return nil
+	}
+	db.imm, db.mem = db.mem, newMemtable()
+	db.signal(db.flushSignal)
+	for db.imm != nil {
+		db.flushed.Wait()
+	}
+	db.mu.Unlock()
+	return nil
+}
+
+// Close 关闭 DB，等待后台协程退出后释放资源
+// memtable 中的写入已经持久化在 wal 中，重启时回放，不需要 flush
+func (db *DB) Close() error {
+	db.writeMu.Lock()
+	db.closed = true
+	db.writeMu.Unlock()
+
+	close(db.stop)
+	db.background.Wait()
+
+	err := db.Wal.Close()
+
+	db.mu.Lock()
+	db.current.unref()
+	db.mu.Unlock()
+	db.closeBlockCache()
+	return err
+}
+
+// closeBlockCache 数据块缓存容量为0时不缓存
+func (db *DB) closeBlockCache() {
+	if db.blockCache != nil {
+		db.blockCache.Close()
+	}
+}
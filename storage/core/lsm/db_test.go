@@ -0,0 +1,417 @@
+package lsm
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/bloom"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/spf13/viper"
+)
+
+const testDataDir = "../../../test_data/lsm/"
+
+func TestMain(m *testing.M) {
+	// 每次测试之前删除测试数据
+	err := os.RemoveAll(testDataDir)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+
+	err = os.RemoveAll(testDataDir)
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(code)
+}
+
+// newTestConfig 构造指向空测试目录的配置，memtable、SSTable 都很小，少量写入就会触发 flush 与 compaction
+func newTestConfig(name string) *viper.Viper {
+	err := os.RemoveAll(testDataDir + name)
+	if err != nil {
+		panic(err)
+	}
+
+	config := viper.New()
+	config.Set(consts.LsmWalDir, testDataDir+name+"/wal")
+	config.Set(consts.LsmDataDir, testDataDir+name+"/data")
+	config.Set(consts.LsmMemtableSize, 4*consts.KB)
+	config.Set(consts.LsmBlockSize, 256)
+	config.Set(consts.LsmTableSize, 8*consts.KB)
+	config.Set(consts.LsmL0CompactionTrigger, 2)
+	config.Set(consts.LsmLevelBaseSize, 16*consts.KB)
+	config.Set(consts.LsmLevelSizeMultiplier, 4)
+	config.Set(consts.LsmBlockCacheCapacity, 64*consts.KB)
+	return config
+}
+
+// waitCompaction 等待后台 flush、compaction 完成
+func waitCompaction(t *testing.T, db *DB) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		db.mu.RLock()
+		v := db.current
+		v.ref()
+		idle := db.imm == nil
+		db.mu.RUnlock()
+		idle = idle && db.pickCompaction(v) == nil
+		v.unref()
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("wait compaction timeout")
+}
+
+// TestRecord_EncodeDecode 序列化后反序列化能够得到相同的日志
+func TestRecord_EncodeDecode(t *testing.T) {
+	entries := []*entry{
+		{key: "k1", value: []byte("v1"), expireAt: 100},
+		{key: "", value: []byte("empty key")},
+		{key: "deleted", deleted: true},
+	}
+	seq, decoded, err := decodeRecord(encodeRecord(42, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 42 || len(decoded) != len(entries) {
+		t.Fatalf("expect seq 42 with %d entries, got %d with %d", len(entries), seq, len(decoded))
+	}
+	for i, e := range decoded {
+		if e.key != entries[i].key || string(e.value) != string(entries[i].value) || e.expireAt != entries[i].expireAt || e.deleted != entries[i].deleted || e.seq != 42 {
+			t.Errorf("entry %d: expect %+v, got %+v", i, entries[i], e)
+		}
+	}
+
+	if _, _, err := decodeRecord(encodeRecord(1, entries)[:20]); err == nil {
+		t.Error("expect error on truncated record")
+	}
+}
+
+// TestDB_Model 随机写入、删除，期间 flush、compaction 以及重启，读取与迭代的结果始终与内存中的模型一致
+func TestDB_Model(t *testing.T) {
+	config := newTestConfig("model")
+	db, err := Open(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	model := make(map[string]string)
+	verify := func() {
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			value, err := db.Get(key)
+			expect, exist := model[key]
+			if !exist {
+				if errs.GetCode(err) != errs.NotFoundErrCode {
+					t.Fatalf("%s: expect not found, got %s, %v", key, value, err)
+				}
+				continue
+			}
+			if err != nil || string(value) != expect {
+				t.Fatalf("%s: expect %s, got %s, %v", key, expect, value, err)
+			}
+		}
+
+		keys := make([]string, 0, len(model))
+		for key := range model {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, reverse := range []bool{false, true} {
+			it, err := db.NewIterator(&iface.IteratorOptions{Reverse: reverse})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for ; it.Valid(); it.Next() {
+				got = append(got, it.Key())
+			}
+			_ = it.Close()
+			if len(got) != len(keys) {
+				t.Fatalf("reverse %v: expect %d keys, got %d", reverse, len(keys), len(got))
+			}
+			for i := range got {
+				expect := keys[i]
+				if reverse {
+					expect = keys[len(keys)-1-i]
+				}
+				if got[i] != expect {
+					t.Fatalf("reverse %v: expect key %s at %d, got %s", reverse, expect, i, got[i])
+				}
+			}
+		}
+	}
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%03d", r.Intn(500))
+			if r.Intn(4) == 0 {
+				if err := db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(model, key)
+				continue
+			}
+			value := fmt.Sprintf("%s-%d-%d", key, round, i)
+			if err := db.Set(key, []byte(value)); err != nil {
+				t.Fatal(err)
+			}
+			model[key] = value
+		}
+		verify()
+
+		waitCompaction(t, db)
+		verify()
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verify()
+	}
+
+	var deepest int
+	for level, tables := range db.current.levels {
+		if len(tables) > 0 {
+			deepest = level
+		}
+	}
+	t.Logf("deepest level %d", deepest)
+	if deepest < 1 {
+		t.Errorf("expect compaction to level >= 1")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDB_Recover 重启后能读到 memtable 中还没有 flush 的写入以及已经 flush 的写入，序列号继续递增
+func TestDB_Recover(t *testing.T) {
+	config := newTestConfig("recover")
+	config.Set(consts.LsmMemtableSize, consts.MB)
+	db, err := Open(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("flushed", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WriteBatch(iface.NewWriteBatch().Set("k1", []byte("v1")).Set("k2", []byte("v2")).Delete("flushed")); err != nil {
+		t.Fatal(err)
+	}
+	seq := db.seq
+	if length, err := db.Wal.Len(); err != nil || length != 1 {
+		t.Fatalf("expect 1 record in wal after flush, got %d, %v", length, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.seq != seq {
+		t.Errorf("expect seq %d after recover, got %d", seq, db.seq)
+	}
+	for key, expect := range map[string]string{"k1": "v1", "k2": "v2"} {
+		if value, err := db.Get(key); err != nil || string(value) != expect {
+			t.Errorf("%s: expect %s, got %s, %v", key, expect, value, err)
+		}
+	}
+	if _, err := db.Get("flushed"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect deleted key not found, got %v", err)
+	}
+}
+
+// TestDB_TTL 过期的 key 读不到，flush 之后仍然读不到，Persist 之后不再过期
+func TestDB_TTL(t *testing.T) {
+	db, err := Open(newTestConfig("ttl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.SetWithTTL("short", []byte("v"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetWithTTL("long", []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := db.TTL("long"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("expect ttl in (0, 1h], got %v, %v", ttl, err)
+	}
+	if err := db.Persist("long"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := db.TTL("long"); err != nil || ttl != iface.NoTTL {
+		t.Errorf("expect no ttl after persist, got %v, %v", ttl, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := db.Get("short"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect expired key not found, got %v", err)
+	}
+	if err := db.Persist("short"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect persist expired key not found, got %v", err)
+	}
+}
+
+// TestDB_CompareAndSwapIncr CompareAndSwap、SetNX、Incr 读取 SSTable 中的数据
+func TestDB_CompareAndSwapIncr(t *testing.T) {
+	db, err := Open(newTestConfig("cas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if ok, err := db.SetNX("k", []byte("v1")); err != nil || !ok {
+		t.Fatalf("expect setnx ok, got %v, %v", ok, err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.SetNX("k", []byte("v2")); err != nil || ok {
+		t.Errorf("expect setnx fail on existing key, got %v, %v", ok, err)
+	}
+	if ok, err := db.CompareAndSwap("k", []byte("v2"), []byte("v3")); err != nil || ok {
+		t.Errorf("expect cas fail on mismatch, got %v, %v", ok, err)
+	}
+	if ok, err := db.CompareAndSwap("k", []byte("v1"), []byte("v3")); err != nil || !ok {
+		t.Errorf("expect cas ok, got %v, %v", ok, err)
+	}
+
+	if n, err := db.Incr("n", 5); err != nil || n != 5 {
+		t.Errorf("expect 5, got %d, %v", n, err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Decr("n", 7); err != nil || n != -2 {
+		t.Errorf("expect -2, got %d, %v", n, err)
+	}
+	if _, err := db.Incr("k", 1); errs.GetCode(err) != errs.NotIntegerErrCode {
+		t.Errorf("expect not integer error, got %v", err)
+	}
+}
+
+// TestTxn_Conflict 事务读写的 key 被其他写入修改时提交失败，删除的墓碑 compaction 之后仍然能检查到冲突
+func TestTxn_Conflict(t *testing.T) {
+	db, err := Open(newTestConfig("txn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, _ := db.Begin()
+	if value, err := txn.Get("a"); err != nil || string(value) != "1" {
+		t.Fatalf("expect 1, got %s, %v", value, err)
+	}
+	if err := txn.Set("b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := txn.Get("b"); err != nil || string(value) != "2" {
+		t.Errorf("expect read your writes, got %s, %v", value, err)
+	}
+	if _, err := db.Get("b"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect uncommitted write invisible, got %v", err)
+	}
+
+	// 其他写入删除了事务读过的 key，并且墓碑经过 flush、compaction 到了最底层
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Set(fmt.Sprintf("filler%d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitCompaction(t, db)
+
+	if err := txn.Commit(); errs.GetCode(err) != errs.TxnConflictErrCode {
+		t.Errorf("expect conflict, got %v", err)
+	}
+	if err := txn.Commit(); errs.GetCode(err) != errs.TxnFinishedErrCode {
+		t.Errorf("expect finished, got %v", err)
+	}
+	if _, err := db.Get("b"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect conflict txn write not applied, got %v", err)
+	}
+
+	txn, _ = db.Begin()
+	if _, err := txn.Get("a"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect not found, got %v", err)
+	}
+	if err := txn.Set("a", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("a"); err != nil || string(value) != "3" {
+		t.Errorf("expect 3, got %s, %v", value, err)
+	}
+	if len(db.txns) != 0 {
+		t.Errorf("expect no active txn, got %v", db.txns)
+	}
+}
+
+// TestDB_BloomFilter 读取不存在的 key 时大部分被 SSTable 的布隆过滤器过滤，误判计入统计
+func TestDB_BloomFilter(t *testing.T) {
+	db, err := Open(newTestConfig("bloom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := db.Set(fmt.Sprintf("key%03d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	before := bloom.TotalStats()
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%03d-missing", i%100)); errs.GetCode(err) != errs.NotFoundErrCode {
+			t.Fatalf("expect not found, got %v", err)
+		}
+	}
+	after := bloom.TotalStats()
+	negatives := after.Negatives - before.Negatives
+	falsePositives := after.FalsePositives - before.FalsePositives
+	t.Logf("negatives %d, false positives %d", negatives, falsePositives)
+	if negatives < 900 {
+		t.Errorf("expect most lookups filtered, got %d negatives, %d false positives", negatives, falsePositives)
+	}
+}
@@ -0,0 +1,168 @@
+package lsm
+
+import (
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/Trinoooo/eggie_kv/storage/core/lsm/logs"
+)
+
+// Iterator 基于 memtable 以及全部 SSTable 的迭代器
+// 每次移动都在 memtable 以及全部 SSTable 中重新查找下一个 key，再读取该 key 的最新版本判断是否可见，
+// 迭代过程中的写入、flush 以及 compaction 不会使迭代器失效
+type Iterator struct {
+	db       *DB
+	reverse  bool
+	lower    string // lower 遍历范围下界（包含）
+	upper    string // upper 遍历范围上界（不包含），hasUpper 为false时没有上界
+	hasUpper bool
+	key      string
+	valid    bool
+	err      error // err 查找过程中读取 SSTable 出现的错误，出现错误后迭代器失效
+}
+
+// newIterator 创建迭代器，创建之后定位在遍历顺序的第一个 key 上
+func newIterator(db *DB, opts *iface.IteratorOptions) (*Iterator, error) {
+	if opts == nil {
+		opts = &iface.IteratorOptions{}
+	}
+
+	it := &Iterator{
+		db:       db,
+		reverse:  opts.Reverse,
+		lower:    opts.LowerBound,
+		upper:    opts.UpperBound,
+		hasUpper: opts.UpperBound != "",
+	}
+
+	// 前缀范围与上下界取交集
+	if opts.Prefix != "" {
+		if opts.Prefix > it.lower {
+			it.lower = opts.Prefix
+		}
+		if end, ok := prefixEnd(opts.Prefix); ok && (!it.hasUpper || end < it.upper) {
+			it.upper = end
+			it.hasUpper = true
+		}
+	}
+
+	it.rewind()
+	if it.err != nil {
+		return nil, it.err
+	}
+	return it, nil
+}
+
+// prefixEnd 返回大于全部有 prefix 前缀的 key 的最小字符串
+// prefix 全部由0xff组成时不存在这样的字符串，第二个返回值为false
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// rewind 定位到遍历顺序的第一个 key 上
+func (it *Iterator) rewind() {
+	if !it.reverse {
+		it.set(it.db.seek(it.lower, seekGE))
+		return
+	}
+	if it.hasUpper {
+		it.set(it.db.seek(it.upper, seekLT))
+		return
+	}
+	it.set(it.db.last())
+}
+
+// set 更新迭代器位置，超出遍历范围时迭代器失效
+// 查找到的 key 可能只有墓碑或者已经过期，需要跳过
+func (it *Iterator) set(key string, ok bool, err error) {
+	for {
+		if err != nil {
+			logs.Error(err.Error())
+			it.err, it.valid = err, false
+			return
+		}
+		it.key = key
+		it.valid = ok && key >= it.lower && (!it.hasUpper || key < it.upper)
+		if !it.valid {
+			return
+		}
+
+		visible, err := it.db.visible(key)
+		if err != nil {
+			logs.Error(err.Error())
+			it.err, it.valid = err, false
+			return
+		}
+		if visible {
+			return
+		}
+		key, ok, err = it.next(key)
+	}
+}
+
+// next 按遍历顺序查找 key 的下一个 key
+func (it *Iterator) next(key string) (string, bool, error) {
+	if it.reverse {
+		return it.db.seek(key, seekLT)
+	}
+	return it.db.seek(key, seekGT)
+}
+
+func (it *Iterator) Seek(key string) {
+	if it.db == nil {
+		return
+	}
+
+	if !it.reverse {
+		if key < it.lower {
+			key = it.lower
+		}
+		it.set(it.db.seek(key, seekGE))
+		return
+	}
+	if it.hasUpper && key >= it.upper {
+		it.set(it.db.seek(it.upper, seekLT))
+		return
+	}
+	it.set(it.db.seek(key, seekLE))
+}
+
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	it.set(it.next(it.key))
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() string {
+	if !it.valid {
+		return ""
+	}
+	return it.key
+}
+
+// Value 读取当前 key 的 value
+// 定位到 key 之后 key 被并发删除时返回 errs.NewNotFoundErr
+func (it *Iterator) Value() ([]byte, error) {
+	if !it.valid {
+		return nil, errs.NewNotFoundErr()
+	}
+	return it.db.Get(it.key)
+}
+
+// Close 关闭迭代器，关闭之后迭代器失效
+func (it *Iterator) Close() error {
+	it.valid = false
+	it.db = nil
+	return nil
+}
@@ -0,0 +1,33 @@
+package logs
+
+import (
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/storage/logs"
+	"go.uber.org/zap"
+)
+
+var commonFields = []zap.Field{
+	zap.String(consts.Core, consts.Lsm),
+}
+
+var lsmLogger *zap.Logger
+
+func init() {
+	lsmLogger = logs.Logger.With(commonFields...)
+}
+
+func Info(msg string, fields ...zap.Field) {
+	lsmLogger.Info(msg, fields...)
+}
+
+func Warn(msg string, fields ...zap.Field) {
+	lsmLogger.Warn(msg, fields...)
+}
+
+func Error(msg string, fields ...zap.Field) {
+	lsmLogger.Error(msg, fields...)
+}
+
+func Fatal(msg string, fields ...zap.Field) {
+	lsmLogger.Fatal(msg, fields...)
+}
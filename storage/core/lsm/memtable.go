@@ -0,0 +1,203 @@
+package lsm
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const (
+	memtableMaxLevel    = 32   // memtableMaxLevel 跳表最大层数
+	memtableProbability = 0.25 // memtableProbability 节点出现在上一层的概率
+	entryOverhead       = 32   // entryOverhead 估算 memtable 大小时每个 entry 除 key、value 之外的开销
+)
+
+// memtableNode 跳表节点
+type memtableNode struct {
+	entry *entry
+	next  []*memtableNode
+}
+
+// memtable 内存中按 key 字典序维护最新写入的有序表
+// 每个 key 只保留最新的版本，删除以墓碑表示。写入由 DB 的写锁串行化，读取可以与写入并发。
+// memtable 写满后转为只读的 immutable memtable，由后台协程 flush 为 L0 的 SSTable
+type memtable struct {
+	mu      sync.RWMutex
+	head    *memtableNode
+	level   int
+	length  int
+	size    int64  // size 估算的内存占用，单位字节
+	maxSeq  uint64 // maxSeq 写入的最大序列号
+	records int64  // records 应用到该 memtable 的 wal 日志数量，flush 之后截断相同数量的日志
+	rand    *rand.Rand
+}
+
+func newMemtable() *memtable {
+	return &memtable{
+		head:  &memtableNode{next: make([]*memtableNode, memtableMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// randomLevel 随机生成新节点的层数
+func (m *memtable) randomLevel() int {
+	level := 1
+	for level < memtableMaxLevel && m.rand.Float64() < memtableProbability {
+		level++
+	}
+	return level
+}
+
+// findPrev 查找每一层中最后一个小于 key 的节点
+func (m *memtable) findPrev(key string) []*memtableNode {
+	prev := make([]*memtableNode, memtableMaxLevel)
+	node := m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].entry.key < key {
+			node = node.next[i]
+		}
+		prev[i] = node
+	}
+	return prev
+}
+
+// put 写入 entry，key 已经存在时替换为新版本
+func (m *memtable) put(e *entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e.seq > m.maxSeq {
+		m.maxSeq = e.seq
+	}
+
+	prev := m.findPrev(e.key)
+	if next := prev[0].next[0]; next != nil && next.entry.key == e.key {
+		m.size += int64(len(e.value) - len(next.entry.value))
+		next.entry = e
+		return
+	}
+
+	level := m.randomLevel()
+	if level > m.level {
+		for i := m.level; i < level; i++ {
+			prev[i] = m.head
+		}
+		m.level = level
+	}
+
+	node := &memtableNode{entry: e, next: make([]*memtableNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+	m.length++
+	m.size += int64(len(e.key) + len(e.value) + entryOverhead)
+}
+
+// get 读取 key 的最新版本，可能是墓碑
+func (m *memtable) get(key string) (*entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	next := m.findPrev(key)[0].next[0]
+	if next == nil || next.entry.key != key {
+		return nil, false
+	}
+	return next.entry, true
+}
+
+// seekGE 查找第一个大于等于 key 的 entry
+func (m *memtable) seekGE(key string) (*entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	next := m.findPrev(key)[0].next[0]
+	if next == nil {
+		return nil, false
+	}
+	return next.entry, true
+}
+
+// seekGT 查找第一个大于 key 的 entry
+func (m *memtable) seekGT(key string) (*entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	next := m.findPrev(key)[0].next[0]
+	if next != nil && next.entry.key == key {
+		next = next.next[0]
+	}
+	if next == nil {
+		return nil, false
+	}
+	return next.entry, true
+}
+
+// seekLT 查找最后一个小于 key 的 entry
+func (m *memtable) seekLT(key string) (*entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	prev := m.findPrev(key)[0]
+	if prev == m.head {
+		return nil, false
+	}
+	return prev.entry, true
+}
+
+// seekLE 查找最后一个小于等于 key 的 entry
+func (m *memtable) seekLE(key string) (*entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	prev := m.findPrev(key)[0]
+	if next := prev.next[0]; next != nil && next.entry.key == key {
+		return next.entry, true
+	}
+	if prev == m.head {
+		return nil, false
+	}
+	return prev.entry, true
+}
+
+// last 查找最后一个 entry
+func (m *memtable) last() (*entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	node := m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for node.next[i] != nil {
+			node = node.next[i]
+		}
+	}
+	if node == m.head {
+		return nil, false
+	}
+	return node.entry, true
+}
+
+// entries 按 key 字典序返回全部 entry，用于 flush
+func (m *memtable) entries() []*entry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := make([]*entry, 0, m.length)
+	for node := m.head.next[0]; node != nil; node = node.next[0] {
+		entries = append(entries, node.entry)
+	}
+	return entries
+}
+
+// approximateSize 返回估算的内存占用
+func (m *memtable) approximateSize() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size
+}
+
+func (m *memtable) len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.length
+}
@@ -0,0 +1,570 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/bloom"
+	"github.com/Trinoooo/eggie_kv/storage/core/cache"
+	"github.com/Trinoooo/eggie_kv/storage/core/lsm/logs"
+	"go.uber.org/zap"
+)
+
+const (
+	tableSuffix = ".sst"
+	tableMagic  = uint64(0x656767696c736d00) // tableMagic "eggilsm\0"，用于识别 SSTable 文件
+
+	// 字段长度，单位字节
+	tableFooterSize      = 48 // tableFooterSize | 索引偏移量 8 | 索引长度 8 | 布隆过滤器偏移量 8 | 布隆过滤器长度 8 | entry数量 8 | magic 8 |
+	blockTrailerSize     = 4  // blockTrailerSize 每个块末尾的 crc32 校验和
+	blockEntryHeaderSize = 25 // blockEntryHeaderSize | 是否删除 1 | 序列号 8 | 过期时间 8 | key长度 4 | value长度 4 |
+)
+
+// tableFileName 返回 id 对应的 SSTable 文件路径
+func tableFileName(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", id, tableSuffix))
+}
+
+// blockHandle 数据块在 SSTable 中的位置
+type blockHandle struct {
+	lastKey string // lastKey 块中最后一个 key，用于二分查找 key 所在的块
+	offset  int64
+	size    int64 // size 包含末尾的校验和
+}
+
+// tableWriter 按 key 升序写入 entry，生成 SSTable 文件
+// 文件结构：| 数据块... | 索引块 | 布隆过滤器块 | footer |
+// 每个块末尾都有 crc32 校验和，数据块由连续的 entry 组成：
+// | 是否删除 1字节 | 序列号 8字节 | 过期时间 8字节 | key长度 4字节 | value长度 4字节 | key | value |
+// 索引块由每个数据块的 | 最后一个key长度 4字节 | 最后一个key | 偏移量 8字节 | 长度 8字节 | 组成
+type tableWriter struct {
+	path      string
+	file      *os.File
+	w         *bufio.Writer
+	blockSize int
+	fpr       float64
+	block     []byte        // block 正在构建的数据块
+	index     []blockHandle // index 已经写入的数据块
+	keys      []string      // keys 写入的全部 key，写完之后用于构建布隆过滤器
+	offset    int64         // offset 已经写入文件的字节数
+	lastKey   string
+}
+
+func newTableWriter(path string, blockSize int, fpr float64) (*tableWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		e := errs.NewOpenFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", path))
+		return nil, e
+	}
+	return &tableWriter{
+		path:      path,
+		file:      file,
+		w:         bufio.NewWriterSize(file, 64*1024),
+		blockSize: blockSize,
+		fpr:       fpr,
+	}, nil
+}
+
+// add 追加 entry，调用方保证 key 严格递增
+func (w *tableWriter) add(e *entry) error {
+	var header [blockEntryHeaderSize]byte
+	if e.deleted {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint64(header[1:], e.seq)
+	binary.BigEndian.PutUint64(header[9:], uint64(e.expireAt))
+	binary.BigEndian.PutUint32(header[17:], uint32(len(e.key)))
+	binary.BigEndian.PutUint32(header[21:], uint32(len(e.value)))
+	w.block = append(w.block, header[:]...)
+	w.block = append(w.block, e.key...)
+	w.block = append(w.block, e.value...)
+	w.keys = append(w.keys, e.key)
+	w.lastKey = e.key
+
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// size 返回已经写入的数据大小，包括还没有写入文件的数据块
+func (w *tableWriter) size() int64 {
+	return w.offset + int64(len(w.block))
+}
+
+// flushBlock 将正在构建的数据块写入文件
+func (w *tableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	offset, size, err := w.writeBlock(w.block)
+	if err != nil {
+		return err
+	}
+	w.index = append(w.index, blockHandle{lastKey: w.lastKey, offset: offset, size: size})
+	w.block = w.block[:0]
+	return nil
+}
+
+// writeBlock 写入一个块以及末尾的校验和，返回块的偏移量和长度
+func (w *tableWriter) writeBlock(data []byte) (int64, int64, error) {
+	var trailer [blockTrailerSize]byte
+	binary.BigEndian.PutUint32(trailer[:], crc32.ChecksumIEEE(data))
+	_, err := w.w.Write(data)
+	if err == nil {
+		_, err = w.w.Write(trailer[:])
+	}
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", w.path))
+		return 0, 0, e
+	}
+	offset := w.offset
+	w.offset += int64(len(data) + blockTrailerSize)
+	return offset, int64(len(data) + blockTrailerSize), nil
+}
+
+// finish 写入索引块、布隆过滤器块以及 footer，持久化之后关闭文件
+func (w *tableWriter) finish() error {
+	err := w.flushBlock()
+	if err != nil {
+		return err
+	}
+
+	var index []byte
+	for _, handle := range w.index {
+		index = binary.BigEndian.AppendUint32(index, uint32(len(handle.lastKey)))
+		index = append(index, handle.lastKey...)
+		index = binary.BigEndian.AppendUint64(index, uint64(handle.offset))
+		index = binary.BigEndian.AppendUint64(index, uint64(handle.size))
+	}
+	indexOffset, indexSize, err := w.writeBlock(index)
+	if err != nil {
+		return err
+	}
+
+	filter, err := bloom.New(len(w.keys), w.fpr)
+	if err != nil {
+		logs.Error(err.Error(), zap.Float64("fpr", w.fpr))
+		return err
+	}
+	for _, key := range w.keys {
+		filter.Add([]byte(key))
+	}
+	filterOffset, filterSize, err := w.writeBlock(filter.Encode())
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, tableFooterSize)
+	binary.BigEndian.PutUint64(footer, uint64(indexOffset))
+	binary.BigEndian.PutUint64(footer[8:], uint64(indexSize))
+	binary.BigEndian.PutUint64(footer[16:], uint64(filterOffset))
+	binary.BigEndian.PutUint64(footer[24:], uint64(filterSize))
+	binary.BigEndian.PutUint64(footer[32:], uint64(len(w.keys)))
+	binary.BigEndian.PutUint64(footer[40:], tableMagic)
+	_, err = w.w.Write(footer)
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", w.path))
+		return e
+	}
+	w.offset += tableFooterSize
+
+	err = w.file.Sync()
+	if err != nil {
+		e := errs.NewSyncFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", w.path))
+		return e
+	}
+	err = w.file.Close()
+	if err != nil {
+		e := errs.NewCloseFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", w.path))
+		return e
+	}
+	return nil
+}
+
+// abort 放弃写入，删除写到一半的文件
+func (w *tableWriter) abort() {
+	if err := w.file.Close(); err != nil {
+		logs.Warn(errs.NewCloseFileErr().WithErr(err).Error(), zap.String("path", w.path))
+	}
+	if err := os.Remove(w.path); err != nil {
+		logs.Warn(errs.NewRemoveFileErr().WithErr(err).Error(), zap.String("path", w.path))
+	}
+}
+
+// table 只读的 SSTable
+// 索引和布隆过滤器在打开时全部加载到内存，数据块按需读取并放入数据块缓存。
+// table 被 version 引用，compaction 之后不再被任何 version 引用时关闭并删除文件
+type table struct {
+	id         uint64
+	path       string
+	file       *os.File
+	size       int64
+	count      int64 // count entry 数量
+	index      []blockHandle
+	filter     *bloom.Filter
+	smallest   string
+	largest    string
+	blockCache *cache.Cache
+	refs       int32 // refs 引用该 table 的 version 数量
+	obsolete   int32 // obsolete 为1时 table 已经被 compaction 移除，不再被引用时删除文件
+}
+
+// openTable 打开 SSTable，校验 footer、索引块以及布隆过滤器块
+func openTable(dir string, id uint64, blockCache *cache.Cache) (*table, error) {
+	path := tableFileName(dir, id)
+	file, err := os.Open(path)
+	if err != nil {
+		e := errs.NewOpenFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", path))
+		return nil, e
+	}
+
+	t := &table{id: id, path: path, file: file, blockCache: blockCache}
+	err = t.load()
+	if err != nil {
+		if e := file.Close(); e != nil {
+			logs.Warn(e.Error(), zap.String("path", path))
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *table) load() error {
+	info, err := t.file.Stat()
+	if err != nil {
+		e := errs.NewFileStatErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", t.path))
+		return e
+	}
+	t.size = info.Size()
+	if t.size < tableFooterSize {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error(), zap.String("path", t.path), zap.Int64("size", t.size))
+		return e
+	}
+
+	footer := make([]byte, tableFooterSize)
+	err = t.readAt(footer, t.size-tableFooterSize)
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(footer[40:]) != tableMagic {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error(), zap.String("path", t.path))
+		return e
+	}
+	t.count = int64(binary.BigEndian.Uint64(footer[32:]))
+
+	index, err := t.readRawBlock(int64(binary.BigEndian.Uint64(footer)), int64(binary.BigEndian.Uint64(footer[8:])))
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(index); {
+		if len(index)-offset < 4 {
+			e := errs.NewCorruptErr()
+			logs.Error(e.Error(), zap.String("path", t.path))
+			return e
+		}
+		keyLen := int(binary.BigEndian.Uint32(index[offset:]))
+		offset += 4
+		if len(index)-offset < keyLen+16 {
+			e := errs.NewCorruptErr()
+			logs.Error(e.Error(), zap.String("path", t.path))
+			return e
+		}
+		t.index = append(t.index, blockHandle{
+			lastKey: string(index[offset : offset+keyLen]),
+			offset:  int64(binary.BigEndian.Uint64(index[offset+keyLen:])),
+			size:    int64(binary.BigEndian.Uint64(index[offset+keyLen+8:])),
+		})
+		offset += keyLen + 16
+	}
+	if len(t.index) == 0 {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error(), zap.String("path", t.path))
+		return e
+	}
+	t.largest = t.index[len(t.index)-1].lastKey
+
+	raw, err := t.readRawBlock(int64(binary.BigEndian.Uint64(footer[16:])), int64(binary.BigEndian.Uint64(footer[24:])))
+	if err != nil {
+		return err
+	}
+	t.filter, err = bloom.Decode(raw)
+	if err != nil {
+		logs.Error(err.Error(), zap.String("path", t.path))
+		return err
+	}
+
+	first, err := t.readBlock(0)
+	if err != nil {
+		return err
+	}
+	key, _, err := parseEntry(first, 0)
+	if err != nil {
+		logs.Error(err.Error(), zap.String("path", t.path))
+		return err
+	}
+	t.smallest = string(key)
+	return nil
+}
+
+func (t *table) readAt(buf []byte, offset int64) error {
+	_, err := t.file.ReadAt(buf, offset)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		e := errs.NewCorruptErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", t.path), zap.Int64("offset", offset))
+		return e
+	} else if err != nil {
+		e := errs.NewReadFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", t.path), zap.Int64("offset", offset))
+		return e
+	}
+	return nil
+}
+
+// readRawBlock 从文件中读取块并校验末尾的校验和，返回去掉校验和的块内容
+func (t *table) readRawBlock(offset, size int64) ([]byte, error) {
+	if size < blockTrailerSize || offset < 0 || offset+size > t.size {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error(), zap.String("path", t.path), zap.Int64("offset", offset), zap.Int64("size", size))
+		return nil, e
+	}
+
+	buf := make([]byte, size)
+	err := t.readAt(buf, offset)
+	if err != nil {
+		return nil, err
+	}
+	data := buf[:size-blockTrailerSize]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(buf[size-blockTrailerSize:]) {
+		e := errs.NewFileIntegrityErr()
+		logs.Error(e.Error(), zap.String("path", t.path), zap.Int64("offset", offset))
+		return nil, e
+	}
+	return data, nil
+}
+
+// readBlock 读取第 i 个数据块，优先读取数据块缓存
+func (t *table) readBlock(i int) ([]byte, error) {
+	handle := t.index[i]
+	var key string
+	if t.blockCache != nil {
+		key = strconv.FormatUint(t.id, 10) + "/" + strconv.FormatInt(handle.offset, 10)
+		if data, ok := t.blockCache.Get(key, nil); ok {
+			return data, nil
+		}
+	}
+
+	data, err := t.readRawBlock(handle.offset, handle.size)
+	if err != nil {
+		return nil, err
+	}
+	if t.blockCache != nil {
+		t.blockCache.Set(key, data, nil)
+	}
+	return data, nil
+}
+
+// parseEntry 解析数据块中 offset 处 entry 的 key，返回下一个 entry 的偏移量
+func parseEntry(data []byte, offset int) ([]byte, int, error) {
+	if len(data)-offset < blockEntryHeaderSize {
+		return nil, 0, errs.NewCorruptErr()
+	}
+	keyLen := int(binary.BigEndian.Uint32(data[offset+17:]))
+	valueLen := int(binary.BigEndian.Uint32(data[offset+21:]))
+	start := offset + blockEntryHeaderSize
+	if len(data)-start < keyLen+valueLen {
+		return nil, 0, errs.NewCorruptErr()
+	}
+	return data[start : start+keyLen], start + keyLen + valueLen, nil
+}
+
+// decodeEntry 解析数据块中 offset 处的完整 entry，调用方保证 parseEntry 已经校验过长度
+func decodeEntry(data []byte, offset int) *entry {
+	keyLen := int(binary.BigEndian.Uint32(data[offset+17:]))
+	valueLen := int(binary.BigEndian.Uint32(data[offset+21:]))
+	start := offset + blockEntryHeaderSize
+	e := &entry{
+		key:      string(data[start : start+keyLen]),
+		seq:      binary.BigEndian.Uint64(data[offset+1:]),
+		expireAt: int64(binary.BigEndian.Uint64(data[offset+9:])),
+		deleted:  data[offset] == 1,
+	}
+	if !e.deleted {
+		e.value = append([]byte{}, data[start+keyLen:start+keyLen+valueLen]...)
+	}
+	return e
+}
+
+// scanBlock 遍历第 i 个数据块，fn 返回false时停止遍历，返回停止时的 entry
+// last 为true时返回最后一个使 fn 返回true的 entry，否则返回第一个使 fn 返回false的 entry
+func (t *table) scanBlock(i int, last bool, fn func(key []byte) bool) (*entry, bool, error) {
+	data, err := t.readBlock(i)
+	if err != nil {
+		return nil, false, err
+	}
+
+	matched := -1
+	for offset := 0; offset < len(data); {
+		key, next, err := parseEntry(data, offset)
+		if err != nil {
+			logs.Error(err.Error(), zap.String("path", t.path), zap.Int("block", i))
+			return nil, false, err
+		}
+		if !fn(key) {
+			if !last {
+				return decodeEntry(data, offset), true, nil
+			}
+			break
+		}
+		matched = offset
+		offset = next
+	}
+	if !last || matched == -1 {
+		return nil, false, nil
+	}
+	return decodeEntry(data, matched), true, nil
+}
+
+// get 读取 key 的版本，可能是墓碑
+func (t *table) get(key string) (*entry, bool, error) {
+	if key < t.smallest || key > t.largest || !t.filter.MayContain([]byte(key)) {
+		return nil, false, nil
+	}
+	e, ok, err := t.seekGE(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok || e.key != key {
+		bloom.RecordFalsePositive()
+		return nil, false, nil
+	}
+	return e, true, nil
+}
+
+// seekGE 查找第一个大于等于 key 的 entry
+func (t *table) seekGE(key string) (*entry, bool, error) {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= key })
+	if i == len(t.index) {
+		return nil, false, nil
+	}
+	return t.scanBlock(i, false, func(k []byte) bool { return string(k) < key })
+}
+
+// seekGT 查找第一个大于 key 的 entry
+func (t *table) seekGT(key string) (*entry, bool, error) {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey > key })
+	if i == len(t.index) {
+		return nil, false, nil
+	}
+	return t.scanBlock(i, false, func(k []byte) bool { return string(k) <= key })
+}
+
+// seekLT 查找最后一个小于 key 的 entry
+func (t *table) seekLT(key string) (*entry, bool, error) {
+	return t.seekBefore(key, func(k []byte) bool { return string(k) < key })
+}
+
+// seekLE 查找最后一个小于等于 key 的 entry
+func (t *table) seekLE(key string) (*entry, bool, error) {
+	return t.seekBefore(key, func(k []byte) bool { return string(k) <= key })
+}
+
+// seekBefore 在第一个最后一个 key 大于等于 key 的数据块中查找最后一个满足 fn 的 entry，
+// 找不到时返回前一个数据块的最后一个 entry
+func (t *table) seekBefore(key string, fn func(k []byte) bool) (*entry, bool, error) {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= key })
+	if i < len(t.index) {
+		e, ok, err := t.scanBlock(i, true, fn)
+		if err != nil || ok {
+			return e, ok, err
+		}
+	}
+	if i == 0 {
+		return nil, false, nil
+	}
+	return t.scanBlock(i-1, true, func([]byte) bool { return true })
+}
+
+// overlaps 判断 table 的 key 范围与 [smallest, largest] 是否有交集
+func (t *table) overlaps(smallest, largest string) bool {
+	return t.largest >= smallest && t.smallest <= largest
+}
+
+func (t *table) ref() {
+	atomic.AddInt32(&t.refs, 1)
+}
+
+// unref 释放引用，不再被任何 version 引用时关闭文件，已经被 compaction 移除时同时删除文件
+func (t *table) unref() {
+	if atomic.AddInt32(&t.refs, -1) > 0 {
+		return
+	}
+
+	if err := t.file.Close(); err != nil {
+		logs.Warn(errs.NewCloseFileErr().WithErr(err).Error(), zap.String("path", t.path))
+	}
+	if atomic.LoadInt32(&t.obsolete) == 0 {
+		return
+	}
+	if err := os.Remove(t.path); err != nil {
+		logs.Warn(errs.NewRemoveFileErr().WithErr(err).Error(), zap.String("path", t.path))
+	}
+}
+
+// tableIterator 顺序遍历 table 中的全部 entry，用于 compaction，读取的数据块不放入缓存
+type tableIterator struct {
+	t      *table
+	block  int
+	data   []byte
+	offset int
+}
+
+func newTableIterator(t *table) *tableIterator {
+	return &tableIterator{t: t, block: -1}
+}
+
+// next 返回下一个 entry，遍历结束时第二个返回值为false
+func (it *tableIterator) next() (*entry, bool, error) {
+	for it.offset >= len(it.data) {
+		it.block++
+		if it.block >= len(it.t.index) {
+			return nil, false, nil
+		}
+		handle := it.t.index[it.block]
+		data, err := it.t.readRawBlock(handle.offset, handle.size)
+		if err != nil {
+			return nil, false, err
+		}
+		it.data, it.offset = data, 0
+	}
+
+	_, next, err := parseEntry(it.data, it.offset)
+	if err != nil {
+		logs.Error(err.Error(), zap.String("path", it.t.path), zap.Int("block", it.block))
+		return nil, false, err
+	}
+	e := decodeEntry(it.data, it.offset)
+	it.offset = next
+	return e, true, nil
+}
@@ -0,0 +1,152 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestTable_Seek 写入 SSTable 之后按 key 读取以及四种方式有序查找
+func TestTable_Seek(t *testing.T) {
+	dir := testDataDir + "table_seek"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newTableWriter(tableFileName(dir, 1), 256, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// key 为 k0000、k0002 ... k1998，奇数 key 不存在
+	for i := 0; i < 2000; i += 2 {
+		e := &entry{key: fmt.Sprintf("k%04d", i), value: []byte(fmt.Sprintf("v%d", i)), seq: uint64(i)}
+		if i%10 == 0 {
+			e.deleted, e.value = true, nil
+		}
+		if err := w.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	tbl, err := openTable(dir, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl.ref()
+	defer tbl.unref()
+	if tbl.smallest != "k0000" || tbl.largest != "k1998" || tbl.count != 1000 || len(tbl.index) < 2 {
+		t.Fatalf("unexpect table meta: %s %s %d %d", tbl.smallest, tbl.largest, tbl.count, len(tbl.index))
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("k%04d", i)
+		e, ok, err := tbl.get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (i%2 == 0) {
+			t.Fatalf("%s: expect found %v, got %v", key, i%2 == 0, ok)
+		}
+		if ok && (e.deleted != (i%10 == 0) || e.seq != uint64(i) || (!e.deleted && string(e.value) != fmt.Sprintf("v%d", i))) {
+			t.Fatalf("%s: unexpect entry %+v", key, e)
+		}
+	}
+
+	cases := []struct {
+		key    string
+		mode   seekMode
+		expect string
+	}{
+		{"k0000", seekGE, "k0000"},
+		{"k0000", seekGT, "k0002"},
+		{"k0001", seekGE, "k0002"},
+		{"a", seekGE, "k0000"},
+		{"k1998", seekGT, ""},
+		{"k1999", seekLT, "k1998"},
+		{"k1998", seekLT, "k1996"},
+		{"k1998", seekLE, "k1998"},
+		{"k0001", seekLE, "k0000"},
+		{"k0000", seekLT, ""},
+		{"z", seekLE, "k1998"},
+	}
+	for _, c := range cases {
+		e, ok, err := tbl.seek(c.key, c.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if ok {
+			got = e.key
+		}
+		if got != c.expect {
+			t.Errorf("seek %s mode %d: expect %q, got %q", c.key, c.mode, c.expect, got)
+		}
+	}
+
+	it := newTableIterator(tbl)
+	var count int
+	for {
+		_, ok, err := it.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		count++
+	}
+	if count != 1000 {
+		t.Errorf("expect iterate 1000 entries, got %d", count)
+	}
+}
+
+// TestTable_Corrupt 数据块损坏时读取返回错误，footer 损坏时无法打开
+func TestTable_Corrupt(t *testing.T) {
+	dir := testDataDir + "table_corrupt"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newTableWriter(tableFileName(dir, 1), 4096, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := w.add(&entry{key: fmt.Sprintf("k%d", i), value: []byte("value")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := tableFileName(dir, 1)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 翻转第一个数据块中的一个字节，打开时读取第一个数据块校验失败
+	raw[30] ^= 0xff
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openTable(dir, 1, nil); err == nil {
+		t.Error("expect error on corrupt block")
+	}
+
+	if err := os.WriteFile(path, raw[:len(raw)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openTable(dir, 1, nil); err == nil {
+		t.Error("expect error on truncated footer")
+	}
+}
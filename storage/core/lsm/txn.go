@@ -0,0 +1,124 @@
+package lsm
+
+import (
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/lsm/logs"
+)
+
+// Txn 乐观事务
+// memtable 中每个 key 只保留最新版本，事务不读取快照，而是读取最新数据并记录读过的 key；
+// 提交时在写锁中检查读写过的 key 最新版本的序列号都不大于事务开始时的序列号，
+// 即事务读到的数据就是开始时的数据，检查通过后全部写入作为一条日志原子地写入，否则返回 errs.NewTxnConflictErr。
+// 不保证并发安全，同一个事务只能在一个协程中使用
+type Txn struct {
+	db       *DB
+	seq      uint64              // seq 事务开始时最后一次写入的序列号
+	reads    map[string]struct{} // reads 事务中读取过的 key
+	writes   map[string]*Op      // writes 事务中每个 key 最后一次写入或删除
+	order    []string            // order 按第一次写入的顺序记录 writes 中的 key
+	finished bool
+}
+
+func newTxn(db *DB) *Txn {
+	return &Txn{
+		db:     db,
+		seq:    db.beginTxn(),
+		reads:  make(map[string]struct{}),
+		writes: make(map[string]*Op),
+	}
+}
+
+// Get 读取 key，优先读取事务中的写入
+func (txn *Txn) Get(key string) ([]byte, error) {
+	if txn.finished {
+		e := errs.NewTxnFinishedErr()
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	if op, exist := txn.writes[key]; exist {
+		if op.Type == consts.OperatorTypeDelete {
+			return nil, errs.NewNotFoundErr()
+		}
+		return op.Value, nil
+	}
+
+	// 读不到的 key 同样需要检查，保证提交时 key 仍然不存在
+	txn.reads[key] = struct{}{}
+	return txn.db.Get(key)
+}
+
+// Set 在事务中写入 key，提交之前对其他读取不可见
+func (txn *Txn) Set(key string, value []byte) error {
+	return txn.write(NewOp(consts.OperatorTypeSet, key, value))
+}
+
+// Delete 在事务中删除 key，提交之前对其他读取不可见
+func (txn *Txn) Delete(key string) error {
+	return txn.write(NewOp(consts.OperatorTypeDelete, key, nil))
+}
+
+func (txn *Txn) write(op *Op) error {
+	if txn.finished {
+		e := errs.NewTxnFinishedErr()
+		logs.Error(e.Error())
+		return e
+	}
+
+	if _, exist := txn.writes[op.Key]; !exist {
+		txn.order = append(txn.order, op.Key)
+	}
+	txn.writes[op.Key] = op
+	return nil
+}
+
+// Commit 提交事务，读写过的 key 在事务开始之后被修改时返回 errs.NewTxnConflictErr
+// 事务读取的是最新数据，只读事务同样需要检查，保证读到的数据来自同一时刻。无论提交是否成功，事务都会结束
+func (txn *Txn) Commit() error {
+	if txn.finished {
+		e := errs.NewTxnFinishedErr()
+		logs.Error(e.Error())
+		return e
+	}
+	txn.finished = true
+	defer txn.db.endTxn(txn.seq)
+
+	if len(txn.reads) == 0 && len(txn.writes) == 0 {
+		return nil
+	}
+
+	// 读写过的 key 都需要检查：只写的 key 检查写写冲突，读过的 key 检查读写冲突
+	ops := make([]*Op, 0, len(txn.reads)+2*len(txn.order))
+	for key := range txn.reads {
+		if _, exist := txn.writes[key]; !exist {
+			ops = append(ops, txn.checkOp(key))
+		}
+	}
+	for _, key := range txn.order {
+		ops = append(ops, txn.checkOp(key))
+	}
+	for _, key := range txn.order {
+		ops = append(ops, txn.writes[key])
+	}
+
+	_, err := txn.db.write(ops)
+	return err
+}
+
+// checkOp 构造检查 key 在事务开始之后没有被修改的条件
+func (txn *Txn) checkOp(key string) *Op {
+	op := NewOp(opTypeCheck, key, nil)
+	op.Seq = txn.seq
+	return op
+}
+
+// Rollback 放弃事务中的全部写入，事务已经结束时什么都不做
+func (txn *Txn) Rollback() error {
+	if txn.finished {
+		return nil
+	}
+	txn.finished = true
+	txn.db.endTxn(txn.seq)
+	return nil
+}
@@ -0,0 +1,308 @@
+package lsm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/lsm/logs"
+	"go.uber.org/zap"
+)
+
+const (
+	numLevels    = 7 // numLevels SSTable 的层数
+	manifestName = "MANIFEST"
+)
+
+// seekMode 有序查找的方式
+type seekMode int
+
+const (
+	seekGE seekMode = iota // seekGE 第一个大于等于 key 的 entry
+	seekGT                 // seekGT 第一个大于 key 的 entry
+	seekLT                 // seekLT 最后一个小于 key 的 entry
+	seekLE                 // seekLE 最后一个小于等于 key 的 entry
+)
+
+// forward 判断查找方向是否为正向
+func (mode seekMode) forward() bool {
+	return mode == seekGE || mode == seekGT
+}
+
+// version 某一时刻全部 SSTable 的集合，创建之后不再修改
+// L0 的 SSTable 由 memtable 直接 flush 生成，key 范围可能重叠，按从新到旧排列；
+// L1 及以下每层的 SSTable key 范围互不重叠，按 key 范围排列。
+// 读取时持有 version 的引用，保证读取过程中 compaction 不会删除正在读取的 SSTable
+type version struct {
+	levels [numLevels][]*table
+	refs   int32
+}
+
+// versionEdit flush、compaction 对 version 的修改
+type versionEdit struct {
+	added   [numLevels][]*table // added 每层新增的 SSTable，L0 中新增的 SSTable 比已有的都新
+	removed map[uint64]struct{} // removed 移除的 SSTable id
+	lastSeq uint64              // lastSeq flush 之后已经持久化到 SSTable 的最大序列号，0表示不变
+}
+
+func newVersionEdit() *versionEdit {
+	return &versionEdit{removed: make(map[uint64]struct{})}
+}
+
+// apply 在 v 的基础上应用 edit 生成新的 version，新 version 持有一个引用
+func (v *version) apply(edit *versionEdit) *version {
+	next := &version{refs: 1}
+	for level := range v.levels {
+		tables := make([]*table, 0, len(v.levels[level])+len(edit.added[level]))
+		if level == 0 {
+			tables = append(tables, edit.added[level]...)
+		}
+		for _, t := range v.levels[level] {
+			if _, removed := edit.removed[t.id]; !removed {
+				tables = append(tables, t)
+			}
+		}
+		if level > 0 {
+			tables = append(tables, edit.added[level]...)
+			sort.Slice(tables, func(i, j int) bool { return tables[i].smallest < tables[j].smallest })
+		}
+		for _, t := range tables {
+			t.ref()
+		}
+		next.levels[level] = tables
+	}
+	return next
+}
+
+func (v *version) ref() {
+	atomic.AddInt32(&v.refs, 1)
+}
+
+// unref 释放引用，不再被引用时释放对 SSTable 的引用
+func (v *version) unref() {
+	if atomic.AddInt32(&v.refs, -1) > 0 {
+		return
+	}
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			t.unref()
+		}
+	}
+}
+
+// get 按从新到旧的顺序读取 key 的最新版本，可能是墓碑
+func (v *version) get(key string) (*entry, bool, error) {
+	for _, t := range v.levels[0] {
+		e, ok, err := t.get(key)
+		if err != nil || ok {
+			return e, ok, err
+		}
+	}
+	for level := 1; level < numLevels; level++ {
+		tables := v.levels[level]
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].largest >= key })
+		if i == len(tables) {
+			continue
+		}
+		e, ok, err := tables[i].get(key)
+		if err != nil || ok {
+			return e, ok, err
+		}
+	}
+	return nil, false, nil
+}
+
+// seek 在全部 SSTable 中按 mode 查找离 key 最近的 entry，不区分版本新旧
+func (v *version) seek(key string, mode seekMode) (*entry, bool, error) {
+	var best *entry
+	consider := func(e *entry, ok bool, err error) error {
+		if err != nil || !ok {
+			return err
+		}
+		if best == nil || (mode.forward() && e.key < best.key) || (!mode.forward() && e.key > best.key) {
+			best = e
+		}
+		return nil
+	}
+
+	for _, t := range v.levels[0] {
+		if err := consider(t.seek(key, mode)); err != nil {
+			return nil, false, err
+		}
+	}
+	for level := 1; level < numLevels; level++ {
+		tables := v.levels[level]
+		var t *table
+		switch mode {
+		case seekGE, seekGT:
+			i := sort.Search(len(tables), func(i int) bool {
+				return tables[i].largest > key || (mode == seekGE && tables[i].largest == key)
+			})
+			if i < len(tables) {
+				t = tables[i]
+			}
+		case seekLT, seekLE:
+			i := sort.Search(len(tables), func(i int) bool {
+				return tables[i].smallest > key || (mode == seekLT && tables[i].smallest == key)
+			})
+			if i > 0 {
+				t = tables[i-1]
+			}
+		}
+		if t == nil {
+			continue
+		}
+		if err := consider(t.seek(key, mode)); err != nil {
+			return nil, false, err
+		}
+	}
+	return best, best != nil, nil
+}
+
+// overlapsBelow 判断 level 以下的层中是否有 SSTable 可能包含 key
+// 没有时 compaction 到 level 的墓碑不再遮住任何旧版本，可以丢弃
+func (v *version) overlapsBelow(level int, key string) bool {
+	for l := level + 1; l < numLevels; l++ {
+		tables := v.levels[l]
+		i := sort.Search(len(tables), func(i int) bool { return tables[i].largest >= key })
+		if i < len(tables) && tables[i].smallest <= key {
+			return true
+		}
+	}
+	return false
+}
+
+// levelSize 返回某一层全部 SSTable 的总大小
+func (v *version) levelSize(level int) int64 {
+	var size int64
+	for _, t := range v.levels[level] {
+		size += t.size
+	}
+	return size
+}
+
+// seek 按 mode 在 table 中查找离 key 最近的 entry
+func (t *table) seek(key string, mode seekMode) (*entry, bool, error) {
+	switch mode {
+	case seekGE:
+		return t.seekGE(key)
+	case seekGT:
+		return t.seekGT(key)
+	case seekLT:
+		return t.seekLT(key)
+	default:
+		return t.seekLE(key)
+	}
+}
+
+// seek 按 mode 在 memtable 中查找离 key 最近的 entry
+func (m *memtable) seek(key string, mode seekMode) (*entry, bool) {
+	switch mode {
+	case seekGE:
+		return m.seekGE(key)
+	case seekGT:
+		return m.seekGT(key)
+	case seekLT:
+		return m.seekLT(key)
+	default:
+		return m.seekLE(key)
+	}
+}
+
+// manifest 持久化的 version 信息，每次 flush、compaction 之后整体重写
+type manifest struct {
+	NextFileID uint64     `json:"next_file_id"` // NextFileID 下一个 SSTable 的 id
+	LastSeq    uint64     `json:"last_seq"`     // LastSeq 已经持久化到 SSTable 的最大序列号，回放 wal 时跳过不大于它的日志
+	Levels     [][]uint64 `json:"levels"`       // Levels 每层 SSTable 的 id，顺序与 version 一致
+}
+
+// readManifest 读取 manifest，文件不存在时返回空的 manifest
+func readManifest(dir string) (*manifest, error) {
+	path := filepath.Join(dir, manifestName)
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &manifest{NextFileID: 1}, nil
+	} else if err != nil {
+		e := errs.NewReadFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", path))
+		return nil, e
+	}
+
+	m := &manifest{}
+	err = json.Unmarshal(raw, m)
+	if err != nil {
+		e := errs.NewJsonUnmarshalErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", path))
+		return nil, e
+	}
+	return m, nil
+}
+
+// writeManifest 原子地重写 manifest：先写入临时文件并持久化，再重命名覆盖
+func writeManifest(dir string, m *manifest) error {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		e := errs.NewJsonMarshalErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+
+	path := filepath.Join(dir, manifestName)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		e := errs.NewOpenFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", tmp))
+		return e
+	}
+	_, err = file.Write(raw)
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", tmp))
+		_ = file.Close()
+		return e
+	}
+	err = file.Sync()
+	if err != nil {
+		e := errs.NewSyncFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", tmp))
+		_ = file.Close()
+		return e
+	}
+	err = file.Close()
+	if err != nil {
+		e := errs.NewCloseFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", tmp))
+		return e
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		e := errs.NewRenameFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", path))
+		return e
+	}
+	return syncDir(dir)
+}
+
+// syncDir 持久化目录项，保证新建、重命名的文件在宕机之后仍然可见
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		e := errs.NewOpenFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", dir))
+		return e
+	}
+	defer fd.Close()
+
+	err = fd.Sync()
+	if err != nil {
+		e := errs.NewSyncFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", dir))
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package memory
+
+import (
+	"github.com/Trinoooo/eggie_kv/consts"
+)
+
+// opTypeCheck 事务提交时检查 key 在事务开始之后没有被修改
+const opTypeCheck consts.OperatorType = -1
+
+// Op 一次写入请求中的操作
+type Op struct {
+	Type     consts.OperatorType
+	Key      string
+	Value    []byte
+	ExpireAt int64  // ExpireAt 过期时间，unix 纳秒时间戳，0表示永不过期
+	Expected []byte // Expected CompareAndSwap 期望的当前 value
+	Seq      uint64 // Seq 只用于 opTypeCheck，事务开始时的序列号
+	Observed uint64 // Observed 只用于 opTypeCheck，事务第一次读写 key 时 key 的序列号，key 不存在时为0
+}
+
+func NewOp(opType consts.OperatorType, key string, value []byte) *Op {
+	return &Op{
+		Type:  opType,
+		Key:   key,
+		Value: value,
+	}
+}
+
+// entry key 的当前版本，是分片中存储的基本单位
+// entry 写入分片之后不再修改，更新 key 时整体替换
+type entry struct {
+	key      string
+	value    []byte
+	expireAt int64  // expireAt 过期时间，unix 纳秒时间戳，0表示永不过期
+	seq      uint64 // seq 写入时的序列号
+	deleted  bool   // deleted 只用于 resolve 的结果，表示删除 key，不会写入分片
+}
+
+func (e *entry) isExpired(now int64) bool {
+	return e.expireAt != 0 && e.expireAt <= now
+}
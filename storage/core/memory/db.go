@@ -0,0 +1,554 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/Trinoooo/eggie_kv/storage/core/memory/logs"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	expireSampleSize  = 20   // expireSampleSize 主动过期每个分片每轮采样的 key 数量
+	expireSampleRatio = 0.25 // expireSampleRatio 采样中过期 key 的比例超过该值时继续下一轮采样
+	expireMaxRounds   = 16   // expireMaxRounds 每个周期最多采样的轮数，避免长时间占用写锁
+)
+
+// shard 一个分片，key 按哈希分布到各个分片
+type shard struct {
+	mu      sync.RWMutex
+	items   map[string]*entry
+	expires map[string]struct{} // expires 设置了过期时间的 key，用于主动过期采样
+}
+
+// DB 纯内存存储引擎，不写 wal，适用于测试以及缓存场景
+// 数据分布在多个分片中，每个分片一把读写锁；一次写入涉及的分片按下标顺序加锁，保证多个 key 的写入原子地可见。
+// 配置了 consts.MemorySnapshotPath 时，启动时加载快照文件，关闭时写入快照文件，两次之间的数据不保证持久化
+type DB struct {
+	Config     *viper.Viper
+	shards     []*shard
+	seq        uint64         // seq 最后一次写入的序列号，原子递增
+	closed     int32          // closed 为1时拒绝写入
+	stop       chan struct{}  // stop 关闭时通知后台协程退出
+	background sync.WaitGroup // background 等待主动过期协程退出
+}
+
+func New(config *viper.Viper) (iface.ICore, error) {
+	return Open(config)
+}
+
+// Open 创建 DB，配置了快照文件并且文件存在时加载快照
+func Open(config *viper.Viper) (*DB, error) {
+	if config == nil {
+		config = viper.New()
+	}
+	config.SetDefault(consts.MemoryShards, 32)
+	config.SetDefault(consts.MemoryExpireInterval, 100*time.Millisecond)
+	config.SetDefault(consts.MemorySnapshotPath, "")
+
+	n := config.GetInt(consts.MemoryShards)
+	if n <= 0 {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, consts.MemoryShards), zap.Int(consts.LogFieldValue, n))
+		return nil, e
+	}
+
+	db := &DB{
+		Config: config,
+		shards: make([]*shard, n),
+		stop:   make(chan struct{}),
+	}
+	for i := range db.shards {
+		db.shards[i] = &shard{
+			items:   make(map[string]*entry),
+			expires: make(map[string]struct{}),
+		}
+	}
+
+	if path := config.GetString(consts.MemorySnapshotPath); path != "" {
+		err := db.loadSnapshot(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db.background.Add(1)
+	go db.expireLoop()
+	return db, nil
+}
+
+// shardIndex 按 FNV-1a 哈希选择分片
+func (db *DB) shardIndex(key string) int {
+	var h uint32 = 2166136261
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(db.shards)))
+}
+
+func (db *DB) shard(key string) *shard {
+	return db.shards[db.shardIndex(key)]
+}
+
+// lockShards 按下标顺序给 ops 涉及的分片加写锁，返回解锁函数
+// 固定的加锁顺序避免多个写入互相等待对方持有的分片
+func (db *DB) lockShards(ops []*Op) func() {
+	set := make(map[int]struct{}, len(ops))
+	for _, op := range ops {
+		set[db.shardIndex(op.Key)] = struct{}{}
+	}
+	indexes := make([]int, 0, len(set))
+	for i := range set {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	for _, i := range indexes {
+		db.shards[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			db.shards[i].mu.Unlock()
+		}
+	}
+}
+
+// lookup 读取 key 当前可见的版本，调用方需要持有 key 所在分片的锁
+func (s *shard) lookup(key string, now int64) (*entry, bool) {
+	e, exist := s.items[key]
+	if !exist || e.isExpired(now) {
+		return nil, false
+	}
+	return e, true
+}
+
+// get 加读锁读取 key 当前可见的版本
+func (db *DB) get(key string) (*entry, bool) {
+	s := db.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lookup(key, time.Now().UnixNano())
+}
+
+// write 在 ops 涉及的分片的写锁中提交一组 op
+// 先检查事务冲突，再将需要读取当前数据的 op 转换为写入或删除，最后应用到分片。
+// 返回需要回传给调用方的结果，例如 CompareAndSwap 是否写入、Incr 之后的值
+func (db *DB) write(ops []*Op) (map[*Op][]byte, error) {
+	unlock := db.lockShards(ops)
+	defer unlock()
+
+	// 持有分片锁之后再判断，保证关闭时写入快照之后不会再有写入
+	if atomic.LoadInt32(&db.closed) == 1 {
+		e := errs.NewFileClosedErr()
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	now := time.Now().UnixNano()
+	err := db.check(ops, now)
+	if err != nil {
+		return nil, err
+	}
+	entries, values, err := db.resolve(ops, now)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return values, nil
+	}
+
+	seq := atomic.AddUint64(&db.seq, 1)
+	for _, e := range entries {
+		s := db.shard(e.key)
+		if e.deleted {
+			delete(s.items, e.key)
+			delete(s.expires, e.key)
+			continue
+		}
+		e.seq = seq
+		s.items[e.key] = e
+		if e.expireAt != 0 {
+			s.expires[e.key] = struct{}{}
+		} else {
+			delete(s.expires, e.key)
+		}
+	}
+	return values, nil
+}
+
+// check 检查事务读写的 key 在事务开始之后都没有被修改，否则返回 errs.NewTxnConflictErr
+// 删除不保留墓碑，key 在事务第一次读写之后被删除通过序列号与 Observed 不相等检查
+func (db *DB) check(ops []*Op, now int64) error {
+	for _, op := range ops {
+		if op.Type != opTypeCheck {
+			continue
+		}
+		var seq uint64
+		if e, ok := db.shard(op.Key).lookup(op.Key, now); ok {
+			seq = e.seq
+		}
+		if seq > op.Seq || seq != op.Observed {
+			e := errs.NewTxnConflictErr()
+			logs.Warn(e.Error(), zap.String("key", op.Key), zap.Uint64("seq", op.Seq))
+			return e
+		}
+	}
+	return nil
+}
+
+// resolve 将 op 转换为应用到分片的 entry，value 拷贝一份，调用方之后修改传入的 value 不影响存储的数据
+func (db *DB) resolve(ops []*Op, now int64) ([]*entry, map[*Op][]byte, error) {
+	entries := make([]*entry, 0, len(ops))
+	values := make(map[*Op][]byte)
+	// 同一组 op 中前面的写入还没有应用到分片，读取时需要先看前面的写入
+	written := make(map[string]*entry)
+	read := func(key string) ([]byte, int64, error) {
+		e, exist := written[key]
+		if !exist {
+			e, exist = db.shard(key).lookup(key, now)
+		}
+		if !exist || e.deleted {
+			return nil, 0, errs.NewNotFoundErr()
+		}
+		return e.value, e.expireAt, nil
+	}
+
+	for _, op := range ops {
+		var write *entry
+		switch op.Type {
+		case opTypeCheck:
+			continue
+		case consts.OperatorTypeSet:
+			write = &entry{key: op.Key, value: copyValue(op.Value), expireAt: op.ExpireAt}
+		case consts.OperatorTypeDelete:
+			write = &entry{key: op.Key, deleted: true}
+		case consts.OperatorTypePersist:
+			value, expireAt, err := read(op.Key)
+			if err != nil {
+				return nil, nil, err
+			}
+			// 没有过期时间时不需要写入
+			if expireAt != 0 {
+				write = &entry{key: op.Key, value: value}
+			}
+		case consts.OperatorTypeCAS:
+			value, _, err := read(op.Key)
+			swapped := err == nil && bytes.Equal(value, op.Expected)
+			if swapped {
+				write = &entry{key: op.Key, value: copyValue(op.Value)}
+			}
+			values[op] = encodeBool(swapped)
+		case consts.OperatorTypeSetNX:
+			_, _, err := read(op.Key)
+			notExist := err != nil
+			if notExist {
+				write = &entry{key: op.Key, value: copyValue(op.Value)}
+			}
+			values[op] = encodeBool(notExist)
+		case consts.OperatorTypeIncr, consts.OperatorTypeDecr:
+			n, err := incr(op, read)
+			if err != nil {
+				return nil, nil, err
+			}
+			write = n
+			values[op] = n.value
+		default:
+			e := errs.NewUnsupportedOperatorTypeErr()
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "opType"), zap.Int64(consts.LogFieldValue, int64(op.Type)))
+			return nil, nil, e
+		}
+
+		if write != nil {
+			entries = append(entries, write)
+			written[write.key] = write
+		}
+	}
+	return entries, values, nil
+}
+
+// incr 计算 Incr、Decr 之后的值，转换为保留原有过期时间的写入
+// value 按十进制 int64 解析，key 不存在时视为0，溢出时返回 errs.NewNotIntegerErr
+func incr(op *Op, read func(key string) ([]byte, int64, error)) (*entry, error) {
+	if len(op.Value) != 8 {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "delta"), zap.Int(consts.LogFieldValue, len(op.Value)))
+		return nil, e
+	}
+	delta := int64(binary.BigEndian.Uint64(op.Value))
+
+	var n int64
+	value, expireAt, err := read(op.Key)
+	if err == nil {
+		n, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			e := errs.NewNotIntegerErr().WithErr(err)
+			logs.Error(e.Error())
+			return nil, e
+		}
+	}
+
+	if op.Type == consts.OperatorTypeDecr {
+		if delta == math.MinInt64 {
+			e := errs.NewNotIntegerErr()
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "delta"), zap.Int64(consts.LogFieldValue, delta))
+			return nil, e
+		}
+		delta = -delta
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		e := errs.NewNotIntegerErr()
+		logs.Error(e.Error(), zap.Int64("value", n), zap.Int64("delta", delta))
+		return nil, e
+	}
+
+	return &entry{key: op.Key, value: strconv.AppendInt(nil, n+delta, 10), expireAt: expireAt}, nil
+}
+
+// encodeBool 将 CompareAndSwap、SetNX 是否写入编码为结果
+func encodeBool(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// decodeBool 是 encodeBool 的逆过程
+func decodeBool(raw []byte) bool {
+	return len(raw) == 1 && raw[0] == 1
+}
+
+// copyValue 拷贝 value，存储的数据与调用方持有的切片互不影响
+func copyValue(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(value)), value...)
+}
+
+// expireLoop 后台主动过期协程
+// 与 ragdoll 相同，每个周期在每个分片中随机采样设置了过期时间的 key，删除其中已经过期的 key，
+// 过期比例超过 expireSampleRatio 时认为还有较多过期 key，继续采样
+func (db *DB) expireLoop() {
+	defer db.background.Done()
+
+	interval := db.Config.GetDuration(consts.MemoryExpireInterval)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, s := range db.shards {
+			for i := 0; i < expireMaxRounds; i++ {
+				sampled, expired := s.sweepExpired(expireSampleSize)
+				if sampled == 0 || float64(expired) <= float64(sampled)*expireSampleRatio {
+					break
+				}
+			}
+		}
+	}
+}
+
+// sweepExpired 随机采样至多 sample 个设置了过期时间的 key，删除其中已经过期的 key，返回采样数量以及删除数量
+func (s *shard) sweepExpired(sample int) (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	var sampled, expired int
+	// note：map 遍历的起点是随机的，近似随机采样
+	for key := range s.expires {
+		if sampled >= sample {
+			break
+		}
+		sampled++
+
+		if s.items[key].isExpired(now) {
+			delete(s.items, key)
+			delete(s.expires, key)
+			expired++
+		}
+	}
+	return sampled, expired
+}
+
+// keys 按字典序返回 [lower, upper) 范围内全部可见的 key，hasUpper 为false时没有上界
+// 按下标顺序同时持有全部分片的读锁，返回的 key 来自同一时刻
+func (db *DB) keys(lower, upper string, hasUpper bool) []string {
+	for _, s := range db.shards {
+		s.mu.RLock()
+	}
+	now := time.Now().UnixNano()
+	var keys []string
+	for _, s := range db.shards {
+		for key, e := range s.items {
+			if key >= lower && (!hasUpper || key < upper) && !e.isExpired(now) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	for _, s := range db.shards {
+		s.mu.RUnlock()
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Get 读取 key，返回的 value 是副本，调用方可以修改
+func (db *DB) Get(key string) ([]byte, error) {
+	e, ok := db.get(key)
+	if !ok {
+		return nil, errs.NewNotFoundErr()
+	}
+	return copyValue(e.value), nil
+}
+
+func (db *DB) Set(key string, value []byte) error {
+	_, err := db.write([]*Op{NewOp(consts.OperatorTypeSet, key, value)})
+	return err
+}
+
+// SetWithTTL 写入 key，ttl 之后 key 过期
+func (db *DB) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "ttl"), zap.Duration(consts.LogFieldValue, ttl))
+		return e
+	}
+
+	op := NewOp(consts.OperatorTypeSet, key, value)
+	op.ExpireAt = time.Now().Add(ttl).UnixNano()
+	_, err := db.write([]*Op{op})
+	return err
+}
+
+// TTL 返回 key 的剩余存活时间，没有设置过期时间时返回 iface.NoTTL
+func (db *DB) TTL(key string) (time.Duration, error) {
+	e, ok := db.get(key)
+	if !ok {
+		return 0, errs.NewNotFoundErr()
+	}
+	if e.expireAt == 0 {
+		return iface.NoTTL, nil
+	}
+	return time.Duration(e.expireAt - time.Now().UnixNano()), nil
+}
+
+// Persist 去掉 key 的过期时间，key 不存在或者已经过期时返回 errs.NewNotFoundErr
+func (db *DB) Persist(key string) error {
+	_, err := db.write([]*Op{NewOp(consts.OperatorTypePersist, key, nil)})
+	return err
+}
+
+// Delete 删除 key，key 不存在时不返回错误
+func (db *DB) Delete(key string) error {
+	_, err := db.write([]*Op{NewOp(consts.OperatorTypeDelete, key, nil)})
+	return err
+}
+
+// CompareAndSwap key 当前的 value 等于 expected 时写入 value，返回是否写入
+// key 不存在或者已经过期时不写入。写入的 value 没有过期时间
+func (db *DB) CompareAndSwap(key string, expected, value []byte) (bool, error) {
+	op := NewOp(consts.OperatorTypeCAS, key, value)
+	op.Expected = expected
+	values, err := db.write([]*Op{op})
+	if err != nil {
+		return false, err
+	}
+	return decodeBool(values[op]), nil
+}
+
+// SetNX key 不存在或者已经过期时写入 value，返回是否写入
+func (db *DB) SetNX(key string, value []byte) (bool, error) {
+	op := NewOp(consts.OperatorTypeSetNX, key, value)
+	values, err := db.write([]*Op{op})
+	if err != nil {
+		return false, err
+	}
+	return decodeBool(values[op]), nil
+}
+
+// Incr 将 key 的 value 作为十进制 int64 加上 delta，返回相加之后的值
+// key 不存在时视为0，value 不是整数或者溢出时返回 errs.NewNotIntegerErr，key 原有的过期时间保持不变
+func (db *DB) Incr(key string, delta int64) (int64, error) {
+	return db.incrBy(consts.OperatorTypeIncr, key, delta)
+}
+
+// Decr 将 key 的 value 作为十进制 int64 减去 delta，返回相减之后的值，其他行为与 Incr 相同
+func (db *DB) Decr(key string, delta int64) (int64, error) {
+	return db.incrBy(consts.OperatorTypeDecr, key, delta)
+}
+
+func (db *DB) incrBy(opType consts.OperatorType, key string, delta int64) (int64, error) {
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, uint64(delta))
+	op := NewOp(opType, key, raw)
+	values, err := db.write([]*Op{op})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(values[op]), 10, 64)
+}
+
+// WriteBatch 原子地应用一组写入和删除，涉及的分片全部加锁之后再应用，读取不会看到应用了一部分的 batch
+func (db *DB) WriteBatch(wb *iface.WriteBatch) error {
+	if wb == nil || len(wb.Ops) == 0 {
+		return nil
+	}
+
+	ops := make([]*Op, 0, len(wb.Ops))
+	for _, op := range wb.Ops {
+		if op.Type != consts.OperatorTypeSet && op.Type != consts.OperatorTypeDelete {
+			e := errs.NewUnsupportedOperatorTypeErr()
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "opType"), zap.Int64(consts.LogFieldValue, int64(op.Type)))
+			return e
+		}
+		ops = append(ops, NewOp(op.Type, op.Key, op.Value))
+	}
+	_, err := db.write(ops)
+	return err
+}
+
+// NewIterator 创建按 key 字典序遍历的迭代器
+func (db *DB) NewIterator(opts *iface.IteratorOptions) (iface.Iterator, error) {
+	return newIterator(db, opts), nil
+}
+
+// Begin 开始一个乐观事务，写入缓存在事务中直到提交
+func (db *DB) Begin() (iface.Txn, error) {
+	return newTxn(db), nil
+}
+
+// Close 关闭 DB，配置了快照文件时写入快照，关闭之后不能再写入
+func (db *DB) Close() error {
+	if !atomic.CompareAndSwapInt32(&db.closed, 0, 1) {
+		return nil
+	}
+	close(db.stop)
+	db.background.Wait()
+
+	path := db.Config.GetString(consts.MemorySnapshotPath)
+	if path == "" {
+		return nil
+	}
+	return db.dumpSnapshot(path)
+}
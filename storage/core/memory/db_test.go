@@ -0,0 +1,322 @@
+package memory
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/spf13/viper"
+)
+
+const testDataDir = "../../../test_data/memory/"
+
+func TestMain(m *testing.M) {
+	// 每次测试之前删除测试数据
+	err := os.RemoveAll(testDataDir)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+
+	err = os.RemoveAll(testDataDir)
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(code)
+}
+
+// TestDB_Basic 写入、覆盖、删除，读取到的 value 与调用方持有的切片互不影响
+func TestDB_Basic(t *testing.T) {
+	db, err := Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := []byte("v1")
+	if err := db.Set("k", value); err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 'x'
+	got, err := db.Get("k")
+	if err != nil || string(got) != "v1" {
+		t.Fatalf("expect v1, got %s, %v", got, err)
+	}
+	got[0] = 'x'
+	if got, err := db.Get("k"); err != nil || string(got) != "v1" {
+		t.Errorf("expect v1 after modify returned value, got %s, %v", got, err)
+	}
+
+	if err := db.WriteBatch(iface.NewWriteBatch().Set("k", []byte("v2")).Set("k2", []byte("v")).Delete("k2")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("k"); err != nil || string(got) != "v2" {
+		t.Errorf("expect v2, got %s, %v", got, err)
+	}
+	if _, err := db.Get("k2"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect k2 not found, got %v", err)
+	}
+	if err := db.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("k"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect not found after delete, got %v", err)
+	}
+
+	if n, err := db.Incr("n", 5); err != nil || n != 5 {
+		t.Errorf("expect 5, got %d, %v", n, err)
+	}
+	if ok, err := db.CompareAndSwap("n", []byte("5"), []byte("6")); err != nil || !ok {
+		t.Errorf("expect cas ok, got %v, %v", ok, err)
+	}
+	if ok, err := db.SetNX("n", []byte("0")); err != nil || ok {
+		t.Errorf("expect setnx fail on existing key, got %v, %v", ok, err)
+	}
+	if n, err := db.Decr("n", 8); err != nil || n != -2 {
+		t.Errorf("expect -2, got %d, %v", n, err)
+	}
+}
+
+// TestDB_TTL 过期的 key 读不到，并且会被主动过期删除
+func TestDB_TTL(t *testing.T) {
+	config := viper.New()
+	config.Set(consts.MemoryExpireInterval, 10*time.Millisecond)
+	db, err := Open(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := db.SetWithTTL(fmt.Sprintf("short%d", i), []byte("v"), 20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetWithTTL("long", []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Persist("long"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := db.TTL("long"); err != nil || ttl != iface.NoTTL {
+		t.Errorf("expect no ttl after persist, got %v, %v", ttl, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := db.Get("short0"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect expired key not found, got %v", err)
+	}
+	var remain int
+	for _, s := range db.shards {
+		s.mu.RLock()
+		remain += len(s.items)
+		s.mu.RUnlock()
+	}
+	if remain != 1 {
+		t.Errorf("expect expired keys swept, remain %d", remain)
+	}
+}
+
+// TestDB_Iterator 有序遍历、前缀以及反向 Seek
+func TestDB_Iterator(t *testing.T) {
+	db, err := Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a1", "a2", "a3", "b1", "c1"} {
+		if err := db.Set(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it, _ := db.NewIterator(&iface.IteratorOptions{Prefix: "a", Reverse: true})
+	var got []string
+	for ; it.Valid(); it.Next() {
+		got = append(got, it.Key())
+	}
+	if fmt.Sprint(got) != "[a3 a2 a1]" {
+		t.Errorf("expect [a3 a2 a1], got %v", got)
+	}
+	it.Seek("a25")
+	if it.Key() != "a2" {
+		t.Errorf("expect seek to a2, got %s", it.Key())
+	}
+	_ = it.Close()
+
+	it, _ = db.NewIterator(&iface.IteratorOptions{LowerBound: "a2", UpperBound: "c1"})
+	it.Seek("b")
+	if value, err := it.Value(); err != nil || string(value) != "b1" {
+		t.Errorf("expect b1, got %s, %v", value, err)
+	}
+	it.Next()
+	if it.Valid() {
+		t.Errorf("expect upper bound excluded, got %s", it.Key())
+	}
+	_ = it.Close()
+}
+
+// TestTxn_Conflict 事务读写的 key 被其他写入修改或删除时提交失败
+func TestTxn_Conflict(t *testing.T) {
+	db, err := Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn, _ := db.Begin()
+	if value, err := txn.Get("a"); err != nil || string(value) != "1" {
+		t.Fatalf("expect 1, got %s, %v", value, err)
+	}
+	if err := txn.Set("b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("b"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect uncommitted write invisible, got %v", err)
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); errs.GetCode(err) != errs.TxnConflictErrCode {
+		t.Errorf("expect conflict, got %v", err)
+	}
+	if _, err := db.Get("b"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect conflict txn write not applied, got %v", err)
+	}
+
+	// 事务开始之后 key 被修改，即使第一次读取在修改之后也会冲突
+	txn, _ = db.Begin()
+	if err := db.Set("a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Set("a", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); errs.GetCode(err) != errs.TxnConflictErrCode {
+		t.Errorf("expect conflict, got %v", err)
+	}
+
+	txn, _ = db.Begin()
+	if err := txn.Set("a", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("a"); err != nil || string(value) != "3" {
+		t.Errorf("expect 3, got %s, %v", value, err)
+	}
+}
+
+// TestTxn_Concurrent 并发事务对同一个 key 加一，冲突时重试，最终结果等于事务数量
+func TestTxn_Concurrent(t *testing.T) {
+	db, err := Open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				for {
+					txn, _ := db.Begin()
+					var n int
+					if value, err := txn.Get("counter"); err == nil {
+						_, _ = fmt.Sscan(string(value), &n)
+					}
+					_ = txn.Set("counter", []byte(fmt.Sprint(n+1)))
+					err := txn.Commit()
+					if err == nil {
+						break
+					}
+					if errs.GetCode(err) != errs.TxnConflictErrCode {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, err := db.Get("counter"); err != nil || string(value) != "400" {
+		t.Errorf("expect 400, got %s, %v", value, err)
+	}
+}
+
+// TestDB_Snapshot 关闭时写入快照，重新打开时加载；快照损坏时无法打开
+func TestDB_Snapshot(t *testing.T) {
+	if err := os.RemoveAll(testDataDir + "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	path := testDataDir + "snapshot/data.snap"
+	config := viper.New()
+	config.Set(consts.MemorySnapshotPath, path)
+	db, err := Open(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Set(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetWithTTL("ttl", []byte("v"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetWithTTL("expired", []byte("v"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("k0", []byte("v")); errs.GetCode(err) != errs.FileClosedErrCode {
+		t.Errorf("expect closed error, got %v", err)
+	}
+
+	db, err = Open(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if value, err := db.Get(fmt.Sprintf("k%d", i)); err != nil || string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("k%d: expect v%d, got %s, %v", i, i, value, err)
+		}
+	}
+	if ttl, err := db.TTL("ttl"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("expect ttl kept, got %v, %v", ttl, err)
+	}
+	if _, err := db.Get("expired"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect expired key not loaded, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[20] ^= 0xff
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(config); errs.GetCode(err) != errs.FileIntegrityErrCode {
+		t.Errorf("expect integrity error, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package memory
+
+import (
+	"sort"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+)
+
+// Iterator 基于创建时刻 key 集合的迭代器
+// 分片中的 key 是无序的，创建时一次性取出遍历范围内的全部 key 并排序；value 在读取时从分片中读取最新版本，
+// 迭代过程中新写入的 key 不可见，被删除的 key 读取 value 时返回 errs.NewNotFoundErr
+type Iterator struct {
+	db      *DB
+	reverse bool
+	keys    []string // keys 创建时遍历范围内的全部 key，升序排列
+	pos     int      // pos 当前 key 在 keys 中的下标
+}
+
+// newIterator 创建迭代器，创建之后定位在遍历顺序的第一个 key 上
+func newIterator(db *DB, opts *iface.IteratorOptions) *Iterator {
+	if opts == nil {
+		opts = &iface.IteratorOptions{}
+	}
+
+	lower, upper, hasUpper := opts.LowerBound, opts.UpperBound, opts.UpperBound != ""
+	// 前缀范围与上下界取交集
+	if opts.Prefix != "" {
+		if opts.Prefix > lower {
+			lower = opts.Prefix
+		}
+		if end, ok := prefixEnd(opts.Prefix); ok && (!hasUpper || end < upper) {
+			upper = end
+			hasUpper = true
+		}
+	}
+
+	it := &Iterator{
+		db:      db,
+		reverse: opts.Reverse,
+		keys:    db.keys(lower, upper, hasUpper),
+	}
+	if it.reverse {
+		it.pos = len(it.keys) - 1
+	}
+	return it
+}
+
+// prefixEnd 返回大于全部有 prefix 前缀的 key 的最小字符串
+// prefix 全部由0xff组成时不存在这样的字符串，第二个返回值为false
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+func (it *Iterator) Seek(key string) {
+	if it.db == nil {
+		return
+	}
+
+	// 第一个大于等于 key 的下标
+	i := sort.SearchStrings(it.keys, key)
+	if !it.reverse {
+		it.pos = i
+		return
+	}
+	if i < len(it.keys) && it.keys[i] == key {
+		it.pos = i
+		return
+	}
+	it.pos = i - 1
+}
+
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	if it.reverse {
+		it.pos--
+		return
+	}
+	it.pos++
+}
+
+func (it *Iterator) Valid() bool {
+	return it.db != nil && it.pos >= 0 && it.pos < len(it.keys)
+}
+
+func (it *Iterator) Key() string {
+	if !it.Valid() {
+		return ""
+	}
+	return it.keys[it.pos]
+}
+
+// Value 读取当前 key 的 value
+// 创建迭代器之后 key 被删除或者过期时返回 errs.NewNotFoundErr
+func (it *Iterator) Value() ([]byte, error) {
+	if !it.Valid() {
+		return nil, errs.NewNotFoundErr()
+	}
+	return it.db.Get(it.keys[it.pos])
+}
+
+// Close 关闭迭代器，关闭之后迭代器失效
+func (it *Iterator) Close() error {
+	it.db = nil
+	it.keys = nil
+	return nil
+}
@@ -0,0 +1,33 @@
+package logs
+
+import (
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/storage/logs"
+	"go.uber.org/zap"
+)
+
+var commonFields = []zap.Field{
+	zap.String(consts.Core, consts.Memory),
+}
+
+var memoryLogger *zap.Logger
+
+func init() {
+	memoryLogger = logs.Logger.With(commonFields...)
+}
+
+func Info(msg string, fields ...zap.Field) {
+	memoryLogger.Info(msg, fields...)
+}
+
+func Warn(msg string, fields ...zap.Field) {
+	memoryLogger.Warn(msg, fields...)
+}
+
+func Error(msg string, fields ...zap.Field) {
+	memoryLogger.Error(msg, fields...)
+}
+
+func Fatal(msg string, fields ...zap.Field) {
+	memoryLogger.Fatal(msg, fields...)
+}
@@ -0,0 +1,176 @@
+package memory
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/memory/logs"
+	"go.uber.org/zap"
+)
+
+// 快照文件字段长度，单位字节
+const (
+	snapshotMagic      = 0x656767696d656d00 // snapshotMagic 快照文件魔数
+	snapshotHeaderSize = 16                 // snapshotHeaderSize | 魔数 8字节 | key数量 8字节 |
+	snapshotEntrySize  = 16                 // snapshotEntrySize | 过期时间 8字节 | key长度 4字节 | value长度 4字节 |
+	snapshotCrcSize    = 4                  // snapshotCrcSize 文件末尾 crc32 校验和
+)
+
+// dumpSnapshot 将全部没有过期的 key 写入快照文件
+// 先写入临时文件再重命名，写入过程中宕机不会破坏上一次的快照
+// 结构：| 魔数 8字节 | key数量 8字节 | entry... | crc32 4字节 |
+// entry 结构：| 过期时间 8字节 | key长度 4字节 | value长度 4字节 | key | value |
+func (db *DB) dumpSnapshot(path string) error {
+	for _, s := range db.shards {
+		s.mu.RLock()
+	}
+	now := time.Now().UnixNano()
+	buf := make([]byte, snapshotHeaderSize)
+	var count uint64
+	for _, s := range db.shards {
+		for key, e := range s.items {
+			if e.isExpired(now) {
+				continue
+			}
+			buf = binary.BigEndian.AppendUint64(buf, uint64(e.expireAt))
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(key)))
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(e.value)))
+			buf = append(buf, key...)
+			buf = append(buf, e.value...)
+			count++
+		}
+	}
+	for _, s := range db.shards {
+		s.mu.RUnlock()
+	}
+	binary.BigEndian.PutUint64(buf, snapshotMagic)
+	binary.BigEndian.PutUint64(buf[8:], count)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		e := errs.NewMkdirErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", dir))
+		return e
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		e := errs.NewOpenFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", tmp))
+		return e
+	}
+	_, err = file.Write(buf)
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", tmp))
+		_ = file.Close()
+		return e
+	}
+	err = file.Sync()
+	if err != nil {
+		e := errs.NewSyncFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", tmp))
+		_ = file.Close()
+		return e
+	}
+	err = file.Close()
+	if err != nil {
+		e := errs.NewCloseFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", tmp))
+		return e
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		e := errs.NewRenameFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", path))
+		return e
+	}
+
+	fd, err := os.Open(dir)
+	if err != nil {
+		e := errs.NewOpenFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", dir))
+		return e
+	}
+	defer fd.Close()
+	err = fd.Sync()
+	if err != nil {
+		e := errs.NewSyncFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", dir))
+		return e
+	}
+
+	logs.Info("memory snapshot dumped", zap.String("path", path), zap.Uint64("count", count))
+	return nil
+}
+
+// loadSnapshot 加载快照文件，文件不存在时什么都不做，已经过期的 key 不加载
+// 加载的 key 共享同一个序列号，只在 Open 中调用，不需要加锁
+func (db *DB) loadSnapshot(path string) error {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		e := errs.NewReadFileErr().WithErr(err)
+		logs.Error(e.Error(), zap.String("path", path))
+		return e
+	}
+
+	if len(raw) < snapshotHeaderSize+snapshotCrcSize || binary.BigEndian.Uint64(raw) != snapshotMagic {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error(), zap.String("path", path), zap.Int("size", len(raw)))
+		return e
+	}
+	body := raw[:len(raw)-snapshotCrcSize]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(raw[len(body):]) {
+		e := errs.NewFileIntegrityErr()
+		logs.Error(e.Error(), zap.String("path", path))
+		return e
+	}
+
+	now := time.Now().UnixNano()
+	db.seq = 1
+	count := binary.BigEndian.Uint64(body[8:])
+	offset := snapshotHeaderSize
+	for i := uint64(0); i < count; i++ {
+		if len(body)-offset < snapshotEntrySize {
+			e := errs.NewCorruptErr()
+			logs.Error(e.Error(), zap.String("path", path), zap.Int("offset", offset))
+			return e
+		}
+		expireAt := int64(binary.BigEndian.Uint64(body[offset:]))
+		keyLen := int(binary.BigEndian.Uint32(body[offset+8:]))
+		valueLen := int(binary.BigEndian.Uint32(body[offset+12:]))
+		offset += snapshotEntrySize
+		if len(body)-offset < keyLen+valueLen {
+			e := errs.NewCorruptErr()
+			logs.Error(e.Error(), zap.String("path", path), zap.Int("offset", offset))
+			return e
+		}
+		key := string(body[offset : offset+keyLen])
+		value := copyValue(body[offset+keyLen : offset+keyLen+valueLen])
+		offset += keyLen + valueLen
+
+		e := &entry{key: key, value: value, expireAt: expireAt, seq: db.seq}
+		if e.isExpired(now) {
+			continue
+		}
+		s := db.shard(key)
+		s.items[key] = e
+		if expireAt != 0 {
+			s.expires[key] = struct{}{}
+		}
+	}
+
+	logs.Info("memory snapshot loaded", zap.String("path", path), zap.Uint64("count", count))
+	return nil
+}
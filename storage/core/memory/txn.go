@@ -0,0 +1,129 @@
+package memory
+
+import (
+	"sync/atomic"
+
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/memory/logs"
+)
+
+// Txn 乐观事务
+// 分片中每个 key 只保留当前版本，事务不读取快照，而是读取最新数据，并记录第一次读写每个 key 时 key 的序列号；
+// 提交时在涉及分片的写锁中检查这些 key 的序列号没有变化并且都不大于事务开始时的序列号，
+// 检查通过后全部写入原子地应用，否则返回 errs.NewTxnConflictErr。
+// 删除不保留墓碑，事务开始之后、第一次读写 key 之前 key 被删除的情况检查不到。
+// 不保证并发安全，同一个事务只能在一个协程中使用
+type Txn struct {
+	db       *DB
+	seq      uint64            // seq 事务开始时最后一次写入的序列号
+	observed map[string]uint64 // observed 第一次读写每个 key 时 key 的序列号，key 不存在时为0
+	writes   map[string]*Op    // writes 事务中每个 key 最后一次写入或删除
+	order    []string          // order 按第一次写入的顺序记录 writes 中的 key
+	finished bool
+}
+
+func newTxn(db *DB) *Txn {
+	return &Txn{
+		db:       db,
+		seq:      atomic.LoadUint64(&db.seq),
+		observed: make(map[string]uint64),
+		writes:   make(map[string]*Op),
+	}
+}
+
+// observe 第一次读写 key 时记录 key 当前的序列号，返回 key 当前可见的版本
+func (txn *Txn) observe(key string) (*entry, bool) {
+	e, ok := txn.db.get(key)
+	if _, exist := txn.observed[key]; !exist {
+		var seq uint64
+		if ok {
+			seq = e.seq
+		}
+		txn.observed[key] = seq
+	}
+	return e, ok
+}
+
+// Get 读取 key，优先读取事务中的写入
+func (txn *Txn) Get(key string) ([]byte, error) {
+	if txn.finished {
+		e := errs.NewTxnFinishedErr()
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	if op, exist := txn.writes[key]; exist {
+		if op.Type == consts.OperatorTypeDelete {
+			return nil, errs.NewNotFoundErr()
+		}
+		return op.Value, nil
+	}
+
+	// 读不到的 key 同样需要检查，保证提交时 key 仍然不存在
+	e, ok := txn.observe(key)
+	if !ok {
+		return nil, errs.NewNotFoundErr()
+	}
+	return copyValue(e.value), nil
+}
+
+// Set 在事务中写入 key，提交之前对其他读取不可见
+func (txn *Txn) Set(key string, value []byte) error {
+	return txn.write(NewOp(consts.OperatorTypeSet, key, value))
+}
+
+// Delete 在事务中删除 key，提交之前对其他读取不可见
+func (txn *Txn) Delete(key string) error {
+	return txn.write(NewOp(consts.OperatorTypeDelete, key, nil))
+}
+
+func (txn *Txn) write(op *Op) error {
+	if txn.finished {
+		e := errs.NewTxnFinishedErr()
+		logs.Error(e.Error())
+		return e
+	}
+
+	if _, exist := txn.writes[op.Key]; !exist {
+		txn.observe(op.Key)
+		txn.order = append(txn.order, op.Key)
+	}
+	txn.writes[op.Key] = op
+	return nil
+}
+
+// Commit 提交事务，读写过的 key 在事务开始之后被修改时返回 errs.NewTxnConflictErr
+// 事务读取的是最新数据，只读事务同样需要检查，保证读到的数据来自同一时刻。无论提交是否成功，事务都会结束
+func (txn *Txn) Commit() error {
+	if txn.finished {
+		e := errs.NewTxnFinishedErr()
+		logs.Error(e.Error())
+		return e
+	}
+	txn.finished = true
+
+	if len(txn.observed) == 0 {
+		return nil
+	}
+
+	ops := make([]*Op, 0, len(txn.observed)+len(txn.order))
+	for key, seq := range txn.observed {
+		op := NewOp(opTypeCheck, key, nil)
+		op.Seq = txn.seq
+		op.Observed = seq
+		ops = append(ops, op)
+	}
+	for _, key := range txn.order {
+		ops = append(ops, txn.writes[key])
+	}
+
+	_, err := txn.db.write(ops)
+	return err
+}
+
+// Rollback 放弃事务中的全部写入，事务已经结束时什么都不做
+func (txn *Txn) Rollback() error {
+	txn.finished = true
+	return nil
+}
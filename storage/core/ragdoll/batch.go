@@ -1,11 +1,34 @@
 package ragdoll
 
-import "github.com/Trinoooo/eggie_kv/consts"
+import (
+	"encoding/binary"
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
+	"go.uber.org/zap"
+)
+
+const (
+	// 字段长度，单位字节
+	batchOpCountSize  = 8
+	opTypeSize        = 8
+	opKeyLengthSize   = 8
+	opValueLengthSize = 8
+	opExpireAtSize    = 8
+	opHeaderSize      = opTypeSize + opKeyLengthSize + opValueLengthSize + opExpireAtSize
+)
+
+// opTypeCheck 事务提交时检查 key 在事务开始之后没有被修改
+// 只在消费协程中执行，不会写入 wal
+const opTypeCheck consts.OperatorType = -1
 
 type Op struct {
-	Type  consts.OperatorType
-	Key   string
-	Value []byte
+	Type     consts.OperatorType
+	Key      string
+	Value    []byte
+	ExpireAt int64  // ExpireAt 过期时间，unix 纳秒时间戳，0表示永不过期
+	Version  int64  // Version 只用于 opTypeCheck，事务开始时的版本号，不会序列化
+	Expected []byte // Expected 只用于 CompareAndSwap，期望的当前 value，不会序列化
 }
 
 func NewOp(t consts.OperatorType, key string, value []byte) *Op {
@@ -16,6 +39,32 @@ func NewOp(t consts.OperatorType, key string, value []byte) *Op {
 	}
 }
 
+// isWrite 判断 Op 是否会修改数据，只有会修改数据的 Op 需要写入 wal
+func (op *Op) isWrite() bool {
+	switch op.Type {
+	case consts.OperatorTypeSet, consts.OperatorTypeDelete:
+		return true
+	default:
+		return op.isReadWrite()
+	}
+}
+
+// isReadWrite 判断 Op 是否需要读取当前数据才能确定写入内容
+// 这类 Op 在消费协程中转换为 Set、Delete 之后再写入 wal
+func (op *Op) isReadWrite() bool {
+	switch op.Type {
+	case consts.OperatorTypePersist, consts.OperatorTypeCAS, consts.OperatorTypeSetNX, consts.OperatorTypeIncr, consts.OperatorTypeDecr:
+		return true
+	default:
+		return false
+	}
+}
+
+// isExpired 判断 Op 写入的数据在 now 时是否已经过期
+func (op *Op) isExpired(now int64) bool {
+	return op.ExpireAt != 0 && op.ExpireAt <= now
+}
+
 type Batch struct {
 	Ops []*Op
 }
@@ -30,6 +79,115 @@ func (b *Batch) AppendOps(ops ...*Op) {
 	b.Ops = append(b.Ops, ops...)
 }
 
+// writeOps 返回 Batch 中全部写操作
+func (b *Batch) writeOps() []*Op {
+	var ops []*Op
+	for _, op := range b.Ops {
+		if op.isWrite() {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// checkOps 返回 Batch 中全部需要在写入之前检查的条件
+func (b *Batch) checkOps() []*Op {
+	var ops []*Op
+	for _, op := range b.Ops {
+		if op.Type == opTypeCheck {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// needsRead 判断 Batch 中是否有需要读取当前数据才能确定写入内容的写操作，或者需要检查的条件
+func (b *Batch) needsRead() bool {
+	for _, op := range b.Ops {
+		if op.isReadWrite() || op.Type == opTypeCheck {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *Batch) Reset() {
 	b.Ops = b.Ops[:0]
 }
+
+// Encode 序列化 Batch，序列化结果作为一条日志写入 wal
+// 结构：| op 数量 8字节 | op #1 | op #2 | ... |
+// 单个 op 结构：| type 8字节 | key 长度 8字节 | value 长度 8字节 | 过期时间 8字节 | key | value |
+func (b *Batch) Encode() []byte {
+	length := batchOpCountSize
+	for _, op := range b.Ops {
+		length += opHeaderSize + len(op.Key) + len(op.Value)
+	}
+
+	// prof: 避免buf重分配
+	buf := make([]byte, length)
+	binary.BigEndian.PutUint64(buf, uint64(len(b.Ops)))
+	offset := batchOpCountSize
+	for _, op := range b.Ops {
+		binary.BigEndian.PutUint64(buf[offset:], uint64(op.Type))
+		binary.BigEndian.PutUint64(buf[offset+opTypeSize:], uint64(len(op.Key)))
+		binary.BigEndian.PutUint64(buf[offset+opTypeSize+opKeyLengthSize:], uint64(len(op.Value)))
+		binary.BigEndian.PutUint64(buf[offset+opTypeSize+opKeyLengthSize+opValueLengthSize:], uint64(op.ExpireAt))
+		offset += opHeaderSize
+		offset += copy(buf[offset:], op.Key)
+		offset += copy(buf[offset:], op.Value)
+	}
+	return buf
+}
+
+// DecodeBatch 反序列化 Batch，是 Batch.Encode 的逆过程
+func DecodeBatch(raw []byte) (*Batch, error) {
+	rawSize := uint64(len(raw))
+	if rawSize < batchOpCountSize {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	count := binary.BigEndian.Uint64(raw)
+	offset := uint64(batchOpCountSize)
+	// note：count 来自磁盘，按剩余数据最多能容纳的 op 数量校验之后再分配，避免损坏的日志导致超大分配
+	if count > (rawSize-offset)/opHeaderSize {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error(), zap.Uint64(consts.LogFieldValue, count))
+		return nil, e
+	}
+	batch := &Batch{
+		Ops: make([]*Op, 0, count),
+	}
+	for i := uint64(0); i < count; i++ {
+		if rawSize-offset < opHeaderSize {
+			e := errs.NewCorruptErr()
+			logs.Error(e.Error())
+			return nil, e
+		}
+
+		opType := consts.OperatorType(binary.BigEndian.Uint64(raw[offset:]))
+		keyLength := binary.BigEndian.Uint64(raw[offset+opTypeSize:])
+		valueLength := binary.BigEndian.Uint64(raw[offset+opTypeSize+opKeyLengthSize:])
+		expireAt := int64(binary.BigEndian.Uint64(raw[offset+opTypeSize+opKeyLengthSize+opValueLengthSize:]))
+		offset += opHeaderSize
+		if rawSize-offset < keyLength || rawSize-offset-keyLength < valueLength {
+			e := errs.NewCorruptErr()
+			logs.Error(e.Error())
+			return nil, e
+		}
+
+		key := string(raw[offset : offset+keyLength])
+		offset += keyLength
+		// note：拷贝一份 value，避免外部持有 raw 的引用
+		value := make([]byte, valueLength)
+		copy(value, raw[offset:offset+valueLength])
+		offset += valueLength
+		op := NewOp(opType, key, value)
+		op.ExpireAt = expireAt
+		batch.AppendOps(op)
+	}
+
+	return batch, nil
+}
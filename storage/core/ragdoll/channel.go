@@ -4,6 +4,7 @@ import (
 	"github.com/Trinoooo/eggie_kv/errs"
 	"github.com/Trinoooo/eggie_kv/utils"
 	"github.com/bytedance/gopkg/collection/lscq"
+	"runtime"
 	"unsafe"
 )
 
@@ -29,8 +30,11 @@ func NewChannel() *Channel {
 	}
 }
 
+// Produce 提交 batch，返回接收执行结果的管道
+// batch 中每个 op 都会对应一个 Result，按 op 顺序依次写入管道
 func (c *Channel) Produce(batch *Batch) chan *Result {
-	result := make(chan *Result)
+	// note：管道容量与 op 数量一致，避免消费者回传结果时阻塞
+	result := make(chan *Result, len(batch.Ops))
 	c.queue.Enqueue(unsafe.Pointer(&Task{
 		batch:  batch,
 		result: result,
@@ -39,8 +43,45 @@ func (c *Channel) Produce(batch *Batch) chan *Result {
 	return result
 }
 
+// Consume 消费一个 task，队列为空时阻塞等待
+// Channel 关闭且队列中的 task 全部消费完之后返回nil
 func (c *Channel) Consume() *Task {
-	c.notifier.Out()
+	if !c.notifier.Out() {
+		return nil
+	}
 	data, _ := c.queue.Dequeue()
 	return (*Task)(data)
 }
+
+// ConsumeBatch 消费至少一个、至多 max 个 task，队列为空时阻塞等待
+// 取到第一个 task 之后不再等待，只取出队列中已经就绪的 task
+// Channel 关闭且队列中的 task 全部消费完之后返回nil
+func (c *Channel) ConsumeBatch(max int) []*Task {
+	task := c.Consume()
+	if task == nil {
+		return nil
+	}
+
+	tasks := []*Task{task}
+	for len(tasks) < max {
+		got, open := c.notifier.TryOut()
+		if !open {
+			break
+		}
+		if !got {
+			// note：notifier 内部协程可能还没有把已经提交的 task 转移到输出管道，让出一次 cpu 再尝试
+			runtime.Gosched()
+			if got, open = c.notifier.TryOut(); !got || !open {
+				break
+			}
+		}
+		data, _ := c.queue.Dequeue()
+		tasks = append(tasks, (*Task)(data))
+	}
+	return tasks
+}
+
+// Close 关闭 Channel，关闭之后不能再调用 Produce
+func (c *Channel) Close() {
+	c.notifier.Close()
+}
@@ -1,50 +1,1056 @@
 package ragdoll
 
 import (
-	"crypto/md5"
+	"bufio"
 	"encoding/binary"
+	"errors"
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/bloom"
+	"github.com/Trinoooo/eggie_kv/storage/core/cache"
+	"github.com/Trinoooo/eggie_kv/storage/core/compress"
+	"github.com/Trinoooo/eggie_kv/storage/core/encrypt"
+	"github.com/Trinoooo/eggie_kv/storage/core/format"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
 	"github.com/Trinoooo/eggie_kv/utils"
+	"go.uber.org/zap"
+	"io"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+const (
+	// 字段长度，单位字节
+	recordCheckSumSize  = 16
+	recordFlagSize      = 1
+	recordExpireAtSize  = 8
+	recordKeySizeSize   = 8
+	recordValueSizeSize = 8
+	recordHeaderSize    = 41
+
+	// 字段偏移量，单位字节
+	recordFlagOffset      = 16
+	recordExpireAtOffset  = 17
+	recordKeySizeOffset   = 25
+	recordValueSizeOffset = 33
+	recordKeyOffset       = 41
+)
+
+const (
+	recordFlagTombstone uint8 = 1 << iota // recordFlagTombstone 墓碑 Record，表示 key 已经被删除
+
+	// flag 的第1、2位记录 value 的压缩算法，取值见 compress.Codec，为0表示没有压缩
+	// 没有压缩的旧数据这两位都是0，因此压缩和不压缩的 Record 可以混合存储在数据文件中
+	recordFlagCodecShift       = 1
+	recordFlagCodecMask  uint8 = 0x3 << recordFlagCodecShift
+
+	// recordFlagEncrypted key 以及压缩之后的 value 分别使用 AES-GCM 加密，密文中带有加密使用的密钥id，见 encrypt.Keyring.Seal
+	// 加密 value 时认证 flag、过期时间以及明文 key，篡改其中任何一个都会导致解密失败；
+	// 加密 key 时不认证其他字段，hint 文件中只记录 key 的密文也可以解密，key 被替换时读取 value 会解密失败
+	recordFlagEncrypted uint8 = 1 << 3
+)
+
+const (
+	dataFileSuffix      = ".data" // dataFileSuffix 数据文件的后缀标识
+	dataFileBaseFormat  = "%010d" // dataFileBaseFormat 数据文件名中数据文件id部分宽度
+	dataFileMagic       = "EGGIEDAT"
+	defaultDataFilePerm = 0660
+	defaultDataDirPerm  = 0770
+)
+
+// Record 数据文件中的一条记录
+// 存储在数据文件中的结构：| checksum 16字节 | flag 1字节 | 过期时间 8字节 | key 长度 8字节 | value 长度 8字节 | key | value |
+// checksum 使用所在数据文件的文件头中记录的算法，新构造的 Record 总是使用 CRC32C，见 format.Checksum
+// value 压缩、加密时 ValueSize、Value 都是处理之后的数据；key 加密时 KeySize 是密文的长度，Key 始终是明文，
+// 打开加密的数据文件时需要 keyring 解密 key 才能重建 keydir
 type Record struct {
-	CheckSum [16]byte
-	Size     uint64
-	Key      string
-	Value    []byte
+	CheckSum  [format.SumSize]byte
+	Flag      uint8
+	ExpireAt  int64 // ExpireAt 过期时间，unix 纳秒时间戳，0表示永不过期
+	KeySize   uint64
+	ValueSize uint64
+	Key       string
+	Value     []byte
+	sealedKey []byte // sealedKey 加密的 Record 在数据文件中存储的 key 密文，没有加密时为nil
+}
+
+func NewRecord(key string, value []byte, expireAt int64) *Record {
+	return newSealedRecord(key, value, expireAt, nil, nil)
+}
+
+// newSealedRecord 构造 Record，value 依次经过压缩、加密，compressor、keyring 为nil时分别不压缩、不加密
+func newSealedRecord(key string, value []byte, expireAt int64, compressor *compress.Compressor, keyring *encrypt.Keyring) *Record {
+	value, codec := compressor.Compress(value)
+	return newFlaggedRecord(key, value, expireAt, uint8(codec)<<recordFlagCodecShift, keyring)
+}
+
+// newFlaggedRecord 构造 Record，value 已经按 flag 中的压缩算法压缩，keyring 不为nil时加密 key 以及 value
+func newFlaggedRecord(key string, value []byte, expireAt int64, flag uint8, keyring *encrypt.Keyring) *Record {
+	flag &^= recordFlagEncrypted
+	if keyring != nil {
+		flag |= recordFlagEncrypted
+		value = keyring.Seal(value, recordAAD(key, expireAt, flag))
+	}
+	r := &Record{
+		Flag:      flag,
+		ExpireAt:  expireAt,
+		ValueSize: uint64(len(value)),
+		Key:       key,
+		Value:     value,
+	}
+	r.sealKey(keyring)
+	r.sign()
+	return r
 }
 
-func NewRecord(key string, value []byte) *Record {
+// NewTombstone 构造 key 的墓碑 Record
+func NewTombstone(key string) *Record {
+	return newSealedTombstone(key, nil)
+}
+
+// newSealedTombstone 构造 key 的墓碑 Record，keyring 不为nil时加密 key
+func newSealedTombstone(key string, keyring *encrypt.Keyring) *Record {
 	r := &Record{
-		Size:  uint64(len(append([]byte(key), value...))),
-		Key:   key,
-		Value: value,
+		Flag: recordFlagTombstone,
+		Key:  key,
+	}
+	if keyring != nil {
+		r.Flag |= recordFlagEncrypted
 	}
-	r.CheckSum = r.signature()
+	r.sealKey(keyring)
+	r.sign()
 	return r
 }
 
-func (r *Record) signature() [16]byte {
-	buffer := make([]byte, 8)
-	binary.BigEndian.PutUint64(buffer, r.Size)
-	return md5.Sum(append(append(buffer, []byte(r.Key)...), r.Value...))
+// sealKey 按 keyring 加密 key 并更新 KeySize，keyring 为nil时 key 保持明文
+func (r *Record) sealKey(keyring *encrypt.Keyring) {
+	r.sealedKey = nil
+	r.KeySize = uint64(len(r.Key))
+	if keyring != nil {
+		r.sealedKey = keyring.Seal([]byte(r.Key), nil)
+		r.KeySize = uint64(len(r.sealedKey))
+	}
+}
+
+// openKey 解密数据文件中存储的 key 密文
+//
+// 异常：
+//   - errs.NewKeyNotFoundErr key 加密使用的密钥不在 keyring 中
+//   - errs.NewFileIntegrityErr key 被篡改
+func (r *Record) openKey(sealed []byte, keyring *encrypt.Keyring) error {
+	if keyring == nil {
+		e := errs.NewKeyNotFoundErr()
+		logs.Error(e.Error())
+		return e
+	}
+	key, err := keyring.Open(sealed, nil)
+	if err != nil {
+		logs.Error(err.Error())
+		return err
+	}
+	r.Key = string(key)
+	r.sealedKey = sealed
+	return nil
+}
+
+// storedKey 返回数据文件中存储的 key，加密的 Record 是 key 的密文
+func (r *Record) storedKey() []byte {
+	if r.sealedKey != nil {
+		return r.sealedKey
+	}
+	return []byte(r.Key)
+}
+
+// sign 使用当前格式的校验和算法重新计算 checksum
+func (r *Record) sign() {
+	format.CRC32C.Sum(r.CheckSum[:], r.encode()[recordFlagOffset:])
+}
+
+// isTombstone 判断是否是墓碑 Record
+func (r *Record) isTombstone() bool {
+	return r.Flag&recordFlagTombstone != 0
+}
+
+// codec 返回 value 的压缩算法
+func (r *Record) codec() compress.Codec {
+	return compress.Codec((r.Flag & recordFlagCodecMask) >> recordFlagCodecShift)
+}
+
+// isEncrypted 判断 value 是否加密
+func (r *Record) isEncrypted() bool {
+	return r.Flag&recordFlagEncrypted != 0
+}
+
+// value 返回解密、解压之后的 value
+//
+// 异常：
+//   - errs.NewKeyNotFoundErr value 加密使用的密钥不在 keyring 中
+//   - errs.NewFileIntegrityErr value 或者认证的字段被篡改
+//   - errs.NewCorruptErr value 无法解压
+func (r *Record) value(keyring *encrypt.Keyring) ([]byte, error) {
+	value, err := r.decrypt(keyring)
+	if err != nil {
+		return nil, err
+	}
+	return compress.Decompress(r.codec(), value)
+}
+
+// decrypt 返回解密之后的 value，value 仍然是压缩之后的
+func (r *Record) decrypt(keyring *encrypt.Keyring) ([]byte, error) {
+	if !r.isEncrypted() {
+		return r.Value, nil
+	}
+	if keyring == nil {
+		return nil, errs.NewKeyNotFoundErr()
+	}
+	return keyring.Open(r.Value, recordAAD(r.Key, r.ExpireAt, r.Flag))
+}
+
+// recordAAD 加密 value 时认证的附加数据：| flag 1字节 | 过期时间 8字节 | key |
+func recordAAD(key string, expireAt int64, flag uint8) []byte {
+	aad := make([]byte, recordFlagSize+recordExpireAtSize, recordFlagSize+recordExpireAtSize+len(key))
+	aad[0] = flag
+	binary.BigEndian.PutUint64(aad[recordFlagSize:], uint64(expireAt))
+	return append(aad, key...)
+}
+
+// isExpired 判断 Record 在 now 时是否已经过期
+func (r *Record) isExpired(now int64) bool {
+	return r.ExpireAt != 0 && r.ExpireAt <= now
+}
+
+// size 返回 Record 序列化后的长度
+func (r *Record) size() int64 {
+	return int64(recordHeaderSize + r.KeySize + r.ValueSize)
+}
+
+// encode 序列化 Record
+func (r *Record) encode() []byte {
+	// prof: 避免buf重分配
+	buf := make([]byte, r.size())
+	copy(buf, r.CheckSum[:])
+	buf[recordFlagOffset] = r.Flag
+	binary.BigEndian.PutUint64(buf[recordExpireAtOffset:], uint64(r.ExpireAt))
+	binary.BigEndian.PutUint64(buf[recordKeySizeOffset:], r.KeySize)
+	binary.BigEndian.PutUint64(buf[recordValueSizeOffset:], r.ValueSize)
+	copy(buf[recordKeyOffset:], r.storedKey())
+	copy(buf[recordKeyOffset+r.KeySize:], r.Value)
+	return buf
+}
+
+// decodeRecord 反序列化 Record 并校验完整性，checksum 是 Record 所在数据文件使用的校验和算法
+// 加密的 Record 使用 keyring 解密 key，value 仍然是加密的，见 Record.value
+func decodeRecord(raw []byte, checksum format.Checksum, keyring *encrypt.Keyring) (*Record, error) {
+	rawSize := uint64(len(raw))
+	if rawSize < recordHeaderSize {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	r := &Record{
+		Flag:      raw[recordFlagOffset],
+		ExpireAt:  int64(binary.BigEndian.Uint64(raw[recordExpireAtOffset:])),
+		KeySize:   binary.BigEndian.Uint64(raw[recordKeySizeOffset:]),
+		ValueSize: binary.BigEndian.Uint64(raw[recordValueSizeOffset:]),
+	}
+	copy(r.CheckSum[:], raw[:recordCheckSumSize])
+	if rawSize-recordHeaderSize < r.KeySize || rawSize-recordHeaderSize-r.KeySize < r.ValueSize {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	size := recordHeaderSize + r.KeySize + r.ValueSize
+	if !checksum.Verify(r.CheckSum[:], raw[recordFlagOffset:size]) {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	r.Value = raw[recordKeyOffset+r.KeySize : size]
+	if r.isEncrypted() {
+		err := r.openKey(raw[recordKeyOffset:recordKeyOffset+r.KeySize], keyring)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	r.Key = string(raw[recordKeyOffset : recordKeyOffset+r.KeySize])
+	return r, nil
+}
+
+// Entry keydir 中的一项，描述 key 对应的最新 Record 在数据文件中的位置
+// 快照的历史版本中同样使用 Entry 描述 key 在某个版本的 Record 位置
+type Entry struct {
+	FileID   int64 // FileID 数据文件id
+	Offset   int64 // Offset Record 在数据文件中的起始偏移量
+	Size     int64 // Size Record 序列化后的长度
+	ExpireAt int64 // ExpireAt 过期时间，unix 纳秒时间戳，0表示永不过期
+	Version  int64 // Version 写入时的版本号，打开数据文件时加载的 Record 版本号为0
+	Deleted  bool  // Deleted 只出现在历史版本中，表示 key 从 Version 开始被删除
+}
+
+// samePosition 判断两个 Entry 是否指向同一条 Record
+func (e *Entry) samePosition(other *Entry) bool {
+	return e.FileID == other.FileID && e.Offset == other.Offset && e.Size == other.Size
+}
+
+// isExpired 判断 key 在 now 时是否已经过期
+func (e *Entry) isExpired(now int64) bool {
+	return e.ExpireAt != 0 && e.ExpireAt <= now
+}
+
+// dataFile 单个数据文件
+// 数据文件以 format.Header 开头，没有文件头的旧格式数据文件直接从第一条 Record 开始，使用 MD5 校验
+type dataFile struct {
+	id       int64           // id 数据文件id，新的数据文件id更大
+	fd       *os.File        // fd 数据文件描述符
+	size     int64           // size 数据文件当前大小
+	dead     int64           // dead 数据文件中已经失效（被覆盖、删除以及墓碑本身）的 Record 总长度
+	base     int64           // base 第一条 Record 的偏移量，即文件头的长度
+	checksum format.Checksum // checksum 数据文件中 Record 使用的校验和算法
+	filter   *bloom.Filter   // filter 数据文件中全部 key 的布隆过滤器，只有 merge 生成的数据文件才有，为nil时不过滤
+}
+
+// isEmpty 判断数据文件中是否没有 Record
+func (df *dataFile) isEmpty() bool {
+	return df.size == df.base
 }
 
 // Data 磁盘中的数据文件
+// 数据文件只追加写入，内存中只维护每个 key 最新 Record 的位置（keydir），
+// 读取时通过 pread 从数据文件中读出 Record。
+// 后台 merge 会与读写并发执行，对外暴露的方法通过内部加锁保证并发安全
 type Data struct {
-	Fd  *os.File
-	Mem map[string]*Record
+	mu       sync.RWMutex
+	mergeMu  sync.Mutex          // mergeMu 保证同一时间只有一个 merge 在执行
+	dirPath  string              // dirPath 数据文件目录
+	capacity int64               // capacity 单个数据文件的最大容量
+	files    map[int64]*dataFile // files 全部数据文件，包含 active
+	active   *dataFile           // active 当前追加写入的数据文件
+	Mem      map[string]*Entry   // Mem keydir，key 到最新 Record 位置的映射
+	Index    *Index              // Index 有序索引，包含 Mem 以及 history 中的全部 key，用于范围查询
+	expires  map[string]struct{} // expires 设置了过期时间的 key，用于主动过期时采样
+
+	version   int64               // version 最后应用的写操作版本号
+	history   map[string][]*Entry // history 仍然可能被快照读到的历史版本，按版本号从小到大排列
+	snapshots map[int64]int       // snapshots 未释放的快照版本号以及引用计数
+
+	cache      *cache.Cache         // cache 最新版本 value 的缓存，为nil时不缓存
+	compressor *compress.Compressor // compressor 写入时压缩 value，为nil时不压缩
+	keyring    *encrypt.Keyring     // keyring 写入时加密 key 以及 value，为nil时不加密；旧密钥用于读取轮换之前写入的 Record
+	bloomFPR   float64              // bloomFPR merge 时为新数据文件构建的布隆过滤器的误判率
+
+	applyHook func(ops []*Op) // applyHook 只用于测试，ApplyGroup 持有锁应用每个 task 之前调用
+}
+
+// NewData 打开数据文件目录，扫描全部数据文件重建 keydir
+//
+// 参数：
+//   - dirPath 数据文件目录，不存在时会创建
+//   - capacity 单个数据文件的最大容量，写满之后会新开一个数据文件
+func NewData(dirPath string, capacity int64) (*Data, error) {
+	return newData(dirPath, capacity, nil)
+}
+
+// newData 与 NewData 相同，keyring 在重建 keydir 时解密数据文件以及 hint 文件中加密的 key，为nil时不加密
+//
+// 异常：
+//   - errs.NewKeyNotFoundErr 数据文件中的 Record 加密使用的密钥不在 keyring 中
+func newData(dirPath string, capacity int64, keyring *encrypt.Keyring) (*Data, error) {
+	if capacity <= format.HeaderSize+recordHeaderSize {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "capacity"), zap.Int64(consts.LogFieldValue, capacity))
+		return nil, e
+	}
+
+	err := os.MkdirAll(dirPath, defaultDataDirPerm)
+	if err != nil {
+		e := errs.NewMkdirErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	d := &Data{
+		dirPath:  dirPath,
+		capacity: capacity,
+		files:    make(map[int64]*dataFile),
+		Mem:      make(map[string]*Entry),
+		Index:    NewIndex(),
+		expires:  make(map[string]struct{}),
+
+		history:   make(map[string][]*Entry),
+		snapshots: make(map[int64]int),
+
+		keyring:  keyring,
+		bloomFPR: defaultBloomFalsePositiveRate,
+	}
+
+	// 上次 merge 生成的数据文件可能还没有替换完成
+	err = d.finishMerge()
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := d.listFileIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	// 首次启动目录下没有数据文件
+	if len(ids) == 0 {
+		ids = append(ids, 0)
+	}
+
+	for i, id := range ids {
+		df, err := d.openFile(id)
+		if err != nil {
+			_ = d.Close()
+			return nil, err
+		}
+		d.files[id] = df
+
+		// merge 生成的数据文件旁边有 hint 文件，可以跳过扫描整个数据文件
+		isLast := i == len(ids)-1
+		if !isLast {
+			d.loadFilter(df)
+			if d.loadHint(df) {
+				continue
+			}
+		}
+
+		// 只有最后一个数据文件可能存在写到一半的 Record
+		err = d.loadFile(df, isLast)
+		if err != nil {
+			_ = d.Close()
+			return nil, err
+		}
+	}
+	d.active = d.files[ids[len(ids)-1]]
+
+	// 旧格式的数据文件只读，新的 Record 写入当前格式的数据文件
+	if d.active.checksum != format.CRC32C {
+		err = d.rotate()
+		if err != nil {
+			_ = d.Close()
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// listFileIDs 获取目录下全部数据文件id，按从小到大排序
+func (d *Data) listFileIDs() ([]int64, error) {
+	entries, err := os.ReadDir(d.dirPath)
+	if err != nil {
+		e := errs.NewWalkDirErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	var ids []int64
+	for _, entry := range entries {
+		base, ok := strings.CutSuffix(entry.Name(), dataFileSuffix)
+		// 其他文件与目录我们认为是预期之外的，有则忽略
+		if entry.IsDir() || !ok {
+			continue
+		}
+
+		id, err := strconv.ParseInt(base, 10, 64)
+		if err != nil {
+			e := errs.NewParseIntErr().WithErr(err)
+			logs.Error(e.Error())
+			return nil, e
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
+
+// openFile 打开指定id的数据文件，不存在时创建
+// 新建的数据文件以及空的数据文件会写入当前格式的文件头
+//
+// 异常：
+//   - errs.NewUnsupportedFormatErr 数据文件的格式版本比当前版本新
+func (d *Data) openFile(id int64) (*dataFile, error) {
+	fd, err := utils.CheckAndCreateFile(d.filePath(id), syscall.O_APPEND|syscall.O_CREAT|syscall.O_RDWR, defaultDataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	df, err := loadDataFile(id, fd)
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return df, nil
+}
+
+// loadDataFile 解析数据文件的文件头
+func loadDataFile(id int64, fd *os.File) (*dataFile, error) {
+	stat, err := fd.Stat()
+	if err != nil {
+		e := errs.NewFileStatErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	df := &dataFile{
+		id:   id,
+		fd:   fd,
+		size: stat.Size(),
+	}
+	raw := make([]byte, format.HeaderSize)
+	n, err := fd.ReadAt(raw, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		e := errs.NewReadFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+	raw = raw[:n]
+
+	header, err := format.ParseHeader(raw, dataFileMagic)
+	if err != nil {
+		logs.Error(err.Error(), zap.String("path", fd.Name()))
+		return nil, err
+	}
+	if header != nil {
+		df.base = format.HeaderSize
+		df.checksum = header.Checksum
+		return df, nil
+	}
+
+	// 新建数据文件写文件头时宕机，文件中只有一部分文件头，按空文件处理
+	if format.IsTornHeader(raw, dataFileMagic) {
+		logs.Warn("drop torn data file header", zap.String("path", fd.Name()), zap.Int64("size", df.size))
+		err = fd.Truncate(0)
+		if err != nil {
+			e := errs.NewTruncateFileErr().WithErr(err)
+			logs.Error(e.Error())
+			return nil, e
+		}
+		df.size = 0
+	}
+
+	if df.size > 0 {
+		df.checksum = format.MD5
+		return df, nil
+	}
+
+	_, err = fd.Write(format.NewHeader(dataFileMagic).Encode())
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+	df.size = format.HeaderSize
+	df.base = format.HeaderSize
+	df.checksum = format.CRC32C
+	return df, nil
+}
+
+// filePath 数据文件id转数据文件路径
+func (d *Data) filePath(id int64) string {
+	return dataPath(d.dirPath, id)
+}
+
+// loadFile 顺序扫描数据文件，用其中的 Record 更新 keydir
+// tolerateTornTail 为true时丢弃文件末尾写到一半的 Record
+func (d *Data) loadFile(df *dataFile, tolerateTornTail bool) error {
+	now := time.Now().UnixNano()
+	reader := bufio.NewReader(io.NewSectionReader(df.fd, df.base, df.size-df.base))
+	offset := df.base
+	for offset < df.size {
+		record, size, err := readRecord(reader, df.checksum, d.keyring)
+		if err != nil {
+			// 剩余数据不足一条完整的 Record，或者剩余数据恰好是一条损坏的 Record 时认为是末尾写到一半
+			isTornTail := errs.GetCode(err) == errs.CorruptErrCode && offset+size >= df.size
+			if !tolerateTornTail || !isTornTail {
+				return err
+			}
+
+			logs.Warn("drop torn tail record", zap.String("path", df.fd.Name()), zap.Int64("offset", offset), zap.Int64("size", df.size-offset))
+			err = df.fd.Truncate(offset)
+			if err != nil {
+				e := errs.NewTruncateFileErr().WithErr(err)
+				logs.Error(e.Error())
+				return e
+			}
+			df.size = offset
+			return nil
+		}
+
+		// 已经过期的 Record 与墓碑一样需要屏蔽更早的 Record
+		if record.isTombstone() || record.isExpired(now) {
+			d.removeEntry(record.Key, df, record.size(), 0)
+		} else {
+			d.setEntry(record.Key, &Entry{
+				FileID:   df.id,
+				Offset:   offset,
+				Size:     record.size(),
+				ExpireAt: record.ExpireAt,
+			})
+		}
+		offset += record.size()
+	}
+
+	return nil
+}
+
+// setEntry 更新 keydir，被覆盖的 Record 计入所在数据文件的失效数据
+// 存在快照时被覆盖的版本保存到 history 中
+func (d *Data) setEntry(key string, entry *Entry) {
+	if old, exist := d.Mem[key]; exist {
+		if df, exist := d.files[old.FileID]; exist {
+			df.dead += old.Size
+		}
+		d.keepVersion(key, old)
+	} else {
+		d.Index.Insert(key)
+	}
+	d.Mem[key] = entry
+
+	if entry.ExpireAt != 0 {
+		d.expires[key] = struct{}{}
+	} else {
+		delete(d.expires, key)
+	}
+}
+
+// removeEntry 从 keydir 中删除 key，被删除的 Record 以及墓碑本身都计入失效数据
+// 墓碑只用于在重启时屏蔽更早的 Record，merge 会将更早的数据文件一并压缩，因此墓碑不需要保留
+func (d *Data) removeEntry(key string, tombstoneFile *dataFile, tombstoneSize int64, version int64) {
+	if old, exist := d.Mem[key]; exist {
+		if df, exist := d.files[old.FileID]; exist {
+			df.dead += old.Size
+		}
+		d.dropEntry(key, old, version)
+	}
+	tombstoneFile.dead += tombstoneSize
+}
+
+// dropEntry 从 keydir 中删除 key，存在快照时保存被删除的版本，并记录 key 从 version 开始被删除
+// 只有 history 中也没有 key 时才从有序索引中删除
+func (d *Data) dropEntry(key string, old *Entry, version int64) {
+	d.keepVersion(key, old)
+	d.markDeleted(key, version)
+	delete(d.Mem, key)
+	delete(d.expires, key)
+	if d.cache != nil {
+		d.cache.Remove(key)
+	}
+	if _, exist := d.history[key]; !exist {
+		d.Index.Delete(key)
+	}
+}
+
+// readRecord 从 reader 中读取一条完整的 Record，checksum 是数据文件使用的校验和算法，keyring 用于解密 key
+// 额外返回 Record header 中声明的 Record 长度，header 不完整时是0
+func readRecord(reader io.Reader, checksum format.Checksum, keyring *encrypt.Keyring) (*Record, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		e := errs.NewCorruptErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, 0, e
+	} else if err != nil {
+		e := errs.NewReadFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, 0, e
+	}
+
+	keySize := binary.BigEndian.Uint64(header[recordKeySizeOffset:])
+	valueSize := binary.BigEndian.Uint64(header[recordValueSizeOffset:])
+	// note：长度字段可能已经损坏，避免按损坏的长度申请过大的内存
+	if keySize > consts.GB || valueSize > consts.GB {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error())
+		return nil, 0, e
+	}
+
+	size := int64(recordHeaderSize + keySize + valueSize)
+	raw := make([]byte, size)
+	copy(raw, header)
+	_, err = io.ReadFull(reader, raw[recordHeaderSize:])
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		e := errs.NewCorruptErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, size, e
+	} else if err != nil {
+		e := errs.NewReadFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, size, e
+	}
+
+	record, err := decodeRecord(raw, checksum, keyring)
+	return record, size, err
+}
+
+// Put 追加写入一条 Record，并更新 keydir
+// 写入的数据不会立刻持久化，需要调用 Sync
+func (d *Data) Put(key string, value []byte) error {
+	return d.Apply(0, []*Op{NewOp(consts.OperatorTypeSet, key, value)})
+}
+
+// PutWithExpire 追加写入一条带过期时间的 Record，expireAt 是 unix 纳秒时间戳
+func (d *Data) PutWithExpire(key string, value []byte, expireAt int64) error {
+	op := NewOp(consts.OperatorTypeSet, key, value)
+	op.ExpireAt = expireAt
+	return d.Apply(0, []*Op{op})
+}
+
+// Delete 追加写入一条墓碑 Record，并从 keydir 中删除 key
+// key 不存在时不写入墓碑，直接返回
+func (d *Data) Delete(key string) error {
+	return d.Apply(0, []*Op{NewOp(consts.OperatorTypeDelete, key, nil)})
+}
+
+// Validate 检查一组写操作能否写入同一个数据文件
+// 调用方在写入 wal 之前检查，避免 wal 中出现无法应用的日志
+// 按压缩前的 value 长度估算，压缩之后只会更小，加密时 key、value 都额外加上密钥id、随机数以及认证标签的长度
+// 新数据文件开头有文件头，可用容量需要减去文件头的长度
+func (d *Data) Validate(ops []*Op) error {
+	var overhead int64
+	if d.keyring != nil {
+		overhead = encrypt.KeyIDSize + encrypt.Overhead
+	}
+
+	var size int64
+	for _, op := range ops {
+		switch op.Type {
+		case consts.OperatorTypeSet:
+			size += recordHeaderSize + int64(len(op.Key)) + int64(len(op.Value)) + 2*overhead
+		case consts.OperatorTypeDelete:
+			size += recordHeaderSize + int64(len(op.Key)) + overhead
+		default:
+			e := errs.NewUnsupportedOperatorTypeErr()
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "opType"), zap.Int64(consts.LogFieldValue, int64(op.Type)))
+			return e
+		}
+	}
+
+	if size > d.capacity-format.HeaderSize {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "size"), zap.Int64(consts.LogFieldValue, size))
+		return e
+	}
+	return nil
+}
+
+// Apply 原子地应用一组写操作
+// 全部 Record 通过一次写入追加到同一个数据文件，写入成功后才更新 keydir；
+// 写入失败时截断已经写入的部分，keydir 保持不变。
+// 已经过期的写入等同于删除，回放 wal 时已经过期的 key 不会恢复。
+// version 是这组写操作的版本号，由调用方保证递增，为0时使用当前版本号加一
+func (d *Data) Apply(version int64, ops []*Op) error {
+	return d.ApplyGroup(version, [][]*Op{ops})[0]
+}
+
+// ApplyGroup 在一次加锁中依次应用组提交中每个任务的写操作，每个任务的写操作与 Apply 一样原子地应用，
+// 全部应用之后才更新当前版本号。快照以及事务冲突检查都需要加锁，
+// 因此同一组提交的写操作要么全部可见，要么全部不可见。
+// 返回每个任务的错误，某个任务应用失败不影响其他任务
+func (d *Data) ApplyGroup(version int64, groups [][]*Op) []error {
+	results := make([]error, len(groups))
+	for i, ops := range groups {
+		results[i] = d.Validate(ops)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if version == 0 {
+		version = d.version + 1
+	}
+	for i, ops := range groups {
+		if d.applyHook != nil {
+			d.applyHook(ops)
+		}
+		if results[i] == nil {
+			results[i] = d.apply(version, ops)
+		}
+	}
+	if version > d.version {
+		d.version = version
+	}
+	return results
+}
+
+// apply 应用一组写操作，调用方需要持有锁并在应用之后更新版本号
+func (d *Data) apply(version int64, ops []*Op) error {
+	// 删除不存在的 key 不需要写入墓碑，需要考虑同一组写操作中前面的写入
+	written := make(map[string]bool, len(ops))
+	records := make([]*Record, 0, len(ops))
+	var size int64
+	now := time.Now().UnixNano()
+	for _, op := range ops {
+		var record *Record
+		if op.Type == consts.OperatorTypeDelete || op.isExpired(now) {
+			if _, exist := d.Mem[op.Key]; !exist && !written[op.Key] {
+				continue
+			}
+			record = newSealedTombstone(op.Key, d.keyring)
+			written[op.Key] = false
+		} else {
+			record = newSealedRecord(op.Key, op.Value, op.ExpireAt, d.compressor, d.keyring)
+			written[op.Key] = true
+		}
+		records = append(records, record)
+		size += record.size()
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	if d.active.size+size > d.capacity {
+		err := d.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 0, size)
+	for _, record := range records {
+		buf = append(buf, record.encode()...)
+	}
+	_, err := d.active.fd.Write(buf)
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error())
+		if te := d.active.fd.Truncate(d.active.size); te != nil {
+			logs.Error(errs.NewTruncateFileErr().WithErr(te).Error())
+		}
+		return e
+	}
+
+	offset := d.active.size
+	for _, record := range records {
+		if record.isTombstone() {
+			d.removeEntry(record.Key, d.active, record.size(), version)
+		} else {
+			d.setEntry(record.Key, &Entry{
+				FileID:   d.active.id,
+				Offset:   offset,
+				Size:     record.size(),
+				ExpireAt: record.ExpireAt,
+				Version:  version,
+			})
+		}
+		offset += record.size()
+	}
+	d.active.size = offset
+	return nil
+}
+
+// Get 通过 keydir 定位 Record，从数据文件中读取 value
+func (d *Data) Get(key string) ([]byte, error) {
+	return d.getAt(key, latestVersion)
 }
 
-func NewData(path string) (*Data, error) {
-	fd, err := utils.CheckAndCreateFile(path, syscall.O_APPEND|syscall.O_CREAT|syscall.O_RDWR, 0660)
+// getAt 读取 key 在 version 时的 value，version 为 latestVersion 时读取最新版本
+func (d *Data) getAt(key string, version int64) ([]byte, error) {
+	record, err := d.getRecord(key, version)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// getRecord 读取 key 在 version 时的 Record
+func (d *Data) getRecord(key string, version int64) (*Record, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	// 惰性过期：已经过期但还没有被主动清理的 key 同样视为不存在
+	entry, exist := d.lookup(key, version)
+	if !exist || entry.isExpired(time.Now().UnixNano()) {
+		return nil, errs.NewNotFoundErr()
+	}
+
+	// 只缓存最新版本，Entry 在写入、删除以及 merge 时都会替换为新的对象，
+	// 以 Entry 作为缓存的 tag，缓存中的旧版本不会被读到
+	cacheable := d.cache != nil && d.Mem[key] == entry
+	if cacheable {
+		if value, ok := d.cache.Get(key, entry); ok {
+			return &Record{Key: key, Value: value, ExpireAt: entry.ExpireAt}, nil
+		}
+	}
+
+	df, exist := d.files[entry.FileID]
+	if !exist {
+		e := errs.NewNotFoundErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "fileID"), zap.Int64(consts.LogFieldValue, entry.FileID))
+		return nil, e
+	}
+
+	// keydir 与数据文件不一致时，布隆过滤器判断 key 不在数据文件中，不需要读取数据文件
+	if df.filter != nil && !df.filter.MayContain([]byte(key)) {
+		e := errs.NewNotFoundErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "fileID"), zap.Int64(consts.LogFieldValue, entry.FileID))
+		return nil, e
+	}
+
+	raw := make([]byte, entry.Size)
+	_, err := df.fd.ReadAt(raw, entry.Offset)
+	if err != nil {
+		e := errs.NewReadFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	record, err := decodeRecord(raw, df.checksum, d.keyring)
 	if err != nil {
 		return nil, err
 	}
+	// 缓存中保存解密、解压之后的 value，命中缓存时不需要再次处理
+	record.Value, err = record.value(d.keyring)
+	if err != nil {
+		logs.Error(err.Error(), zap.String(consts.LogFieldParams, "flag"), zap.Uint8(consts.LogFieldValue, record.Flag))
+		return nil, err
+	}
+	if cacheable {
+		d.cache.Set(key, record.Value, entry)
+	}
+	return record, nil
+}
+
+// TTL 返回 key 的剩余存活时间，没有设置过期时间时返回 iface.NoTTL
+func (d *Data) TTL(key string) (time.Duration, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	return &Data{
-		Fd:  fd,
-		Mem: make(map[string]*Record),
-	}, nil
+	now := time.Now().UnixNano()
+	entry, exist := d.Mem[key]
+	if !exist || entry.isExpired(now) {
+		return 0, errs.NewNotFoundErr()
+	}
+	if entry.ExpireAt == 0 {
+		return iface.NoTTL, nil
+	}
+	return time.Duration(entry.ExpireAt - now), nil
+}
+
+// visible 判断 key 在 version 时是否存在并且没有过期
+func (d *Data) visible(key string, version int64) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	entry, exist := d.lookup(key, version)
+	return exist && !entry.isExpired(time.Now().UnixNano())
+}
+
+// SweepExpired 主动过期：随机采样至多 sample 个设置了过期时间的 key，从 keydir 中删除其中已经过期的 key
+// 过期时间持久化在 Record 中，重启时会再次判断，因此不需要写入墓碑。返回采样数量以及删除数量
+func (d *Data) SweepExpired(sample int) (int, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	var sampled, expired int
+	// note：map 遍历的起点是随机的，近似随机采样
+	for key := range d.expires {
+		if sampled >= sample {
+			break
+		}
+		sampled++
+
+		entry := d.Mem[key]
+		if entry.isExpired(now) {
+			if df, exist := d.files[entry.FileID]; exist {
+				df.dead += entry.Size
+			}
+			// 过期不对应写操作，从过期的版本开始删除，快照读到该版本时同样视为过期
+			d.dropEntry(key, entry, entry.Version)
+			expired++
+		}
+	}
+	return sampled, expired
+}
+
+// seekIndex 加读锁在有序索引中查找 key
+func (d *Data) seekIndex(fn func(index *Index) (string, bool)) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return fn(d.Index)
+}
+
+// rotate 持久化当前 active 数据文件，并新开一个数据文件作为 active
+func (d *Data) rotate() error {
+	err := d.sync()
+	if err != nil {
+		return err
+	}
+
+	df, err := d.openFile(d.active.id + 1)
+	if err != nil {
+		return err
+	}
+	d.files[df.id] = df
+	d.active = df
+	return nil
+}
+
+// Sync 持久化 active 数据文件
+// 只有 active 数据文件会写入，其他数据文件在 rotate 时已经持久化
+func (d *Data) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.sync()
+}
+
+// sync 持久化 active 数据文件，调用方需要持有写锁
+func (d *Data) sync() error {
+	err := d.active.fd.Sync()
+	if err != nil {
+		e := errs.NewSyncFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+	return nil
+}
+
+// Close 持久化并关闭全部数据文件
+func (d *Data) Close() error {
+	// 等待正在执行的 merge 结束
+	d.mergeMu.Lock()
+	defer d.mergeMu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// 持久化失败时仍然关闭全部数据文件，返回第一个错误
+	var err error
+	if d.active != nil {
+		err = d.sync()
+	}
+
+	for _, df := range d.files {
+		if e := df.fd.Close(); e != nil {
+			e := errs.NewCloseFileErr().WithErr(e)
+			logs.Error(e.Error())
+			if err == nil {
+				err = e
+			}
+		}
+	}
+
+	d.files = nil
+	d.active = nil
+	if d.cache != nil {
+		d.cache.Close()
+	}
+	return err
 }
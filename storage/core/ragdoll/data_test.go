@@ -0,0 +1,376 @@
+package ragdoll
+
+import (
+	"fmt"
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/compress"
+	"github.com/Trinoooo/eggie_kv/storage/core/format"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestData_PutGet 写入超过单个数据文件容量的数据，重新打开后仍能读到每个 key 的最新值
+func TestData_PutGet(t *testing.T) {
+	dirPath := testDataDir + "data_put_get"
+	data, err := NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		err = data.Put(fmt.Sprintf("k%d", i%100), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(data.files) <= 1 {
+		t.Errorf("expect more than one data file, got %d", len(data.files))
+	}
+
+	err = data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	for i := 900; i < 1000; i++ {
+		value, err := data.Get(fmt.Sprintf("k%d", i%100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expect v%d, got %s", i, value)
+		}
+	}
+}
+
+// TestData_OpenTornTail 数据文件末尾存在写到一半的 Record，打开时丢弃该 Record
+func TestData_OpenTornTail(t *testing.T) {
+	dirPath := testDataDir + "data_torn_tail"
+	data, err := NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.Put("k1", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := data.filePath(data.active.id)
+	err = data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fd.Write(NewRecord("k2", []byte("v2"), 0).encode()[:recordHeaderSize+1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	value, err := data.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "v1" {
+		t.Errorf("expect v1, got %s", value)
+	}
+
+	if _, exist := data.Mem["k2"]; exist {
+		t.Error("expect torn record k2 dropped")
+	}
+}
+
+// TestData_DeleteMerge 删除的 key 在 merge 以及重新打开之后都不会复活
+func TestData_DeleteMerge(t *testing.T) {
+	dirPath := testDataDir + "data_delete_merge"
+	data, err := NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		err = data.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		err = data.Delete(fmt.Sprintf("k%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func() {
+		for i := 0; i < 100; i++ {
+			value, err := data.Get(fmt.Sprintf("k%d", i))
+			if i%2 == 0 {
+				if errs.GetCode(err) != errs.NotFoundErrCode {
+					t.Errorf("expect k%d not found, got %s, %v", i, value, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != fmt.Sprintf("v%d", i) {
+				t.Errorf("expect v%d, got %s", i, value)
+			}
+		}
+	}
+
+	// 墓碑还没有被 merge 时重新打开
+	err = data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	err = data.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	err = data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	check()
+}
+
+// TestData_ApplyExpired 回放已经过期的写入时等同于删除
+func TestData_ApplyExpired(t *testing.T) {
+	dirPath := testDataDir + "data_apply_expired"
+	data, err := NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	err = data.Put("k1", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := NewOp(consts.OperatorTypeSet, "k1", []byte("v2"))
+	op.ExpireAt = time.Now().Add(-time.Second).UnixNano()
+	err = data.Apply(0, []*Op{op})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = data.Get("k1")
+	if errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect not found error, got %v", err)
+	}
+}
+
+// TestData_Compression 不同压缩配置写入的 Record 混合存储在数据文件中，重新打开以及 merge 之后都可以读取
+func TestData_Compression(t *testing.T) {
+	dirPath := testDataDir + "data_compression"
+	large := strings.Repeat("eggie_kv", 128)
+	codecs := []compress.Codec{compress.None, compress.Snappy, compress.Zstd}
+	for _, codec := range codecs {
+		data, err := NewData(dirPath, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data.compressor = compress.NewCompressor(codec, 64)
+		for i := 0; i < 10; i++ {
+			err = data.Put(fmt.Sprintf("%d-small%d", codec, i), []byte("small"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = data.Put(fmt.Sprintf("%d-large%d", codec, i), []byte(large))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if codec != compress.None {
+			record, err := data.getRecord(fmt.Sprintf("%d-large0", codec), latestVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry := data.Mem[fmt.Sprintf("%d-large0", codec)]; entry.Size >= int64(recordHeaderSize+len(large)) {
+				t.Errorf("expect compressed record, got size %d", entry.Size)
+			}
+			if string(record.Value) != large {
+				t.Errorf("expect large value, got %s", record.Value)
+			}
+		}
+		err = data.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := NewData(dirPath, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	check := func() {
+		for _, codec := range codecs {
+			for i := 0; i < 10; i++ {
+				value, err := data.Get(fmt.Sprintf("%d-small%d", codec, i))
+				if err != nil || string(value) != "small" {
+					t.Errorf("expect small, got %s, %v", value, err)
+				}
+				value, err = data.Get(fmt.Sprintf("%d-large%d", codec, i))
+				if err != nil || string(value) != large {
+					t.Errorf("expect large value, got %d bytes, %v", len(value), err)
+				}
+			}
+		}
+	}
+	check()
+
+	err = data.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+// TestData_LegacyFormat 没有文件头、使用 MD5 校验的旧格式数据文件可以读取，新的写入以及 merge 输出都使用当前格式
+func TestData_LegacyFormat(t *testing.T) {
+	dirPath := testDataDir + "data_legacy_format"
+	err := os.MkdirAll(dirPath, defaultDataDirPerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var legacy []byte
+	for i := 0; i < 10; i++ {
+		record := NewRecord(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)), 0)
+		format.MD5.Sum(record.CheckSum[:], record.encode()[recordFlagOffset:])
+		legacy = append(legacy, record.encode()...)
+	}
+	err = os.WriteFile(dataPath(dirPath, 0), legacy, defaultDataFilePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.active.id == 0 || data.active.checksum != format.CRC32C {
+		t.Errorf("expect writes go to a new data file, got file %d", data.active.id)
+	}
+	err = data.Put("k0", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		for i := 0; i < 10; i++ {
+			expect := fmt.Sprintf("v%d", i)
+			if i == 0 {
+				expect = "new"
+			}
+			value, err := data.Get(fmt.Sprintf("k%d", i))
+			if err != nil || string(value) != expect {
+				t.Errorf("expect %s, got %s, %v", expect, value, err)
+			}
+		}
+	}
+	check()
+
+	err = data.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(dataPath(dirPath, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := format.ParseHeader(raw, dataFileMagic)
+	if err != nil || header == nil || header.Checksum != format.CRC32C {
+		t.Errorf("expect merged data file in current format, got %+v, %v", header, err)
+	}
+
+	data, err = NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	check()
+}
+
+// TestData_CloseSyncFail 活跃文件持久化失败时，Close 返回错误并仍然关闭其余数据文件
+func TestData_CloseSyncFail(t *testing.T) {
+	dirPath := testDataDir + "data_close_sync_fail"
+	data, err := NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		err = data.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := data.files
+	if len(files) <= 1 {
+		t.Fatalf("expect more than one data file, got %d", len(files))
+	}
+
+	// 提前关闭活跃文件，使 Close 中的 sync 失败
+	err = data.active.fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.Close()
+	if err == nil {
+		t.Fatal("expect close error")
+	}
+
+	for _, df := range files {
+		if err := df.fd.Close(); err == nil {
+			t.Errorf("expect data file %d closed", df.id)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package ragdoll
+
+import (
+	"math/rand"
+)
+
+const (
+	indexMaxLevel    = 32   // indexMaxLevel 跳表最大层数
+	indexProbability = 0.25 // indexProbability 节点出现在上一层的概率
+)
+
+// indexNode 跳表节点
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+// Index 有序索引，按字典序维护 keydir 中的全部 key
+// 使用跳表实现，不保证并发安全，由 Data 加锁保护
+type Index struct {
+	head   *indexNode
+	level  int
+	length int
+	rand   *rand.Rand
+}
+
+func NewIndex() *Index {
+	return &Index{
+		head:  &indexNode{next: make([]*indexNode, indexMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// randomLevel 随机生成新节点的层数
+func (idx *Index) randomLevel() int {
+	level := 1
+	for level < indexMaxLevel && idx.rand.Float64() < indexProbability {
+		level++
+	}
+	return level
+}
+
+// findPrev 查找每一层中最后一个小于 key 的节点
+func (idx *Index) findPrev(key string) []*indexNode {
+	prev := make([]*indexNode, indexMaxLevel)
+	node := idx.head
+	for i := idx.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		prev[i] = node
+	}
+	return prev
+}
+
+// Insert 插入 key，key 已经存在时什么都不做
+func (idx *Index) Insert(key string) {
+	prev := idx.findPrev(key)
+	if next := prev[0].next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := idx.randomLevel()
+	if level > idx.level {
+		for i := idx.level; i < level; i++ {
+			prev[i] = idx.head
+		}
+		idx.level = level
+	}
+
+	node := &indexNode{key: key, next: make([]*indexNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+	idx.length++
+}
+
+// Delete 删除 key，key 不存在时什么都不做
+func (idx *Index) Delete(key string) {
+	prev := idx.findPrev(key)
+	node := prev[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		prev[i].next[i] = node.next[i]
+	}
+	for idx.level > 1 && idx.head.next[idx.level-1] == nil {
+		idx.level--
+	}
+	idx.length--
+}
+
+// Len 返回索引中 key 的数量
+func (idx *Index) Len() int {
+	return idx.length
+}
+
+// SeekGE 返回第一个大于等于 key 的 key，不存在时第二个返回值为false
+func (idx *Index) SeekGE(key string) (string, bool) {
+	node := idx.findPrev(key)[0].next[0]
+	if node == nil {
+		return "", false
+	}
+	return node.key, true
+}
+
+// SeekGT 返回第一个大于 key 的 key，不存在时第二个返回值为false
+func (idx *Index) SeekGT(key string) (string, bool) {
+	node := idx.findPrev(key)[0].next[0]
+	if node != nil && node.key == key {
+		node = node.next[0]
+	}
+	if node == nil {
+		return "", false
+	}
+	return node.key, true
+}
+
+// SeekLT 返回最后一个小于 key 的 key，不存在时第二个返回值为false
+func (idx *Index) SeekLT(key string) (string, bool) {
+	node := idx.findPrev(key)[0]
+	if node == idx.head {
+		return "", false
+	}
+	return node.key, true
+}
+
+// SeekLE 返回最后一个小于等于 key 的 key，不存在时第二个返回值为false
+func (idx *Index) SeekLE(key string) (string, bool) {
+	prev := idx.findPrev(key)[0]
+	if next := prev.next[0]; next != nil && next.key == key {
+		return key, true
+	}
+	if prev == idx.head {
+		return "", false
+	}
+	return prev.key, true
+}
+
+// First 返回最小的 key，索引为空时第二个返回值为false
+func (idx *Index) First() (string, bool) {
+	node := idx.head.next[0]
+	if node == nil {
+		return "", false
+	}
+	return node.key, true
+}
+
+// Last 返回最大的 key，索引为空时第二个返回值为false
+func (idx *Index) Last() (string, bool) {
+	node := idx.head
+	for i := idx.level - 1; i >= 0; i-- {
+		for node.next[i] != nil {
+			node = node.next[i]
+		}
+	}
+	if node == idx.head {
+		return "", false
+	}
+	return node.key, true
+}
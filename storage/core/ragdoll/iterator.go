@@ -0,0 +1,165 @@
+package ragdoll
+
+import (
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+)
+
+// Iterator 基于 Data 有序索引的迭代器
+// 每次移动都在有序索引中重新查找下一个 key，迭代过程中的写入、删除以及 merge 不会使迭代器失效。
+// 基于快照创建的迭代器只能看到快照版本的数据
+type Iterator struct {
+	data     *Data
+	version  int64 // version 读取的版本号，latestVersion 表示读取最新版本
+	reverse  bool
+	lower    string // lower 遍历范围下界（包含）
+	upper    string // upper 遍历范围上界（不包含），hasUpper 为false时没有上界
+	hasUpper bool
+	key      string
+	valid    bool
+}
+
+// NewIterator 创建迭代器，创建之后定位在遍历顺序的第一个 key 上
+func NewIterator(data *Data, opts *iface.IteratorOptions) *Iterator {
+	return newIteratorAt(data, opts, latestVersion)
+}
+
+// newIteratorAt 创建读取 version 版本数据的迭代器
+func newIteratorAt(data *Data, opts *iface.IteratorOptions, version int64) *Iterator {
+	if opts == nil {
+		opts = &iface.IteratorOptions{}
+	}
+
+	it := &Iterator{
+		data:     data,
+		version:  version,
+		reverse:  opts.Reverse,
+		lower:    opts.LowerBound,
+		upper:    opts.UpperBound,
+		hasUpper: opts.UpperBound != "",
+	}
+
+	// 前缀范围与上下界取交集
+	if opts.Prefix != "" {
+		if opts.Prefix > it.lower {
+			it.lower = opts.Prefix
+		}
+		if end, ok := prefixEnd(opts.Prefix); ok && (!it.hasUpper || end < it.upper) {
+			it.upper = end
+			it.hasUpper = true
+		}
+	}
+
+	it.rewind()
+	return it
+}
+
+// prefixEnd 返回大于全部有 prefix 前缀的 key 的最小字符串
+// prefix 全部由0xff组成时不存在这样的字符串，第二个返回值为false
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// rewind 定位到遍历顺序的第一个 key 上
+func (it *Iterator) rewind() {
+	if !it.reverse {
+		it.set(it.data.seekIndex(func(index *Index) (string, bool) {
+			return index.SeekGE(it.lower)
+		}))
+		return
+	}
+
+	it.set(it.data.seekIndex(func(index *Index) (string, bool) {
+		if it.hasUpper {
+			return index.SeekLT(it.upper)
+		}
+		return index.Last()
+	}))
+}
+
+// set 更新迭代器位置，超出遍历范围时迭代器失效
+// 有序索引中还包含只存在于历史版本中的 key，不可见以及已经过期但还没有被主动清理的 key 会被跳过
+func (it *Iterator) set(key string, ok bool) {
+	for {
+		it.key = key
+		it.valid = ok && key >= it.lower && (!it.hasUpper || key < it.upper)
+		if !it.valid || it.data.visible(key, it.version) {
+			return
+		}
+		key, ok = it.next(key)
+	}
+}
+
+// next 按遍历顺序查找 key 的下一个 key
+func (it *Iterator) next(key string) (string, bool) {
+	return it.data.seekIndex(func(index *Index) (string, bool) {
+		if it.reverse {
+			return index.SeekLT(key)
+		}
+		return index.SeekGT(key)
+	})
+}
+
+func (it *Iterator) Seek(key string) {
+	if it.data == nil {
+		return
+	}
+
+	if !it.reverse {
+		if key < it.lower {
+			key = it.lower
+		}
+		it.set(it.data.seekIndex(func(index *Index) (string, bool) {
+			return index.SeekGE(key)
+		}))
+		return
+	}
+
+	it.set(it.data.seekIndex(func(index *Index) (string, bool) {
+		if it.hasUpper && key >= it.upper {
+			return index.SeekLT(it.upper)
+		}
+		return index.SeekLE(key)
+	}))
+}
+
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	it.set(it.next(it.key))
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() string {
+	if !it.valid {
+		return ""
+	}
+	return it.key
+}
+
+// Value 读取当前 key 的 value
+// 定位到 key 之后 key 被并发删除时返回 errs.NewNotFoundErr
+func (it *Iterator) Value() ([]byte, error) {
+	if !it.valid {
+		return nil, errs.NewNotFoundErr()
+	}
+	return it.data.getAt(it.key, it.version)
+}
+
+// Close 关闭迭代器，关闭之后迭代器失效
+func (it *Iterator) Close() error {
+	it.valid = false
+	it.data = nil
+	return nil
+}
@@ -0,0 +1,138 @@
+package ragdoll
+
+import (
+	"fmt"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestIndex_Random 随机插入删除之后，跳表与排序后的 key 列表一致
+func TestIndex_Random(t *testing.T) {
+	index := NewIndex()
+	expect := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("k%d", rand.Intn(1000))
+		if rand.Intn(3) == 0 {
+			index.Delete(key)
+			delete(expect, key)
+		} else {
+			index.Insert(key)
+			expect[key] = true
+		}
+	}
+
+	var keys []string
+	for key := range expect {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var got []string
+	for key, ok := index.First(); ok; key, ok = index.SeekGT(key) {
+		got = append(got, key)
+	}
+	if !reflect.DeepEqual(keys, got) || index.Len() != len(keys) {
+		t.Fatalf("forward mismatch, expect %d keys, got %d keys, len %d", len(keys), len(got), index.Len())
+	}
+
+	got = got[:0]
+	for key, ok := index.Last(); ok; key, ok = index.SeekLT(key) {
+		got = append(got, key)
+	}
+	for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+		got[i], got[j] = got[j], got[i]
+	}
+	if !reflect.DeepEqual(keys, got) {
+		t.Fatalf("reverse mismatch, expect %d keys, got %d keys", len(keys), len(got))
+	}
+}
+
+// collect 遍历迭代器中全部 key
+func collect(t *testing.T, it iface.Iterator) []string {
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		value, err := it.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "v"+it.Key() {
+			t.Errorf("expect v%s, got %s", it.Key(), value)
+		}
+		keys = append(keys, it.Key())
+	}
+	err := it.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// TestKV_Iterator 正向、反向、上下界以及前缀遍历
+func TestKV_Iterator(t *testing.T) {
+	config := newTestConfig("iterator")
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	for _, key := range []string{"a", "ab", "abc", "b", "ba", "c"} {
+		err = kv.Set(key, []byte("v"+key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = kv.Set("d", []byte("vd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Delete("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		opts   *iface.IteratorOptions
+		expect []string
+	}{
+		{nil, []string{"a", "ab", "abc", "b", "ba", "c"}},
+		{&iface.IteratorOptions{Reverse: true}, []string{"c", "ba", "b", "abc", "ab", "a"}},
+		{&iface.IteratorOptions{LowerBound: "ab", UpperBound: "ba"}, []string{"ab", "abc", "b"}},
+		{&iface.IteratorOptions{LowerBound: "ab", UpperBound: "ba", Reverse: true}, []string{"b", "abc", "ab"}},
+		{&iface.IteratorOptions{Prefix: "a"}, []string{"a", "ab", "abc"}},
+		{&iface.IteratorOptions{Prefix: "a", Reverse: true}, []string{"abc", "ab", "a"}},
+		{&iface.IteratorOptions{Prefix: "a", LowerBound: "aa"}, []string{"ab", "abc"}},
+		{&iface.IteratorOptions{Prefix: "x"}, nil},
+	}
+	for i, c := range cases {
+		it, err := kv.NewIterator(c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := collect(t, it)
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("case #%d expect %v, got %v", i, c.expect, got)
+		}
+	}
+
+	it, err := kv.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Seek("abd")
+	if got := collect(t, it); !reflect.DeepEqual(got, []string{"b", "ba", "c"}) {
+		t.Errorf("seek forward got %v", got)
+	}
+
+	it, err = kv.NewIterator(&iface.IteratorOptions{Reverse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Seek("abd")
+	if got := collect(t, it); !reflect.DeepEqual(got, []string{"abc", "ab", "a"}) {
+		t.Errorf("seek reverse got %v", got)
+	}
+}
@@ -1,34 +1,111 @@
 package ragdoll
 
 import (
+	"bytes"
+	"encoding/binary"
 	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/cache"
+	"github.com/Trinoooo/eggie_kv/storage/core/compress"
+	"github.com/Trinoooo/eggie_kv/storage/core/encrypt"
 	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
 	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/wal"
 	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"math"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
+)
+
+const (
+	expireSampleSize  = 20   // expireSampleSize 主动过期每轮采样的 key 数量
+	expireSampleRatio = 0.25 // expireSampleRatio 采样中过期 key 的比例超过该值时继续下一轮采样
+	expireMaxRounds   = 16   // expireMaxRounds 每个周期最多采样的轮数，避免长时间占用写锁
 )
 
 type KV struct {
-	Config    *viper.Viper
-	Data      *Data
-	Wal       *wal.Log
-	BatchPool sync.Pool
-	Chan      *Channel
+	Config        *viper.Viper
+	Data          *Data
+	Wal           *wal.Log
+	BatchPool     sync.Pool
+	Chan          *Channel
+	firstBlockIdx int64          // firstBlockIdx 还没有 checkpoint 的第一条日志索引，-1表示没有日志
+	lastBlockIdx  int64          // lastBlockIdx 已经写入 wal 的最后一条日志索引
+	done          chan struct{}  // done 消费协程退出时关闭
+	mergeSignal   chan struct{}  // mergeSignal 失效数据占比达到阈值时通知 merge 协程
+	stop          chan struct{}  // stop 关闭时通知后台协程退出
+	background    sync.WaitGroup // background 等待 merge、主动过期等后台协程退出
 }
 
 func New(config *viper.Viper) (iface.ICore, error) {
-	data, err := NewData("")
+	if config == nil {
+		config = viper.New()
+	}
+	config.SetDefault(consts.RagdollWalDir, filepath.Join(consts.BaseDir, consts.Ragdoll, "wal"))
+	config.SetDefault(consts.RagdollDataDir, filepath.Join(consts.BaseDir, consts.Ragdoll, "data"))
+	config.SetDefault(consts.RagdollDataFileCapacity, 64*consts.MB)
+	config.SetDefault(consts.RagdollCheckpointThreshold, 1e5)
+	config.SetDefault(consts.RagdollMergeDeadRatio, 0.5)
+	config.SetDefault(consts.RagdollMergeInterval, time.Hour)
+	config.SetDefault(consts.RagdollWalSyncMode, int64(wal.FullManagedAsync))
+	config.SetDefault(consts.RagdollWalRecoveryMode, int64(wal.RecoveryFail))
+	config.SetDefault(consts.RagdollGroupCommitSize, 1024)
+	config.SetDefault(consts.RagdollExpireInterval, 100*time.Millisecond)
+	config.SetDefault(consts.RagdollCacheCapacity, 64*consts.MB)
+	config.SetDefault(consts.RagdollCacheShards, 16)
+	config.SetDefault(consts.RagdollCachePolicy, "2q")
+	config.SetDefault(consts.RagdollCompression, "none")
+	config.SetDefault(consts.RagdollCompressionThreshold, 64)
+	config.SetDefault(consts.RagdollBloomFalsePositiveRate, defaultBloomFalsePositiveRate)
+
+	codec, err := compress.ParseCodec(config.GetString(consts.RagdollCompression))
 	if err != nil {
+		logs.Error(err.Error(), zap.String(consts.LogFieldParams, consts.RagdollCompression), zap.String(consts.LogFieldValue, config.GetString(consts.RagdollCompression)))
 		return nil, err
 	}
+	threshold := config.GetInt(consts.RagdollCompressionThreshold)
 
-	wal, err := wal.NewLog("123", wal.NewOptions())
+	fpr := config.GetFloat64(consts.RagdollBloomFalsePositiveRate)
+	if fpr <= 0 || fpr >= 1 {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, consts.RagdollBloomFalsePositiveRate), zap.Float64(consts.LogFieldValue, fpr))
+		return nil, e
+	}
+
+	keyring, err := encrypt.LoadKeyring(config.GetString(consts.RagdollEncryptionKey), config.GetStringSlice(consts.RagdollEncryptionRetiredKeys))
 	if err != nil {
+		logs.Error(err.Error(), zap.String(consts.LogFieldParams, consts.RagdollEncryptionKey))
 		return nil, err
 	}
 
-	err = wal.Open()
+	valueCache, err := newValueCache(config)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := newData(config.GetString(consts.RagdollDataDir), config.GetInt64(consts.RagdollDataFileCapacity), keyring)
+	if err != nil {
+		return nil, err
+	}
+	data.cache = valueCache
+	data.compressor = compress.NewCompressor(codec, threshold)
+	data.bloomFPR = fpr
+
+	wal, err := wal.NewLog(config.GetString(consts.RagdollWalDir), wal.NewOptions().
+		SetSyncMode(wal.SyncMode(config.GetInt64(consts.RagdollWalSyncMode))).
+		SetRecoveryMode(wal.RecoveryMode(config.GetInt64(consts.RagdollWalRecoveryMode))).
+		SetCompression(codec, threshold).
+		SetKeyring(keyring))
+	if err == nil {
+		err = wal.Open()
+	}
 	if err != nil {
+		if e := data.Close(); e != nil {
+			logs.Error(e.Error())
+		}
 		return nil, err
 	}
 
@@ -39,40 +116,738 @@ func New(config *viper.Viper) (iface.ICore, error) {
 		BatchPool: sync.Pool{
 			New: NewBatch,
 		},
-		Chan: NewChannel(),
+		Chan:          NewChannel(),
+		firstBlockIdx: -1,
+		lastBlockIdx:  -1,
+		done:          make(chan struct{}),
+		mergeSignal:   make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+
+	err = kv.recover()
+	if err != nil {
+		if e := kv.Wal.Close(); e != nil {
+			logs.Error(e.Error())
+		}
+		if e := kv.Data.Close(); e != nil {
+			logs.Error(e.Error())
+		}
+		return nil, err
 	}
 
+	// bugfix：每轮循环都需要重新消费 task，否则会重复处理第一个 task
 	go func() {
-		for task := kv.Chan.Consume(); ; {
-			handleTask(task)
+		defer close(kv.done)
+		groupCommitSize := config.GetInt(consts.RagdollGroupCommitSize)
+		for tasks := kv.Chan.ConsumeBatch(groupCommitSize); tasks != nil; tasks = kv.Chan.ConsumeBatch(groupCommitSize) {
+			kv.handleTasks(tasks)
 		}
 	}()
+	kv.background.Add(2)
+	go kv.mergeLoop()
+	go kv.expireLoop()
 
 	return kv, nil
 }
 
-func handleTask(task *Task) {
-	// TODO
+// mergeLoop 后台 merge 协程
+// 定期触发，或者在失效数据占比达到阈值时由写入方通知触发
+func (kv *KV) mergeLoop() {
+	defer kv.background.Done()
+
+	var tick <-chan time.Time
+	if interval := kv.Config.GetDuration(consts.RagdollMergeInterval); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-kv.stop:
+			return
+		case <-tick:
+		case <-kv.mergeSignal:
+		}
+
+		err := kv.Data.Merge()
+		if err != nil {
+			logs.Error(err.Error())
+		}
+	}
+}
+
+// expireLoop 后台主动过期协程
+// 参考 redis 的做法，每个周期随机采样设置了过期时间的 key，删除其中已经过期的 key，
+// 过期比例超过 expireSampleRatio 时认为还有较多过期 key，继续采样
+func (kv *KV) expireLoop() {
+	defer kv.background.Done()
+
+	interval := kv.Config.GetDuration(consts.RagdollExpireInterval)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-kv.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for i := 0; i < expireMaxRounds; i++ {
+			sampled, expired := kv.Data.SweepExpired(expireSampleSize)
+			if sampled == 0 || float64(expired) <= float64(sampled)*expireSampleRatio {
+				break
+			}
+		}
+	}
+}
+
+// maybeMerge 失效数据占比达到阈值，并且数据量超过一个数据文件时通知 merge 协程
+// 通知不会阻塞，merge 协程正在执行时多余的通知会被合并
+func (kv *KV) maybeMerge() {
+	ratio, total := kv.Data.DeadRatio()
+	if ratio < kv.Config.GetFloat64(consts.RagdollMergeDeadRatio) || total < kv.Config.GetInt64(consts.RagdollDataFileCapacity) {
+		return
+	}
+
+	select {
+	case kv.mergeSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Merge 手动触发一次 merge，merge 完成后返回
+// merge 期间不阻塞读写
+func (kv *KV) Merge() error {
+	return kv.Data.Merge()
+}
+
+// ReEncrypt 使用当前密钥重新加密数据文件以及 wal，完成之后旧密钥可以从配置中删除
+// 数据文件通过一次 merge 重写，wal 中没有使用当前密钥加密的 segment 原地重写
+func (kv *KV) ReEncrypt() error {
+	if kv.Data.keyring == nil {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, consts.RagdollEncryptionKey))
+		return e
+	}
+
+	err := kv.Data.Merge()
+	if err != nil {
+		return err
+	}
+
+	count, err := kv.Wal.ReEncrypt()
+	if err != nil {
+		return err
+	}
+	logs.Info("ragdoll re-encrypt finish", zap.Uint32("keyID", kv.Data.keyring.Active().ID()), zap.Int("segments", count))
+	return nil
+}
+
+// newValueCache 按配置创建 value 缓存，容量为0时不缓存
+func newValueCache(config *viper.Viper) (*cache.Cache, error) {
+	capacity := config.GetInt64(consts.RagdollCacheCapacity)
+	if capacity == 0 {
+		return nil, nil
+	}
+
+	policy, err := cache.ParsePolicy(config.GetString(consts.RagdollCachePolicy))
+	if err != nil {
+		logs.Error(err.Error(), zap.String(consts.LogFieldParams, consts.RagdollCachePolicy), zap.String(consts.LogFieldValue, config.GetString(consts.RagdollCachePolicy)))
+		return nil, err
+	}
+
+	valueCache, err := cache.New(capacity, config.GetInt(consts.RagdollCacheShards), policy)
+	if err != nil {
+		logs.Error(err.Error(), zap.String(consts.LogFieldParams, consts.RagdollCacheCapacity), zap.Int64(consts.LogFieldValue, capacity))
+		return nil, err
+	}
+	return valueCache, nil
+}
+
+// recover 回放 wal 中持久化的日志，恢复日志索引范围
+// Data 打开时已经通过扫描数据文件重建了 keydir，回放 wal 补齐还没有 checkpoint 的写入，
+// 回放完成后执行一次 checkpoint。wal 打开时已经丢弃了尾部写到一半的日志，这里读到的都是完整的日志
+func (kv *KV) recover() error {
+	start := time.Now()
+	length, err := kv.Wal.Len()
+	if err != nil {
+		return err
+	}
+
+	var opCount int
+	if length > 0 {
+		firstBlockIdx, _, err := kv.Wal.BlockRange()
+		if err != nil {
+			return err
+		}
+
+		// 修复时跳过的日志以及日志索引回绕都会让日志索引不连续，版本号取每条日志自己的索引
+		it := kv.Wal.NewIterator(firstBlockIdx)
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			batch, err := DecodeBatch(it.Value())
+			if err != nil {
+				return err
+			}
+
+			// 日志已经完整持久化，回放时不需要保证原子性，
+			// 组提交的日志可能超过单个数据文件容量，逐个 op 应用
+			version := blockIdxToVersion(it.Index())
+			for _, op := range batch.Ops {
+				err = kv.Data.Apply(version, []*Op{op})
+				if err != nil {
+					return err
+				}
+			}
+			opCount += len(batch.Ops)
+		}
+		if err = it.Err(); err != nil {
+			return err
+		}
+	}
+
+	kv.firstBlockIdx, kv.lastBlockIdx, err = kv.Wal.BlockRange()
+	if err != nil {
+		return err
+	}
+	// wal 已经被 checkpoint 截断时没有回放任何日志，快照版本号仍然需要与日志索引对齐。
+	// 此时消费协程以及后台协程都还没有启动，不需要加锁
+	kv.Data.version = blockIdxToVersion(kv.lastBlockIdx)
+
+	logs.Info("ragdoll recover finish",
+		zap.Int64("records", length),
+		zap.Int("ops", opCount),
+		zap.Int("keys", len(kv.Data.Mem)),
+		zap.Int64("firstBlockIdx", kv.firstBlockIdx),
+		zap.Int64("lastBlockIdx", kv.lastBlockIdx),
+		zap.Duration("cost", time.Since(start)),
+	)
+
+	return kv.checkpoint()
+}
+
+// checkpoint 持久化数据文件后截断已经应用的 wal 日志
+// 此后重启不再需要回放这部分日志，避免 wal 无限增长
+func (kv *KV) checkpoint() error {
+	if kv.firstBlockIdx == -1 {
+		return nil
+	}
+
+	err := kv.Data.Sync()
+	if err != nil {
+		return err
+	}
+
+	length, err := kv.Wal.Len()
+	if err != nil {
+		return err
+	}
+
+	err = kv.Wal.Truncate(length)
+	if err != nil {
+		return err
+	}
+
+	kv.firstBlockIdx, kv.lastBlockIdx, err = kv.Wal.BlockRange()
+	return err
+}
+
+// handleTasks 组提交一组 task
+// 需要读取当前数据才能确定写入内容的 task（例如 Persist）会把一组 task 切分开，
+// 保证它能读到前面 task 的写入
+func (kv *KV) handleTasks(tasks []*Task) {
+	start := 0
+	for i, task := range tasks {
+		if i > start && task.batch.needsRead() {
+			kv.commit(tasks[start:i])
+			start = i
+		}
+	}
+	kv.commit(tasks[start:])
+
+	// 积累的日志数量达到阈值后 checkpoint，checkpoint 失败不影响本次写入结果
+	if kv.lastBlockIdx-kv.firstBlockIdx+1 >= kv.Config.GetInt64(consts.RagdollCheckpointThreshold) {
+		err := kv.checkpoint()
+		if err != nil {
+			logs.Error(err.Error())
+		}
+	}
+}
+
+// commit 提交一组 task
+// 全部 task 的写操作合并为一条日志写入 wal，只需要一次写入和一次持久化；
+// 写入成功后逐个 task 原子地应用到 Data，最后按 op 顺序为每个 op 回传一个 Result。
+// 同一个 task 中的读操作能够读到该 task 的写操作
+func (kv *KV) commit(tasks []*Task) {
+	// 写入 wal 之前先检查能否应用，避免 wal 中出现重启时无法回放的日志，
+	// 无法应用的 task 直接失败，不影响同一组中的其他 task
+	group := &Batch{}
+	pending := make([]*Task, 0, len(tasks))
+	pendingOps := make([][]*Op, 0, len(tasks))
+	pendingValues := make([]map[*Op][]byte, 0, len(tasks))
+	for _, task := range tasks {
+		var writeOps []*Op
+		var values map[*Op][]byte
+		err := kv.check(task.batch.checkOps())
+		if err == nil {
+			writeOps, values, err = kv.resolve(task.batch.writeOps())
+		}
+		if err == nil && len(writeOps) > 0 {
+			err = kv.Data.Validate(writeOps)
+		}
+		if isPassThroughErr(err) {
+			kv.finishTask(task, err.(*errs.KvErr), nil)
+			continue
+		} else if err != nil {
+			kv.finishTask(task, errs.NewSetErr().WithErr(err), nil)
+			continue
+		}
+		group.AppendOps(writeOps...)
+		pending = append(pending, task)
+		pendingOps = append(pendingOps, writeOps)
+		pendingValues = append(pendingValues, values)
+	}
+
+	if len(group.Ops) > 0 {
+		err := kv.Wal.Write(group.Encode())
+		if err == nil {
+			kv.firstBlockIdx, kv.lastBlockIdx, err = kv.Wal.BlockRange()
+		}
+		if err != nil {
+			e := errs.NewSetErr().WithErr(err)
+			for _, task := range pending {
+				kv.finishTask(task, e, nil)
+			}
+			return
+		}
+	}
+
+	// 写入 wal 成功但应用到 Data 失败时返回错误，重启回放之后这组写操作仍然会生效。
+	// 同一条日志中的写操作使用同一个版本号，并且在一次加锁中全部应用之后才更新版本号，
+	// 快照以及事务要么全部看到，要么全部看不到
+	results := kv.Data.ApplyGroup(blockIdxToVersion(kv.lastBlockIdx), pendingOps)
+	for i, task := range pending {
+		var e *errs.KvErr
+		if results[i] != nil {
+			e = errs.NewSetErr().WithErr(results[i])
+		}
+		kv.finishTask(task, e, pendingValues[i])
+	}
+
+	if len(group.Ops) > 0 {
+		kv.maybeMerge()
+	}
+}
+
+// check 检查事务读写的 key 在事务开始之后都没有被修改，否则返回 errs.NewTxnConflictErr
+// 消费协程串行执行 check 与写入，检查通过之后到写入之前不会有其他写入
+func (kv *KV) check(ops []*Op) error {
+	for _, op := range ops {
+		if kv.Data.modifiedSince(op.Key, op.Version) {
+			e := errs.NewTxnConflictErr()
+			logs.Warn(e.Error(), zap.String("key", op.Key), zap.Int64("version", op.Version))
+			return e
+		}
+	}
+	return nil
+}
+
+// isPassThroughErr 判断写入前检查出的错误是否直接返回给调用方，其他错误包装为 errs.NewSetErr
+func isPassThroughErr(err error) bool {
+	switch errs.GetCode(err) {
+	case errs.NotFoundErrCode, errs.TxnConflictErrCode, errs.NotIntegerErrCode:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolve 将需要读取当前数据的写操作转换为 Set、Delete，写入 wal 的日志只包含 Set、Delete，
+// 回放时不依赖回放时刻的数据与时间。
+// 额外返回需要回传给调用方的结果，例如 CompareAndSwap 是否写入、Incr 之后的值
+func (kv *KV) resolve(ops []*Op) ([]*Op, map[*Op][]byte, error) {
+	resolved := make([]*Op, 0, len(ops))
+	values := make(map[*Op][]byte)
+	// 同一个 Batch 中前面的写操作还没有应用到 Data，读取时需要先看前面的写操作
+	written := make(map[string]*Op)
+	now := time.Now().UnixNano()
+	read := func(key string) ([]byte, int64, error) {
+		if op, exist := written[key]; exist {
+			if op.Type == consts.OperatorTypeDelete || op.isExpired(now) {
+				return nil, 0, errs.NewNotFoundErr()
+			}
+			return op.Value, op.ExpireAt, nil
+		}
+		record, err := kv.Data.getRecord(key, latestVersion)
+		if err != nil {
+			return nil, 0, err
+		}
+		return record.Value, record.ExpireAt, nil
+	}
+
+	for _, op := range ops {
+		var write *Op
+		switch op.Type {
+		case consts.OperatorTypePersist:
+			value, expireAt, err := read(op.Key)
+			if err != nil {
+				return nil, nil, err
+			}
+			// 没有过期时间时不需要写入
+			if expireAt != 0 {
+				write = NewOp(consts.OperatorTypeSet, op.Key, value)
+			}
+		case consts.OperatorTypeCAS:
+			value, _, err := read(op.Key)
+			if err != nil && errs.GetCode(err) != errs.NotFoundErrCode {
+				return nil, nil, err
+			}
+			swapped := err == nil && bytes.Equal(value, op.Expected)
+			if swapped {
+				write = NewOp(consts.OperatorTypeSet, op.Key, op.Value)
+			}
+			values[op] = encodeBool(swapped)
+		case consts.OperatorTypeSetNX:
+			_, _, err := read(op.Key)
+			if err != nil && errs.GetCode(err) != errs.NotFoundErrCode {
+				return nil, nil, err
+			}
+			notExist := err != nil
+			if notExist {
+				write = NewOp(consts.OperatorTypeSet, op.Key, op.Value)
+			}
+			values[op] = encodeBool(notExist)
+		case consts.OperatorTypeIncr, consts.OperatorTypeDecr:
+			n, err := kv.incr(op, read)
+			if err != nil {
+				return nil, nil, err
+			}
+			write = n
+			values[op] = n.Value
+		default:
+			write = op
+		}
+
+		if write != nil {
+			resolved = append(resolved, write)
+			written[write.Key] = write
+		}
+	}
+	return resolved, values, nil
+}
+
+// incr 计算 Incr、Decr 之后的值，转换为保留原有过期时间的 Set
+// value 按十进制 int64 解析，key 不存在时视为0，溢出时返回 errs.NewNotIntegerErr
+func (kv *KV) incr(op *Op, read func(key string) ([]byte, int64, error)) (*Op, error) {
+	if len(op.Value) != 8 {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "delta"), zap.Int(consts.LogFieldValue, len(op.Value)))
+		return nil, e
+	}
+	delta := int64(binary.BigEndian.Uint64(op.Value))
+
+	var n int64
+	value, expireAt, err := read(op.Key)
+	if err == nil {
+		n, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			e := errs.NewNotIntegerErr().WithErr(err)
+			logs.Error(e.Error())
+			return nil, e
+		}
+	} else if errs.GetCode(err) != errs.NotFoundErrCode {
+		return nil, err
+	}
+
+	if op.Type == consts.OperatorTypeDecr {
+		if delta == math.MinInt64 {
+			e := errs.NewNotIntegerErr()
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "delta"), zap.Int64(consts.LogFieldValue, delta))
+			return nil, e
+		}
+		delta = -delta
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		e := errs.NewNotIntegerErr()
+		logs.Error(e.Error(), zap.Int64("value", n), zap.Int64("delta", delta))
+		return nil, e
+	}
+
+	write := NewOp(consts.OperatorTypeSet, op.Key, strconv.AppendInt(nil, n+delta, 10))
+	write.ExpireAt = expireAt
+	return write, nil
+}
+
+// encodeBool 将 CompareAndSwap、SetNX 是否写入编码为 Result.Value
+func encodeBool(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// decodeBool 是 encodeBool 的逆过程
+func decodeBool(raw []byte) bool {
+	return len(raw) == 1 && raw[0] == 1
+}
+
+// finishTask 按 op 顺序为每个 op 回传一个 Result
+// e 不为nil时全部 op 都返回该错误，否则写操作返回 values 中的结果，读操作从 Data 中读取
+func (kv *KV) finishTask(task *Task, e *errs.KvErr, values map[*Op][]byte) {
+	if e != nil {
+		logs.Error(e.Error())
+		for range task.batch.Ops {
+			task.result <- &Result{Error: e}
+		}
+		return
+	}
+
+	for _, op := range task.batch.Ops {
+		if op.isWrite() {
+			task.result <- &Result{Value: values[op]}
+			continue
+		}
+		task.result <- kv.apply(op)
+	}
+}
+
+// apply 将读操作应用到 Data 中，写操作统一由 write 处理
+func (kv *KV) apply(op *Op) *Result {
+	switch op.Type {
+	case opTypeCheck:
+		return &Result{}
+	case consts.OperatorTypeGet:
+		value, err := kv.Data.Get(op.Key)
+		if errs.GetCode(err) == errs.NotFoundErrCode {
+			return &Result{Error: err.(*errs.KvErr)}
+		} else if err != nil {
+			e := errs.NewGetErr().WithErr(err)
+			logs.Error(e.Error())
+			return &Result{Error: e}
+		}
+		return &Result{Value: value}
+	default:
+		e := errs.NewUnsupportedOperatorTypeErr()
+		logs.Error(e.Error())
+		return &Result{Error: e}
+	}
 }
 
 func (kv *KV) Get(key string) ([]byte, error) {
 	batch := kv.BatchPool.Get().(*Batch)
+	defer kv.BatchPool.Put(batch)
 	batch.Reset()
 	batch.AppendOps(
 		NewOp(consts.OperatorTypeGet, key, nil),
 	)
 
 	result := <-kv.Chan.Produce(batch)
-	return result.Value, result.Error
+	// bugfix：直接返回值为nil的 *errs.KvErr 会得到一个不为nil的 error
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return result.Value, nil
 }
 
 func (kv *KV) Set(key string, value []byte) error {
 	batch := kv.BatchPool.Get().(*Batch)
+	defer kv.BatchPool.Put(batch)
 	batch.Reset()
 	batch.AppendOps(
 		NewOp(consts.OperatorTypeSet, key, value),
 	)
 
 	result := <-kv.Chan.Produce(batch)
-	return result.Error
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// SetWithTTL 写入 key，ttl 之后 key 过期
+// 过期时间在提交时确定，作为绝对时间写入 wal 以及数据文件
+func (kv *KV) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "ttl"), zap.Duration(consts.LogFieldValue, ttl))
+		return e
+	}
+
+	batch := kv.BatchPool.Get().(*Batch)
+	defer kv.BatchPool.Put(batch)
+	batch.Reset()
+	op := NewOp(consts.OperatorTypeSet, key, value)
+	op.ExpireAt = time.Now().Add(ttl).UnixNano()
+	batch.AppendOps(op)
+
+	result := <-kv.Chan.Produce(batch)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// TTL 返回 key 的剩余存活时间，没有设置过期时间时返回 iface.NoTTL
+func (kv *KV) TTL(key string) (time.Duration, error) {
+	return kv.Data.TTL(key)
+}
+
+// Persist 去掉 key 的过期时间，key 不存在或者已经过期时返回 errs.NewNotFoundErr
+func (kv *KV) Persist(key string) error {
+	batch := kv.BatchPool.Get().(*Batch)
+	defer kv.BatchPool.Put(batch)
+	batch.Reset()
+	batch.AppendOps(
+		NewOp(consts.OperatorTypePersist, key, nil),
+	)
+
+	result := <-kv.Chan.Produce(batch)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// Delete 删除 key，key 不存在时不返回错误
+func (kv *KV) Delete(key string) error {
+	batch := kv.BatchPool.Get().(*Batch)
+	defer kv.BatchPool.Put(batch)
+	batch.Reset()
+	batch.AppendOps(
+		NewOp(consts.OperatorTypeDelete, key, nil),
+	)
+
+	result := <-kv.Chan.Produce(batch)
+	if result.Error != nil {
+		return result.Error
+	}
+	return nil
+}
+
+// CompareAndSwap key 当前的 value 等于 expected 时写入 value，返回是否写入
+// key 不存在或者已经过期时不写入。写入的 value 没有过期时间
+func (kv *KV) CompareAndSwap(key string, expected, value []byte) (bool, error) {
+	op := NewOp(consts.OperatorTypeCAS, key, value)
+	op.Expected = expected
+	result, err := kv.produceOne(op)
+	if err != nil {
+		return false, err
+	}
+	return decodeBool(result), nil
+}
+
+// SetNX key 不存在或者已经过期时写入 value，返回是否写入
+func (kv *KV) SetNX(key string, value []byte) (bool, error) {
+	result, err := kv.produceOne(NewOp(consts.OperatorTypeSetNX, key, value))
+	if err != nil {
+		return false, err
+	}
+	return decodeBool(result), nil
+}
+
+// Incr 将 key 的 value 作为十进制 int64 加上 delta，返回相加之后的值
+// key 不存在时视为0，value 不是整数或者溢出时返回 errs.NewNotIntegerErr，key 原有的过期时间保持不变
+func (kv *KV) Incr(key string, delta int64) (int64, error) {
+	return kv.incrBy(consts.OperatorTypeIncr, key, delta)
+}
+
+// Decr 将 key 的 value 作为十进制 int64 减去 delta，返回相减之后的值，其他行为与 Incr 相同
+func (kv *KV) Decr(key string, delta int64) (int64, error) {
+	return kv.incrBy(consts.OperatorTypeDecr, key, delta)
+}
+
+func (kv *KV) incrBy(opType consts.OperatorType, key string, delta int64) (int64, error) {
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, uint64(delta))
+	result, err := kv.produceOne(NewOp(opType, key, raw))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(result), 10, 64)
+}
+
+// produceOne 提交只有一个 op 的 Batch，返回该 op 的结果
+func (kv *KV) produceOne(op *Op) ([]byte, error) {
+	batch := kv.BatchPool.Get().(*Batch)
+	defer kv.BatchPool.Put(batch)
+	batch.Reset()
+	batch.AppendOps(op)
+
+	result := <-kv.Chan.Produce(batch)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return result.Value, nil
+}
+
+// WriteBatch 原子地应用一组写入和删除
+// 整个 batch 作为一条日志写入 wal，重启回放时要么全部生效，要么全部不生效
+func (kv *KV) WriteBatch(wb *iface.WriteBatch) error {
+	if wb == nil || len(wb.Ops) == 0 {
+		return nil
+	}
+
+	batch := kv.BatchPool.Get().(*Batch)
+	defer kv.BatchPool.Put(batch)
+	batch.Reset()
+	for _, op := range wb.Ops {
+		if op.Type != consts.OperatorTypeSet && op.Type != consts.OperatorTypeDelete {
+			e := errs.NewUnsupportedOperatorTypeErr()
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "opType"), zap.Int64(consts.LogFieldValue, int64(op.Type)))
+			return e
+		}
+		batch.AppendOps(NewOp(op.Type, op.Key, op.Value))
+	}
+
+	// 同一个 batch 中写操作的结果相同，读出全部结果之后消费协程不再使用 batch，才能放回 BatchPool
+	resultChan := kv.Chan.Produce(batch)
+	var err error
+	for range batch.Ops {
+		result := <-resultChan
+		if result.Error != nil && err == nil {
+			err = result.Error
+		}
+	}
+	return err
+}
+
+// NewIterator 创建按 key 字典序遍历的迭代器
+// 迭代器直接读取 Data，不经过消费协程，迭代时能够读到已经返回成功的写入
+func (kv *KV) NewIterator(opts *iface.IteratorOptions) (iface.Iterator, error) {
+	return NewIterator(kv.Data, opts), nil
+}
+
+// Snapshot 创建固定在最后应用的 wal 日志上的只读快照，使用完之后需要调用 Snapshot.Release
+// 快照只包含已经应用到 Data 的写入，已经返回成功的写入都能通过快照读到
+func (kv *KV) Snapshot() *Snapshot {
+	return kv.Data.Snapshot()
+}
+
+// Begin 开始一个乐观事务，事务中的读取基于开始时的快照，写入缓存在事务中直到提交
+func (kv *KV) Begin() (iface.Txn, error) {
+	return newTxn(kv), nil
+}
+
+// Close 关闭 KV，等待已提交的 task 处理完成后释放资源
+// 关闭之后不能再调用 Get、Set、Delete、WriteBatch
+func (kv *KV) Close() error {
+	kv.Chan.Close()
+	<-kv.done
+	close(kv.stop)
+	kv.background.Wait()
+
+	// checkpoint 失败时仍然关闭 Wal 以及 Data，返回第一个错误
+	err := kv.checkpoint()
+	if e := kv.Wal.Close(); err == nil {
+		err = e
+	}
+	if e := kv.Data.Close(); err == nil {
+		err = e
+	}
+	return err
 }
@@ -0,0 +1,960 @@
+package ragdoll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/wal"
+	"github.com/spf13/viper"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testDataDir = "../../../test_data/ragdoll/"
+
+func TestMain(m *testing.M) {
+	// 每次测试之前删除测试数据
+	err := os.RemoveAll(testDataDir)
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+
+	err = os.RemoveAll(testDataDir)
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(code)
+}
+
+// newTestConfig 构造指向测试目录的配置
+func newTestConfig(name string) *viper.Viper {
+	config := viper.New()
+	config.Set(consts.RagdollWalDir, testDataDir+name+"/wal")
+	config.Set(consts.RagdollDataDir, testDataDir+name+"/data")
+	return config
+}
+
+// TestBatch_EncodeDecode 序列化后反序列化能够得到相同的 Batch
+func TestBatch_EncodeDecode(t *testing.T) {
+	batch := NewBatch().(*Batch)
+	batch.AppendOps(
+		NewOp(consts.OperatorTypeSet, "k1", []byte("v1")),
+		NewOp(consts.OperatorTypeSet, "", []byte("empty key")),
+		NewOp(consts.OperatorTypeSet, "empty value", nil),
+	)
+
+	decoded, err := DecodeBatch(batch.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.Ops) != len(batch.Ops) {
+		t.Fatalf("expect %d ops, got %d", len(batch.Ops), len(decoded.Ops))
+	}
+	for i, op := range batch.Ops {
+		if decoded.Ops[i].Type != op.Type || decoded.Ops[i].Key != op.Key || !bytes.Equal(decoded.Ops[i].Value, op.Value) {
+			t.Errorf("op #%d mismatch, expect %#v, got %#v", i, op, decoded.Ops[i])
+		}
+	}
+
+	_, err = DecodeBatch(batch.Encode()[:20])
+	if errs.GetCode(err) != errs.CorruptErrCode {
+		t.Errorf("expect corrupt error, got %v", err)
+	}
+
+	// op 数量被破坏时不按数量分配内存
+	raw := batch.Encode()
+	binary.BigEndian.PutUint64(raw, math.MaxUint64)
+	_, err = DecodeBatch(raw)
+	if errs.GetCode(err) != errs.CorruptErrCode {
+		t.Errorf("expect corrupt error, got %v", err)
+	}
+}
+
+// TestKV_SetGet 写入后能够读到
+func TestKV_SetGet(t *testing.T) {
+	kv, err := New(newTestConfig("set_get"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	_, err = kv.Get("k1")
+	if errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect not found error, got %v", err)
+	}
+
+	err = kv.Set("k1", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Set("k1", []byte("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := kv.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte("v2")) {
+		t.Errorf("expect v2, got %s", value)
+	}
+}
+
+// TestKV_Recover 重启之后能够从 wal 中恢复数据
+func TestKV_Recover(t *testing.T) {
+	config := newTestConfig("recover")
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		err = kv.Set(fmt.Sprintf("k%d", i%10), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	for i := 90; i < 100; i++ {
+		value, err := kv.Get(fmt.Sprintf("k%d", i%10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expect v%d, got %s", i, value)
+		}
+	}
+}
+
+// TestKV_RecoverTornTail wal 末尾存在写到一半的日志时丢弃该日志，其余数据正常恢复
+func TestKV_RecoverTornTail(t *testing.T) {
+	config := newTestConfig("recover_torn_tail")
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Set("k1", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟写入 block 过程中宕机：只写入了 block 的一部分
+	matches, err := filepath.Glob(filepath.Join(config.GetString(consts.RagdollWalDir), "*.active"))
+	if err != nil || len(matches) != 1 {
+		t.Fatal(matches, err)
+	}
+	active, err := os.OpenFile(matches[0], os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = active.Write([]byte{120, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = active.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	value, err := kv.Get("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "v1" {
+		t.Errorf("expect v1, got %s", value)
+	}
+
+	err = kv.Set("k2", []byte("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestKV_RecoverSkipCorrupt 修复时跳过损坏的日志之后，回放的版本号仍然取每条日志自己的索引
+func TestKV_RecoverSkipCorrupt(t *testing.T) {
+	config := newTestConfig("recover_skip_corrupt")
+	config.Set(consts.RagdollWalSyncMode, int64(wal.FullManagedSync))
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	for i := 0; i < 5; i++ {
+		err = kv.Set(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 不关闭直接复制，模拟进程崩溃，否则关闭时的 checkpoint 会截断 wal
+	crashed := newTestConfig("recover_skip_corrupt_crashed")
+	crashed.Set(consts.RagdollWalRecoveryMode, int64(wal.RecoverySkipCorrupt))
+	copyTestDir(t, config.GetString(consts.RagdollWalDir), crashed.GetString(consts.RagdollWalDir))
+	copyTestDir(t, config.GetString(consts.RagdollDataDir), crashed.GetString(consts.RagdollDataDir))
+
+	matches, err := filepath.Glob(filepath.Join(crashed.GetString(consts.RagdollWalDir), "*.active"))
+	if err != nil || len(matches) != 1 {
+		t.Fatal(matches, err)
+	}
+	raw, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := bytes.Index(raw, []byte("value-1"))
+	if pos == -1 {
+		t.Fatal("value-1 not found in wal")
+	}
+	raw[pos] ^= 0xff
+	err = os.WriteFile(matches[0], raw, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := New(crashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+
+	entry, ok := recovered.(*KV).Data.Mem["k3"]
+	if !ok {
+		t.Fatal("k3 not recovered")
+	}
+	if entry.Version != blockIdxToVersion(3) {
+		t.Errorf("expect version %d, got %d", blockIdxToVersion(3), entry.Version)
+	}
+	value, err := recovered.Get("k3")
+	if err != nil || string(value) != "value-3" {
+		t.Errorf("expect value-3, got %s, %v", value, err)
+	}
+}
+
+// copyTestDir 复制 src 目录下的全部文件到 dst
+func copyTestDir(t *testing.T, src, dst string) {
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0770)
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), raw, info.Mode())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestKV_Delete 删除之后读不到，重启之后仍然读不到
+func TestKV_Delete(t *testing.T) {
+	config := newTestConfig("delete")
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = kv.Set(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i += 2 {
+		err = kv.Delete(fmt.Sprintf("k%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 删除不存在的 key 不返回错误
+	err = kv.Delete("not exist")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	for i := 0; i < 10; i++ {
+		value, err := kv.Get(fmt.Sprintf("k%d", i))
+		if i%2 == 0 {
+			if errs.GetCode(err) != errs.NotFoundErrCode {
+				t.Errorf("expect k%d not found, got %s, %v", i, value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expect v%d, got %s", i, value)
+		}
+	}
+}
+
+// TestKV_WriteBatch batch 中的写入和删除全部生效；无法写入的 batch 全部不生效，重启之后仍然如此
+func TestKV_WriteBatch(t *testing.T) {
+	config := newTestConfig("write_batch")
+	config.Set(consts.RagdollDataFileCapacity, 1024)
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Set("k0", []byte("v0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.WriteBatch(iface.NewWriteBatch().
+		Set("k1", []byte("v1")).
+		Set("k2", []byte("v2")).
+		Delete("k0").
+		Set("k3", []byte("v3")).
+		Delete("k3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// batch 总长度超过单个数据文件容量，整个 batch 都不会生效
+	err = kv.WriteBatch(iface.NewWriteBatch().
+		Set("k1", []byte("changed")).
+		Set("big", make([]byte, 1024)))
+	if err == nil {
+		t.Fatal("expect write batch failed")
+	}
+
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	expects := map[string]string{"k1": "v1", "k2": "v2"}
+	for key, expect := range expects {
+		value, err := kv.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expect {
+			t.Errorf("expect %s, got %s", expect, value)
+		}
+	}
+	for _, key := range []string{"k0", "k3", "big"} {
+		_, err = kv.Get(key)
+		if errs.GetCode(err) != errs.NotFoundErrCode {
+			t.Errorf("expect %s not found, got %v", key, err)
+		}
+	}
+}
+
+// TestKV_GroupCommit 并发写入时多个 task 合并写入 wal，重启之后全部写入都能恢复
+func TestKV_GroupCommit(t *testing.T) {
+	config := newTestConfig("group_commit")
+	config.Set(consts.RagdollWalSyncMode, int64(wal.FullManagedSync))
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				err := kv.Set(fmt.Sprintf("g%d-k%d", g, i), []byte(fmt.Sprintf("v%d", i)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// 组提交之后 wal 中的日志数量少于写入次数
+	last := kv.(*KV).lastBlockIdx
+	t.Log("wal records:", last+1, "writes:", 50*20)
+	if last+1 >= 50*20 {
+		t.Errorf("expect concurrent writes group committed, got %d wal records for %d writes", last+1, 50*20)
+	}
+
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	for g := 0; g < 50; g++ {
+		for i := 0; i < 20; i++ {
+			value, err := kv.Get(fmt.Sprintf("g%d-k%d", g, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != fmt.Sprintf("v%d", i) {
+				t.Errorf("expect v%d, got %s", i, value)
+			}
+		}
+	}
+}
+
+func BenchmarkKV_Write_NoGroupCommit(b *testing.B) {
+	benchmarkKVWrite(b, "bench_no_group_commit", 1)
+}
+
+func BenchmarkKV_Write_GroupCommit(b *testing.B) {
+	benchmarkKVWrite(b, "bench_group_commit", 1024)
+}
+
+// benchmarkKVWrite 在 wal.FullManagedSync 模式下并发写入
+func benchmarkKVWrite(b *testing.B, name string, groupCommitSize int) {
+	config := newTestConfig(name)
+	config.Set(consts.RagdollWalSyncMode, int64(wal.FullManagedSync))
+	config.Set(consts.RagdollGroupCommitSize, groupCommitSize)
+	kv, err := New(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer kv.Close()
+
+	value := make([]byte, 100)
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			err := kv.Set(fmt.Sprintf("k%d", i), value)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+// TestKV_CloseCheckpointFail checkpoint 失败时 Close 返回错误，并且仍然会关闭 wal
+func TestKV_CloseCheckpointFail(t *testing.T) {
+	config := newTestConfig("close_checkpoint_fail")
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.Set("k1", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 提前关闭 active 数据文件，checkpoint 持久化数据文件时失败
+	err = kv.(*KV).Data.active.fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Close()
+	if err == nil {
+		t.Fatal("expect close failed")
+	}
+
+	// wal 已经关闭时目录锁已经释放，能够再次打开
+	log, err := wal.NewLog(config.GetString(consts.RagdollWalDir), wal.NewOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = log.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = log.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestKV_TTL 过期之后读不到，Persist 之后不再过期，重启之后已经过期的 key 不会恢复
+func TestKV_TTL(t *testing.T) {
+	config := newTestConfig("ttl")
+	// 关闭主动过期，只验证惰性过期
+	config.Set(consts.RagdollExpireInterval, 0)
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = kv.SetWithTTL("k1", []byte("v1"), 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.SetWithTTL("k2", []byte("v2"), 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Persist("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 已经有不过期的旧值，过期之后不能恢复旧值
+	err = kv.Set("k3", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.SetWithTTL("k3", []byte("v3"), 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttl, err := kv.TTL("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 0 || ttl > 200*time.Millisecond {
+		t.Errorf("expect ttl in (0, 200ms], got %v", ttl)
+	}
+	ttl, err = kv.TTL("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != iface.NoTTL {
+		t.Errorf("expect no ttl, got %v", ttl)
+	}
+
+	err = kv.Persist("not exist")
+	if errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect not found error, got %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	check := func() {
+		for _, key := range []string{"k1", "k3"} {
+			_, err = kv.Get(key)
+			if errs.GetCode(err) != errs.NotFoundErrCode {
+				t.Errorf("expect %s expired, got %v", key, err)
+			}
+		}
+		value, err := kv.Get("k2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "v2" {
+			t.Errorf("expect v2, got %s", value)
+		}
+	}
+	check()
+
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+	check()
+}
+
+// TestKV_ExpireSweep 主动过期会清理没有被读取的过期 key
+func TestKV_ExpireSweep(t *testing.T) {
+	config := newTestConfig("expire_sweep")
+	config.Set(consts.RagdollExpireInterval, 10*time.Millisecond)
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	for i := 0; i < 100; i++ {
+		err = kv.SetWithTTL(fmt.Sprintf("k%d", i), []byte("v"), 50*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = kv.Set("persist", []byte("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	data := kv.(*KV).Data
+	data.mu.RLock()
+	keys := len(data.Mem)
+	data.mu.RUnlock()
+	if keys != 1 {
+		t.Errorf("expect 1 key left, got %d", keys)
+	}
+}
+
+// TestKV_CompareAndSwap CompareAndSwap 以及 SetNX 只在条件满足时写入
+func TestKV_CompareAndSwap(t *testing.T) {
+	config := newTestConfig("cas")
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	ok, err := kv.CompareAndSwap("lock", []byte(""), []byte("a"))
+	if err != nil || ok {
+		t.Errorf("expect cas on missing key fail, got %v, %v", ok, err)
+	}
+	ok, err = kv.SetNX("lock", []byte("a"))
+	if err != nil || !ok {
+		t.Errorf("expect setnx success, got %v, %v", ok, err)
+	}
+	ok, err = kv.SetNX("lock", []byte("b"))
+	if err != nil || ok {
+		t.Errorf("expect setnx on existing key fail, got %v, %v", ok, err)
+	}
+	ok, err = kv.CompareAndSwap("lock", []byte("b"), []byte("c"))
+	if err != nil || ok {
+		t.Errorf("expect cas with wrong expected fail, got %v, %v", ok, err)
+	}
+	ok, err = kv.CompareAndSwap("lock", []byte("a"), []byte("c"))
+	if err != nil || !ok {
+		t.Errorf("expect cas success, got %v, %v", ok, err)
+	}
+
+	value, err := kv.Get("lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "c" {
+		t.Errorf("expect c, got %s", value)
+	}
+
+	// 并发抢锁只有一个成功
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var winners int
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := kv.SetNX("mutex", []byte(fmt.Sprintf("owner%d", i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Errorf("expect 1 winner, got %d", winners)
+	}
+}
+
+// TestKV_Incr 并发 Incr、Decr 不会丢失更新，重启后计数不变，非整数以及溢出返回错误
+func TestKV_Incr(t *testing.T) {
+	config := newTestConfig("incr")
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := kv.Incr("counter", 2)
+				if err == nil {
+					_, err = kv.Decr("counter", 1)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	n, err := kv.Incr("counter", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Errorf("expect 1000, got %d", n)
+	}
+
+	err = kv.SetWithTTL("ttl", []byte("41"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = kv.Incr("ttl", 1)
+	if err != nil || n != 42 {
+		t.Errorf("expect 42, got %d, %v", n, err)
+	}
+	if ttl, err := kv.TTL("ttl"); err != nil || ttl == iface.NoTTL {
+		t.Errorf("expect ttl kept after incr, got %v, %v", ttl, err)
+	}
+
+	err = kv.Set("str", []byte("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kv.Incr("str", 1)
+	if errs.GetCode(err) != errs.NotIntegerErrCode {
+		t.Errorf("expect not integer error, got %v", err)
+	}
+
+	err = kv.Set("max", []byte(fmt.Sprint(int64(1<<63-1))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kv.Incr("max", 1)
+	if errs.GetCode(err) != errs.NotIntegerErrCode {
+		t.Errorf("expect overflow error, got %v", err)
+	}
+}
+
+// TestKV_ValueCache 重复读取命中缓存，覆盖写入、删除以及 merge 之后不会读到缓存中的旧值
+func TestKV_ValueCache(t *testing.T) {
+	config := newTestConfig("value_cache")
+	config.Set(consts.RagdollDataFileCapacity, 1024)
+	config.Set(consts.RagdollCachePolicy, "lru")
+	core, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := core.(*KV)
+	defer kv.Close()
+
+	check := func(i int, expect string) {
+		value, err := kv.Get(fmt.Sprintf("k%d", i))
+		if expect == "" {
+			if errs.GetCode(err) != errs.NotFoundErrCode {
+				t.Errorf("expect k%d not found, got %s, %v", i, value, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != expect {
+			t.Errorf("expect %s, got %s", expect, value)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		err = kv.Set(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 50; i++ {
+			check(i, fmt.Sprintf("v%d", i))
+		}
+	}
+	stats := kv.Data.cache.Stats()
+	if stats.Hits != 50 || stats.Misses != 50 {
+		t.Errorf("expect 50 hits and 50 misses, got %+v", stats)
+	}
+
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			err = kv.Delete(fmt.Sprintf("k%d", i))
+		} else {
+			err = kv.Set(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("new%d", i)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = kv.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			check(i, "")
+		} else {
+			check(i, fmt.Sprintf("new%d", i))
+		}
+	}
+
+	config = newTestConfig("value_cache_invalid")
+	config.Set(consts.RagdollCachePolicy, "unknown")
+	if _, err := New(config); errs.GetCode(err) != errs.InvalidParamErrCode {
+		t.Errorf("expect invalid param error, got %v", err)
+	}
+}
+
+// TestKV_Encryption 开启加密、轮换密钥之后旧数据仍然可以读取，重新加密之后不再需要旧密钥，数据文件中没有明文 value
+func TestKV_Encryption(t *testing.T) {
+	name := "encryption"
+	t.Setenv("EGGIE_KV_TEST_OLD_KEY", "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f")
+	newKeyPath := testDataDir + name + "/new.key"
+	err := os.MkdirAll(filepath.Dir(newKeyPath), 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(newKeyPath, []byte("0f0e0d0c0b0a09080706050403020100f0e0d0c0b0a090807060504030201000\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(key string, retired ...string) *KV {
+		config := newTestConfig(name)
+		config.Set(consts.RagdollDataFileCapacity, 1024)
+		config.Set(consts.RagdollCompression, "snappy")
+		config.Set(consts.RagdollCompressionThreshold, 0)
+		config.Set(consts.RagdollEncryptionKey, key)
+		config.Set(consts.RagdollEncryptionRetiredKeys, retired)
+		core, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return core.(*KV)
+	}
+	check := func(kv *KV, n int) {
+		for i := 0; i < n; i++ {
+			value, err := kv.Get(fmt.Sprintf("secret-key-%d", i))
+			if err != nil || string(value) != fmt.Sprintf("secret-value-%d", i) {
+				t.Errorf("secret-key-%d: expect secret-value-%d, got %s, %v", i, i, value, err)
+			}
+		}
+	}
+
+	// 依次以不加密、旧密钥加密写入
+	for round, key := range []string{"", "env:EGGIE_KV_TEST_OLD_KEY"} {
+		kv := open(key)
+		for i := round * 20; i < (round+1)*20; i++ {
+			err = kv.Set(fmt.Sprintf("secret-key-%d", i), []byte(fmt.Sprintf("secret-value-%d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = kv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kv := open(newKeyPath, "env:EGGIE_KV_TEST_OLD_KEY")
+	check(kv, 40)
+	err = kv.ReEncrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv = open("file:" + newKeyPath)
+	check(kv, 40)
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(testDataDir + name + "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		raw, err := os.ReadFile(testDataDir + name + "/data/" + entry.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte("secret-value")) {
+			t.Errorf("expect no plaintext value in %s", entry.Name())
+		}
+		if bytes.Contains(raw, []byte("secret-key")) {
+			t.Errorf("expect no plaintext key in %s", entry.Name())
+		}
+	}
+
+	config := newTestConfig(name)
+	if _, err := New(config); errs.GetCode(err) != errs.KeyNotFoundErrCode {
+		t.Errorf("expect key not found without key, got %v", err)
+	}
+}
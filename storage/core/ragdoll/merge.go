@@ -0,0 +1,790 @@
+package ragdoll
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/bloom"
+	"github.com/Trinoooo/eggie_kv/storage/core/encrypt"
+	"github.com/Trinoooo/eggie_kv/storage/core/format"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
+	"github.com/Trinoooo/eggie_kv/utils"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const (
+	hintFileSuffix  = ".hint"        // hintFileSuffix hint 文件的后缀标识
+	bloomFileSuffix = ".bloom"       // bloomFileSuffix 布隆过滤器文件的后缀标识
+	mergeDirName    = "merge"        // mergeDirName merge 过程中新数据文件所在的子目录
+	mergeMarkerName = "MERGE_FINISH" // mergeMarkerName merge 数据文件全部写入完成的标记文件
+
+	// hint 文件中每一项的字段长度，单位字节
+	hintKeySizeSize  = 8
+	hintOffsetSize   = 8
+	hintSizeSize     = 8
+	hintExpireAtSize = 8
+	hintHeaderSize   = 32
+
+	// merge 标记文件长度，单位字节
+	mergeMarkerSize = 24
+
+	// hintTombstone 墓碑对应 hint 的过期时间，加载时与已经过期的 Record 一样屏蔽更早的 Record
+	hintTombstone int64 = -1
+
+	// hintFlagSealed key 是加密之后的密文，与数据文件中对应 Record 存储的 key 相同
+	hintFlagSealed uint8 = 1
+	// hintKeySizeMask key 长度字段中除去最高字节标记位之外的部分
+	hintKeySizeMask uint64 = 1<<56 - 1
+
+	// defaultBloomFalsePositiveRate 布隆过滤器默认的误判率
+	defaultBloomFalsePositiveRate = 0.01
+	// bloomFlagSealed 布隆过滤器文件中的过滤器是加密之后的密文，避免通过过滤器确认猜测的 key 是否存在
+	bloomFlagSealed uint8 = 1
+)
+
+// hint hint 文件中的一项，对应 merge 后数据文件中的一条 Record
+// 存储在 hint 文件中的结构：| 标记位 1字节 | key 长度 7字节 | offset 8字节 | size 8字节 | 过期时间 8字节 | key |
+// 没有标记位的旧 hint 文件中这个字节始终是0，即 key 是明文；墓碑的过期时间是 hintTombstone
+type hint struct {
+	flag     uint8
+	key      string // key 写入时是 hint 文件中存储的 key，flag 中有 hintFlagSealed 时是密文；加载之后是明文
+	offset   int64
+	size     int64
+	expireAt int64
+}
+
+// encode 序列化 hint
+func (h *hint) encode() []byte {
+	buf := make([]byte, hintHeaderSize+len(h.key))
+	binary.BigEndian.PutUint64(buf, uint64(len(h.key)))
+	buf[0] = h.flag
+	binary.BigEndian.PutUint64(buf[hintKeySizeSize:], uint64(h.offset))
+	binary.BigEndian.PutUint64(buf[hintKeySizeSize+hintOffsetSize:], uint64(h.size))
+	binary.BigEndian.PutUint64(buf[hintKeySizeSize+hintOffsetSize+hintSizeSize:], uint64(h.expireAt))
+	copy(buf[hintHeaderSize:], h.key)
+	return buf
+}
+
+// mergeMove merge 过程中一条存活 Record 的新旧位置，new 为nil表示 Record 已经过期，需要从 keydir 中删除
+type mergeMove struct {
+	key string
+	old *Entry
+	new *Entry
+}
+
+// mergeFile merge 过程中正在写入的新数据文件
+type mergeFile struct {
+	id     int64
+	data   *os.File
+	hint   *os.File
+	size   int64
+	dead   int64 // dead 写入时就已经失效的 Record 总长度，即跟在历史版本后面的墓碑
+	hintBw *bufio.Writer
+	keys   []string      // keys 写入的全部明文 key，全部写入之后用于构建布隆过滤器
+	filter *bloom.Filter // filter 全部写入之后构建的布隆过滤器，替换输入文件之后交给新数据文件
+}
+
+// write 追加写入一条 Record 以及对应的 hint
+func (mf *mergeFile) write(record *Record) error {
+	_, err := mf.data.Write(record.encode())
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+
+	// 加密的 Record 在 hint 中同样只记录 key 的密文
+	h := &hint{key: string(record.storedKey()), offset: mf.size, size: record.size(), expireAt: record.ExpireAt}
+	if record.sealedKey != nil {
+		h.flag = hintFlagSealed
+	}
+	if record.isTombstone() {
+		h.expireAt = hintTombstone
+	}
+	_, err = mf.hintBw.Write(h.encode())
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+	mf.keys = append(mf.keys, record.Key)
+	mf.size += record.size()
+	return nil
+}
+
+// hintPath 数据文件id转 hint 文件路径
+func hintPath(dirPath string, id int64) string {
+	return filepath.Join(dirPath, fmt.Sprintf(dataFileBaseFormat, id)+hintFileSuffix)
+}
+
+// bloomPath 数据文件id转布隆过滤器文件路径
+func bloomPath(dirPath string, id int64) string {
+	return filepath.Join(dirPath, fmt.Sprintf(dataFileBaseFormat, id)+bloomFileSuffix)
+}
+
+// dataPath 数据文件id转数据文件路径
+func dataPath(dirPath string, id int64) string {
+	return filepath.Join(dirPath, fmt.Sprintf(dataFileBaseFormat, id)+dataFileSuffix)
+}
+
+// mergeDir merge 子目录路径
+func (d *Data) mergeDir() string {
+	return filepath.Join(d.dirPath, mergeDirName)
+}
+
+// DeadRatio 返回全部数据文件中失效数据的占比，以及数据文件的总大小
+func (d *Data) DeadRatio() (float64, int64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var total, dead int64
+	for _, df := range d.files {
+		total += df.size
+		dead += df.dead
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(dead) / float64(total), total
+}
+
+// Merge 压缩除 active 之外的全部数据文件，只保留 keydir 中仍然指向的 Record
+//
+// merge 分为三个阶段：
+//  1. 加锁 rotate 出新的 active 数据文件，此前的数据文件都是不会再写入的 merge 输入
+//  2. 不加锁顺序扫描输入文件，将存活的 Record 写入 merge 子目录下的新数据文件，同时生成 hint 文件，
+//     全部写完并持久化之后写入标记文件
+//  3. 加锁更新 keydir，用新数据文件替换输入文件
+//
+// 第二阶段不阻塞读写，第三阶段只涉及文件重命名。标记文件写入之后宕机，重启时会继续完成替换；
+// 标记文件写入之前宕机，重启时丢弃 merge 子目录
+func (d *Data) Merge() error {
+	d.mergeMu.Lock()
+	defer d.mergeMu.Unlock()
+
+	start := time.Now()
+	inputs, err := d.prepareMerge()
+	if err != nil || len(inputs) == 0 {
+		return err
+	}
+
+	outputs, moves, err := d.writeMerge(inputs)
+	if err != nil {
+		_ = os.RemoveAll(d.mergeDir())
+		return err
+	}
+
+	err = d.installMerge(inputs, outputs, moves)
+	if err != nil {
+		return err
+	}
+
+	var inputSize, outputSize int64
+	for _, df := range inputs {
+		inputSize += df.size
+	}
+	for _, mf := range outputs {
+		outputSize += mf.size
+	}
+	logs.Info("ragdoll merge finish",
+		zap.Int("inputs", len(inputs)),
+		zap.Int("outputs", len(outputs)),
+		zap.Int64("inputSize", inputSize),
+		zap.Int64("outputSize", outputSize),
+		zap.Duration("cost", time.Since(start)),
+	)
+	return nil
+}
+
+// needReseal 判断 Record 是否需要使用当前密钥重新加密
+func (d *Data) needReseal(record *Record) bool {
+	if d.keyring == nil {
+		return false
+	}
+	if !record.isEncrypted() {
+		return true
+	}
+	id, ok := encrypt.SealedKeyID(record.sealedKey)
+	return !ok || id != d.keyring.Active().ID()
+}
+
+// prepareMerge rotate 出新的 active 数据文件，返回按id从小到大排序的 merge 输入
+func (d *Data) prepareMerge() ([]*dataFile, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.active == nil {
+		e := errs.NewFileClosedErr()
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	if !d.active.isEmpty() {
+		err := d.rotate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var inputs []*dataFile
+	for id := int64(0); id < d.active.id; id++ {
+		if df, exist := d.files[id]; exist {
+			inputs = append(inputs, df)
+		}
+	}
+	return inputs, nil
+}
+
+// writeMerge 将输入文件中存活的 Record 写入 merge 子目录
+// 新数据文件id从最小的输入文件id开始递增。重新加密会让 Record 变大，历史版本后面还会追加墓碑，
+// 新数据文件的数量可能超过输入文件，此时在写入标记文件之前后移 merge 开始之后的数据文件，见 Data.shiftNewerFiles
+func (d *Data) writeMerge(inputs []*dataFile) ([]*mergeFile, []*mergeMove, error) {
+	err := os.RemoveAll(d.mergeDir())
+	if err != nil {
+		e := errs.NewRemoveFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, nil, e
+	}
+	err = os.MkdirAll(d.mergeDir(), defaultDataDirPerm)
+	if err != nil {
+		e := errs.NewMkdirErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, nil, e
+	}
+
+	var (
+		outputs []*mergeFile
+		moves   []*mergeMove
+		current *mergeFile
+	)
+	// 出错时也需要关闭新数据文件
+	defer func() {
+		for _, mf := range outputs {
+			_ = mf.data.Close()
+			_ = mf.hint.Close()
+		}
+	}()
+
+	now := time.Now().UnixNano()
+	nextID := inputs[0].id
+	for _, df := range inputs {
+		reader := bufio.NewReader(io.NewSectionReader(df.fd, df.base, df.size-df.base))
+		offset := df.base
+		for offset < df.size {
+			record, _, err := readRecord(reader, df.checksum, d.keyring)
+			if err != nil {
+				return nil, nil, err
+			}
+			old := &Entry{FileID: df.id, Offset: offset, Size: record.size(), ExpireAt: record.ExpireAt}
+			offset += record.size()
+
+			// 被覆盖、删除的 Record 以及墓碑都不再保留
+			live, latest := d.isLive(record.Key, old)
+			if !live {
+				continue
+			}
+
+			// 已经过期的 Record 同样不再保留，更早的 Record 也在本次 merge 的输入中，
+			// 其中仍然保留的历史版本后面都有墓碑，不需要再为过期的 Record 写入墓碑
+			if record.isExpired(now) {
+				moves = append(moves, &mergeMove{key: record.Key, old: old})
+				continue
+			}
+
+			// 没有加密或者使用旧密钥加密的 Record 使用当前密钥重新加密，压缩算法保持不变，merge 完成之后旧密钥就不再需要
+			if d.needReseal(record) {
+				value, err := record.decrypt(d.keyring)
+				if err != nil {
+					logs.Error(err.Error(), zap.String(consts.LogFieldParams, "key"), zap.String(consts.LogFieldValue, record.Key))
+					return nil, nil, err
+				}
+				record = newFlaggedRecord(record.Key, value, record.ExpireAt, record.Flag, d.keyring)
+			} else if df.checksum != format.CRC32C {
+				// 旧格式数据文件中的 Record 写入新数据文件时需要按当前格式重新计算 checksum
+				record.sign()
+			}
+
+			// 只被快照读到的历史版本后面紧跟一条墓碑：屏蔽它的更新版本或者墓碑可能已经过期、
+			// 或者同样在本次 merge 的输入中被丢弃，没有墓碑时重启会读到这个历史版本。
+			// key 仍然存在时更新的版本在新数据文件中排在墓碑之后，或者在更新的数据文件中
+			records := []*Record{record}
+			if !latest {
+				records = append(records, newSealedTombstone(record.Key, d.keyring))
+			}
+			var size int64
+			for _, r := range records {
+				size += r.size()
+			}
+
+			if current == nil || current.size+size > d.capacity {
+				current, err = d.createMergeFile(nextID)
+				if err != nil {
+					return nil, nil, err
+				}
+				outputs = append(outputs, current)
+				nextID++
+			}
+
+			for _, r := range records {
+				err = current.write(r)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+
+			offset := current.size - size
+			moves = append(moves, &mergeMove{
+				key: record.Key,
+				old: old,
+				new: &Entry{FileID: current.id, Offset: offset, Size: record.size(), ExpireAt: record.ExpireAt},
+			})
+			if !latest {
+				current.dead += size - record.size()
+			}
+		}
+	}
+
+	for _, mf := range outputs {
+		err = mf.hintBw.Flush()
+		if err != nil {
+			e := errs.NewWriteFileErr().WithErr(err)
+			logs.Error(e.Error())
+			return nil, nil, e
+		}
+		for _, fd := range []*os.File{mf.data, mf.hint} {
+			err = fd.Sync()
+			if err != nil {
+				e := errs.NewSyncFileErr().WithErr(err)
+				logs.Error(e.Error())
+				return nil, nil, e
+			}
+		}
+		err = d.writeFilter(mf)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(outputs) > 0 {
+		err = d.shiftNewerFiles(inputs[len(inputs)-1].id, outputs[len(outputs)-1].id)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// 新数据文件全部持久化之后才写入标记文件
+	marker := make([]byte, mergeMarkerSize)
+	binary.BigEndian.PutUint64(marker, uint64(inputs[0].id))
+	binary.BigEndian.PutUint64(marker[8:], uint64(inputs[len(inputs)-1].id))
+	binary.BigEndian.PutUint64(marker[16:], uint64(len(outputs)))
+	fd, err := utils.CheckAndCreateFile(filepath.Join(d.mergeDir(), mergeMarkerName), syscall.O_CREAT|syscall.O_TRUNC|syscall.O_WRONLY, defaultDataFilePerm)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fd.Close()
+	_, err = fd.Write(marker)
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, nil, e
+	}
+	err = fd.Sync()
+	if err != nil {
+		e := errs.NewSyncFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, nil, e
+	}
+
+	return outputs, moves, nil
+}
+
+// isLive 判断 Record 是否仍然是 key 对应的最新 Record，或者仍然可能被快照读到
+// 第二个返回值表示 Record 是否是最新 Record，只被快照读到的历史版本返回false
+func (d *Data) isLive(key string, entry *Entry) (bool, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	current, exist := d.Mem[key]
+	if exist && current.samePosition(entry) {
+		return true, true
+	}
+	for _, version := range d.history[key] {
+		if !version.Deleted && version.samePosition(entry) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// shiftNewerFiles 新数据文件的id超过最大的输入文件id时，将 merge 开始之后的数据文件（包括 active）整体后移，
+// 为多出的新数据文件腾出id，保证新数据文件替换时不会覆盖这些数据文件，并且仍然排在它们之前。
+// 按id从大到小依次重命名，中途宕机时数据文件之间的顺序不变，此时还没有标记文件，重启时丢弃 merge 子目录
+func (d *Data) shiftNewerFiles(maxInputID, maxOutputID int64) error {
+	shift := maxOutputID - maxInputID
+	if shift <= 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var ids []int64
+	for id := range d.files {
+		if id > maxInputID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] > ids[j]
+	})
+
+	for _, id := range ids {
+		err := os.Rename(d.filePath(id), d.filePath(id+shift))
+		if err != nil {
+			e := errs.NewRenameFileErr().WithErr(err)
+			logs.Error(e.Error())
+			return e
+		}
+		df := d.files[id]
+		delete(d.files, id)
+		df.id = id + shift
+		d.files[df.id] = df
+	}
+
+	// 与 merge 一样替换为新的 Entry，缓存中以旧 Entry 为 tag 的 value 不会再被读到
+	shiftEntry := func(entry *Entry) *Entry {
+		shifted := *entry
+		shifted.FileID += shift
+		return &shifted
+	}
+	for key, entry := range d.Mem {
+		if entry.FileID > maxInputID {
+			d.Mem[key] = shiftEntry(entry)
+		}
+	}
+	for _, history := range d.history {
+		for i, version := range history {
+			if !version.Deleted && version.FileID > maxInputID {
+				history[i] = shiftEntry(version)
+			}
+		}
+	}
+
+	logs.Info("ragdoll shift data files for merge output", zap.Int64("maxInputID", maxInputID), zap.Int64("shift", shift), zap.Int("files", len(ids)))
+	return nil
+}
+
+// writeFilter 为新数据文件中的全部 key 构建布隆过滤器，写入 merge 子目录中的布隆过滤器文件
+// 存储在布隆过滤器文件中的结构：| 标记位 1字节 | 布隆过滤器 |，有密钥时布隆过滤器加密存储，见 bloomFlagSealed
+func (d *Data) writeFilter(mf *mergeFile) error {
+	filter, err := bloom.New(len(mf.keys), d.bloomFPR)
+	if err != nil {
+		logs.Error(err.Error(), zap.Float64("fpr", d.bloomFPR))
+		return err
+	}
+	for _, key := range mf.keys {
+		filter.Add([]byte(key))
+	}
+
+	raw := filter.Encode()
+	flag := uint8(0)
+	if d.keyring != nil {
+		raw = d.keyring.Seal(raw, nil)
+		flag = bloomFlagSealed
+	}
+
+	fd, err := utils.CheckAndCreateFile(bloomPath(d.mergeDir(), mf.id), syscall.O_CREAT|syscall.O_TRUNC|syscall.O_WRONLY, defaultDataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = fd.Write(append([]byte{flag}, raw...))
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+	err = fd.Sync()
+	if err != nil {
+		e := errs.NewSyncFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+
+	mf.keys = nil
+	mf.filter = filter
+	return nil
+}
+
+// createMergeFile 在 merge 子目录中创建新数据文件以及对应的 hint 文件
+func (d *Data) createMergeFile(id int64) (*mergeFile, error) {
+	data, err := utils.CheckAndCreateFile(dataPath(d.mergeDir(), id), syscall.O_APPEND|syscall.O_CREAT|syscall.O_TRUNC|syscall.O_WRONLY, defaultDataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	hintFd, err := utils.CheckAndCreateFile(hintPath(d.mergeDir(), id), syscall.O_APPEND|syscall.O_CREAT|syscall.O_TRUNC|syscall.O_WRONLY, defaultDataFilePerm)
+	if err != nil {
+		_ = data.Close()
+		return nil, err
+	}
+
+	_, err = data.Write(format.NewHeader(dataFileMagic).Encode())
+	if err != nil {
+		_ = data.Close()
+		_ = hintFd.Close()
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	return &mergeFile{
+		id:     id,
+		data:   data,
+		hint:   hintFd,
+		size:   format.HeaderSize,
+		hintBw: bufio.NewWriter(hintFd),
+	}, nil
+}
+
+// installMerge 用新数据文件替换输入文件
+// merge 期间被覆盖的 key 不会更新 keydir，对应的 Record 计入新数据文件的失效数据；
+// 快照读到的历史版本同样指向新数据文件，这部分 Record 对于最新版本已经失效
+func (d *Data) installMerge(inputs []*dataFile, outputs []*mergeFile, moves []*mergeMove) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dead := make(map[int64]int64, len(outputs))
+	for _, mf := range outputs {
+		dead[mf.id] = mf.dead
+	}
+	for _, move := range moves {
+		if move.new != nil {
+			d.relocateHistory(move)
+		}
+
+		current, exist := d.Mem[move.key]
+		switch {
+		case exist && current.samePosition(move.old) && move.new == nil:
+			// 与主动过期一样，快照读到该版本时同样视为过期
+			d.dropEntry(move.key, current, current.Version)
+		case exist && current.samePosition(move.old):
+			relocated := *move.new
+			relocated.Version = current.Version
+			d.Mem[move.key] = &relocated
+		case move.new != nil:
+			dead[move.new.FileID] += move.new.Size
+		}
+	}
+
+	for _, df := range inputs {
+		err := df.fd.Close()
+		if err != nil {
+			e := errs.NewCloseFileErr().WithErr(err)
+			logs.Error(e.Error())
+			return e
+		}
+		delete(d.files, df.id)
+	}
+
+	err := d.finishMerge()
+	if err != nil {
+		return err
+	}
+
+	for _, mf := range outputs {
+		df, err := d.openFile(mf.id)
+		if err != nil {
+			return err
+		}
+		df.dead = dead[mf.id]
+		df.filter = mf.filter
+		d.files[df.id] = df
+	}
+	return nil
+}
+
+// relocateHistory 将指向 move.old 的历史版本改为指向 move.new，版本号保持不变
+func (d *Data) relocateHistory(move *mergeMove) {
+	history := d.history[move.key]
+	for i, version := range history {
+		if !version.Deleted && version.samePosition(move.old) {
+			relocated := *move.new
+			relocated.Version = version.Version
+			history[i] = &relocated
+		}
+	}
+}
+
+// finishMerge 如果 merge 子目录中存在标记文件，将新数据文件移动到数据文件目录并删除多余的输入文件
+// 替换过程可以重复执行，中途宕机后重启会再次执行；没有标记文件时说明 merge 没有完成，直接丢弃
+func (d *Data) finishMerge() error {
+	raw, err := os.ReadFile(filepath.Join(d.mergeDir(), mergeMarkerName))
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.RemoveAll(d.mergeDir())
+		if err != nil {
+			e := errs.NewRemoveFileErr().WithErr(err)
+			logs.Error(e.Error())
+			return e
+		}
+		return nil
+	} else if err != nil {
+		e := errs.NewReadFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+	if len(raw) != mergeMarkerSize {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "marker"), zap.Int(consts.LogFieldValue, len(raw)))
+		return e
+	}
+	minID := int64(binary.BigEndian.Uint64(raw))
+	maxID := int64(binary.BigEndian.Uint64(raw[8:]))
+	n := int64(binary.BigEndian.Uint64(raw[16:]))
+
+	entries, err := os.ReadDir(d.mergeDir())
+	if err != nil {
+		e := errs.NewWalkDirErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+	for _, entry := range entries {
+		if entry.Name() == mergeMarkerName {
+			continue
+		}
+		err = os.Rename(filepath.Join(d.mergeDir(), entry.Name()), filepath.Join(d.dirPath, entry.Name()))
+		if err != nil {
+			e := errs.NewRenameFileErr().WithErr(err)
+			logs.Error(e.Error())
+			return e
+		}
+	}
+
+	// [minID, minID+n) 已经被新数据文件覆盖，剩余的输入文件直接删除
+	for id := minID + n; id <= maxID; id++ {
+		for _, path := range []string{dataPath(d.dirPath, id), hintPath(d.dirPath, id), bloomPath(d.dirPath, id)} {
+			err = os.Remove(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				e := errs.NewRemoveFileErr().WithErr(err)
+				logs.Error(e.Error())
+				return e
+			}
+		}
+	}
+
+	err = os.RemoveAll(d.mergeDir())
+	if err != nil {
+		e := errs.NewRemoveFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+	return nil
+}
+
+// loadFilter 加载 merge 时为数据文件构建的布隆过滤器
+// 布隆过滤器文件不存在或者损坏时不过滤，读取时直接访问数据文件
+func (d *Data) loadFilter(df *dataFile) {
+	raw, err := os.ReadFile(bloomPath(d.dirPath, df.id))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logs.Warn("read bloom file failed", zap.Int64("fileID", df.id), zap.Error(err))
+		}
+		return
+	}
+	if len(raw) == 0 {
+		logs.Warn("bloom file corrupt", zap.Int64("fileID", df.id))
+		return
+	}
+
+	flag := raw[0]
+	raw = raw[1:]
+	if flag&bloomFlagSealed != 0 {
+		if d.keyring == nil {
+			logs.Warn("bloom file sealed without keyring", zap.Int64("fileID", df.id))
+			return
+		}
+		raw, err = d.keyring.Open(raw, nil)
+		if err != nil {
+			logs.Warn("open bloom file failed", zap.Int64("fileID", df.id), zap.Error(err))
+			return
+		}
+	}
+
+	filter, err := bloom.Decode(raw)
+	if err != nil {
+		logs.Warn("bloom file corrupt", zap.Int64("fileID", df.id), zap.Error(err))
+		return
+	}
+	df.filter = filter
+}
+
+// loadHint 通过 hint 文件重建数据文件对应的 keydir
+// hint 文件不存在或者损坏时返回false，需要扫描数据文件
+func (d *Data) loadHint(df *dataFile) bool {
+	raw, err := os.ReadFile(hintPath(d.dirPath, df.id))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logs.Warn("read hint file failed", zap.Int64("fileID", df.id), zap.Error(err))
+		}
+		return false
+	}
+
+	// 先完整解析再更新 keydir，避免损坏的 hint 文件留下一半的数据
+	var hints []*hint
+	for len(raw) > 0 {
+		if len(raw) < hintHeaderSize {
+			logs.Warn("hint file corrupt", zap.Int64("fileID", df.id))
+			return false
+		}
+		flag := raw[0]
+		keySize := binary.BigEndian.Uint64(raw) & hintKeySizeMask
+		offset := int64(binary.BigEndian.Uint64(raw[hintKeySizeSize:]))
+		size := int64(binary.BigEndian.Uint64(raw[hintKeySizeSize+hintOffsetSize:]))
+		expireAt := int64(binary.BigEndian.Uint64(raw[hintKeySizeSize+hintOffsetSize+hintSizeSize:]))
+		if uint64(len(raw)-hintHeaderSize) < keySize || offset < 0 || size < recordHeaderSize || offset+size > df.size {
+			logs.Warn("hint file corrupt", zap.Int64("fileID", df.id))
+			return false
+		}
+		key := raw[hintHeaderSize : hintHeaderSize+keySize]
+		if flag&hintFlagSealed != 0 {
+			// 没有密钥时无法解密 key，扫描数据文件时会返回具体的错误
+			if d.keyring == nil {
+				logs.Warn("hint file sealed without keyring", zap.Int64("fileID", df.id))
+				return false
+			}
+			key, err = d.keyring.Open(key, nil)
+			if err != nil {
+				logs.Warn("open hint key failed", zap.Int64("fileID", df.id), zap.Error(err))
+				return false
+			}
+		}
+		hints = append(hints, &hint{
+			flag:     flag,
+			key:      string(key),
+			offset:   offset,
+			size:     size,
+			expireAt: expireAt,
+		})
+		raw = raw[hintHeaderSize+keySize:]
+	}
+
+	// 墓碑以及已经过期的 key 需要屏蔽更早的 Record
+	now := time.Now().UnixNano()
+	for _, h := range hints {
+		if h.expireAt == hintTombstone || (h.expireAt != 0 && h.expireAt <= now) {
+			d.removeEntry(h.key, df, h.size, 0)
+			continue
+		}
+		d.setEntry(h.key, &Entry{FileID: df.id, Offset: h.offset, Size: h.size, ExpireAt: h.expireAt})
+	}
+	return true
+}
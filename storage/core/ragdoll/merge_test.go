@@ -0,0 +1,363 @@
+package ragdoll
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/bloom"
+	"github.com/Trinoooo/eggie_kv/storage/core/encrypt"
+	"os"
+	"testing"
+)
+
+// diskUsage 统计数据文件目录下全部数据文件的大小
+func diskUsage(t *testing.T, data *Data) int64 {
+	ids, err := data.listFileIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	for _, id := range ids {
+		stat, err := os.Stat(data.filePath(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += stat.Size()
+	}
+	return total
+}
+
+// TestData_Merge 反复覆盖写入后 merge，磁盘占用下降，重新打开后通过 hint 文件恢复每个 key 的最新值
+func TestData_Merge(t *testing.T) {
+	dirPath := testDataDir + "data_merge"
+	data, err := NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		err = data.Put(fmt.Sprintf("k%d", i%50), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ratio, _ := data.DeadRatio()
+	if ratio < 0.9 {
+		t.Errorf("expect dead ratio >= 0.9, got %f", ratio)
+	}
+
+	before := diskUsage(t, data)
+	err = data.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := diskUsage(t, data)
+	t.Log("disk usage before merge:", before, "after merge:", after)
+	if after >= before/10 {
+		t.Errorf("expect disk usage shrink, before %d, after %d", before, after)
+	}
+
+	ratio, _ = data.DeadRatio()
+	if ratio != 0 {
+		t.Errorf("expect dead ratio 0 after merge, got %f", ratio)
+	}
+
+	for i := 950; i < 1000; i++ {
+		value, err := data.Get(fmt.Sprintf("k%d", i%50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expect v%d, got %s", i, value)
+		}
+	}
+
+	// merge 之后继续写入
+	err = data.Put("k0", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(hintPath(dirPath, 0)); err != nil {
+		t.Fatal("expect hint file exist", err)
+	}
+
+	data, err = NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	for i := 951; i < 1000; i++ {
+		value, err := data.Get(fmt.Sprintf("k%d", i%50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expect v%d, got %s", i, value)
+		}
+	}
+	value, err := data.Get("k0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "new" {
+		t.Errorf("expect new, got %s", value)
+	}
+}
+
+// TestData_MergeConcurrent merge 期间并发读写，读写结果不受影响
+func TestData_MergeConcurrent(t *testing.T) {
+	dirPath := testDataDir + "data_merge_concurrent"
+	data, err := NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	for i := 0; i < 500; i++ {
+		err = data.Put(fmt.Sprintf("k%d", i%20), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- data.Merge()
+	}()
+
+	for i := 500; i < 1000; i++ {
+		key := fmt.Sprintf("k%d", i%20)
+		err = data.Put(key, []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := data.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expect v%d, got %s", i, value)
+		}
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 980; i < 1000; i++ {
+		value, err := data.Get(fmt.Sprintf("k%d", i%20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expect v%d, got %s", i, value)
+		}
+	}
+}
+
+// TestData_MergeRecover 模拟标记文件写入之后、替换完成之前宕机，重新打开时继续完成替换
+func TestData_MergeRecover(t *testing.T) {
+	dirPath := testDataDir + "data_merge_recover"
+	data, err := NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		err = data.Put(fmt.Sprintf("k%d", i%50), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inputs, err := data.prepareMerge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = data.writeMerge(inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	if _, err = os.Stat(data.mergeDir()); !os.IsNotExist(err) {
+		t.Error("expect merge dir removed", err)
+	}
+	if len(data.files) >= len(inputs) {
+		t.Errorf("expect less than %d data files, got %d", len(inputs), len(data.files))
+	}
+
+	for i := 950; i < 1000; i++ {
+		value, err := data.Get(fmt.Sprintf("k%d", i%50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expect v%d, got %s", i, value)
+		}
+	}
+}
+
+// TestData_MergeGrow 开启加密之后 merge 重新加密写满的数据文件，新数据文件比输入文件多，
+// 不会覆盖 merge 开始之后的数据文件，merge 之后的写入在重新打开之后仍然可以读到
+func TestData_MergeGrow(t *testing.T) {
+	dirPath := testDataDir + "data_merge_grow"
+	data, err := NewData(dirPath, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		err = data.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputs := len(data.files)
+
+	key, err := encrypt.NewKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := encrypt.NewKeyring(key)
+	data.keyring = keyring
+	err = data.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// active 之前的全部数据文件都是 merge 的输出
+	if outputs := len(data.files) - 1; outputs <= inputs {
+		t.Fatalf("expect more than %d merge outputs, got %d", inputs, outputs)
+	}
+
+	for i := 200; i < 210; i++ {
+		err = data.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func() {
+		for i := 0; i < 210; i++ {
+			value, err := data.Get(fmt.Sprintf("k%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != fmt.Sprintf("v%d", i) {
+				t.Errorf("expect v%d, got %s", i, value)
+			}
+		}
+	}
+	check()
+
+	err = data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hint 文件中的 key 同样是密文，没有密钥时不能跳过数据文件重建 keydir
+	_, err = NewData(dirPath, 1024)
+	if errs.GetCode(err) != errs.KeyNotFoundErrCode {
+		t.Fatalf("expect key not found without keyring, got %v", err)
+	}
+
+	data, err = newData(dirPath, 1024, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	check()
+}
+
+// TestData_MergeBloom merge 为新数据文件构建布隆过滤器，重新打开之后从布隆过滤器文件中加载，
+// 布隆过滤器判断 key 不存在时不读取数据文件
+func TestData_MergeBloom(t *testing.T) {
+	dirPath := testDataDir + "data_merge_bloom"
+	key, err := encrypt.NewKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := encrypt.NewKeyring(key)
+	data, err := newData(dirPath, 1024, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		err = data.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = data.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = data.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(bloomPath(dirPath, 0)); err != nil {
+		t.Fatal("expect bloom file exist", err)
+	}
+
+	data, err = newData(dirPath, 1024, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprintf("k%d", i)
+		entry := data.Mem[k]
+		df := data.files[entry.FileID]
+		if df.filter == nil {
+			t.Fatalf("expect bloom filter for file %d", df.id)
+		}
+		if !df.filter.MayContain([]byte(k)) {
+			t.Fatalf("expect bloom filter of file %d contains %s", df.id, k)
+		}
+		value, err := data.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expect v%d, got %s", i, value)
+		}
+	}
+
+	// 替换为空的布隆过滤器，读取时不再访问数据文件
+	entry := data.Mem["k0"]
+	data.files[entry.FileID].filter, err = bloom.New(0, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := bloom.TotalStats()
+	_, err = data.Get("k0")
+	if errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Fatalf("expect not found, got %v", err)
+	}
+	if after := bloom.TotalStats(); after.Negatives != before.Negatives+1 {
+		t.Errorf("expect one bloom negative, got %d", after.Negatives-before.Negatives)
+	}
+}
@@ -0,0 +1,183 @@
+package ragdoll
+
+import (
+	"sync"
+
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+)
+
+// latestVersion 读取最新版本时使用的版本号
+const latestVersion int64 = -1
+
+// Snapshot 只读快照，固定在创建时最后应用的 wal 日志上
+// 通过快照读取只能看到这条日志及之前的写入，之后的写入、删除以及 merge 都不影响快照的读取结果；
+// 过期时间仍然按读取时的时间判断。
+// 快照持有期间被覆盖、删除的版本会保留在内存中，使用完之后需要调用 Release
+type Snapshot struct {
+	data    *Data
+	version int64
+	once    sync.Once
+}
+
+// BlockIdx 返回快照固定的 wal 日志索引，没有任何写入时是-1
+func (s *Snapshot) BlockIdx() int64 {
+	return versionToBlockIdx(s.version)
+}
+
+// Get 读取 key 在快照中的 value
+func (s *Snapshot) Get(key string) ([]byte, error) {
+	return s.data.getAt(key, s.version)
+}
+
+// NewIterator 创建遍历快照的迭代器，需要在 Release 之前使用完
+func (s *Snapshot) NewIterator(opts *iface.IteratorOptions) iface.Iterator {
+	return newIteratorAt(s.data, opts, s.version)
+}
+
+// Release 释放快照，最早的快照释放后清理不再被任何快照读到的历史版本，重复调用没有影响
+func (s *Snapshot) Release() {
+	s.once.Do(func() {
+		s.data.releaseSnapshot(s.version)
+	})
+}
+
+// blockIdxToVersion wal 日志索引转版本号
+// 版本号0留给打开数据文件时加载的 Record，因此版本号是日志索引加一。
+// note：日志索引达到 wal 容量上限后会从0开始循环，目前不考虑循环之后的版本号
+func blockIdxToVersion(blockIdx int64) int64 {
+	return blockIdx + 1
+}
+
+// versionToBlockIdx 版本号转 wal 日志索引
+func versionToBlockIdx(version int64) int64 {
+	return version - 1
+}
+
+// Snapshot 创建固定在当前版本的快照
+func (d *Data) Snapshot() *Snapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.snapshots[d.version]++
+	return &Snapshot{data: d, version: d.version}
+}
+
+// releaseSnapshot 释放 version 的一次引用
+// 历史版本只会被不晚于它的快照读到，只有最早的快照全部释放时才需要清理，
+// 避免每次事务提交或回滚都在写锁下扫描整个 history
+func (d *Data) releaseSnapshot(version int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.snapshots[version]--
+	if d.snapshots[version] > 0 {
+		return
+	}
+	delete(d.snapshots, version)
+	for other := range d.snapshots {
+		if other < version {
+			return
+		}
+	}
+	d.pruneHistory()
+}
+
+// lookup 查找 key 在 version 时的 Entry，调用方需要持有锁
+// 当前版本不晚于 version 时直接使用 keydir，否则在历史版本中查找最后一个不晚于 version 的版本
+func (d *Data) lookup(key string, version int64) (*Entry, bool) {
+	entry, exist := d.Mem[key]
+	if version == latestVersion || (exist && entry.Version <= version) {
+		return entry, exist
+	}
+
+	history := d.history[key]
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Version <= version {
+			if history[i].Deleted {
+				return nil, false
+			}
+			return history[i], true
+		}
+	}
+	return nil, false
+}
+
+// keepVersion key 的版本 old 即将被覆盖或删除，仍然可能被快照读到时保存到 history 中
+// 快照的版本号都不大于当前版本，只需要和最大的快照版本号比较
+func (d *Data) keepVersion(key string, old *Entry) {
+	if len(d.snapshots) == 0 {
+		return
+	}
+
+	var latest int64 = latestVersion
+	for version := range d.snapshots {
+		if version > latest {
+			latest = version
+		}
+	}
+	if old.Version <= latest {
+		d.history[key] = append(d.history[key], old)
+	}
+}
+
+// markDeleted 记录 key 从 version 开始被删除
+// history 为空时快照读不到 key 的任何版本，不需要记录
+func (d *Data) markDeleted(key string, version int64) {
+	history, exist := d.history[key]
+	if !exist {
+		return
+	}
+	d.history[key] = append(history, &Entry{Version: version, Deleted: true})
+}
+
+// pruneHistory 清理不会再被任何快照读到的历史版本
+// 每个 key 只需要保留最后一个不晚于最小快照版本号的版本以及之后的版本
+func (d *Data) pruneHistory() {
+	oldest := latestVersion
+	for version := range d.snapshots {
+		if oldest == latestVersion || version < oldest {
+			oldest = version
+		}
+	}
+
+	for key, history := range d.history {
+		i := len(history) - 1
+		for i >= 0 && history[i].Version > oldest {
+			i--
+		}
+		if i < 0 {
+			i = 0
+		}
+		// 开头的删除标记与没有历史版本等价
+		for i < len(history) && history[i].Deleted {
+			i++
+		}
+
+		entry, exist := d.Mem[key]
+		if oldest == latestVersion || i == len(history) || (exist && entry.Version <= oldest) {
+			delete(d.history, key)
+			if !exist {
+				d.Index.Delete(key)
+			}
+			continue
+		}
+		if i > 0 {
+			d.history[key] = append([]*Entry(nil), history[i:]...)
+		}
+	}
+}
+
+// modifiedSince 判断 key 在 version 之后是否被写入或删除
+// 调用方需要持有 version 的快照，保证 version 之后的删除会记录在 history 中；
+// key 在 version 之后被创建又被删除时状态与 version 时相同，不认为被修改。
+// 组提交全部应用之后才更新版本号（见 Data.ApplyGroup），事务快照的版本号不会与读到旧值的写入版本号相同
+func (d *Data) modifiedSince(key string, version int64) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if entry, exist := d.Mem[key]; exist && entry.Version > version {
+		return true
+	}
+	history := d.history[key]
+	return len(history) > 0 && history[len(history)-1].Version > version
+}
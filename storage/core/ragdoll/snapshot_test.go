@@ -0,0 +1,371 @@
+package ragdoll
+
+import (
+	"fmt"
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestKV_Snapshot 快照只能看到创建之前的写入，之后的覆盖、删除以及新写入都不可见
+func TestKV_Snapshot(t *testing.T) {
+	config := newTestConfig("snapshot")
+	core, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := core.(*KV)
+	defer kv.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		err = kv.Set(key, []byte("v"+key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := kv.Snapshot()
+	if snapshot.BlockIdx() != 2 {
+		t.Errorf("expect snapshot pinned at block 2, got %d", snapshot.BlockIdx())
+	}
+
+	err = kv.WriteBatch(iface.NewWriteBatch().Set("a", []byte("new")).Delete("b").Set("d", []byte("vd")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 删除之后重新写入
+	err = kv.Delete("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Set("c", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		value, err := snapshot.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "v"+key {
+			t.Errorf("expect v%s, got %s", key, value)
+		}
+	}
+	_, err = snapshot.Get("d")
+	if errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect d not found in snapshot, got %v", err)
+	}
+
+	if got := collect(t, snapshot.NewIterator(nil)); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("snapshot iterator got %v", got)
+	}
+	it, err := kv.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var latest []string
+	for ; it.Valid(); it.Next() {
+		latest = append(latest, it.Key())
+	}
+	if !reflect.DeepEqual(latest, []string{"a", "c", "d"}) {
+		t.Errorf("latest iterator got %v", latest)
+	}
+
+	snapshot.Release()
+	snapshot.Release()
+	if len(kv.Data.history) != 0 || kv.Data.Index.Len() != 3 {
+		t.Errorf("expect history cleaned after release, got %d history keys, %d index keys", len(kv.Data.history), kv.Data.Index.Len())
+	}
+}
+
+// TestKV_SnapshotReleasePrune 释放较新的快照不清理历史版本，最早的快照释放后才清理
+func TestKV_SnapshotReleasePrune(t *testing.T) {
+	config := newTestConfig("snapshot_release_prune")
+	core, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := core.(*KV)
+	defer kv.Close()
+
+	err = kv.Set("a", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest := kv.Snapshot()
+	err = kv.Set("a", []byte("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer := kv.Snapshot()
+	err = kv.Set("a", []byte("v3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newer.Release()
+	if len(kv.Data.history["a"]) != 2 {
+		t.Errorf("expect history kept until the oldest snapshot is released, got %d versions", len(kv.Data.history["a"]))
+	}
+	value, err := oldest.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "v1" {
+		t.Errorf("expect v1, got %s", value)
+	}
+
+	oldest.Release()
+	if len(kv.Data.history) != 0 {
+		t.Errorf("expect history cleaned after the oldest snapshot is released, got %d history keys", len(kv.Data.history))
+	}
+}
+
+// TestKV_SnapshotMerge 快照持有期间 merge 不会清理快照仍然需要的 Record
+func TestKV_SnapshotMerge(t *testing.T) {
+	config := newTestConfig("snapshot_merge")
+	config.Set(consts.RagdollDataFileCapacity, 1024)
+	core, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := core.(*KV)
+	defer kv.Close()
+
+	for i := 0; i < 50; i++ {
+		err = kv.Set(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := kv.Snapshot()
+	defer snapshot.Release()
+
+	for i := 0; i < 500; i++ {
+		if i%50 < 10 {
+			err = kv.Delete(fmt.Sprintf("k%d", i%50))
+		} else {
+			err = kv.Set(fmt.Sprintf("k%d", i%50), []byte(fmt.Sprintf("new%d", i)))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = kv.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		value, err := snapshot.Get(fmt.Sprintf("k%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("expect v%d, got %s", i, value)
+		}
+
+		value, err = kv.Get(fmt.Sprintf("k%d", i))
+		if i < 10 {
+			if errs.GetCode(err) != errs.NotFoundErrCode {
+				t.Errorf("expect k%d not found, got %s, %v", i, value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != fmt.Sprintf("new%d", 450+i) {
+			t.Errorf("expect new%d, got %s", 450+i, value)
+		}
+	}
+}
+
+// TestKV_SnapshotMergeReopen 快照持有期间 merge 保留的历史版本，在快照释放、重新打开之后不会复活
+// 屏蔽历史版本的删除以及过期的写入都在 merge 的输入中被丢弃
+func TestKV_SnapshotMergeReopen(t *testing.T) {
+	config := newTestConfig("snapshot_merge_reopen")
+	core, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := core.(*KV)
+
+	for _, key := range []string{"deleted", "expired", "kept"} {
+		err = kv.Set(key, []byte("old"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := kv.Snapshot()
+	err = kv.Delete("deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.SetWithTTL("expired", []byte("new"), 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.Set("kept", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	err = kv.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"deleted", "expired", "kept"} {
+		value, err := snapshot.Get(key)
+		if err != nil || string(value) != "old" {
+			t.Errorf("expect snapshot reads old for %s, got %s, %v", key, value, err)
+		}
+	}
+	snapshot.Release()
+
+	err = kv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, err = New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer core.Close()
+
+	for _, key := range []string{"deleted", "expired"} {
+		value, err := core.Get(key)
+		if errs.GetCode(err) != errs.NotFoundErrCode {
+			t.Errorf("expect %s not found after reopen, got %s, %v", key, value, err)
+		}
+	}
+	value, err := core.Get("kept")
+	if err != nil || string(value) != "new" {
+		t.Errorf("expect new for kept, got %s, %v", value, err)
+	}
+}
+
+// groupAttempts 组提交取出 task 时不等待还没有转移到输出管道的 task，偶尔会把同时提交的 task 分成多组，
+// 需要同一组提交的测试最多重试的次数
+const groupAttempts = 10
+
+// commitGroup 每个 op 作为一个 task 提交，返回每个 task 的结果以及这些 task 是否在同一组中提交
+// 持有 Data 的锁阻塞处理 blocker 的消费协程，期间提交的 task 在消费协程恢复之后作为同一组提交
+func commitGroup(t *testing.T, kv *KV, ops ...*Op) bool {
+	produce := func(op *Op) chan *Result {
+		batch := NewBatch().(*Batch)
+		batch.AppendOps(op)
+		return kv.Chan.Produce(batch)
+	}
+
+	kv.Data.mu.Lock()
+	blocker := produce(NewOp(consts.OperatorTypeSet, "blocker", []byte("blocker")))
+	time.Sleep(20 * time.Millisecond)
+	chans := make([]chan *Result, 0, len(ops))
+	for _, op := range ops {
+		chans = append(chans, produce(op))
+	}
+	time.Sleep(20 * time.Millisecond)
+	kv.Data.mu.Unlock()
+
+	<-blocker
+	for _, ch := range chans {
+		if result := <-ch; result.Error != nil {
+			t.Fatal(result.Error)
+		}
+	}
+
+	// 同一组提交的写操作版本号相同
+	kv.Data.mu.RLock()
+	defer kv.Data.mu.RUnlock()
+	for _, op := range ops[1:] {
+		if kv.Data.Mem[op.Key].Version != kv.Data.Mem[ops[0].Key].Version {
+			return false
+		}
+	}
+	return true
+}
+
+// hookApplyGroup 应用第一个写操作的 key 为 key 的 task 时在另一个协程中执行 fn，
+// 并等待一段时间让 fn 在组提交应用过程中开始执行，返回的函数取消 hook
+func hookApplyGroup(kv *KV, key string, fn func()) func() {
+	var once sync.Once
+	kv.Data.applyHook = func(ops []*Op) {
+		if len(ops) > 0 && ops[0].Key == key {
+			once.Do(func() {
+				go fn()
+				time.Sleep(20 * time.Millisecond)
+			})
+		}
+	}
+	return func() {
+		kv.Data.applyHook = nil
+	}
+}
+
+// TestKV_SnapshotDuringGroup 组提交应用过程中创建的快照要么看到整组写入，要么都看不到，并且看不到创建之后的写入
+func TestKV_SnapshotDuringGroup(t *testing.T) {
+	// 快照需要区分组提交之前与之后的状态，-count 多次运行时先清理上一次写入的数据
+	err := os.RemoveAll(testDataDir + "snapshot_during_group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig("snapshot_during_group")
+	core, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer core.Close()
+	kv := core.(*KV)
+
+	// 记录创建快照时能读到哪些 key，之后快照读到的结果必须一致
+	type taken struct {
+		snapshot *Snapshot
+		visible  map[string]bool
+	}
+	for attempt := 0; attempt < groupAttempts; attempt++ {
+		a, b := fmt.Sprintf("a%d", attempt), fmt.Sprintf("b%d", attempt)
+		ch := make(chan taken, 1)
+		unhook := hookApplyGroup(kv, b, func() {
+			snapshot := kv.Snapshot()
+			visible := make(map[string]bool)
+			for _, key := range []string{a, b} {
+				_, err := kv.Data.Get(key)
+				visible[key] = err == nil
+			}
+			ch <- taken{snapshot, visible}
+		})
+		grouped := commitGroup(t, kv,
+			NewOp(consts.OperatorTypeSet, a, []byte("1")),
+			NewOp(consts.OperatorTypeSet, b, []byte("2")),
+		)
+		unhook()
+		got := <-ch
+		if !grouped {
+			got.snapshot.Release()
+			continue
+		}
+
+		defer got.snapshot.Release()
+		if got.visible[a] != got.visible[b] {
+			t.Errorf("expect snapshot taken before or after the whole group, visible: %v", got.visible)
+		}
+		for key, visible := range got.visible {
+			if _, err := got.snapshot.Get(key); (err == nil) != visible {
+				t.Errorf("expect snapshot sees %s: %v, got err %v", key, visible, err)
+			}
+		}
+		return
+	}
+	t.Fatalf("writes not committed in one group after %d attempts", groupAttempts)
+}
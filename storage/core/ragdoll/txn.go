@@ -0,0 +1,132 @@
+package ragdoll
+
+import (
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
+)
+
+// Txn 乐观事务
+// 读取基于事务开始时的快照，写入缓存在事务中；提交时在消费协程中检查读写过的 key 在事务开始之后都没有被修改，
+// 检查通过后全部写入作为一个 Batch 原子地写入，否则返回 errs.NewTxnConflictErr，调用方可以重试整个事务。
+// 不保证并发安全，同一个事务只能在一个协程中使用
+type Txn struct {
+	kv       *KV
+	snapshot *Snapshot
+	reads    map[string]struct{} // reads 事务中读取过的 key
+	writes   map[string]*Op      // writes 事务中每个 key 最后一次写入或删除
+	order    []string            // order 按第一次写入的顺序记录 writes 中的 key
+	finished bool
+}
+
+func newTxn(kv *KV) *Txn {
+	return &Txn{
+		kv:       kv,
+		snapshot: kv.Snapshot(),
+		reads:    make(map[string]struct{}),
+		writes:   make(map[string]*Op),
+	}
+}
+
+// Get 读取 key，优先读取事务中的写入，否则读取事务开始时的快照
+func (txn *Txn) Get(key string) ([]byte, error) {
+	if txn.finished {
+		e := errs.NewTxnFinishedErr()
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	if op, exist := txn.writes[key]; exist {
+		if op.Type == consts.OperatorTypeDelete {
+			return nil, errs.NewNotFoundErr()
+		}
+		return op.Value, nil
+	}
+
+	// 读不到的 key 同样需要检查，保证提交时 key 仍然不存在
+	txn.reads[key] = struct{}{}
+	return txn.snapshot.Get(key)
+}
+
+// Set 在事务中写入 key，提交之前对其他读取不可见
+func (txn *Txn) Set(key string, value []byte) error {
+	return txn.write(NewOp(consts.OperatorTypeSet, key, value))
+}
+
+// Delete 在事务中删除 key，提交之前对其他读取不可见
+func (txn *Txn) Delete(key string) error {
+	return txn.write(NewOp(consts.OperatorTypeDelete, key, nil))
+}
+
+func (txn *Txn) write(op *Op) error {
+	if txn.finished {
+		e := errs.NewTxnFinishedErr()
+		logs.Error(e.Error())
+		return e
+	}
+
+	if _, exist := txn.writes[op.Key]; !exist {
+		txn.order = append(txn.order, op.Key)
+	}
+	txn.writes[op.Key] = op
+	return nil
+}
+
+// Commit 提交事务，读写过的 key 在事务开始之后被修改时返回 errs.NewTxnConflictErr
+// 只读事务读到的是同一个快照，直接提交成功。无论提交是否成功，事务都会结束
+func (txn *Txn) Commit() error {
+	if txn.finished {
+		e := errs.NewTxnFinishedErr()
+		logs.Error(e.Error())
+		return e
+	}
+	txn.finished = true
+	defer txn.snapshot.Release()
+
+	if len(txn.writes) == 0 {
+		return nil
+	}
+
+	// 读写过的 key 都需要检查：只写的 key 检查写写冲突，读过的 key 检查读写冲突
+	batch := txn.kv.BatchPool.Get().(*Batch)
+	defer txn.kv.BatchPool.Put(batch)
+	batch.Reset()
+	for key := range txn.reads {
+		if _, exist := txn.writes[key]; !exist {
+			batch.AppendOps(txn.checkOp(key))
+		}
+	}
+	for _, key := range txn.order {
+		batch.AppendOps(txn.checkOp(key))
+	}
+	for _, key := range txn.order {
+		batch.AppendOps(txn.writes[key])
+	}
+
+	resultChan := txn.kv.Chan.Produce(batch)
+	var err error
+	for range batch.Ops {
+		result := <-resultChan
+		if result.Error != nil && err == nil {
+			err = result.Error
+		}
+	}
+	return err
+}
+
+// checkOp 构造检查 key 在事务开始之后没有被修改的条件
+func (txn *Txn) checkOp(key string) *Op {
+	op := NewOp(opTypeCheck, key, nil)
+	op.Version = txn.snapshot.version
+	return op
+}
+
+// Rollback 放弃事务中的全部写入，事务已经结束时什么都不做
+func (txn *Txn) Rollback() error {
+	if txn.finished {
+		return nil
+	}
+	txn.finished = true
+	txn.snapshot.Release()
+	return nil
+}
@@ -0,0 +1,244 @@
+package ragdoll
+
+import (
+	"fmt"
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestTxn_CommitRollback 事务中能读到自己的写入，提交之前对外不可见，回滚之后不生效
+func TestTxn_CommitRollback(t *testing.T) {
+	config := newTestConfig("txn_commit")
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	err = kv.Set("k1", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, err := kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = txn.Set("k2", []byte("v2"))
+	_ = txn.Delete("k1")
+	if value, err := txn.Get("k2"); err != nil || string(value) != "v2" {
+		t.Errorf("expect v2 in txn, got %s, %v", value, err)
+	}
+	if _, err := txn.Get("k1"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect k1 deleted in txn, got %v", err)
+	}
+	if _, err := kv.Get("k2"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect k2 invisible before commit, got %v", err)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := kv.Get("k2"); err != nil || string(value) != "v2" {
+		t.Errorf("expect v2 after commit, got %s, %v", value, err)
+	}
+	if _, err := kv.Get("k1"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect k1 deleted after commit, got %v", err)
+	}
+	if err := txn.Set("k3", nil); errs.GetCode(err) != errs.TxnFinishedErrCode {
+		t.Errorf("expect txn finished error, got %v", err)
+	}
+
+	txn, err = kv.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = txn.Set("k3", []byte("v3"))
+	err = txn.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get("k3"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect k3 not found after rollback, got %v", err)
+	}
+}
+
+// TestTxn_Conflict 事务开始之后读写过的 key 被修改时提交失败，没有读写过的 key 不影响提交
+func TestTxn_Conflict(t *testing.T) {
+	config := newTestConfig("txn_conflict")
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		err = kv.Set(key, []byte("0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		txn      func(txn iface.Txn)
+		concur   func() error
+		conflict bool
+	}{
+		{"write-write", func(txn iface.Txn) { _ = txn.Set("a", []byte("1")) }, func() error { return kv.Set("a", []byte("2")) }, true},
+		{"read-write", func(txn iface.Txn) { _, _ = txn.Get("a"); _ = txn.Set("b", []byte("1")) }, func() error { return kv.Delete("a") }, true},
+		{"read-missing", func(txn iface.Txn) { _, _ = txn.Get("x"); _ = txn.Set("b", []byte("1")) }, func() error { return kv.Set("x", []byte("1")) }, true},
+		{"disjoint", func(txn iface.Txn) { _, _ = txn.Get("b"); _ = txn.Set("b", []byte("2")) }, func() error { return kv.Set("c", []byte("1")) }, false},
+	}
+	for _, c := range cases {
+		txn, err := kv.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.txn(txn)
+		err = c.concur()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = txn.Commit()
+		if c.conflict && errs.GetCode(err) != errs.TxnConflictErrCode {
+			t.Errorf("%s: expect conflict, got %v", c.name, err)
+		} else if !c.conflict && err != nil {
+			t.Errorf("%s: expect commit success, got %v", c.name, err)
+		}
+	}
+
+	// 冲突的事务不会有任何写入生效
+	value, err := kv.Get("a")
+	if errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect a not found, got %s, %v", value, err)
+	}
+}
+
+// TestTxn_ConcurrentIncr 并发的读改写事务在冲突时重试，不会丢失更新
+func TestTxn_ConcurrentIncr(t *testing.T) {
+	config := newTestConfig("txn_incr")
+	kv, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	const workers, rounds = 8, 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var conflicts int
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				for {
+					txn, err := kv.Begin()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					var n int
+					value, err := txn.Get("counter")
+					if err == nil {
+						n, _ = strconv.Atoi(string(value))
+					}
+					_ = txn.Set("counter", []byte(strconv.Itoa(n+1)))
+					err = txn.Commit()
+					if errs.GetCode(err) == errs.TxnConflictErrCode {
+						mu.Lock()
+						conflicts++
+						mu.Unlock()
+						continue
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					break
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := kv.Get("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("conflicts:", conflicts)
+	if string(value) != strconv.Itoa(workers*rounds) {
+		t.Errorf("expect %d, got %s", workers*rounds, value)
+	}
+}
+
+// TestTxn_BeginDuringGroup 组提交应用过程中开始的事务读到旧值时提交冲突，不会丢失同一组中的更新
+func TestTxn_BeginDuringGroup(t *testing.T) {
+	config := newTestConfig("txn_begin_during_group")
+	core, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer core.Close()
+	kv := core.(*KV)
+
+	// 事务只在 hook 中开始并读取，组提交完成之后再提交事务
+	type begun struct {
+		txn iface.Txn
+		n   int
+	}
+	for attempt := 0; attempt < groupAttempts; attempt++ {
+		counter, other := fmt.Sprintf("counter%d", attempt), fmt.Sprintf("other%d", attempt)
+		err = kv.Set(counter, []byte("1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := make(chan begun, 1)
+		unhook := hookApplyGroup(kv, counter, func() {
+			txn, err := kv.Begin()
+			if err != nil {
+				t.Error(err)
+			}
+			value, err := txn.Get(counter)
+			if err != nil {
+				t.Error(err)
+			}
+			n, _ := strconv.Atoi(string(value))
+			ch <- begun{txn, n}
+		})
+		grouped := commitGroup(t, kv,
+			NewOp(consts.OperatorTypeSet, other, []byte("1")),
+			NewOp(consts.OperatorTypeSet, counter, []byte("2")),
+		)
+		unhook()
+		got := <-ch
+		if !grouped {
+			_ = got.txn.Rollback()
+			continue
+		}
+
+		_ = got.txn.Set(counter, []byte(strconv.Itoa(got.n+1)))
+		err = got.txn.Commit()
+		if errs.GetCode(err) == errs.TxnConflictErrCode {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := kv.Get(counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != "3" {
+			t.Errorf("expect txn read 2 and commit 3 or conflict, read %d and got %s", got.n, value)
+		}
+		return
+	}
+	t.Fatalf("writes not committed in one group after %d attempts", groupAttempts)
+}
@@ -1,6 +1,9 @@
 package wal
 
-import "github.com/Trinoooo/eggie_kv/utils"
+import (
+	"github.com/Trinoooo/eggie_kv/storage/core/format"
+	"github.com/Trinoooo/eggie_kv/utils"
+)
 
 const dirLock = ".lock"
 
@@ -13,7 +16,7 @@ const (
 	// 字段长度，单位字节
 	headerLengthSize  = 8
 	headerBlockIdSize = 8
-	headerSummarySize = 16
+	headerSummarySize = 16 // headerSummarySize 校验和字段长度，CRC32C 只使用前4个字节，见 format.SumSize
 	headerSize        = 32
 
 	// 字段偏移量，单位字节
@@ -21,10 +24,42 @@ const (
 	headerBlockIdOffset = 8
 	headerSummaryOffset = 16
 	headerDataOffset    = 32
+
+	// headerFlagOffset length 字段的最后一个字节用作 block 的标记位，记录 payload 的压缩算法
+	// length 以 varint 编码，不超过 dataFileCapacity 上限（1GB）时最多占用5个字节，
+	// 旧数据中这个字节始终是0，即没有压缩
+	headerFlagOffset = 7
+)
+
+const (
+	headerFlagCodecMask uint8 = 0x3    // headerFlagCodecMask 标记位第0、1位记录 payload 的压缩算法，取值见 compress.Codec
+	headerFlagEncrypted uint8 = 1 << 2 // headerFlagEncrypted payload 在压缩之后使用 segment 文件头中的密钥加密
+	headerFlagHole      uint8 = 1 << 3 // headerFlagHole 修复损坏的 segment 时代替丢失 block 的占位 block，payload 为空，读取时跳过
+	headerFlagTail      uint8 = 1 << 4 // headerFlagTail 每次同步时追加在新写入的 block 之后的 tail block，不占用 blockIdx，读取时跳过
+)
+
+const (
+	// segmentVersion 当前的 segment 格式版本，只记录在 segment 文件头中，与数据文件使用的 format.Version 分开演进
+	// 版本1开始追加写入，每次同步之后追加 tail block；没有文件头的旧格式（版本0）同步时仍然整体写时复制
+	segmentVersion uint8 = 1
+	// tailPayloadSize tail block 的 payload 长度：| 这次同步写入的长度 8字节 | 这次同步写入数据的校验和 16字节 |
+	// blockid 字段记录这次同步写入的最后一个 block 的 blockIdx
+	tailPayloadSize = 8 + format.SumSize
+	// tailSize tail block 的长度
+	tailSize = headerSize + tailPayloadSize
+)
+
+const (
+	// segmentMagic segment 文件头的 magic，文件头结构见 format.Header
+	// magic 第一个字节按 varint 解析是负数，合法 block 的 length 不会是负数，因此不会和旧格式的 block 混淆
+	// 旧格式（版本0）的 segment 没有文件头，直接从第一个 block 开始，block 使用 MD5 校验
+	segmentMagic = "EGGIEWAL"
 )
 
 const suffix = ".active" // suffix 活跃segment文件的后缀标识
 
+const quarantineDirName = "quarantine" // quarantineDirName 损坏的 segment 文件在修复之前备份到该子目录
+
 // getBaseFormat 获取segment文件名中blockIdx部分宽度
 func getBaseFormat() string {
 	return utils.GetValueOnEnv("%010d", "%08d").(string)
@@ -39,3 +74,13 @@ const (
 	FullManagedAsync                 // 全托管 - 异步
 	SelfManaged                      // 自托管
 )
+
+// RecoveryMode 打开 Log 时发现 segment 损坏的处理方式
+// 活跃 segment 末尾写到一半的 block 在任何模式下都会直接丢弃
+type RecoveryMode int64
+
+const (
+	RecoveryFail         RecoveryMode = iota // 打开失败，segment 只在第一次读取时打开并校验
+	RecoveryTruncateTail                     // 打开时校验全部 segment，在第一个损坏的 block 处截断日志，之后的日志全部丢弃
+	RecoverySkipCorrupt                      // 打开时校验全部 segment，丢弃损坏的 block 并写入占位 block，其余 block 的索引保持不变
+)
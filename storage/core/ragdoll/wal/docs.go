@@ -1,7 +1,9 @@
 // Package wal 实现预写日志（Write-Ahead-Log）
 //
 // Log 致力于对外提供高性能读、写、截断日志服务，这些操作通过内部加锁保证外部
-// 并发调用不会出现竞态条件。
+// 并发调用不会出现竞态条件。除了从头读取，Log 也支持通过 ReadAt、ReadRange 按索引
+// 读取，以及通过 Iterator 逐条遍历，这些读取按需打开 Segment，不会加载全部日志。
+// Subscribe 在 Iterator 的基础上阻塞等待新写入的日志，用于向下游持续同步日志。
 //
 // Log 提供两种数据持久化级别：
 //  1. 同步：每次写日志都会将数据同步到磁盘，一致性好，但性能差。
@@ -12,13 +14,20 @@
 //  1. Block：描述单条日志记录的逻辑概念。用于定位日志记录边界、记录完整性校验、
 //     限制 Log 下最大日志数量（通过maxBlockCapacityInWAL）。
 //  2. Segment：日志数据文件，由零或多个 Block 组成。一个 Log 中通常有多个 Segment
-//     这是出于变更 Segment 文件时写时复制（Copy-On-Write）的性能考虑，这意味着
-//     Segment 保证原子写入文件。Segment 允许自定义容量（可通过 Options 配置），
+//     这是出于截断 Segment 文件时写时复制（Copy-On-Write）的性能考虑。同步时新写入的
+//     Block 追加写入文件末尾，之后紧跟一个记录这次写入长度和校验和的 tail Block，打开
+//     时损坏位置之后没有校验通过的 tail Block 才视为没有写完的同步并丢弃，否则按
+//     RecoveryMode 处理。tail Block 同样计入 Segment 容量。截断、重新加密、
+//     修复时仍然写时复制，保证原子替换文件。Segment 允许自定义容量（可通过 Options 配置），
 //     但这不意味只有当一个数据文件写满后才会创建下一个，Segment 会保证 Block完整地
-//     存在一个数据文件中。
+//     存在一个数据文件中。Segment 以文件头开头，记录格式版本、Block 校验和算法以及
+//     加密使用的密钥id（见 format.Header），没有文件头的旧格式 Segment 仍然可以读写。
 //  3. Log：预写日志实体，由多个 Segment 组成。Log 将 Segment 维护在指定目录
 //     下（可通过 Options 配置）。内部通过 LRU 缓存最近读命中的 Segment，同样的，
 //     可以通过 Options 配置 LRU 缓存大小。
 //
-// TODO(Trino)：日志损坏后没有修复机制，如果出现内容被篡改、损坏会导致日志不可用
+// Log 打开时按照 RecoveryMode 处理损坏的 Block（可通过 Options 配置）：默认直接报错；
+// RecoveryTruncateTail 丢弃第一个损坏 Block 及之后的日志；RecoverySkipCorrupt 用空洞
+// Block 占位损坏的日志，保持 blockIdx 连续。被修改的 Segment 会先备份到 quarantine
+// 目录下。Repair 以 RecoverySkipCorrupt 模式离线修复整个目录，并返回损坏 Block 的报告。
 package wal
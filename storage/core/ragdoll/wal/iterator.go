@@ -0,0 +1,117 @@
+package wal
+
+import (
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
+	"go.uber.org/zap"
+)
+
+// Iterator 按写入顺序遍历 Log 中日志的迭代器
+// 迭代器每次只读取当前位置的 block，所在 segment 按需打开并写入 segmentCache；segment 打开时只校验 block 并记录位置，
+// 读取时按位置从文件中读取，不会把全部日志保留在内存中。
+// 迭代过程中新写入的日志对迭代器可见；修复时已经丢失的日志会被跳过；
+// 当前位置被 Truncate 截断之后迭代器失效，Err 返回 errs.NewNotFoundErr
+type Iterator struct {
+	wal   *Log
+	idx   int64  // idx 当前位置的 block 索引
+	data  []byte // data 当前位置的日志数据
+	valid bool
+	err   error
+}
+
+// NewIterator 创建迭代器，创建之后定位在 from 或者其后第一条日志上
+func (wal *Log) NewIterator(from int64) *Iterator {
+	it := &Iterator{wal: wal}
+	it.SeekTo(from)
+	return it
+}
+
+// set 定位到 idx 或者其后第一个不是占位 block 的位置，并读取该位置的日志数据
+// 到达 Log 末尾时迭代器失效，但不记录错误
+func (it *Iterator) set(idx int64) {
+	it.wal.mu.Lock()
+	defer it.wal.mu.Unlock()
+
+	it.valid, it.data = false, nil
+	it.err = it.wal.checkState(true, true, true)
+	if it.err != nil {
+		return
+	}
+
+	for {
+		if idx == (it.wal.lastBlockIdx+1)%getMaxBlockCapacityInWAL() {
+			it.idx = idx
+			return
+		}
+		// 日志被全部截断之后只有下一条要写入的日志的索引有效，其余位置都已经被截断
+		if it.wal.firstBlockIdx == -1 {
+			e := errs.NewNotFoundErr()
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "idx"), zap.Int64(consts.LogFieldValue, idx))
+			it.err = e
+			return
+		}
+
+		seg, err := it.wal.locateSegment(idx)
+		if err != nil {
+			it.err = err
+			return
+		}
+
+		data, hole, err := seg.readBlock(idx)
+		if err != nil {
+			it.err = err
+			return
+		}
+		if !hole {
+			it.idx, it.data, it.valid = idx, data, true
+			return
+		}
+		idx = (idx + 1) % getMaxBlockCapacityInWAL()
+	}
+}
+
+// SeekTo 定位到 idx 或者其后第一条日志上，同时清除之前的错误
+func (it *Iterator) SeekTo(idx int64) {
+	if it.wal == nil {
+		return
+	}
+	it.set(idx)
+}
+
+// Next 按写入顺序移动到下一条日志
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	it.set((it.idx + 1) % getMaxBlockCapacityInWAL())
+}
+
+// Valid 判断迭代器是否定位在有效的日志上
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Index 当前位置的 block 索引
+// 迭代器到达末尾失效之后是下一条要写入的日志的索引，可以在新日志写入之后 SeekTo 到该位置继续遍历
+func (it *Iterator) Index() int64 {
+	return it.idx
+}
+
+// Value 当前位置的日志数据，迭代器失效时返回nil
+func (it *Iterator) Value() []byte {
+	return it.data
+}
+
+// Err 返回迭代器失效的原因，正常到达末尾时返回nil
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close 关闭迭代器，关闭之后迭代器失效
+func (it *Iterator) Close() error {
+	it.valid = false
+	it.data = nil
+	it.wal = nil
+	return nil
+}
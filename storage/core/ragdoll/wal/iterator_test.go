@@ -0,0 +1,59 @@
+package wal
+
+import (
+	"github.com/Trinoooo/eggie_kv/errs"
+	"testing"
+)
+
+// TestIterator 按写入顺序遍历，到达末尾之后可以从 Index 继续遍历新写入的日志，位置被截断之后迭代器失效
+func TestIterator(t *testing.T) {
+	iteratorDirPath := "../../../../test_data/wal_iterator/"
+	wal, err := NewLog(iteratorDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	for i := 0; i < 3; i++ {
+		err = wal.Write(testData[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := wal.NewIterator(1)
+	defer it.Close()
+	var count int
+	for ; it.Valid(); it.Next() {
+		if it.Index() != int64(count+1) || string(it.Value()) != string(testData[count+1]) {
+			t.Errorf("block #%d mismatch, got %v", it.Index(), it.Value())
+		}
+		count++
+	}
+	if it.Err() != nil || count != 2 || it.Index() != 3 {
+		t.Fatalf("expect stop at #3 after 2 blocks, got #%d after %d blocks, %v", it.Index(), count, it.Err())
+	}
+
+	err = wal.Write(testData[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.SeekTo(it.Index())
+	if !it.Valid() || string(it.Value()) != string(testData[3]) {
+		t.Errorf("expect new block #3 visible, got %v, %v", it.Value(), it.Err())
+	}
+
+	err = wal.Truncate(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.SeekTo(1)
+	if it.Valid() || errs.GetCode(it.Err()) != errs.NotFoundErrCode {
+		t.Errorf("expect not found err after truncate, got %v", it.Err())
+	}
+}
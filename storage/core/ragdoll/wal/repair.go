@@ -0,0 +1,369 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/format"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BadBlock segment 文件中的一段损坏区域
+type BadBlock struct {
+	Path   string // Path segment 文件路径
+	Index  int64  // Index 损坏区域中第一个丢失的 block 索引
+	Count  int64  // Count 损坏区域中丢失的 block 数量，损坏区域位于活跃 segment 末尾时无法确定，为0
+	Offset int64  // Offset 损坏区域在 segment 文件中的起始偏移量
+	Size   int64  // Size 损坏区域长度，单位字节
+}
+
+// RepairReport Repair 的修复结果
+type RepairReport struct {
+	BadBlocks   []*BadBlock // BadBlocks 扫描发现的全部损坏区域
+	Quarantined []string    // Quarantined 损坏的 segment 文件在 quarantine 子目录中的备份路径
+}
+
+// Repair 修复 dirPath 下损坏的 Log
+//
+// 扫描全部 segment，报告损坏区域中丢失的 block 索引以及在 segment 文件中的偏移量。损坏的 segment 文件
+// 原样备份到 quarantine 子目录之后重写：丢失的 block 使用占位 block 代替，其余 block 的索引保持不变，
+// 修复之后 Log 可以按 RecoveryFail 正常打开。修复需要独占目录，与打开同一目录的 Log 互斥
+//
+// 参数：
+//   - dirPath 存放 Log 日志的目录
+//   - opts 配置选项，不传配置将设置成默认值，加密的 segment 需要配置 keyring；其中的 RecoveryMode、SyncMode 不生效
+//
+// 返回值：
+//   - 修复结果（*RepairReport）
+//   - errs 过程中出现的错误，类型是 *errs.KvErr
+//
+// 异常：
+//   - errs.NewFlockFileErr 目录已经被其他 Log 实例打开
+//   - errs.NewKeyNotFoundErr 加密的 segment 使用的密钥不在 keyring 中
+//   - errs.NewUnsupportedFormatErr segment 的格式版本比当前版本新
+//   - errs.NewWriteFileErr 备份或者重写 segment 文件失败
+func Repair(dirPath string, opts *Options) (*RepairReport, error) {
+	if opts == nil {
+		opts = NewOptions()
+	}
+	repairOpts := *opts
+	repairOpts.recoveryMode = RecoverySkipCorrupt
+	repairOpts.syncMode = SelfManaged
+
+	wal, err := NewLog(dirPath, &repairOpts)
+	if err != nil {
+		return nil, err
+	}
+	err = wal.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{
+		BadBlocks:   wal.badBlocks,
+		Quarantined: wal.quarantined,
+	}
+	err = wal.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	logs.Info("wal repair finish", zap.String("dir", dirPath), zap.Int("badBlocks", len(report.BadBlocks)), zap.Strings("quarantined", report.Quarantined))
+	return report, nil
+}
+
+// recover 按 RecoveryMode 打开并校验全部 segment
+// RecoveryFail 时不做任何处理，非活跃 segment 在第一次读取时才会打开
+func (wal *Log) recover() error {
+	if wal.opts.recoveryMode == RecoveryFail {
+		return nil
+	}
+
+	ordered := wal.orderedSegments()
+	for i, seg := range ordered {
+		isActive := seg == wal.activeSegment
+		if !seg.isOpened() {
+			err := seg.open(wal.opts.dataFilePerm)
+			if err != nil {
+				return err
+			}
+		}
+
+		truncated := false
+		if !isActive {
+			var err error
+			switch {
+			case wal.opts.recoveryMode == RecoveryTruncateTail && len(seg.damages) > 0:
+				err = wal.truncateAfter(ordered, i)
+				truncated = true
+			case wal.opts.recoveryMode == RecoverySkipCorrupt:
+				err = seg.fillHoles(ordered[i+1].getStartBlockIdx())
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, bad := range seg.damages {
+			logs.Warn("wal corrupt block", zap.String("path", bad.Path), zap.Int64("index", bad.Index), zap.Int64("count", bad.Count), zap.Int64("offset", bad.Offset), zap.Int64("size", bad.Size))
+		}
+		wal.badBlocks = append(wal.badBlocks, seg.damages...)
+		if seg.quarantined != "" {
+			wal.quarantined = append(wal.quarantined, seg.quarantined)
+		}
+
+		if truncated {
+			return nil
+		}
+		if !isActive {
+			err := seg.close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// truncateAfter 在 ordered[i] 中第一个损坏的 block 处截断日志
+// 之后的 segment 移动到 quarantine 子目录，ordered[i] 成为新的活跃 segment
+func (wal *Log) truncateAfter(ordered []*segment, i int) error {
+	for _, seg := range ordered[i+1:] {
+		err := seg.moveToQuarantine()
+		if err != nil {
+			return err
+		}
+		wal.quarantined = append(wal.quarantined, seg.quarantined)
+	}
+
+	err := ordered[i].rename()
+	if err != nil {
+		return err
+	}
+	wal.activeSegment = ordered[i]
+	wal.segments = ordered[:i+1]
+	wal.isSegmentsOrdered = false
+	return nil
+}
+
+// orderedSegments 按日志写入顺序返回全部 segment，活跃 segment 在最后
+// 日志发生循环时 blockIdx 最小的 segment 不一定最早写入，需要从活跃 segment 的下一个开始
+func (wal *Log) orderedSegments() []*segment {
+	wal.sortSegments()
+	var active int
+	for i, seg := range wal.segments {
+		if seg == wal.activeSegment {
+			active = i
+		}
+	}
+	ordered := make([]*segment, 0, len(wal.segments))
+	ordered = append(ordered, wal.segments[active+1:]...)
+	ordered = append(ordered, wal.segments[:active+1]...)
+	return ordered
+}
+
+// scannedBlock scanBlocks 找到的完整 block
+type scannedBlock struct {
+	raw      []byte
+	blockIdx int64
+	offset   int64 // offset block 在 raw 中的起始偏移量
+	damaged  int64 // damaged block 之前损坏区域在 raw 中的起始偏移量，-1表示前面没有损坏
+}
+
+// scanBlocks 顺序解析 raw 中的 block，遇到损坏的数据时逐字节向后查找下一个完整的 block
+// 损坏区域之后找到的 block 索引不能小于期望的索引，也不能超过损坏区域最多能容纳的 block 数量，
+// 避免把 payload 中恰好能解析的数据误认为 block。
+// 返回完整的 block 以及末尾损坏区域的起始偏移量，末尾没有损坏时为-1
+func scanBlocks(raw []byte, checksum format.Checksum, startBlockIdx int64) ([]*scannedBlock, int64) {
+	var blocks []*scannedBlock
+	size := int64(len(raw))
+	next, damaged := startBlockIdx, int64(-1)
+	for offset := int64(0); offset < size; {
+		if size-offset < headerSize {
+			if damaged == -1 {
+				damaged = offset
+			}
+			break
+		}
+
+		// prof：损坏区域中先检查 blockIdx 范围，大部分位置不需要计算校验和
+		candidate, _ := binary.Varint(raw[offset+headerBlockIdOffset : offset+headerSummaryOffset])
+		inRange := candidate == next
+		if damaged != -1 {
+			inRange = candidate >= next && candidate <= next+(offset-damaged)/headerSize
+		}
+		// tail block 不占用 blockIdx，blockid 是前一个 block 的索引
+		tail := raw[offset+headerFlagOffset]&headerFlagTail != 0
+		if tail {
+			inRange = inRange || candidate == next-1
+		}
+		if inRange {
+			block, blockSize, blockIdx, ok := parseBlock(raw[offset:], checksum)
+			// 完整的 tail block 直接跳过，不影响损坏区域的判断
+			if ok && tail {
+				offset += blockSize
+				continue
+			}
+			if ok {
+				blocks = append(blocks, &scannedBlock{raw: block, blockIdx: blockIdx, offset: offset, damaged: damaged})
+				next, damaged = blockIdx+1, -1
+				offset += blockSize
+				continue
+			}
+		}
+
+		if damaged == -1 {
+			damaged = offset
+		}
+		offset++
+	}
+	return blocks, damaged
+}
+
+// skipCorrupt 跳过 raw 中损坏的 block，丢失的 block 使用占位 block 代替，末尾损坏的部分直接丢弃
+// base 是 raw 在 segment 文件中的偏移量，返回按顺序排列的完整 block，用于重写 segment 文件
+func (seg *segment) skipCorrupt(raw []byte, base int64) [][]byte {
+	scanned, tail := scanBlocks(raw, seg.checksum, seg.getStartBlockIdx())
+	blocks := make([][]byte, 0, len(scanned))
+	next := seg.getStartBlockIdx()
+	for _, block := range scanned {
+		if block.damaged != -1 {
+			seg.damages = append(seg.damages, &BadBlock{
+				Path:   seg.path,
+				Index:  next,
+				Count:  block.blockIdx - next,
+				Offset: base + block.damaged,
+				Size:   block.offset - block.damaged,
+			})
+			for ; next < block.blockIdx; next++ {
+				blocks = append(blocks, seg.hole(next))
+			}
+		}
+		blocks = append(blocks, block.raw)
+		next = block.blockIdx + 1
+	}
+
+	if tail != -1 {
+		seg.damages = append(seg.damages, &BadBlock{
+			Path:   seg.path,
+			Index:  next,
+			Offset: base + tail,
+			Size:   int64(len(raw)) - tail,
+		})
+	}
+	return blocks
+}
+
+// fillHoles 使用占位 block 补齐 segment 末尾与下一个 segment 之间丢失的 block，保证 Log 中的 blockIdx 连续
+// segment 末尾损坏，或者文件恰好在 block 边界被截断时会出现这种情况
+func (seg *segment) fillHoles(nextStartBlockIdx int64) error {
+	next := seg.getStartBlockIdx() + seg.size()
+	end := nextStartBlockIdx
+	// segment 内部的 blockIdx 不会循环，下一个 segment 从更小的 blockIdx 开始说明日志在这里发生了循环
+	if end < next {
+		end = getMaxBlockCapacityInWAL()
+	}
+	if next == end {
+		return nil
+	}
+
+	var bad *BadBlock
+	if n := len(seg.damages); n > 0 && seg.damages[n-1].Index == next && seg.damages[n-1].Count == 0 {
+		bad = seg.damages[n-1]
+	} else {
+		bad = &BadBlock{Path: seg.path, Index: next, Offset: seg.fileSize}
+		seg.damages = append(seg.damages, bad)
+	}
+	bad.Count = end - next
+
+	for ; next < end; next++ {
+		seg.appendPending(seg.hole(next))
+	}
+	if seg.firstBlockIdx == -1 {
+		seg.firstBlockIdx = seg.getStartBlockIdx()
+	}
+	seg.lastBlockIdx = end - 1
+	return seg.sync()
+}
+
+// hole 构造代替丢失 block 的占位 block
+func (seg *segment) hole(blockIdx int64) []byte {
+	flag, payload := seg.seal(blockIdx, nil, headerFlagHole)
+	return buildBinary(blockIdx, payload, flag, seg.checksum)
+}
+
+// quarantine 修复之前把损坏的 segment 文件原样备份到 quarantine 子目录
+func (seg *segment) quarantine(all []byte, perm os.FileMode) error {
+	path, err := seg.quarantinePath()
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		e := errs.NewOpenFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+	defer fd.Close()
+
+	_, err = fd.Write(all)
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+	// note：备份持久化之后才能修改原文件
+	err = fd.Sync()
+	if err != nil {
+		e := errs.NewSyncFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+
+	seg.quarantined = path
+	logs.Warn("quarantine corrupt segment", zap.String("path", seg.path), zap.String("quarantine", path))
+	return nil
+}
+
+// moveToQuarantine 关闭 segment 并把 segment 文件移动到 quarantine 子目录
+func (seg *segment) moveToQuarantine() error {
+	if seg.isOpened() {
+		err := seg.close()
+		if err != nil {
+			return err
+		}
+	}
+
+	path, err := seg.quarantinePath()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(seg.path, path)
+	if err != nil {
+		e := errs.NewRenameFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+
+	seg.quarantined = path
+	logs.Warn("quarantine segment after corrupt block", zap.String("path", seg.path), zap.String("quarantine", path))
+	return nil
+}
+
+// quarantinePath 创建 quarantine 子目录，返回 segment 文件备份路径
+// 备份文件名带有时间戳，同一个 segment 多次损坏时不会覆盖之前的备份
+func (seg *segment) quarantinePath() (string, error) {
+	dir := filepath.Join(filepath.Dir(seg.path), quarantineDirName)
+	err := os.MkdirAll(dir, 0770)
+	if err != nil {
+		e := errs.NewMkdirErr().WithErr(err)
+		logs.Error(e.Error())
+		return "", e
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s.%d", filepath.Base(seg.path), time.Now().UnixNano())), nil
+}
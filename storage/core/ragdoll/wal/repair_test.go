@@ -0,0 +1,193 @@
+package wal
+
+import (
+	"bytes"
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildCorruptLog 写入6个 block，每个 segment 容纳2个 block，然后破坏 block #1（segment 末尾）以及 block #2（segment 开头）
+func buildCorruptLog(t *testing.T, dir string) [][]byte {
+	wal, err := NewLog(dir, NewOptions().SetDataFileCapacity(consts.MB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expect [][]byte
+	for i := 0; i < 6; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 400*consts.KB)
+		err = wal.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect = append(expect, data)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockSize := int64(headerSize + 400*consts.KB)
+	corrupt := func(base string, offset int64) {
+		fd, err := os.OpenFile(filepath.Join(dir, base), os.O_RDWR, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		_, err = fd.WriteAt([]byte("corrupt"), offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt(blockIdxToBase(0, false), 16+blockSize+headerSize+100)
+	corrupt(blockIdxToBase(2, false), 16+headerSize+100)
+	return expect
+}
+
+// TestLog_RecoveryMode 不同 RecoveryMode 下打开损坏的 Log
+func TestLog_RecoveryMode(t *testing.T) {
+	base := "../../../../test_data/wal_recovery/"
+
+	// 默认模式下打开时不校验非活跃 segment，读取时返回错误
+	failDir := base + "fail/"
+	buildCorruptLog(t, failDir)
+	wal, err := NewLog(failDir, NewOptions().SetDataFileCapacity(consts.MB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wal.Read(6); errs.GetCode(err) != errs.CorruptErrCode {
+		t.Errorf("expect corrupt err, got %v", err)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 在 block #1 处截断，之后的日志全部丢弃，继续写入时 blockIdx 从1开始
+	truncateDir := base + "truncate/"
+	expect := buildCorruptLog(t, truncateDir)
+	wal, err = NewLog(truncateDir, NewOptions().SetDataFileCapacity(consts.MB).SetRecoveryMode(RecoveryTruncateTail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.badBlocks) != 1 || wal.badBlocks[0].Index != 1 || len(wal.quarantined) != 3 {
+		t.Errorf("expect 1 bad block and 3 quarantined segments, got %d, %d", len(wal.badBlocks), len(wal.quarantined))
+	}
+	err = wal.Write(expect[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, last, err := wal.BlockRange()
+	if err != nil || last != 1 {
+		t.Errorf("expect last block #1, got %d, %v", last, err)
+	}
+	blocks, err := wal.Read(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || !bytes.Equal(blocks[0], expect[0]) || !bytes.Equal(blocks[1], expect[5]) {
+		t.Errorf("unexpected blocks after truncate tail, got %d blocks", len(blocks))
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 跳过 block #1、#2，其余 block 的索引不变
+	skipDir := base + "skip/"
+	expect = buildCorruptLog(t, skipDir)
+	wal, err = NewLog(skipDir, NewOptions().SetDataFileCapacity(consts.MB).SetRecoveryMode(RecoverySkipCorrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	length, err := wal.Len()
+	if err != nil || length != 6 {
+		t.Errorf("expect 6 blocks, got %d, %v", length, err)
+	}
+	blocks, err = wal.Read(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 4 || !bytes.Equal(blocks[0], expect[0]) || !bytes.Equal(blocks[1], expect[3]) {
+		t.Errorf("unexpected blocks after skip corrupt, got %d blocks", len(blocks))
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRepair 修复之后报告损坏区域，备份损坏的 segment，并且可以按默认模式打开
+func TestRepair(t *testing.T) {
+	repairDir := "../../../../test_data/wal_repair/"
+	expect := buildCorruptLog(t, repairDir)
+
+	report, err := Repair(repairDir, NewOptions().SetDataFileCapacity(consts.MB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.BadBlocks) != 2 || len(report.Quarantined) != 2 {
+		t.Fatalf("expect 2 bad blocks and 2 quarantined segments, got %d, %d", len(report.BadBlocks), len(report.Quarantined))
+	}
+	for i, bad := range report.BadBlocks {
+		t.Logf("bad block: %+v", bad)
+		if bad.Index != int64(i+1) || bad.Count != 1 {
+			t.Errorf("expect block #%d lost, got %+v", i+1, bad)
+		}
+	}
+	// Offset 是损坏 block 在 segment 文件中的起始位置
+	blockSize := int64(headerSize + 400*consts.KB)
+	if report.BadBlocks[0].Offset != 16+blockSize || report.BadBlocks[1].Offset != 16 {
+		t.Errorf("unexpected bad block offset %d, %d", report.BadBlocks[0].Offset, report.BadBlocks[1].Offset)
+	}
+	for _, path := range report.Quarantined {
+		if _, err := os.Stat(path); err != nil {
+			t.Error(err)
+		}
+	}
+
+	report, err = Repair(repairDir, NewOptions().SetDataFileCapacity(consts.MB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.BadBlocks) != 0 {
+		t.Errorf("expect repaired log clean, got %d bad blocks", len(report.BadBlocks))
+	}
+
+	wal, err := NewLog(repairDir, NewOptions().SetDataFileCapacity(consts.MB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	blocks, err := wal.Read(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, idx := range []int{0, 3, 4, 5} {
+		if !bytes.Equal(blocks[i], expect[idx]) {
+			t.Errorf("block #%d mismatch", idx)
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package wal
 
 import (
-	"crypto/md5"
 	"encoding/binary"
 	"fmt"
 	"github.com/Trinoooo/eggie_kv/consts"
 	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/compress"
+	"github.com/Trinoooo/eggie_kv/storage/core/encrypt"
+	"github.com/Trinoooo/eggie_kv/storage/core/format"
 	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
 	"github.com/Trinoooo/eggie_kv/utils"
+	"go.uber.org/zap"
 	"io"
 	"os"
 	"path/filepath"
@@ -26,29 +29,39 @@ type segment struct {
 	startBlockIdx *int64
 	firstBlockIdx int64 // firstBlockIdx 数据文件维护的起始 block 索引
 	lastBlockIdx  int64 // lastBlockIdx 数据文件维护的最后 block 索引
-	// bbuf 数据文件活跃状态下在内存中维护日志数据，存储结构如下：
-	// | block #1 | block #2 | block #3 | block #4 ｜ 0000 |
-	// 当文件剩余容量不足以再写下一个完整 block 时文件末尾剩余内容不再使用，
-	// 保证文件开头是一个完整的 block
-	bbuf        []byte
-	bpos        []*position // bpos 指示 bbuf 中每个block的位置
-	bbufSyncIdx int64       // bbufSyncIdx 下一个要同步的 bbuf 数据下标
-	maxSize     int64       // maxSize 数据文件最大体积
-	hasSuffix   bool        // hasSuffix 数据文件路径中是否包含.active后缀，用于标识最后活跃的数据文件
-	opened      bool        // opened 数据文件是否已经打开
+	// bbuf 已经写入但还没有同步的 block，同步时追加写入到 segment 文件末尾（fileSize）之后，存储结构如下：
+	// | block #1 | block #2 | block #3 | block #4 ｜
+	// 已经同步的 block 不在内存中维护，读取时按 bpos 中的偏移量从 segment 文件中读取
+	bbuf      []byte
+	bpos      []*position      // bpos 指示每个 block 在 segment 文件中的位置，还没有同步的 block 按同步之后的位置记录
+	fileSize  int64            // fileSize segment 文件中已经写入的长度，即下一次追加写入的偏移量
+	base      int64            // base segment 文件头的长度，文件中 base 之后的 block 以及 tail block 与 bbuf 一起计入 segment 容量
+	maxSize   int64            // maxSize 数据文件最大体积
+	hasSuffix bool             // hasSuffix 数据文件路径中是否包含.active后缀，用于标识最后活跃的数据文件
+	opened    bool             // opened 数据文件是否已经打开
+	keyring   *encrypt.Keyring // keyring 新建 segment 时使用其中的当前密钥加密，为nil表示不加密
+	key       *encrypt.Key     // key segment 文件头中记录的密钥，为nil表示 segment 没有加密
+	version   uint8            // version segment 的格式版本，0表示没有 format.Header 的旧格式
+	checksum  format.Checksum  // checksum segment 中 block 使用的校验和算法
+	// recoveryMode 打开时发现 block 损坏的处理方式，见 RecoveryMode
+	recoveryMode RecoveryMode
+	damages      []*BadBlock // damages 打开时发现的损坏区域
+	quarantined  string      // quarantined 损坏的 segment 文件在修复之前的备份路径，为空表示没有备份
 }
 
 // position 日志位置信息
 type position struct {
-	start int64 // start 在bbuf中的起始偏移量
-	end   int64 // end 在bbuf中结束偏移量
+	start int64 // start 在 segment 文件中的起始偏移量
+	end   int64 // end 在 segment 文件中的结束偏移量
 }
 
 // newSegment 初始化数据文件
-func newSegment(path string, maxSize int64) (*segment, error) {
+func newSegment(path string, opts *Options) (*segment, error) {
 	seg := &segment{}
 	seg.path = path
-	seg.maxSize = maxSize
+	seg.maxSize = opts.dataFileCapacity
+	seg.keyring = opts.keyring
+	seg.recoveryMode = opts.recoveryMode
 	seg.firstBlockIdx = -1
 	seg.lastBlockIdx = -1
 	startBlockIdx, hasSuffix, err := baseToBlockIdx(filepath.Base(seg.path))
@@ -62,7 +75,7 @@ func newSegment(path string, maxSize int64) (*segment, error) {
 
 // open 打开数据文件
 func (seg *segment) open(perm os.FileMode) error {
-	fd, err := utils.CheckAndCreateFile(seg.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, perm)
+	fd, err := utils.CheckAndCreateFile(seg.path, os.O_RDWR|os.O_CREATE, perm)
 	if err != nil {
 		e := errs.NewOpenFileErr()
 		logs.Error(e.Error())
@@ -77,22 +90,192 @@ func (seg *segment) open(perm os.FileMode) error {
 		return e
 	}
 
-	bps, bbf, err := loadBlocks(all)
+	seg.fileSize = int64(len(all))
+	headerSize, err := seg.loadHeader(all)
 	if err != nil {
 		return err
 	}
 
-	seg.bbuf = bbf
-	seg.bpos = bps
-	seg.bbufSyncIdx = int64(len(seg.bbuf))
-	if lengthOfBpos := int64(len(seg.bpos)); lengthOfBpos > 0 {
+	// note：打开时只校验全部 block 并记录位置，之后读取 block 时再按位置从文件中读取
+	raw := all[headerSize:]
+	bps, valid, err := loadBlocks(raw, headerSize, seg.checksum)
+	var blocks [][]byte
+	rewrite := false
+	if err != nil {
+		if errs.GetCode(err) != errs.CorruptErrCode {
+			return err
+		}
+
+		switch {
+		// 只有活跃 segment 的末尾可能存在写到一半的 block（torn write），
+		// 这种情况丢弃尾部损坏的 block 后 segment 仍然可用，其余情况认为数据已被破坏
+		case seg.hasSuffix && seg.isTorn(raw, valid):
+			logs.Warn("drop torn tail block", zap.String("path", seg.path), zap.Int64("offset", headerSize+valid), zap.Int("size", len(raw)-int(valid)))
+			err = nil
+		case seg.recoveryMode == RecoveryTruncateTail:
+			seg.damages = append(seg.damages, &BadBlock{
+				Path:   seg.path,
+				Index:  seg.getStartBlockIdx() + int64(len(bps)),
+				Offset: headerSize + valid,
+				Size:   int64(len(raw)) - valid,
+			})
+			err = seg.quarantine(all, perm)
+		case seg.recoveryMode == RecoverySkipCorrupt:
+			blocks = seg.skipCorrupt(raw, headerSize)
+			rewrite = true
+			err = seg.quarantine(all, perm)
+		default:
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if !rewrite {
+			err = seg.fd.Truncate(headerSize + valid)
+			if err != nil {
+				e := errs.NewTruncateFileErr().WithErr(err)
+				logs.Error(e.Error())
+				return e
+			}
+			seg.fileSize = headerSize + valid
+		}
+	}
+
+	lengthOfBpos := int64(len(bps))
+	if rewrite {
+		lengthOfBpos = int64(len(blocks))
+	}
+	if lengthOfBpos > 0 {
 		seg.firstBlockIdx = seg.getStartBlockIdx()
 		seg.lastBlockIdx = seg.firstBlockIdx + lengthOfBpos - 1
 	}
+	seg.bpos = bps
 	seg.opened = true
+
+	// 跳过损坏的 block 之后 block 与文件内容不再一致，需要重写 segment 文件
+	if rewrite {
+		return seg.rebuild(blocks)
+	}
 	return nil
 }
 
+// loadHeader 解析 segment 文件头，确定 segment 的格式版本、校验和算法以及使用的密钥，返回 all 中文件头的长度
+// 空的 segment 使用当前格式，配置了密钥时使用当前密钥加密，并立即写入文件头
+//
+// 异常：
+//   - errs.NewUnsupportedFormatErr segment 的格式版本比当前版本新
+//   - errs.NewKeyNotFoundErr segment 使用的密钥不在 keyring 中
+//   - errs.NewTruncateFileErr 丢弃写到一半的文件头失败
+//   - errs.NewWriteFileErr 写入文件头失败
+func (seg *segment) loadHeader(all []byte) (int64, error) {
+	header, err := format.ParseVersionedHeader(all, segmentMagic, segmentVersion)
+	if err != nil {
+		logs.Error(err.Error(), zap.String("path", seg.path))
+		return 0, err
+	}
+	if header != nil {
+		seg.version = header.Version
+		seg.checksum = header.Checksum
+		if header.Flag&format.HeaderFlagEncrypted != 0 {
+			err = seg.resolveKey(header.KeyID)
+			if err != nil {
+				return 0, err
+			}
+		}
+		seg.base = format.HeaderSize
+		return seg.base, nil
+	}
+
+	// 新建的活跃 segment 写文件头时宕机，文件中只有一部分文件头，按空文件处理
+	if seg.hasSuffix && format.IsTornHeader(all, segmentMagic) {
+		logs.Warn("drop torn segment header", zap.String("path", seg.path), zap.Int("size", len(all)))
+		err = seg.fd.Truncate(0)
+		if err != nil {
+			e := errs.NewTruncateFileErr().WithErr(err)
+			logs.Error(e.Error())
+			return 0, e
+		}
+		all = all[:0]
+	}
+
+	// 旧格式：没有文件头，block 使用 MD5 校验
+	if len(all) > 0 {
+		seg.version = 0
+		seg.checksum = format.MD5
+		seg.base = 0
+		return 0, nil
+	}
+
+	seg.upgrade()
+	if seg.keyring != nil {
+		seg.key = seg.keyring.Active()
+	}
+	raw := seg.header()
+	_, err = seg.fd.WriteAt(raw, 0)
+	if err != nil {
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return 0, e
+	}
+	seg.fileSize = int64(len(raw))
+	seg.base = seg.fileSize
+	return 0, nil
+}
+
+// isTorn 判断活跃 segment 中 valid 之后损坏的数据是否是最后一次没有写完的同步（torn write）
+// 追加写入的 segment 中，损坏位置之后还有校验通过的 tail block 说明损坏的是已经同步完成的数据，不能丢弃；
+// 旧格式的 segment 只能根据剩余数据的长度判断
+func (seg *segment) isTorn(raw []byte, valid int64) bool {
+	if seg.version > 0 {
+		return !hasTail(raw, valid, seg.checksum)
+	}
+	return isTornTail(raw[valid:])
+}
+
+// resolveKey 按文件头中的密钥id查找 segment 使用的密钥
+func (seg *segment) resolveKey(keyID uint32) error {
+	if seg.keyring == nil {
+		e := errs.NewKeyNotFoundErr()
+		logs.Error(e.Error(), zap.String("path", seg.path), zap.Uint32(consts.LogFieldValue, keyID))
+		return e
+	}
+	key, err := seg.keyring.Key(keyID)
+	if err != nil {
+		logs.Error(err.Error(), zap.String("path", seg.path), zap.Uint32(consts.LogFieldValue, keyID))
+		return err
+	}
+	seg.key = key
+	return nil
+}
+
+// upgrade 切换到当前格式，只能在 segment 中没有 block，或者全部 block 都会重新构建时调用
+func (seg *segment) upgrade() {
+	seg.version = segmentVersion
+	seg.checksum = format.CRC32C
+}
+
+// header 序列化 segment 文件头，旧格式的 segment 没有文件头
+func (seg *segment) header() []byte {
+	if seg.version == 0 {
+		return nil
+	}
+
+	header := format.NewHeader(segmentMagic)
+	header.Version = seg.version
+	header.Checksum = seg.checksum
+	if seg.key != nil {
+		header.Flag |= format.HeaderFlagEncrypted
+		header.KeyID = seg.key.ID()
+	}
+	return header.Encode()
+}
+
+// sealedWith 判断 segment 是否使用 key 加密
+func (seg *segment) sealedWith(key *encrypt.Key) bool {
+	return seg.key != nil && key != nil && seg.key.ID() == key.ID()
+}
+
 // isOpened 判断数据文件是否处于打开状态
 func (seg *segment) isOpened() bool {
 	return seg.opened
@@ -134,22 +317,28 @@ func (seg *segment) close() error {
 	return nil
 }
 
-// write 写日志到数据文件中
-func (seg *segment) write(data []byte) error {
+// write 写日志到数据文件中，codec 是 data 的压缩算法，加密的 segment 会在写入前加密 data
+func (seg *segment) write(data []byte, codec compress.Codec) error {
 	err := seg.checkState()
 	if err != nil {
 		return err
 	}
 
-	lengthOfBlock := int64(len(data) + headerSize)
-	lengthOfBbuf := int64(len(seg.bbuf))
 	nextBlockIdx := seg.lastBlockIdx + 1
 	// bugfix：新建的/空的 segment 写入时 firstBlockIdx 和 lastBlockIdx 都没有初始化成该文件的起始 blockIdx
 	if seg.firstBlockIdx == -1 {
 		seg.firstBlockIdx = seg.getStartBlockIdx()
 		nextBlockIdx = seg.firstBlockIdx
 	}
-	if lengthOfBlock+lengthOfBbuf > seg.maxSize {
+	// note：blockIdx 参与加密认证，需要在确定 blockIdx 之后加密
+	flag, data := seg.seal(nextBlockIdx, data, uint8(codec))
+	lengthOfBlock := int64(len(data) + headerSize)
+	// 追加写入的 segment 同步时还会写入 tail block，需要为下一次同步的 tail block 预留空间
+	var lengthOfTail int64
+	if seg.version > 0 {
+		lengthOfTail = tailSize
+	}
+	if lengthOfBlock+seg.used()+lengthOfTail > seg.maxSize {
 		// note: 这里不打日志是因为可能是稳态错误，在外层判断再打日志
 		return errs.NewSegmentFullErr()
 	}
@@ -157,73 +346,278 @@ func (seg *segment) write(data []byte) error {
 		// note: 这里不打日志是因为可能是稳态错误，在外层判断再打日志
 		return errs.NewReachBlockIdxLimitErr()
 	}
-	seg.bpos = append(seg.bpos, &position{
-		start: lengthOfBbuf,
-		end:   lengthOfBbuf + lengthOfBlock,
-	})
-	seg.bbuf = append(seg.bbuf, buildBinary(nextBlockIdx, data)...)
+	seg.appendPending(buildBinary(nextBlockIdx, data, flag, seg.checksum))
 	seg.lastBlockIdx = nextBlockIdx
 	return nil
 }
 
+// appendPending 追加还没有同步的 block 到 bbuf 末尾，同时记录 block 同步之后在 segment 文件中的位置
+func (seg *segment) appendPending(block []byte) {
+	start := seg.fileSize + int64(len(seg.bbuf))
+	seg.bpos = append(seg.bpos, &position{
+		start: start,
+		end:   start + int64(len(block)),
+	})
+	seg.bbuf = append(seg.bbuf, block...)
+}
+
+// used 返回 segment 已经占用的容量，即文件头之后已经写入文件的 block、tail block 以及还没有同步的 block 的总长度
+func (seg *segment) used() int64 {
+	return seg.fileSize - seg.base + int64(len(seg.bbuf))
+}
+
 // sync 持久化数据到磁盘
 func (seg *segment) sync() error {
 	err := seg.checkState()
 	if err != nil {
 		return err
 	}
-	lenToWrite := int64(len(seg.bbuf)) - seg.bbufSyncIdx
 	// fast-through
-	if lenToWrite == 0 {
+	if len(seg.bbuf) == 0 {
 		return nil
 	}
 
-	err = seg.copyOnWrite(true)
+	// 旧格式的 segment 没有 tail block，无法识别写到一半的同步，仍然整体写时复制
+	if seg.version == 0 {
+		return seg.copyOnWrite(true)
+	}
+	return seg.appendSync()
+}
+
+// appendSync 把 bbuf 中还没有同步的 block 以及对应的 tail block 追加写入 segment 文件末尾，然后同步到磁盘
+// note：tail block 记录这次写入数据的校验和，两次写入之间不需要保证落盘顺序，
+// 打开时最后一个完整的 tail block 之后的数据都视为没有写完的同步
+func (seg *segment) appendSync() error {
+	chunk := seg.bbuf
+	tail := buildTail(seg.lastBlockIdx, chunk, seg.checksum)
+	_, err := seg.fd.WriteAt(chunk, seg.fileSize)
+	if err == nil {
+		_, err = seg.fd.WriteAt(tail, seg.fileSize+int64(len(chunk)))
+	}
 	if err != nil {
-		return err
+		e := errs.NewWriteFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
 	}
 
+	err = utils.Fdatasync(seg.fd)
+	if err != nil {
+		e := errs.NewSyncFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+	seg.fileSize += int64(len(chunk) + len(tail))
+	seg.bbuf = seg.bbuf[:0]
 	return nil
 }
 
-// read 查询 segment 文件中的指定范围数据
-// 如果执行成功会截断 segment 文件中 [firstBlockIdx, idx] 范围数据
-func (seg *segment) read(idx int64) (map[int64][]byte, error) {
+// read 按写入顺序查询 segment 中 [firstBlockIdx, idx] 范围内的日志数据
+// idx 不在 segment 中时返回 segment 中全部日志，占位 block 不返回
+func (seg *segment) read(idx int64) ([][]byte, error) {
 	err := seg.checkState()
 	if err != nil {
 		return nil, err
 	}
 
-	blockIdxToData := make(map[int64][]byte)
-	border := idx - seg.getStartBlockIdx()
+	last := idx
 	if idx < seg.firstBlockIdx || idx > seg.lastBlockIdx {
-		border = int64(len(seg.bpos)) - 1
+		last = seg.lastBlockIdx
 	}
+	return seg.readRange(seg.firstBlockIdx, last)
+}
 
-	for i := int64(0); i <= border; i++ {
-		data, _, blockIdx, err := parseBinary(seg.bbuf[seg.bpos[i].start:])
+// readRange 按写入顺序查询 segment 中 [from, to] 范围内的日志数据，占位 block 不返回
+// 调用方保证 from、to 都在 segment 中
+func (seg *segment) readRange(from, to int64) ([][]byte, error) {
+	logsData := make([][]byte, 0, to-from+1)
+	for blockIdx := from; blockIdx <= to; blockIdx++ {
+		data, hole, err := seg.readBlock(blockIdx)
 		if err != nil {
 			return nil, err
 		}
-		blockIdxToData[blockIdx] = data
+		if hole {
+			continue
+		}
+		logsData = append(logsData, data)
 	}
+	return logsData, nil
+}
 
-	return blockIdxToData, nil
+// readBlock 查询 segment 中的单个 block，调用方保证 blockIdx 在 segment 中
+// 第二个返回值表示 block 是否是占位 block，占位 block 对应的日志已经丢失，没有日志数据
+func (seg *segment) readBlock(blockIdx int64) ([]byte, bool, error) {
+	raw, err := seg.readRaw(seg.bpos[blockIdx-seg.getStartBlockIdx()])
+	if err != nil {
+		return nil, false, err
+	}
+	block, _, _, err := parseBinary(raw, seg.checksum)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// bugfix：只返回日志内容，去掉 block header
+	flag := block[headerFlagOffset]
+	data, err := seg.unseal(blockIdx, flag, block[headerDataOffset:])
+	if err != nil {
+		logs.Error(err.Error(), zap.String(consts.LogFieldParams, "blockIdx"), zap.Int64(consts.LogFieldValue, blockIdx))
+		return nil, false, err
+	}
+	return data, flag&headerFlagHole != 0, nil
+}
+
+// readRaw 读取 pos 位置的完整 block，还没有同步的 block 从 bbuf 中复制，其余按偏移量从 segment 文件中读取
+// note：bbuf 同步之后会被复用，返回的数据不能引用 bbuf
+func (seg *segment) readRaw(pos *position) ([]byte, error) {
+	raw := make([]byte, pos.end-pos.start)
+	if pos.start >= seg.fileSize {
+		copy(raw, seg.bbuf[pos.start-seg.fileSize:pos.end-seg.fileSize])
+		return raw, nil
+	}
+
+	_, err := seg.fd.ReadAt(raw, pos.start)
+	if err != nil {
+		e := errs.NewReadFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+	return raw, nil
+}
+
+// seal 按 segment 的密钥加密日志数据，flag 是加密之外的标记位，返回 block 的标记位以及写入 block 的 payload
+func (seg *segment) seal(blockIdx int64, data []byte, flag uint8) (uint8, []byte) {
+	if seg.key == nil {
+		return flag, data
+	}
+	flag |= headerFlagEncrypted
+	return flag, seg.key.Seal(data, blockAAD(blockIdx, flag))
+}
+
+// unseal 按 block 标记位解密、解压 payload
+//
+// 异常：
+//   - errs.NewFileIntegrityErr payload 被篡改，或者 block 是否加密与 segment 不一致
+//   - errs.NewCorruptErr payload 无法解压
+func (seg *segment) unseal(blockIdx int64, flag uint8, payload []byte) ([]byte, error) {
+	payload, err := seg.decrypt(blockIdx, flag, payload)
+	if err != nil {
+		return nil, err
+	}
+	return compress.Decompress(compress.Codec(flag&headerFlagCodecMask), payload)
+}
+
+// decrypt 按 block 标记位解密 payload，返回的数据仍然是压缩之后的
+func (seg *segment) decrypt(blockIdx int64, flag uint8, payload []byte) ([]byte, error) {
+	// 加密的 segment 中所有 block 都是加密的，避免篡改标记位绕过认证
+	encrypted := flag&headerFlagEncrypted != 0
+	if encrypted != (seg.key != nil) {
+		return nil, errs.NewFileIntegrityErr()
+	}
+	if !encrypted {
+		return payload, nil
+	}
+	return seg.key.Open(payload, blockAAD(blockIdx, flag))
+}
+
+// reseal 使用 key 重新加密 segment 中的全部 block 并重写 segment 文件，block 的压缩算法保持不变
+// 全部 block 都会重新构建，旧格式的 segment 同时升级到当前格式
+func (seg *segment) reseal(key *encrypt.Key) error {
+	err := seg.checkState()
+	if err != nil {
+		return err
+	}
+
+	blocks := make([][]byte, 0, len(seg.bpos))
+	for _, pos := range seg.bpos {
+		raw, err := seg.readRaw(pos)
+		if err != nil {
+			return err
+		}
+		block, _, blockIdx, err := parseBinary(raw, seg.checksum)
+		if err != nil {
+			return err
+		}
+		flag := block[headerFlagOffset]
+		payload, err := seg.decrypt(blockIdx, flag, block[headerDataOffset:])
+		if err != nil {
+			logs.Error(err.Error(), zap.String(consts.LogFieldParams, "blockIdx"), zap.Int64(consts.LogFieldValue, blockIdx))
+			return err
+		}
+
+		flag = flag&(headerFlagCodecMask|headerFlagHole) | headerFlagEncrypted
+		blocks = append(blocks, buildBinary(blockIdx, key.Seal(payload, blockAAD(blockIdx, flag)), flag, format.CRC32C))
+	}
+
+	seg.key = key
+	seg.upgrade()
+	return seg.rebuild(blocks)
+}
+
+// rebuild 按 blocks 重写整个 segment 文件，blocks 是按顺序排列的完整 block
+// 需要在确定 segment 的格式版本以及密钥之后调用，重写的文件使用对应的文件头
+func (seg *segment) rebuild(blocks [][]byte) error {
+	seg.base = int64(len(seg.header()))
+	seg.fileSize = seg.base
+	seg.bbuf = nil
+	seg.bpos = make([]*position, 0, len(blocks))
+	for _, block := range blocks {
+		seg.appendPending(block)
+	}
+	return seg.copyOnWrite(false)
+}
+
+// blockAAD 加密 payload 时认证的附加数据：| blockIdx 8字节 | 标记位 1字节 |
+// blockIdx 参与认证，避免加密的 block 在 segment 之间被调换
+func blockAAD(blockIdx int64, flag uint8) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, uint64(blockIdx))
+	aad[8] = flag
+	return aad
 }
 
 // truncate 截断 segment 文件中的指定范围数据
 // 如果执行成功会截断 segment 文件中 [firstBlockIdx, idx] 范围数据
 // 如果idx超过 segment 文件容纳的block数量，该文件会被截断成空文件
 func (seg *segment) truncate(idx int64) (err error) {
+	var blocks [][]byte
 	if idx < seg.firstBlockIdx || idx >= seg.lastBlockIdx {
-		seg.bpos = make([]*position, 0, consts.KB)
-		seg.bbuf = make([]byte, 0, seg.maxSize)
+		// bugfix：活跃 segment 被截断成空文件后仍会继续写入，需要把起始边界
+		// 挪到下一个要写入的 block，保证 segment 中的 blockIdx 与 Log 一致
+		if seg.hasSuffix && seg.lastBlockIdx != -1 {
+			oldPath := seg.path
+			defer func() {
+				if err != nil {
+					return
+				}
+
+				err = os.Remove(oldPath)
+				if err != nil {
+					e := errs.NewRemoveFileErr().WithErr(err)
+					logs.Error(e.Error())
+					err = e
+				}
+			}()
+			seg.path = filepath.Join(filepath.Dir(seg.path), blockIdxToBase((seg.lastBlockIdx+1)%getMaxBlockCapacityInWAL(), seg.hasSuffix))
+		}
 		seg.firstBlockIdx = -1
 		seg.lastBlockIdx = -1
+		// 截断成空文件之后没有旧数据需要解密，后续写入使用当前格式以及当前密钥
+		seg.upgrade()
+		if seg.keyring != nil {
+			seg.key = seg.keyring.Active()
+		}
 	} else {
 		seg.firstBlockIdx = idx + 1
-		seg.bpos = seg.bpos[seg.firstBlockIdx-seg.getStartBlockIdx():]
-		seg.bbuf = seg.bbuf[seg.bpos[0].start:] // 前面的判断保证这里取seg.bpos[0]不会有问题
+		// 保留的 block 在重写之后的文件中位置会变化，rebuild 按新文件重新记录位置，
+		// 否则再次截断或者读取同一个 segment 时会越界或者读到错误的 block
+		bpos := seg.bpos[seg.firstBlockIdx-seg.getStartBlockIdx():]
+		blocks = make([][]byte, 0, len(bpos))
+		for _, pos := range bpos {
+			raw, err := seg.readRaw(pos)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, raw)
+		}
 		// note: 这里 rename 可能导致不一致问题
 		// 即原文件内容没有被截断，但是文件名被修改成截断后的
 		oldPath := seg.path
@@ -241,9 +635,8 @@ func (seg *segment) truncate(idx int64) (err error) {
 		}()
 		seg.path = filepath.Join(filepath.Dir(seg.path), blockIdxToBase(seg.firstBlockIdx, seg.hasSuffix))
 	}
-	seg.bbufSyncIdx = 0
 
-	err = seg.copyOnWrite(false)
+	err = seg.rebuild(blocks)
 	if err != nil {
 		return err
 	}
@@ -302,7 +695,8 @@ func (seg *segment) checkState() error {
 	return nil
 }
 
-// copyOnWrite 写时复制
+// copyOnWrite 写时复制，copy 为true时复制原文件之后追加没有同步的 block，否则按文件头以及 bbuf 重写整个文件
+// 截断、重新加密、修复时 block 与文件内容不再一致，需要通过 rebuild 重写；旧格式的 segment 同步时也使用复制的方式
 func (seg *segment) copyOnWrite(copy bool) error {
 	dir, base := filepath.Dir(seg.path), filepath.Base(seg.path)
 	tempFile, err := os.CreateTemp(dir, base)
@@ -327,6 +721,14 @@ func (seg *segment) copyOnWrite(copy bool) error {
 			logs.Error(e.Error())
 			return e
 		}
+	} else {
+		// 不复制原文件时文件头需要重新写入
+		_, err = tempFile.Write(seg.header())
+		if err != nil {
+			e := errs.NewWriteFileErr().WithErr(err)
+			logs.Error(e.Error())
+			return e
+		}
 	}
 
 	err = seg.fd.Close()
@@ -336,13 +738,24 @@ func (seg *segment) copyOnWrite(copy bool) error {
 		return e
 	}
 
-	_, err = tempFile.Write(seg.bbuf[seg.bbufSyncIdx:])
+	chunk := seg.bbuf
+	if !copy && seg.version > 0 && len(chunk) > 0 {
+		chunk = append(chunk[:len(chunk):len(chunk)], buildTail(seg.lastBlockIdx, chunk, seg.checksum)...)
+	}
+	_, err = tempFile.Write(chunk)
 	if err != nil {
 		e := errs.NewWriteFileErr().WithErr(err)
 		logs.Error(e.Error())
 		return e
 	}
 
+	fileSize, err := tempFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		e := errs.NewSeekFileErr().WithErr(err)
+		logs.Error(e.Error())
+		return e
+	}
+
 	err = tempFile.Sync()
 	if err != nil {
 		e := errs.NewSyncFileErr().WithErr(err)
@@ -356,7 +769,8 @@ func (seg *segment) copyOnWrite(copy bool) error {
 		logs.Error(e.Error())
 		return e
 	}
-	seg.bbufSyncIdx = int64(len(seg.bbuf))
+	seg.bbuf = seg.bbuf[:0]
+	seg.fileSize = fileSize
 	seg.fd = tempFile
 	seg.startBlockIdx = nil
 	return nil
@@ -385,84 +799,140 @@ func baseToBlockIdx(base string) (int64, bool, error) {
 	return firstBlockIdOfSegment, hasSuffix, nil
 }
 
-// buildBinary 日志数据格式化成二进制数据
-// 存储在数据文件中的 block 结构：| length 8字节 | blockid 8字节 | checksum 16字节 | payload x字节 |
-func buildBinary(blockId int64, data []byte) []byte {
+// buildBinary 日志数据格式化成二进制数据，checksum 是 block 所在 segment 使用的校验和算法
+// 存储在数据文件中的 block 结构：| length 7字节 | flag 1字节 | blockid 8字节 | checksum 16字节 | payload x字节 |
+func buildBinary(blockId int64, data []byte, flag uint8, checksum format.Checksum) []byte {
 	length := int64(len(data))
 	// prof: 避免buf重分配
 	buf := make([]byte, headerSize, headerSize+length)
-	binary.PutVarint(buf[:headerBlockIdOffset], length)
+	binary.PutVarint(buf[:headerFlagOffset], length)
+	buf[headerFlagOffset] = flag
 	binary.PutVarint(buf[headerBlockIdOffset:headerSummaryOffset], blockId)
-	var dataAndHeader []byte
-	dataAndHeader = append(dataAndHeader, data...)
-	dataAndHeader = append(dataAndHeader, buf[:headerSummaryOffset]...)
-	checksum := md5.Sum(dataAndHeader)
-	for i := 0; i < len(checksum); i++ {
-		buf[headerSummaryOffset+i] = checksum[i]
-	}
+	checksum.Sum(buf[headerSummaryOffset:headerDataOffset], data, buf[:headerSummaryOffset])
 	buf = append(buf, data...)
 	return buf
 }
 
-// loadBlocks 从数据文件中装载并解析二进制数据
-func loadBlocks(raw []byte) ([]*position, []byte, error) {
+// buildTail 构造同步时追加在 chunk 之后的 tail block，lastBlockIdx 是 chunk 中最后一个 block 的索引
+// tail block 的 payload：| chunk 长度 8字节 | chunk 的校验和 16字节 |
+func buildTail(lastBlockIdx int64, chunk []byte, checksum format.Checksum) []byte {
+	payload := make([]byte, tailPayloadSize)
+	binary.BigEndian.PutUint64(payload, uint64(len(chunk)))
+	checksum.Sum(payload[8:], chunk)
+	return buildBinary(lastBlockIdx, payload, headerFlagTail, checksum)
+}
+
+// verifyTail 校验 tail block 的 payload，written 是 tail block 之前的全部数据
+func verifyTail(written []byte, payload []byte, checksum format.Checksum) bool {
+	if len(payload) != tailPayloadSize {
+		return false
+	}
+	length := binary.BigEndian.Uint64(payload)
+	if length > uint64(len(written)) {
+		return false
+	}
+	return checksum.Verify(payload[8:], written[uint64(len(written))-length:])
+}
+
+// loadBlocks 解析并校验数据文件中的二进制数据，返回每个 block 在文件中的位置，tail block 只做校验，不记录位置
+// base 是 raw 在 segment 文件中的偏移量；额外返回成功解析部分的长度，解析失败时可以据此定位损坏的 block
+func loadBlocks(raw []byte, base int64, checksum format.Checksum) ([]*position, int64, error) {
 	var start int64
 	fileSize := int64(len(raw))
 	// prof: 粗拍一个cap，避免小数据段导致的频繁重分配问题
 	bps := make([]*position, 0, consts.KB)
-	bbf := make([]byte, 0, fileSize)
 	for {
 		if start == fileSize {
 			break
 		}
 
-		block, offset, _, err := parseBinary(raw[start:])
+		block, offset, _, err := parseBinary(raw[start:], checksum)
 		if err != nil {
-			return nil, nil, err
+			return bps, start, err
+		}
+
+		if block[headerFlagOffset]&headerFlagTail != 0 {
+			if !verifyTail(raw[:start], block[headerDataOffset:], checksum) {
+				e := errs.NewCorruptErr()
+				logs.Error(e.Error(), zap.Int64("offset", start))
+				return bps, start, e
+			}
+			start += offset
+			continue
 		}
 
 		bps = append(bps, &position{
-			start: start,
-			end:   start + offset,
+			start: base + start,
+			end:   base + start + offset,
 		})
 		start += offset
-		bbf = append(bbf, block...)
 	}
 
-	return bps, bbf, nil
+	return bps, start, nil
 }
 
-// parseBinary 二进制数据解析成日志数据
+// hasTail 判断 raw 中 from 之后是否存在校验通过的 tail block，即 tail block 以及它覆盖的数据都完整地写入了磁盘
+// 最后一次同步没有写完时，即使 tail block 已经落盘，它覆盖的数据也无法通过校验
+func hasTail(raw []byte, from int64, checksum format.Checksum) bool {
+	for offset := from; offset+tailSize <= int64(len(raw)); offset++ {
+		// prof：先检查标记位以及长度，大部分位置不需要计算校验和
+		if raw[offset+headerFlagOffset]&headerFlagTail == 0 {
+			continue
+		}
+		if length, _ := binary.Varint(raw[offset : offset+headerFlagOffset]); length != tailPayloadSize {
+			continue
+		}
+		block, _, _, ok := parseBlock(raw[offset:], checksum)
+		if ok && verifyTail(raw[:offset], block[headerDataOffset:], checksum) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTornTail 判断损坏的数据是否是末尾写到一半的 block
+// 即剩余数据不足一个完整的 block，或者剩余数据恰好是一个 checksum 不匹配的 block
+func isTornTail(raw []byte) bool {
+	rawSize := int64(len(raw))
+	if rawSize < headerSize {
+		return true
+	}
+	length, _ := binary.Varint(raw[:headerFlagOffset])
+	if length < 0 {
+		return false
+	}
+	return rawSize <= headerDataOffset+length
+}
+
+// parseBinary 二进制数据解析成日志数据，checksum 是 block 所在 segment 使用的校验和算法
 // 返回日志内容、日志大小、blockid
-func parseBinary(raw []byte) ([]byte, int64, int64, error) {
+func parseBinary(raw []byte, checksum format.Checksum) ([]byte, int64, int64, error) {
+	block, blockSize, blockId, ok := parseBlock(raw, checksum)
+	if !ok {
+		e := errs.NewCorruptErr()
+		logs.Error(e.Error())
+		return nil, 0, 0, e
+	}
+	return block, blockSize, blockId, nil
+}
+
+// parseBlock 与 parseBinary 相同，解析失败时不打日志，扫描损坏的 segment 时使用
+func parseBlock(raw []byte, checksum format.Checksum) ([]byte, int64, int64, bool) {
 	rawSize := int64(len(raw))
 	// note: 先校验headerSize是不是比raw的长度大，校验通过后
 	// 再检查blockSize是不是比raw的长度大，最后校验读取到的checksum
 	// 是否和计算出的checksum一致（验证数据完整性）
 	if rawSize < headerSize {
-		e := errs.NewCorruptErr()
-		logs.Error(e.Error())
-		return nil, 0, 0, e
+		return nil, 0, 0, false
 	}
-	length, _ := binary.Varint(raw[:headerBlockIdOffset])
+	length, _ := binary.Varint(raw[:headerFlagOffset])
 	blockId, _ := binary.Varint(raw[headerBlockIdOffset:headerSummaryOffset])
-	checksum := raw[headerSummaryOffset:headerDataOffset]
 	blockSize := headerDataOffset + length
-	if rawSize < blockSize {
-		e := errs.NewCorruptErr()
-		logs.Error(e.Error())
-		return nil, 0, 0, e
+	if length < 0 || rawSize < blockSize {
+		return nil, 0, 0, false
 	}
-	var dataAndLength []byte
-	dataAndLength = append(dataAndLength, raw[headerDataOffset:blockSize]...)
-	dataAndLength = append(dataAndLength, raw[:headerSummaryOffset]...)
-	current := md5.Sum(dataAndLength)
-	for i := 0; i < len(checksum); i++ {
-		if checksum[i] != current[i] {
-			e := errs.NewCorruptErr()
-			logs.Error(e.Error())
-			return nil, 0, 0, e
-		}
+	if !checksum.Verify(raw[headerSummaryOffset:headerDataOffset], raw[headerDataOffset:blockSize], raw[:headerSummaryOffset]) {
+		return nil, 0, 0, false
 	}
-	return raw[:blockSize], blockSize, blockId, nil
+	return raw[:blockSize], blockSize, blockId, true
 }
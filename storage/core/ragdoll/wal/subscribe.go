@@ -0,0 +1,126 @@
+package wal
+
+import (
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
+	"go.uber.org/zap"
+	"sync"
+)
+
+// Subscription 日志订阅，按写入顺序逐条返回从指定索引开始的日志，没有新日志时阻塞等待写入
+// 订阅者消费速度比 Truncate 慢、要读取的日志已经被截断时返回 errs.NewSubscriberLaggedErr，
+// 此时订阅者需要通过其他方式（例如快照）追上进度之后重新订阅
+type Subscription struct {
+	wal       *Log
+	it        *Iterator
+	next      int64         // next 下一条要返回的日志的 block 索引
+	done      chan struct{} // done 关闭订阅时关闭，唤醒阻塞中的 Next
+	closeOnce sync.Once
+}
+
+// Subscribe 订阅从 fromIdx 开始的日志
+//
+// 参数：
+//   - fromIdx 第一条要返回的日志的 block 索引，可以是下一条要写入的日志的索引，见 Log.BlockRange
+//
+// 返回值：
+//   - 订阅（*Subscription），结束使用后需要调用 Subscription.Close
+//   - errs 过程中出现的错误，类型是 *errs.KvErr
+//
+// 异常：
+//   - errs.NewFileClosedErr 在wal已经关闭的情况下订阅
+//   - errs.NewCorruptErr 在wal数据已经被破坏的情况下订阅
+//   - errs.NewBackgroundErr 在wal后台协程执行失败的情况下订阅
+//   - errs.NewSubscriberLaggedErr fromIdx 对应的日志已经被截断或者还没有写入
+func (wal *Log) Subscribe(fromIdx int64) (*Subscription, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	err := wal.checkState(true, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	nextBlockIdx := (wal.lastBlockIdx + 1) % getMaxBlockCapacityInWAL()
+	if fromIdx != nextBlockIdx && (wal.firstBlockIdx == -1 || wal.checkRange(fromIdx) != nil) {
+		e := errs.NewSubscriberLaggedErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "fromIdx"), zap.Int64(consts.LogFieldValue, fromIdx))
+		return nil, e
+	}
+
+	return &Subscription{
+		wal:  wal,
+		it:   &Iterator{wal: wal},
+		next: fromIdx,
+		done: make(chan struct{}),
+	}, nil
+}
+
+// Next 返回下一条日志及其 block 索引，没有新日志时阻塞等待写入
+// 修复时已经丢失的日志会被跳过
+//
+// 异常：
+//   - errs.NewSubscriptionClosedErr 订阅已经关闭
+//   - errs.NewSubscriberLaggedErr 下一条日志已经被截断
+//   - errs.NewFileClosedErr 等待过程中 Log 被关闭
+//   - errs.NewCorruptErr block 校验失败
+func (sub *Subscription) Next() (int64, []byte, error) {
+	for {
+		// note：先取出管道再读取日志，避免读取之后、等待之前的写入被漏掉
+		sub.wal.mu.Lock()
+		written := sub.wal.written
+		sub.wal.mu.Unlock()
+
+		idx, data, ok, err := sub.TryNext()
+		if err != nil || ok {
+			return idx, data, err
+		}
+
+		select {
+		case <-written:
+		case <-sub.done:
+			return 0, nil, errs.NewSubscriptionClosedErr()
+		}
+	}
+}
+
+// TryNext 与 Next 相同，但是没有新日志时不阻塞，第三个返回值为false
+func (sub *Subscription) TryNext() (int64, []byte, bool, error) {
+	select {
+	case <-sub.done:
+		return 0, nil, false, errs.NewSubscriptionClosedErr()
+	default:
+	}
+
+	sub.it.SeekTo(sub.next)
+	if sub.it.Valid() {
+		idx, data := sub.it.Index(), sub.it.Value()
+		sub.next = (idx + 1) % getMaxBlockCapacityInWAL()
+		return idx, data, true, nil
+	}
+	if err := sub.it.Err(); err != nil {
+		if errs.GetCode(err) == errs.NotFoundErrCode {
+			e := errs.NewSubscriberLaggedErr().WithErr(err)
+			logs.Error(e.Error(), zap.String(consts.LogFieldParams, "next"), zap.Int64(consts.LogFieldValue, sub.next))
+			return 0, nil, false, e
+		}
+		return 0, nil, false, err
+	}
+	// 跳过占位 block 之后到达末尾时迭代器位置比 next 靠后
+	sub.next = sub.it.Index()
+	return 0, nil, false, nil
+}
+
+// NextIdx 下一条要返回的日志的 block 索引，可以在订阅关闭之后用于重新订阅
+func (sub *Subscription) NextIdx() int64 {
+	return sub.next
+}
+
+// Close 关闭订阅，唤醒阻塞中的 Next，重复关闭不会报错
+func (sub *Subscription) Close() error {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+	})
+	return nil
+}
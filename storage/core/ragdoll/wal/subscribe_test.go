@@ -0,0 +1,152 @@
+package wal
+
+import (
+	"github.com/Trinoooo/eggie_kv/errs"
+	"testing"
+	"time"
+)
+
+// TestLog_Subscribe 订阅者阻塞等待新日志，落后于截断位置时返回错误，关闭订阅之后唤醒阻塞中的 Next
+func TestLog_Subscribe(t *testing.T) {
+	subscribeDirPath := "../../../../test_data/wal_subscribe/"
+	wal, err := NewLog(subscribeDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	for i := 0; i < 2; i++ {
+		err = wal.Write(testData[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub, err := wal.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		idx, data, err := sub.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx != int64(i) || string(data) != string(testData[i]) {
+			t.Errorf("block #%d mismatch, got #%d %v", i, idx, data)
+		}
+	}
+
+	// 没有新日志时阻塞，写入之后返回
+	received := make(chan int64)
+	go func() {
+		idx, _, err := sub.Next()
+		if err != nil {
+			t.Error(err)
+		}
+		received <- idx
+	}()
+	select {
+	case idx := <-received:
+		t.Fatalf("expect blocked, got #%d", idx)
+	case <-time.After(50 * time.Millisecond):
+	}
+	err = wal.Write(testData[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case idx := <-received:
+		if idx != 2 {
+			t.Errorf("expect block #2, got #%d", idx)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect woken up by write")
+	}
+
+	// 订阅者还没有消费的日志被截断
+	lagged, err := wal.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lagged.Close()
+	err = wal.Truncate(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = lagged.Next(); errs.GetCode(err) != errs.SubscriberLaggedErrCode {
+		t.Errorf("expect lagged err, got %v", err)
+	}
+	if _, err = wal.Subscribe(0); errs.GetCode(err) != errs.SubscriberLaggedErrCode {
+		t.Errorf("expect lagged err, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sub.Close()
+	}()
+	if _, _, err = sub.Next(); errs.GetCode(err) != errs.SubscriptionClosedErrCode {
+		t.Errorf("expect subscription closed err, got %v", err)
+	}
+}
+
+// TestLog_SubscribeTruncateAll 日志被全部截断之后，还没有消费完的订阅者立即返回错误，不需要等待下一次写入
+func TestLog_SubscribeTruncateAll(t *testing.T) {
+	subscribeDirPath := "../../../../test_data/wal_subscribe_truncate_all/"
+	wal, err := NewLog(subscribeDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	for i := 0; i < 3; i++ {
+		err = wal.Write(testData[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lagged, err := wal.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lagged.Close()
+	caughtUp, err := wal.Subscribe(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caughtUp.Close()
+
+	length, err := wal.Len()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Truncate(length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok, err := lagged.TryNext(); ok || errs.GetCode(err) != errs.SubscriberLaggedErrCode {
+		t.Errorf("expect subscriber lagged err, got %v, %v", ok, err)
+	}
+	// 已经消费完全部日志的订阅者不受影响，继续等待新日志
+	if _, _, ok, err := caughtUp.TryNext(); ok || err != nil {
+		t.Errorf("expect no new block, got %v, %v", ok, err)
+	}
+	err = wal.Write(testData[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx, _, ok, err := caughtUp.TryNext(); !ok || err != nil || idx != 3 {
+		t.Errorf("expect block #3, got #%d, %v, %v", idx, ok, err)
+	}
+}
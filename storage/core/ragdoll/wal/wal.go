@@ -4,6 +4,8 @@ import (
 	"errors"
 	"github.com/Trinoooo/eggie_kv/consts"
 	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/compress"
+	"github.com/Trinoooo/eggie_kv/storage/core/encrypt"
 	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/logs"
 	"github.com/Trinoooo/eggie_kv/utils"
 	"go.uber.org/zap"
@@ -18,12 +20,15 @@ import (
 
 // Options 日志配置选项
 type Options struct {
-	logDirPerm        os.FileMode   // logDirPerm 先行日志目录文件权限位
-	dataFilePerm      os.FileMode   // dataFilePerm 先行日志数据文件权限位
-	dataFileCapacity  int64         // dataFileCapacity segment 数据文件最大存储容量
-	dataFileCacheSize int           // dataFileCacheSize 内存中缓存 segment 的最大数量
-	syncMode          SyncMode      // syncMode 持久化级别
-	syncInterval      time.Duration // syncInterval 刷盘周期，单位是毫秒
+	logDirPerm        os.FileMode          // logDirPerm 先行日志目录文件权限位
+	dataFilePerm      os.FileMode          // dataFilePerm 先行日志数据文件权限位
+	dataFileCapacity  int64                // dataFileCapacity segment 数据文件最大存储容量
+	dataFileCacheSize int                  // dataFileCacheSize 内存中缓存 segment 的最大数量
+	syncMode          SyncMode             // syncMode 持久化级别
+	syncInterval      time.Duration        // syncInterval 刷盘周期，单位是毫秒
+	compressor        *compress.Compressor // compressor 写入时压缩日志数据，为nil时不压缩
+	keyring           *encrypt.Keyring     // keyring 写入时加密日志数据，为nil时不加密
+	recoveryMode      RecoveryMode         // recoveryMode 打开时发现 segment 损坏的处理方式
 }
 
 // NewOptions 初始化wal配置选项
@@ -124,6 +129,51 @@ func (opts *Options) SetSyncInterval(syncInterval time.Duration) *Options {
 	return opts
 }
 
+// SetCompression 设置日志数据的压缩算法
+//
+// 压缩算法记录在每个 block 的 header 中，修改配置后已经写入的 block 仍然可以读取
+//
+// 参数：
+//   - codec 压缩算法，compress.None 表示不压缩
+//   - threshold 小于该长度的日志数据不压缩，单位字节
+//
+// 返回值：
+//   - 接收器 Log 配置选项（*options）
+func (opts *Options) SetCompression(codec compress.Codec, threshold int) *Options {
+	opts.compressor = compress.NewCompressor(codec, threshold)
+	return opts
+}
+
+// SetKeyring 设置日志数据加密使用的密钥
+//
+// 新建的 segment 使用 keyring 中的当前密钥加密，密钥id记录在 segment 文件头中；
+// 打开 Log 时如果活跃 segment 没有使用当前密钥加密会新开一个 segment。
+// 使用旧密钥加密的 segment 需要旧密钥同时在 keyring 中才能读取，可以通过 Log.ReEncrypt 重新加密
+//
+// 参数：
+//   - keyring 密钥集合，nil 表示不加密
+//
+// 返回值：
+//   - 接收器 Log 配置选项（*options）
+func (opts *Options) SetKeyring(keyring *encrypt.Keyring) *Options {
+	opts.keyring = keyring
+	return opts
+}
+
+// SetRecoveryMode 设置打开 Log 时发现 segment 损坏的处理方式
+//
+// # RecoveryFail 以外的模式会在打开时校验全部 segment，损坏的 segment 文件在修改之前备份到 quarantine 子目录
+//
+// 参数：
+//   - recoveryMode 损坏处理方式，见 RecoveryMode
+//
+// 返回值：
+//   - 接收器 Log 配置选项（*options）
+func (opts *Options) SetRecoveryMode(recoveryMode RecoveryMode) *Options {
+	opts.recoveryMode = recoveryMode
+	return opts
+}
+
 // check 校验 Options 配置
 func (opts *Options) check() error {
 	// note：暂时不考虑特殊权限位
@@ -157,6 +207,12 @@ func (opts *Options) check() error {
 		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "opts.syncInterval"), zap.Duration(consts.LogFieldValue, opts.syncInterval))
 		return e
 	}
+
+	if opts.recoveryMode < RecoveryFail || opts.recoveryMode > RecoverySkipCorrupt {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "opts.recoveryMode"), zap.Int64(consts.LogFieldValue, int64(opts.recoveryMode)))
+		return e
+	}
 	return nil
 }
 
@@ -182,13 +238,17 @@ type Log struct {
 	// 设置为true时表示 segments 处于有序状态，重复调用 sortSegments 不会执行排序过程；
 	// 设置为false时表示 segments 处于无序状态，此时调用 sortSegments 会执行排序过程。
 	isSegmentsOrdered bool
-	activeSegment     *segment   // activeSegment 当前活跃数据文件
-	firstBlockIdx     int64      // firstBlockIdx 第一个日志块索引，nil表示 Log 为空
-	lastBlockIdx      int64      // lastBlockIdx 最后一个日志块索引，nil表示 Log 为空
-	closed            bool       // closed 是否已经关闭
-	corrupted         bool       // corrupted 是否已损坏
-	bgfailed          bool       // bgfailed 后台协程执行失败
-	notifier          chan error // notifier wal主协程与子协程的同步管道，只有设置 opts.syncMode 为true时会用到
+	activeSegment     *segment    // activeSegment 当前活跃数据文件
+	firstBlockIdx     int64       // firstBlockIdx 第一个日志块索引，nil表示 Log 为空
+	lastBlockIdx      int64       // lastBlockIdx 最后一个日志块索引，nil表示 Log 为空
+	closed            bool        // closed 是否已经关闭
+	corrupted         bool        // corrupted 是否已损坏
+	bgfailed          bool        // bgfailed 后台协程执行失败
+	notifier          chan error  // notifier wal主协程与子协程的同步管道，只有设置 opts.syncMode 为true时会用到
+	badBlocks         []*BadBlock // badBlocks 打开时按 RecoveryMode 处理的损坏区域
+	quarantined       []string    // quarantined 打开时备份到 quarantine 子目录的 segment 文件
+	// written 写入新日志或者关闭 Log 时关闭并替换成新的管道，用于唤醒等待新日志的订阅者
+	written chan struct{}
 }
 
 // NewLog 初始化 Log
@@ -221,6 +281,7 @@ func NewLog(dirPath string, opts *Options) (*Log, error) {
 		firstBlockIdx: -1,
 		lastBlockIdx:  -1,
 		closed:        true,
+		written:       make(chan struct{}),
 	}, nil
 }
 
@@ -299,8 +360,25 @@ func (wal *Log) init() error {
 		return err
 	}
 
+	err = wal.recover()
+	if err != nil {
+		return err
+	}
+
 	wal.locateBlockRange()
 
+	// 保证新写入的日志都使用当前密钥加密，空的活跃 segment 直接替换密钥
+	if wal.opts.keyring != nil && !wal.activeSegment.sealedWith(wal.opts.keyring.Active()) {
+		if wal.activeSegment.size() == 0 {
+			err = wal.activeSegment.reseal(wal.opts.keyring.Active())
+		} else {
+			err = wal.rollover((wal.lastBlockIdx + 1) % getMaxBlockCapacityInWAL())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
 	// 全托管-异步 持久化级别开启后台协程定期刷盘
 	// 刷盘周期默认1s
 	if wal.opts.isFullManagedAsync() {
@@ -386,7 +464,7 @@ func (wal *Log) loadSegments() error {
 			return nil
 		}
 
-		currentSegment, err := newSegment(filepath.Join(wal.dirPath, de.Name()), wal.opts.dataFileCapacity)
+		currentSegment, err := newSegment(filepath.Join(wal.dirPath, de.Name()), wal.opts)
 		if err != nil {
 			return err
 		}
@@ -425,7 +503,7 @@ func (wal *Log) loadSegments() error {
 
 	// 首次启动目录下没有segment
 	if activeSegment == nil {
-		activeSegment, err = newSegment(filepath.Join(wal.dirPath, blockIdxToBase(0, true)), wal.opts.dataFileCapacity)
+		activeSegment, err = newSegment(filepath.Join(wal.dirPath, blockIdxToBase(0, true)), wal.opts)
 		if err != nil {
 			return err
 		}
@@ -450,8 +528,8 @@ func (wal *Log) locateBlockRange() {
 	for idx, seg := range wal.segments {
 		if seg == wal.activeSegment {
 			firstSegment := wal.segments[(idx+1)%len(wal.segments)]
-			size := seg.size()
-			if size > 0 {
+			// bugfix：activeSegment 为空时，只要还有其他 segment，Log 就不为空
+			if seg.size() > 0 || firstSegment != seg {
 				wal.firstBlockIdx = firstSegment.getStartBlockIdx()
 			}
 		}
@@ -460,17 +538,19 @@ func (wal *Log) locateBlockRange() {
 	// wal.firstBlockIdx 意味着 Log 中只有一个 segment，且 segment 中没有 block
 	// 如果 activeSegment 不是 firstSegment，且 activeSegment 中没有 block
 	// wal.lastBlockIdx 应该取到上一个 segment 的最后一个 blockIdx
-	if wal.firstBlockIdx != -1 {
-		wal.lastBlockIdx = wal.activeSegment.getStartBlockIdx() + wal.activeSegment.size() - 1
-	}
+	// bugfix：Log 为空时 activeSegment 的起始边界就是下一个要写入的 block，
+	// 需要据此恢复 wal.lastBlockIdx，保证截断全部日志后重启 blockIdx 仍然连续
+	wal.lastBlockIdx = wal.activeSegment.getStartBlockIdx() + wal.activeSegment.size() - 1
 }
 
 // periodicSync 后台协程周期刷盘内存中的日志数据
 // 只有设置 opts.syncMode 为true时才会执行
 func (wal *Log) periodicSync() {
+	// bugfix：Close 会把 opts 置空，需要在等待 open 完成之前读取刷盘周期
+	ticker := time.NewTicker(wal.opts.syncInterval)
+	defer ticker.Stop()
 	// note：等待主协程执行完open
 	<-wal.notifier
-	ticker := time.NewTicker(wal.opts.syncInterval)
 	for {
 		select {
 		case <-wal.notifier:
@@ -559,6 +639,7 @@ func (wal *Log) Close() error {
 		close(wal.notifier) // 关闭管道通知后台子协程结束
 	}
 	wal.opts = nil
+	wal.wakeSubscribers()
 	return nil
 }
 
@@ -599,6 +680,90 @@ func (wal *Log) Write(data []byte) error {
 		return err
 	}
 
+	err = wal.append(data)
+	if err != nil {
+		return err
+	}
+
+	if wal.opts.isFullManagedSync() {
+		err = wal.activeSegment.sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	wal.wakeSubscribers()
+	return nil
+}
+
+// WriteBatch 批量写入日志数据，批次中的日志分配连续的 block 索引，写满当前 segment 时在批次中途新开 segment
+// 持久化模式是 FullManagedSync 时整个批次只同步一次磁盘，调用方可以借此实现组提交
+//
+// 参数：
+//   - datas 日志数据列表，按顺序写入
+//
+// 返回值：
+//   - firstBlockIdx 批次中第一条日志的 block 索引
+//   - lastBlockIdx 批次中最后一条日志的 block 索引，日志开始循环之后可能比 firstBlockIdx 小
+//   - errs 过程中出现的错误，类型是 *errs.KvErr
+//
+// 异常：
+//   - errs.NewWalFullErr Log 剩余容量不足以写入整个批次，此时批次中的日志都没有写入
+//   - errs.NewInvalidParamErr 批次为空，或者其中有日志超过 segment 文件容量、是空数据
+//   - 其余异常与 Log.Write 相同，写入 segment 失败时批次中前面的日志可能已经写入
+func (wal *Log) WriteBatch(datas [][]byte) (int64, int64, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	err := wal.checkState(true, true, true)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(datas) == 0 {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "lengthOfDatas"), zap.Int(consts.LogFieldValue, 0))
+		return 0, 0, e
+	}
+	for _, data := range datas {
+		err = wal.checkDataSize(data)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// 先检查剩余容量，避免批次只写入一部分
+	var length int64
+	if wal.firstBlockIdx != -1 {
+		length = wal.distance(wal.lastBlockIdx) + 1
+	}
+	if int64(len(datas)) > getMaxBlockCapacityInWAL()-length {
+		e := errs.NewWalFullErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "lengthOfDatas"), zap.Int(consts.LogFieldValue, len(datas)))
+		return 0, 0, e
+	}
+
+	firstBlockIdx := (wal.lastBlockIdx + 1) % getMaxBlockCapacityInWAL()
+	for _, data := range datas {
+		err = wal.append(data)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if wal.opts.isFullManagedSync() {
+		err = wal.activeSegment.sync()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	wal.wakeSubscribers()
+	return firstBlockIdx, wal.lastBlockIdx, nil
+}
+
+// append 向活跃 segment 追加一条日志，写满时新开 segment，不负责同步磁盘
+func (wal *Log) append(data []byte) error {
 	// 循环写日志时可能日志文件夹下内容写满
 	// 需要考虑 lastBlockIdx 追上 firstBlockIdx 的情况
 	nextBlockIdx := (wal.lastBlockIdx + 1) % getMaxBlockCapacityInWAL()
@@ -608,42 +773,25 @@ func (wal *Log) Write(data []byte) error {
 		return e
 	}
 	wal.lastBlockIdx = nextBlockIdx
+	// bugfix：向空日志写入第一条记录时需要同时初始化 firstBlockIdx
+	if wal.firstBlockIdx == -1 {
+		wal.firstBlockIdx = nextBlockIdx
+	}
 
-	err = wal.activeSegment.write(data)
+	payload, codec := wal.opts.compressor.Compress(data)
+	err := wal.activeSegment.write(payload, codec)
 	if err != nil {
 		// 1. 如果当前 segment 满了，那么新开一个 segment
 		// 2. 如果写 segment 时发现 segment 内部 blockIdx 已经触达 blockCapacity 上限，那么 blockIdx 从零开始计数新开一个 segment
 		if errs.GetCode(err) == errs.SegmentFullErrCode || errs.GetCode(err) == errs.ReachBlockIdxLimitErrCode {
-			err := wal.activeSegment.close()
-			if err != nil {
-				return err
-			}
-
-			nextActiveSegment, err := newSegment(filepath.Join(wal.dirPath, blockIdxToBase(wal.lastBlockIdx, true)), wal.opts.dataFileCapacity)
-			if err != nil {
-				return err
-			}
-			wal.segments = append(wal.segments, nextActiveSegment)
-			wal.isSegmentsOrdered = false
-			err = nextActiveSegment.open(wal.opts.dataFilePerm)
+			err := wal.rollover(wal.lastBlockIdx)
 			if err != nil {
 				return err
 			}
 
-			// 在下个 segment 文件创建成功后再去掉 activeSegment 文件名
-			// 避免出现目录下出现没有 segment 文件有.active后缀的情况
-			// 如果 rename 失败，目录下会出现多个 segment 文件有.active
-			// 后缀的情况，wal.init()会选择有.active后缀且 startBlockId
-			// 最大的 segment 文件作为 activeSegment
-			err = wal.activeSegment.rename()
-			if err != nil {
-				return err
-			}
-			wal.activeSegment = nextActiveSegment
-
 			// 如果 segmentSize 设置小于一次单日志数据最大体积
 			// 那么可能出现新建一个 segment 也写入失败的问题
-			err = wal.activeSegment.write(data)
+			err = wal.activeSegment.write(payload, codec)
 			if err != nil {
 				logs.Error(err.Error())
 				return err
@@ -652,14 +800,43 @@ func (wal *Log) Write(data []byte) error {
 			return err
 		}
 	}
+	return nil
+}
 
-	if wal.opts.isFullManagedSync() {
-		err = wal.activeSegment.sync()
-		if err != nil {
-			return err
-		}
+// wakeSubscribers 唤醒等待新日志的订阅者
+func (wal *Log) wakeSubscribers() {
+	close(wal.written)
+	wal.written = make(chan struct{})
+}
+
+// rollover 关闭当前活跃 segment，新开一个从 startBlockIdx 开始的 segment 作为活跃 segment
+func (wal *Log) rollover(startBlockIdx int64) error {
+	err := wal.activeSegment.close()
+	if err != nil {
+		return err
 	}
 
+	nextActiveSegment, err := newSegment(filepath.Join(wal.dirPath, blockIdxToBase(startBlockIdx, true)), wal.opts)
+	if err != nil {
+		return err
+	}
+	wal.segments = append(wal.segments, nextActiveSegment)
+	wal.isSegmentsOrdered = false
+	err = nextActiveSegment.open(wal.opts.dataFilePerm)
+	if err != nil {
+		return err
+	}
+
+	// 在下个 segment 文件创建成功后再去掉 activeSegment 文件名
+	// 避免出现目录下出现没有 segment 文件有.active后缀的情况
+	// 如果 rename 失败，目录下会出现多个 segment 文件有.active
+	// 后缀的情况，wal.init()会选择有.active后缀且 startBlockId
+	// 最大的 segment 文件作为 activeSegment
+	err = wal.activeSegment.rename()
+	if err != nil {
+		return err
+	}
+	wal.activeSegment = nextActiveSegment
 	return nil
 }
 
@@ -689,6 +866,13 @@ func (wal *Log) Read(size int64) ([][]byte, error) {
 		return nil, err
 	}
 
+	// 空的 Log 中 firstBlockIdx、lastBlockIdx 都是-1，sizeToIdx 计算出的-1会通过 checkRange 检查
+	if wal.firstBlockIdx == -1 {
+		e := errs.NewNotFoundErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "size"), zap.Int64(consts.LogFieldValue, size))
+		return nil, e
+	}
+
 	idx, err := wal.sizeToIdx(size)
 	if err != nil {
 		return nil, err
@@ -701,39 +885,178 @@ func (wal *Log) Read(size int64) ([][]byte, error) {
 		return nil, e
 	}
 
+	return wal.readRange(wal.firstBlockIdx, idx)
+}
+
+// ReadAt 读取指定索引的日志数据
+//
+// 参数：
+//   - idx 日志的 block 索引，见 Log.BlockRange
+//
+// 返回值：
+//   - data 日志数据
+//   - errs 过程中出现的错误，类型是 *errs.KvErr
+//
+// 异常：
+//   - errs.NewFileClosedErr 在wal已经关闭的情况下读取
+//   - errs.NewCorruptErr 在wal数据已经被破坏的情况下读取，或者 block 校验失败
+//   - errs.NewBackgroundErr 在wal后台协程执行失败的情况下读取
+//   - errs.NewNotFoundErr 传入idx不在有效范围内，或者对应的日志在修复时已经丢失
+//   - errs.NewOpenFileErr 打开 segment 文件失败
+//   - errs.NewReadFileErr 读取 segment 文件失败
+func (wal *Log) ReadAt(idx int64) ([]byte, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	err := wal.checkState(true, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	seg, err := wal.locateSegment(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	data, hole, err := seg.readBlock(idx)
+	if err != nil {
+		return nil, err
+	}
+	if hole {
+		e := errs.NewNotFoundErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "idx"), zap.Int64(consts.LogFieldValue, idx))
+		return nil, e
+	}
+	return data, nil
+}
+
+// ReadRange 读取 [from, to] 范围内的日志数据
+//
+// 日志开始循环之后 to 可能比 from 小，from、to 的先后按写入顺序判断
+//
+// 参数：
+//   - from 范围内第一个日志的 block 索引
+//   - to 范围内最后一个日志的 block 索引
+//
+// 返回值：
+//   - logDatas 查询到的日志数据列表，按写入顺序有序，修复时已经丢失的日志不返回
+//   - errs 过程中出现的错误，类型是 *errs.KvErr
+//
+// 异常：
+//   - errs.NewFileClosedErr 在wal已经关闭的情况下读取
+//   - errs.NewCorruptErr 在wal数据已经被破坏的情况下读取，或者 block 校验失败
+//   - errs.NewBackgroundErr 在wal后台协程执行失败的情况下读取
+//   - errs.NewNotFoundErr 传入from、to不在有效范围内
+//   - errs.NewInvalidParamErr 按写入顺序 from 在 to 之后
+//   - errs.NewOpenFileErr 打开 segment 文件失败
+//   - errs.NewReadFileErr 读取 segment 文件失败
+func (wal *Log) ReadRange(from, to int64) ([][]byte, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	err := wal.checkState(true, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if wal.firstBlockIdx == -1 {
+		e := errs.NewNotFoundErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "from, to"), zap.Int64s(consts.LogFieldValue, []int64{from, to}))
+		return nil, e
+	}
+
+	err = wal.checkRange(from, to)
+	if err != nil {
+		e := errs.NewNotFoundErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	if wal.distance(from) > wal.distance(to) {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "from, to"), zap.Int64s(consts.LogFieldValue, []int64{from, to}))
+		return nil, e
+	}
+
+	return wal.readRange(from, to)
+}
+
+// readRange 按写入顺序逐个 segment 读取 [from, to] 范围内的日志数据，调用方保证 from、to 有效
+func (wal *Log) readRange(from, to int64) ([][]byte, error) {
 	var logsData [][]byte
-	err = wal.traverseSegments(idx, func(seg *segment) error {
-		if !seg.isOpened() {
-			err := seg.open(wal.opts.dataFilePerm)
-			if err != nil {
-				return err
-			}
+	for idx := from; ; {
+		seg, err := wal.locateSegment(idx)
+		if err != nil {
+			return nil, err
 		}
 
-		eliminated := wal.segmentCache.Write(seg.getStartBlockIdx(), seg)
-		if eliminated != nil {
-			err := eliminated.(*segment).close()
-			if err != nil {
-				return err
-			}
+		last := seg.lastBlockIdx
+		if idx <= to && to <= last {
+			last = to
 		}
-
-		partial, err := seg.read(idx)
+		partial, err := seg.readRange(idx, last)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		logsData = append(logsData, partial...)
 
-		for _, data := range partial {
-			logsData = append(logsData, data)
+		if last == to {
+			return logsData, nil
 		}
+		idx = (last + 1) % getMaxBlockCapacityInWAL()
+	}
+}
 
-		return nil
-	})
+// locateSegment 查找存储 idx 对应 block 的 segment，并通过 loadSegment 保证 segment 已经打开
+func (wal *Log) locateSegment(idx int64) (*segment, error) {
+	err := wal.checkRange(idx)
+	if err != nil {
+		e := errs.NewNotFoundErr().WithErr(err)
+		logs.Error(e.Error())
+		return nil, e
+	}
+
+	seg := wal.findSegment(idx)
+	err = wal.loadSegment(seg)
 	if err != nil {
 		return nil, err
 	}
 
-	return logsData, nil
+	// note：防御性检查，segment 与 Log 记录的 block 范围不一致时避免越界，
+	// 没有 block 的 segment 中 firstBlockIdx、lastBlockIdx 都是-1，不能用范围判断
+	if seg.firstBlockIdx == -1 || idx < seg.firstBlockIdx || idx > seg.lastBlockIdx {
+		e := errs.NewNotFoundErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "idx"), zap.Int64(consts.LogFieldValue, idx))
+		return nil, e
+	}
+	return seg, nil
+}
+
+// loadSegment 按需打开 segment 并写入 segmentCache
+// 被淘汰出缓存的 segment 会被关闭，释放其中缓存的 block 数据
+func (wal *Log) loadSegment(seg *segment) error {
+	if !seg.isOpened() {
+		err := seg.open(wal.opts.dataFilePerm)
+		if err != nil {
+			return err
+		}
+	}
+
+	eliminated := wal.segmentCache.Write(seg.getStartBlockIdx(), seg)
+	// bugfix：activeSegment 被淘汰出缓存时不能关闭，否则后续写入会失败
+	if eliminated != nil && eliminated.(*segment) != wal.activeSegment {
+		err := eliminated.(*segment).close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// distance 按写入顺序计算 idx 与 firstBlockIdx 之间的距离
+func (wal *Log) distance(idx int64) int64 {
+	maxCapacity := getMaxBlockCapacityInWAL()
+	return (idx - wal.firstBlockIdx + maxCapacity) % maxCapacity
 }
 
 // Sync 同步内存中的日志数据到磁盘中
@@ -774,14 +1097,43 @@ func (wal *Log) Sync() error {
 //   - errs.NewCorruptErr 在wal数据已经被破坏的情况下调用
 //   - errs.NewBackgroundErr 在wal后台协程执行失败的情况下调用
 func (wal *Log) Len() (int64, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
 	err := wal.checkState(true, true, true)
 	if err != nil {
 		return 0, err
 	}
+	// bugfix：空日志长度为0，非空日志长度需要包含 firstBlockIdx 与 lastBlockIdx 两端
+	if wal.firstBlockIdx == -1 {
+		return 0, nil
+	}
 	if wal.firstBlockIdx <= wal.lastBlockIdx {
-		return wal.lastBlockIdx - wal.firstBlockIdx, nil
+		return wal.lastBlockIdx - wal.firstBlockIdx + 1, nil
+	}
+	return wal.lastBlockIdx + getMaxBlockCapacityInWAL() - wal.firstBlockIdx + 1, nil
+}
+
+// BlockRange 获取 Log 中第一个和最后一个 block 的索引
+//
+// 返回值：
+//   - firstBlockIdx 第一个 block 的索引，Log 为空时是-1
+//   - lastBlockIdx 最后一个 block 的索引，Log 为空时是下一个要写入的 block 的索引减一
+//   - errs 过程中出现的错误，类型是 *errs.KvErr
+//
+// 异常：
+//   - errs.NewFileClosedErr 在wal已经关闭的情况下调用
+//   - errs.NewCorruptErr 在wal数据已经被破坏的情况下调用
+//   - errs.NewBackgroundErr 在wal后台协程执行失败的情况下调用
+func (wal *Log) BlockRange() (int64, int64, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	err := wal.checkState(true, true, true)
+	if err != nil {
+		return 0, 0, err
 	}
-	return wal.lastBlockIdx + getMaxBlockCapacityInWAL() - wal.firstBlockIdx, nil
+	return wal.firstBlockIdx, wal.lastBlockIdx, nil
 }
 
 // Truncate 截断从最早写入日志算起的指定范围内日志
@@ -878,16 +1230,82 @@ func (wal *Log) Truncate(size int64) error {
 		}
 	}
 	wal.segments = segmentTidy
-	wal.firstBlockIdx = idx + 1
-	// 把目录下所有日志全部截断，需要重置 seg.firstBlockIdx 与 seg.lastBlockIdx
-	if wal.firstBlockIdx > wal.lastBlockIdx {
+	wal.firstBlockIdx = (idx + 1) % getMaxBlockCapacityInWAL()
+	// 把目录下所有日志全部截断，需要重置 wal.firstBlockIdx
+	// bugfix：保留 wal.lastBlockIdx，保证后续写入的 blockIdx 连续；
+	// 日志循环后 firstBlockIdx 比 lastBlockIdx 大是正常情况，不能据此判断日志被全部截断
+	if idx == wal.lastBlockIdx {
 		wal.firstBlockIdx = -1
-		wal.lastBlockIdx = -1
 	}
 	wal.isSegmentsOrdered = false
 	return nil
 }
 
+// ReEncrypt 使用当前密钥重新加密没有加密或者使用旧密钥加密的 segment，用于密钥轮换
+//
+// 打开 Log 时已经保证活跃 segment 使用当前密钥，这里只处理其他 segment。
+// 重新加密完成之后旧密钥可以从配置中删除
+//
+// 返回值：
+//   - 重新加密的 segment 数量
+//   - errs 过程中出现的错误，类型是 *errs.KvErr
+//
+// 异常：
+//   - errs.NewFileClosedErr 在wal已经关闭的情况下重新加密
+//   - errs.NewInvalidParamErr 没有配置密钥
+//   - errs.NewKeyNotFoundErr segment 使用的旧密钥不在 keyring 中
+//   - errs.NewFileIntegrityErr segment 数据被篡改
+//   - errs.NewCreateTempFileErr 创建临时文件失败
+//   - errs.NewWriteFileErr 写入 segment 文件失败
+//   - errs.NewSyncFileErr 同步 segment 文件到磁盘失败
+func (wal *Log) ReEncrypt() (int, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	err := wal.checkState(true, true, true)
+	if err != nil {
+		return 0, err
+	}
+
+	if wal.opts.keyring == nil {
+		e := errs.NewInvalidParamErr()
+		logs.Error(e.Error(), zap.String(consts.LogFieldParams, "opts.keyring"))
+		return 0, e
+	}
+
+	active := wal.opts.keyring.Active()
+	var count int
+	for _, seg := range wal.segments {
+		if seg == wal.activeSegment {
+			continue
+		}
+
+		opened := seg.isOpened()
+		if !opened {
+			err := seg.open(wal.opts.dataFilePerm)
+			if err != nil {
+				return count, err
+			}
+		}
+
+		if !seg.sealedWith(active) {
+			err = seg.reseal(active)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		if !opened {
+			err = seg.close()
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
 // traverseSegments 遍历数据文件
 // 并将包含 firstBlockIdx ~ idx 范围内 block 的 segment 传入 fn 执行外部动作
 func (wal *Log) traverseSegments(idx int64, fn func(seg *segment) error) error {
@@ -1,11 +1,17 @@
 package wal
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/Trinoooo/eggie_kv/consts"
 	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/compress"
+	"github.com/Trinoooo/eggie_kv/storage/core/encrypt"
+	"github.com/Trinoooo/eggie_kv/storage/core/format"
 	"github.com/Trinoooo/eggie_kv/utils"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -820,3 +826,888 @@ func benchmarkInner(b *testing.B, data []byte) {
 		}
 	}
 }
+
+// TestLog_OpenTornTail 活跃 segment 末尾存在写到一半的 block，打开时丢弃该 block
+func TestLog_OpenTornTail(t *testing.T) {
+	tornDirPath := "../../../../test_data/wal_torn_tail/"
+	wal, err := NewLog(tornDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = wal.Write(testData[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := os.OpenFile(tornDirPath+blockIdxToBase(0, true), os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = active.Write(buildBinary(3, testData[3], 0, format.CRC32C)[:headerSize+10])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = active.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = NewLog(tornDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	length, err := wal.Len()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != 3 {
+		t.Errorf("expect 3 blocks, got %d", length)
+	}
+
+	blocks, err := wal.Read(length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, block := range blocks {
+		if string(block) != string(testData[i]) {
+			t.Errorf("block #%d mismatch, expect %v, got %v", i, testData[i], block)
+		}
+	}
+
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLog_TruncateAllThenWrite 截断全部日志后继续写入，blockIdx 保持连续
+func TestLog_TruncateAllThenWrite(t *testing.T) {
+	truncateDirPath := "../../../../test_data/wal_truncate_all/"
+	wal, err := NewLog(truncateDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = wal.Write(testData[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = wal.Truncate(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	length, err := wal.Len()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length != 0 {
+		t.Errorf("expect empty log, got %d blocks", length)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = wal.Write(testData[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = NewLog(truncateDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, last, err := wal.BlockRange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 5 || last != 6 {
+		t.Errorf("expect block range [5, 6], got [%d, %d]", first, last)
+	}
+
+	blocks, err := wal.Read(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, block := range blocks {
+		if string(block) != string(testData[i]) {
+			t.Errorf("block #%d mismatch, expect %v, got %v", i, testData[i], block)
+		}
+	}
+
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLog_TruncatePrefixThenRead 多次截断活跃 segment 的前一部分日志，剩余日志仍然能正确读取
+func TestLog_TruncatePrefixThenRead(t *testing.T) {
+	truncateDirPath := "../../../../test_data/wal_truncate_prefix/"
+	wal, err := NewLog(truncateDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = wal.Write(testData[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, size := range []int64{1, 1} {
+		err = wal.Truncate(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocks, err := wal.Read(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, block := range blocks {
+		if string(block) != string(testData[i+2]) {
+			t.Errorf("block #%d mismatch, expect %v, got %v", i, testData[i+2], block)
+		}
+	}
+
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLog_Compression 不同压缩配置写入的 block 混合存储在同一个日志中，重新打开后都可以读取
+func TestLog_Compression(t *testing.T) {
+	compressDirPath := "../../../../test_data/wal_compression/"
+	small := []byte("small")
+	large := []byte(strings.Repeat("eggie_kv", 128))
+	codecs := []compress.Codec{compress.None, compress.Snappy, compress.Zstd}
+	var expect [][]byte
+	for _, codec := range codecs {
+		wal, err := NewLog(compressDirPath, NewOptions().SetCompression(codec, 64))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = wal.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range [][]byte{small, large} {
+			err = wal.Write(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect = append(expect, data)
+		}
+		err = wal.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	raw, err := os.ReadFile(compressDirPath + blockIdxToBase(0, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) >= len(codecs)*(2*headerSize+len(small)+len(large)) {
+		t.Errorf("expect compressed blocks smaller than raw, got %d bytes", len(raw))
+	}
+
+	wal, err := NewLog(compressDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	blocks, err := wal.Read(int64(len(expect)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != len(expect) {
+		t.Fatalf("expect %d blocks, got %d", len(expect), len(blocks))
+	}
+	for i, block := range blocks {
+		if string(block) != string(expect[i]) {
+			t.Errorf("block #%d mismatch, expect %s, got %s", i, expect[i], block)
+		}
+	}
+}
+
+// TestLog_Encryption 密钥轮换前后写入的 segment 都可以读取，重新加密之后不再需要旧密钥
+func TestLog_Encryption(t *testing.T) {
+	encryptDirPath := "../../../../test_data/wal_encryption/"
+	oldKey, _ := encrypt.NewKey([]byte("0123456789abcdef0123456789abcdef"))
+	newKey, _ := encrypt.NewKey([]byte("fedcba9876543210fedcba9876543210"))
+	keyrings := []*encrypt.Keyring{nil, encrypt.NewKeyring(oldKey), encrypt.NewKeyring(newKey, oldKey)}
+	var expect [][]byte
+	for i, keyring := range keyrings {
+		wal, err := NewLog(encryptDirPath, NewOptions().SetKeyring(keyring).SetCompression(compress.Snappy, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = wal.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 2; j++ {
+			data := testData[(i*2+j)%len(testData)]
+			err = wal.Write(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect = append(expect, data)
+		}
+		if i == len(keyrings)-1 {
+			count, err := wal.ReEncrypt()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 2 {
+				t.Errorf("expect 2 segments re-encrypted, got %d", count)
+			}
+		}
+		err = wal.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 只有当前密钥时无法打开加密的日志
+	wal, err := NewLog(encryptDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Open(); errs.GetCode(err) != errs.KeyNotFoundErrCode {
+		t.Fatalf("expect key not found, got %v", err)
+	}
+
+	wal, err = NewLog(encryptDirPath, NewOptions().SetKeyring(encrypt.NewKeyring(newKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := wal.Read(int64(len(expect)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, block := range blocks {
+		if string(block) != string(expect[i]) {
+			t.Errorf("block #%d mismatch, expect %v, got %v", i, expect[i], block)
+		}
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 篡改加密的 payload 并重新计算 checksum，认证失败
+	path := encryptDirPath + blockIdxToBase(0, false)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _, blockIdx, err := parseBinary(raw[format.HeaderSize:], format.CRC32C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := append([]byte(nil), block[headerDataOffset:]...)
+	payload[len(payload)-1] ^= 0xff
+	tampered := append(raw[:format.HeaderSize:format.HeaderSize], buildBinary(blockIdx, payload, block[headerFlagOffset], format.CRC32C)...)
+	tampered = append(tampered, raw[format.HeaderSize+len(block):]...)
+	// tail block 同样校验被篡改的数据，需要一起重新计算
+	for start, offset := format.HeaderSize, format.HeaderSize; offset < len(tampered); {
+		block, blockSize, blockIdx, err := parseBinary(tampered[offset:], format.CRC32C)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block[headerFlagOffset]&headerFlagTail != 0 {
+			copy(tampered[offset:], buildTail(blockIdx, tampered[start:offset], format.CRC32C))
+			start = offset + int(blockSize)
+		}
+		offset += int(blockSize)
+	}
+	err = os.WriteFile(path, tampered, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = NewLog(encryptDirPath, NewOptions().SetKeyring(encrypt.NewKeyring(newKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if _, err := wal.Read(1); errs.GetCode(err) != errs.FileIntegrityErrCode {
+		t.Errorf("expect integrity error, got %v", err)
+	}
+}
+
+// TestLog_OpenLegacyFormat 没有文件头、使用 MD5 校验的旧格式 segment 可以继续读写，截断成空文件之后升级到当前格式
+func TestLog_OpenLegacyFormat(t *testing.T) {
+	legacyDirPath := "../../../../test_data/wal_legacy_format/"
+	err := os.MkdirAll(legacyDirPath, 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var legacy []byte
+	for i := 0; i < 3; i++ {
+		legacy = append(legacy, buildBinary(int64(i), testData[i], 0, format.MD5)...)
+	}
+	err = os.WriteFile(legacyDirPath+blockIdxToBase(0, true), legacy, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := NewLog(legacyDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Write(testData[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = NewLog(legacyDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := wal.Read(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, block := range blocks {
+		if string(block) != string(testData[i]) {
+			t.Errorf("block #%d mismatch, expect %v, got %v", i, testData[i], block)
+		}
+	}
+
+	err = wal.Truncate(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Write(testData[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(legacyDirPath + blockIdxToBase(4, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := format.ParseVersionedHeader(raw, segmentMagic, segmentVersion)
+	if err != nil || header == nil || header.Version != segmentVersion || header.Checksum != format.CRC32C {
+		t.Errorf("expect segment upgraded to current format, got %+v, %v", header, err)
+	}
+}
+
+// BenchmarkParseBinary 对比 MD5 与 CRC32C 格式的 block 解析耗时
+func BenchmarkParseBinary(b *testing.B) {
+	data := make([]byte, 4*consts.KB)
+	for _, checksum := range []format.Checksum{format.MD5, format.CRC32C} {
+		name := map[format.Checksum]string{format.MD5: "md5", format.CRC32C: "crc32c"}[checksum]
+		raw := buildBinary(0, data, 0, checksum)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(raw)))
+			for i := 0; i < b.N; i++ {
+				_, _, _, err := parseBinary(raw, checksum)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestLog_ReadRange 跨多个 segment 按索引读取，segment 缓存只保留一个 segment
+func TestLog_ReadRange(t *testing.T) {
+	rangeDirPath := "../../../../test_data/wal_read_range/"
+	wal, err := NewLog(rangeDirPath, NewOptions().SetDataFileCapacity(consts.MB).SetDataFileCacheSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	var expect [][]byte
+	for i := 0; i < 8; i++ {
+		data := []byte(strings.Repeat(string(rune('a'+i)), 300*consts.KB))
+		err = wal.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect = append(expect, data)
+	}
+	err = wal.Truncate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx := int64(1); idx < 8; idx++ {
+		data, err := wal.ReadAt(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(expect[idx]) {
+			t.Errorf("block #%d mismatch", idx)
+		}
+	}
+
+	blocks, err := wal.ReadRange(2, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 5 {
+		t.Fatalf("expect 5 blocks, got %d", len(blocks))
+	}
+	for i, block := range blocks {
+		if string(block) != string(expect[i+2]) {
+			t.Errorf("block #%d mismatch", i+2)
+		}
+	}
+
+	if _, err = wal.ReadAt(0); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect not found err, got %v", err)
+	}
+	if _, err = wal.ReadRange(1, 8); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect not found err, got %v", err)
+	}
+	if _, err = wal.ReadRange(5, 3); errs.GetCode(err) != errs.InvalidParamErrCode {
+		t.Errorf("expect invalid param err, got %v", err)
+	}
+}
+
+// TestLog_ReadEmpty 空的 Log 以及截断全部日志之后读取返回 errs.NewNotFoundErr
+func TestLog_ReadEmpty(t *testing.T) {
+	emptyDirPath := "../../../../test_data/wal_read_empty/"
+	wal, err := NewLog(emptyDirPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	check := func(stage string) {
+		if _, err := wal.Read(1); errs.GetCode(err) != errs.NotFoundErrCode {
+			t.Errorf("%s: expect Read not found err, got %v", stage, err)
+		}
+		if _, err := wal.ReadRange(-1, -1); errs.GetCode(err) != errs.NotFoundErrCode {
+			t.Errorf("%s: expect ReadRange not found err, got %v", stage, err)
+		}
+		if _, err := wal.ReadAt(-1); errs.GetCode(err) != errs.NotFoundErrCode {
+			t.Errorf("%s: expect ReadAt not found err, got %v", stage, err)
+		}
+	}
+	check("empty")
+
+	err = wal.Write([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Truncate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("truncated")
+}
+
+// TestLog_WriteBatch 批次中的日志分配连续索引，写满 segment 时在批次中途新开 segment
+func TestLog_WriteBatch(t *testing.T) {
+	batchDirPath := "../../../../test_data/wal_write_batch/"
+	wal, err := NewLog(batchDirPath, NewOptions().SetDataFileCapacity(consts.MB).SetSyncMode(FullManagedSync))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	err = wal.Write(testData[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batch [][]byte
+	for i := 0; i < 5; i++ {
+		batch = append(batch, []byte(strings.Repeat(string(rune('a'+i)), 300*consts.KB)))
+	}
+	first, last, err := wal.WriteBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 1 || last != 5 {
+		t.Errorf("expect block range [1, 5], got [%d, %d]", first, last)
+	}
+	if len(wal.segments) != 2 {
+		t.Errorf("expect rollover inside batch, got %d segments", len(wal.segments))
+	}
+
+	blocks, err := wal.ReadRange(first, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, block := range blocks {
+		if string(block) != string(batch[i]) {
+			t.Errorf("block #%d mismatch", first+int64(i))
+		}
+	}
+
+	if _, _, err = wal.WriteBatch(nil); errs.GetCode(err) != errs.InvalidParamErrCode {
+		t.Errorf("expect invalid param err, got %v", err)
+	}
+	if _, _, err = wal.WriteBatch([][]byte{testData[0], {}}); errs.GetCode(err) != errs.InvalidParamErrCode {
+		t.Errorf("expect invalid param err, got %v", err)
+	}
+	length, err := wal.Len()
+	if err != nil || length != 6 {
+		t.Errorf("expect failed batch not written, got %d, %v", length, err)
+	}
+}
+
+// TestLog_SyncAppend 同步时在原文件末尾追加写入，最后一次同步没有写完时即使其中部分 block 完整也会整体丢弃
+func TestLog_SyncAppend(t *testing.T) {
+	appendDirPath := "../../../../test_data/wal_sync_append/"
+	path := appendDirPath + blockIdxToBase(0, true)
+	wal, err := NewLog(appendDirPath, NewOptions().SetSyncMode(FullManagedSync))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before os.FileInfo
+	for i := 0; i < 2; i++ {
+		err = wal.Write(testData[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			before, err = os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) || after.Size() <= before.Size() {
+		t.Errorf("expect segment appended in place")
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟最后一次同步只有第二个 block 和 tail block 落盘，第一个 block 仍然是空洞
+	chunk := append(buildBinary(2, testData[2], 0, format.CRC32C), buildBinary(3, testData[3], 0, format.CRC32C)...)
+	torn := append(chunk, buildTail(3, chunk, format.CRC32C)...)
+	copy(torn, make([]byte, headerSize+len(testData[2])))
+	active, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = active.Write(torn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = active.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = NewLog(appendDirPath, NewOptions().SetSyncMode(FullManagedSync))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	err = wal.Write(testData[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	length, err := wal.Len()
+	if err != nil || length != 3 {
+		t.Errorf("expect 3 blocks, got %d, %v", length, err)
+	}
+	blocks, err := wal.Read(length)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, block := range blocks {
+		if string(block) != string(testData[i]) {
+			t.Errorf("block #%d mismatch, expect %v, got %v", i, testData[i], block)
+		}
+	}
+}
+
+// TestLog_OpenCorruptSynced 活跃 segment 中已经同步完成的 block 损坏时不能当作没有写完的同步丢弃
+func TestLog_OpenCorruptSynced(t *testing.T) {
+	corruptDirPath := "../../../../test_data/wal_corrupt_synced/"
+	wal, err := NewLog(corruptDirPath, NewOptions().SetSyncMode(FullManagedSync))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		err = wal.Write([]byte(fmt.Sprintf("block-%02d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := corruptDirPath + blockIdxToBase(0, true)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := bytes.Index(raw, []byte("block-03"))
+	if offset == -1 {
+		t.Fatal("block #3 not found")
+	}
+	raw[offset] ^= 0xff
+	err = os.WriteFile(path, raw, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = NewLog(corruptDirPath, NewOptions().SetSyncMode(FullManagedSync))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = wal.Open(); errs.GetCode(err) != errs.CorruptErrCode {
+		t.Errorf("expect corrupt err, got %v", err)
+		if err == nil {
+			_ = wal.Close()
+		}
+	}
+}
+
+// TestLog_SyncAppendCapacity tail block 计入 segment 容量，segment 文件不会超过配置的容量
+func TestLog_SyncAppendCapacity(t *testing.T) {
+	capacityDirPath := "../../../../test_data/wal_sync_append_capacity/"
+	capacity := int64(consts.MB)
+	wal, err := NewLog(capacityDirPath, NewOptions().SetDataFileCapacity(capacity).SetSyncMode(FullManagedSync))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 16个 block 恰好写满 bbuf，不计入 tail block 时 segment 文件会超过容量
+	for i := 0; i < 40; i++ {
+		err = wal.Write(make([]byte, capacity/16-headerSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = wal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(capacityDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := 0
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == dirLock {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments++
+		if info.Size() > format.HeaderSize+capacity {
+			t.Errorf("segment %s exceeds capacity, size %d", entry.Name(), info.Size())
+		}
+	}
+	if segments < 2 {
+		t.Errorf("expect segments rolled over, got %d", segments)
+	}
+}
+
+// BenchmarkLog_WriteSync 同步写入 4KB 日志的耗时随活跃 segment 中已有数据量的变化
+func BenchmarkLog_WriteSync(b *testing.B) {
+	data := make([]byte, 4*consts.KB)
+	for _, prefilled := range []int{0, consts.MB, 16 * consts.MB} {
+		b.Run(fmt.Sprintf("prefilled_%dKB", prefilled/consts.KB), func(b *testing.B) {
+			syncDirPath := fmt.Sprintf("../../../../test_data/wal_write_sync_%d/", prefilled)
+			defer os.RemoveAll(syncDirPath)
+			wal, err := NewLog(syncDirPath, NewOptions().SetDataFileCapacity(64*consts.MB).SetSyncMode(FullManagedSync))
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = wal.Open()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer wal.Close()
+
+			if prefilled > 0 {
+				_, _, err = wal.WriteBatch([][]byte{make([]byte, prefilled)})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = wal.Write(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestLog_ReadSynced 已经同步的 block 不保留在内存中，读取时从 segment 文件中读取，还没有同步的 block 从缓冲中读取
+func TestLog_ReadSynced(t *testing.T) {
+	syncedDirPath := "../../../../test_data/wal_read_synced/"
+	wal, err := NewLog(syncedDirPath, NewOptions().SetSyncMode(SelfManaged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wal.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	for i := 0; i < 10; i++ {
+		err = wal.Write(testData[i%len(testData)])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = wal.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 10; i < 15; i++ {
+		err = wal.Write(testData[i%len(testData)])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, seg := range wal.segments {
+		if !seg.hasSuffix {
+			continue
+		}
+		pending := 0
+		for i := 10; i < 15; i++ {
+			pending += headerSize + len(testData[i%len(testData)])
+		}
+		if len(seg.bbuf) != pending {
+			t.Errorf("expect only unsynced blocks buffered, got %d bytes, want %d", len(seg.bbuf), pending)
+		}
+	}
+
+	datas, err := wal.ReadRange(0, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range datas {
+		if !bytes.Equal(data, testData[i%len(testData)]) {
+			t.Errorf("block %d mismatch", i)
+		}
+	}
+}
@@ -2,36 +2,520 @@ package server
 
 import (
 	"encoding/binary"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/wal"
 	"github.com/Trinoooo/eggie_kv/utils"
 	"log"
+	"math"
 	"time"
 )
 
+var kvCore iface.ICore
+
+// RegisterCore 注册处理请求的存储引擎，需要在 Serve 之前调用
+func RegisterCore(core iface.ICore) {
+	kvCore = core
+}
+
+// getCore 返回注册的存储引擎，没有注册时返回 errs.NewCoreNotFoundErr，避免返回伪造的结果
+func getCore() (iface.ICore, error) {
+	if kvCore == nil {
+		return nil, errs.NewCoreNotFoundErr()
+	}
+	return kvCore, nil
+}
+
+// HandleGet 读取 req.Key，resp.Data 是 key 对应的 value，key 不存在时返回 errs.NewNotFoundErr
 func HandleGet(req *KvRequest) (*KvResponse, error) {
+	log.Print(utils.WrapInfo("HandleGet kvRequest: %#v", req))
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	value, err := core.Get(string(req.Key))
+	if err != nil {
+		return nil, err
+	}
 	resp := &KvResponse{
-		Data: make([]byte, 8),
+		Data: value,
 	}
-	log.Print(utils.WrapInfo("HandleGet kvRequest: %#v", req))
-	v := bizLogic(binary.BigEndian.Uint64(req.Value))
-	binary.BigEndian.PutUint64(resp.Data, v)
 	log.Print(utils.WrapInfo("HandleGet kvResponse: %#v", resp))
 	return resp, nil
 }
 
+// HandleSet 写入 req.Key，key 没有过期时间
 func HandleSet(req *KvRequest) (*KvResponse, error) {
 	resp := &KvResponse{}
-	log.Print(utils.WrapInfo("HandleGet kvRequest: %#v", req))
-	bizLogic(binary.BigEndian.Uint64(req.Value))
-	log.Print(utils.WrapInfo("HandleGet kvResponse: %#v", resp))
+	log.Print(utils.WrapInfo("HandleSet kvRequest: %#v", req))
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	err = core.Set(string(req.Key), req.Value)
+	if err != nil {
+		return nil, err
+	}
+	log.Print(utils.WrapInfo("HandleSet kvResponse: %#v", resp))
+	return resp, nil
+}
+
+// HandleSetEx 写入 req.Key，key 在指定秒数之后过期
+// 过期时间与 value 编码在 req.Value 中：| 过期时间 8字节，单位秒，大于0 | value |
+func HandleSetEx(req *KvRequest) (*KvResponse, error) {
+	resp := &KvResponse{}
+	log.Print(utils.WrapInfo("HandleSetEx kvRequest: %#v", req))
+	ttl, value, err := decodeSetExValue(req.Value)
+	if err != nil {
+		return nil, err
+	}
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	err = core.SetWithTTL(string(req.Key), value, ttl)
+	if err != nil {
+		return nil, err
+	}
+	log.Print(utils.WrapInfo("HandleSetEx ttl: %v", ttl))
+	log.Print(utils.WrapInfo("HandleSetEx kvResponse: %#v", resp))
+	return resp, nil
+}
+
+// decodeSetExValue 解析 SetEx 请求中的过期时间以及 value
+func decodeSetExValue(raw []byte) (time.Duration, []byte, error) {
+	if len(raw) < 8 {
+		return 0, nil, errs.NewInvalidParamErr()
+	}
+	seconds := int64(binary.BigEndian.Uint64(raw))
+	if seconds <= 0 || seconds > int64(math.MaxInt64/time.Second) {
+		return 0, nil, errs.NewInvalidParamErr()
+	}
+	return time.Duration(seconds) * time.Second, raw[8:], nil
+}
+
+// HandleDelete 删除 req.Key，key 不存在时不报错
+func HandleDelete(req *KvRequest) (*KvResponse, error) {
+	resp := &KvResponse{}
+	log.Print(utils.WrapInfo("HandleDelete kvRequest: %#v", req))
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	err = core.Delete(string(req.Key))
+	if err != nil {
+		return nil, err
+	}
+	log.Print(utils.WrapInfo("HandleDelete kvResponse: %#v", resp))
+	return resp, nil
+}
+
+// HandleMultiSet 原子地写入多个键值对
+// 键值对编码在 req.Value 中：| 键值对数量 8字节 | key 长度 8字节 | key | value 长度 8字节 | value | ...
+func HandleMultiSet(req *KvRequest) (*KvResponse, error) {
+	resp := &KvResponse{}
+	log.Print(utils.WrapInfo("HandleMultiSet kvRequest: %#v", req))
+	pairs, err := decodeMultiSetPairs(req.Value)
+	if err != nil {
+		return nil, err
+	}
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	batch := iface.NewWriteBatch()
+	for _, pair := range pairs {
+		batch.Set(string(pair[0]), pair[1])
+	}
+	err = core.WriteBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+	log.Print(utils.WrapInfo("HandleMultiSet pairs: %d", len(pairs)))
+	log.Print(utils.WrapInfo("HandleMultiSet kvResponse: %#v", resp))
+	return resp, nil
+}
+
+// decodeMultiSetPairs 解析 MultiSet 请求中的键值对
+func decodeMultiSetPairs(raw []byte) ([][2][]byte, error) {
+	readBytes := func() ([]byte, bool) {
+		if len(raw) < 8 {
+			return nil, false
+		}
+		length := binary.BigEndian.Uint64(raw)
+		raw = raw[8:]
+		if uint64(len(raw)) < length {
+			return nil, false
+		}
+		data := raw[:length]
+		raw = raw[length:]
+		return data, true
+	}
+
+	if len(raw) < 8 {
+		return nil, errs.NewInvalidParamErr()
+	}
+	count := binary.BigEndian.Uint64(raw)
+	raw = raw[8:]
+
+	var pairs [][2][]byte
+	for i := uint64(0); i < count; i++ {
+		key, ok := readBytes()
+		if !ok {
+			return nil, errs.NewInvalidParamErr()
+		}
+		value, ok := readBytes()
+		if !ok {
+			return nil, errs.NewInvalidParamErr()
+		}
+		pairs = append(pairs, [2][]byte{key, value})
+	}
+	if len(raw) != 0 {
+		return nil, errs.NewInvalidParamErr()
+	}
+	return pairs, nil
+}
+
+// encodePairs 编码键值对，是 decodeMultiSetPairs 的逆过程
+func encodePairs(pairs [][2][]byte) []byte {
+	size := 8
+	for _, pair := range pairs {
+		size += 16 + len(pair[0]) + len(pair[1])
+	}
+	buf := make([]byte, 8, size)
+	binary.BigEndian.PutUint64(buf, uint64(len(pairs)))
+	for _, pair := range pairs {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(pair[0])))
+		buf = append(buf, pair[0]...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(pair[1])))
+		buf = append(buf, pair[1]...)
+	}
+	return buf
+}
+
+// HandleScan 按 key 字典序遍历有 req.Key 前缀的键值对
+// req.Value 为空时不限制数量，否则是8字节的最大返回数量
+// resp.Data 的编码与 MultiSet 请求中的键值对相同
+func HandleScan(req *KvRequest) (*KvResponse, error) {
+	log.Print(utils.WrapInfo("HandleScan kvRequest: %#v", req))
+	var limit uint64
+	if len(req.Value) > 0 {
+		if len(req.Value) != 8 {
+			return nil, errs.NewInvalidParamErr()
+		}
+		limit = binary.BigEndian.Uint64(req.Value)
+	}
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	it, err := core.NewIterator(&iface.IteratorOptions{Prefix: string(req.Key)})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var pairs [][2][]byte
+	for ; it.Valid() && (limit == 0 || uint64(len(pairs)) < limit); it.Next() {
+		value, err := it.Value()
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, [2][]byte{[]byte(it.Key()), value})
+	}
+
+	resp := &KvResponse{
+		Data: encodePairs(pairs),
+	}
+	log.Print(utils.WrapInfo("HandleScan prefix: %s, limit: %d, pairs: %d", req.Key, limit, len(pairs)))
+	return resp, nil
+}
+
+// HandleTTL 查询 key 的剩余存活时间，resp.Data 是8字节的剩余毫秒数，没有过期时间时是-1
+func HandleTTL(req *KvRequest) (*KvResponse, error) {
+	resp := &KvResponse{
+		Data: make([]byte, 8),
+	}
+	log.Print(utils.WrapInfo("HandleTTL kvRequest: %#v", req))
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := core.TTL(string(req.Key))
+	if err != nil {
+		return nil, err
+	}
+	ms := int64(-1)
+	if ttl != iface.NoTTL {
+		ms = ttl.Milliseconds()
+	}
+	binary.BigEndian.PutUint64(resp.Data, uint64(ms))
+	log.Print(utils.WrapInfo("HandleTTL kvResponse: %#v", resp))
+	return resp, nil
+}
+
+// HandlePersist 去掉 key 的过期时间
+func HandlePersist(req *KvRequest) (*KvResponse, error) {
+	resp := &KvResponse{}
+	log.Print(utils.WrapInfo("HandlePersist kvRequest: %#v", req))
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	err = core.Persist(string(req.Key))
+	if err != nil {
+		return nil, err
+	}
+	log.Print(utils.WrapInfo("HandlePersist kvResponse: %#v", resp))
+	return resp, nil
+}
+
+// HandleCAS key 当前的 value 等于期望值时写入新的 value，resp.Data 是1字节的是否写入
+// 期望值与新的 value 编码在 req.Value 中：| 期望值长度 8字节 | 期望值 | 新的 value |
+func HandleCAS(req *KvRequest) (*KvResponse, error) {
+	resp := &KvResponse{
+		Data: make([]byte, 1),
+	}
+	log.Print(utils.WrapInfo("HandleCAS kvRequest: %#v", req))
+	expected, value, err := decodeCASValue(req.Value)
+	if err != nil {
+		return nil, err
+	}
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	written, err := core.CompareAndSwap(string(req.Key), expected, value)
+	if err != nil {
+		return nil, err
+	}
+	resp.Data[0] = boolToByte(written)
+	log.Print(utils.WrapInfo("HandleCAS expected: %s, value: %s", expected, value))
+	log.Print(utils.WrapInfo("HandleCAS kvResponse: %#v", resp))
+	return resp, nil
+}
+
+// decodeCASValue 解析 CAS 请求中的期望值以及新的 value
+func decodeCASValue(raw []byte) ([]byte, []byte, error) {
+	if len(raw) < 8 {
+		return nil, nil, errs.NewInvalidParamErr()
+	}
+	length := binary.BigEndian.Uint64(raw)
+	raw = raw[8:]
+	if uint64(len(raw)) < length {
+		return nil, nil, errs.NewInvalidParamErr()
+	}
+	return raw[:length], raw[length:], nil
+}
+
+// boolToByte 布尔值编码成1字节，true 是1
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// HandleSetNX key 不存在时写入 value，resp.Data 是1字节的是否写入
+func HandleSetNX(req *KvRequest) (*KvResponse, error) {
+	resp := &KvResponse{
+		Data: make([]byte, 1),
+	}
+	log.Print(utils.WrapInfo("HandleSetNX kvRequest: %#v", req))
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	written, err := core.SetNX(string(req.Key), req.Value)
+	if err != nil {
+		return nil, err
+	}
+	resp.Data[0] = boolToByte(written)
+	log.Print(utils.WrapInfo("HandleSetNX kvResponse: %#v", resp))
+	return resp, nil
+}
+
+// HandleIncr 将 key 的 value 加上 delta，resp.Data 是8字节的相加之后的值
+// req.Value 为空时 delta 是1，否则是8字节的 delta
+func HandleIncr(req *KvRequest) (*KvResponse, error) {
+	resp := &KvResponse{
+		Data: make([]byte, 8),
+	}
+	log.Print(utils.WrapInfo("HandleIncr kvRequest: %#v", req))
+	delta, err := decodeDelta(req.Value)
+	if err != nil {
+		return nil, err
+	}
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	v, err := core.Incr(string(req.Key), delta)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint64(resp.Data, uint64(v))
+	log.Print(utils.WrapInfo("HandleIncr delta: %d", delta))
+	log.Print(utils.WrapInfo("HandleIncr kvResponse: %#v", resp))
+	return resp, nil
+}
+
+// HandleDecr 将 key 的 value 减去 delta，请求与响应格式与 HandleIncr 相同
+func HandleDecr(req *KvRequest) (*KvResponse, error) {
+	resp := &KvResponse{
+		Data: make([]byte, 8),
+	}
+	log.Print(utils.WrapInfo("HandleDecr kvRequest: %#v", req))
+	delta, err := decodeDelta(req.Value)
+	if err != nil {
+		return nil, err
+	}
+	core, err := getCore()
+	if err != nil {
+		return nil, err
+	}
+	v, err := core.Decr(string(req.Key), delta)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint64(resp.Data, uint64(v))
+	log.Print(utils.WrapInfo("HandleDecr delta: %d", delta))
+	log.Print(utils.WrapInfo("HandleDecr kvResponse: %#v", resp))
+	return resp, nil
+}
+
+// decodeDelta 解析 Incr、Decr 请求中的 delta
+func decodeDelta(raw []byte) (int64, error) {
+	if len(raw) == 0 {
+		return 1, nil
+	}
+	if len(raw) != 8 {
+		return 0, errs.NewInvalidParamErr()
+	}
+	return int64(binary.BigEndian.Uint64(raw)), nil
+}
+
+const (
+	watchBatchSize = 128  // watchBatchSize Watch 请求没有指定数量时单次最多返回的日志数量
+	maxWatchers    = 1024 // maxWatchers 同时阻塞等待的 Watch 请求上限，每个 Watch 占用 handler 协程池中的一个协程
+)
+
+var (
+	watchTimeout = 30 * time.Second                 // watchTimeout Watch 请求没有新日志时的最长等待时间
+	watchers     = make(chan struct{}, maxWatchers) // watchers 正在执行的 Watch 请求，超过 maxWatchers 时直接返回错误
+)
+
+// WatchSource Watch 请求订阅的日志来源，通常是存储引擎的预写日志 *wal.Log
+type WatchSource interface {
+	Subscribe(fromIdx int64) (*wal.Subscription, error)
+}
+
+var watchSource WatchSource
+
+// RegisterWatchSource 注册 Watch 请求订阅的日志来源，需要在 Serve 之前调用
+func RegisterWatchSource(source WatchSource) {
+	watchSource = source
+}
+
+// HandleWatch 订阅从指定索引开始写入的日志，没有新日志时阻塞等待，超过 watchTimeout 返回空结果
+// 客户端在同一个连接上用响应中的起始索引继续发送 Watch，持续消费新写入的日志；
+// 消费速度比日志截断慢时返回 errs.NewSubscriberLaggedErr；
+// 同时执行的 Watch 超过 maxWatchers 时返回 errs.NewTooManyWatchersErr，连接关闭时立即返回
+// req.Value：| 起始索引 8字节 | 单次最多返回的日志数量 8字节，可省略 |
+// resp.Data：| 下一次 Watch 的起始索引 8字节 | 日志数量 8字节 | 日志长度 8字节 | 日志 | ... |
+func HandleWatch(req *KvRequest) (*KvResponse, error) {
+	log.Print(utils.WrapInfo("HandleWatch kvRequest: %#v", req))
+	fromIdx, limit, err := decodeWatchValue(req.Value)
+	if err != nil {
+		return nil, err
+	}
+	// 没有注册日志来源时不支持 Watch
+	if watchSource == nil {
+		return nil, errs.NewUnexpectHandler()
+	}
+
+	select {
+	case watchers <- struct{}{}:
+		defer func() { <-watchers }()
+	default:
+		return nil, errs.NewTooManyWatchersErr()
+	}
+
+	sub, err := watchSource.Subscribe(fromIdx)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+	// 超时或者连接关闭时关闭订阅，唤醒阻塞中的 Next
+	timer := time.NewTimer(watchTimeout)
+	defer timer.Stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-timer.C:
+		case <-req.closed:
+		case <-done:
+			return
+		}
+		_ = sub.Close()
+	}()
+
+	var blocks [][]byte
+	_, data, err := sub.Next()
+	if errs.GetCode(err) != errs.SubscriptionClosedErrCode {
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, data)
+	}
+	// 已经写入的日志不等待，一次返回
+	for len(blocks) > 0 && uint64(len(blocks)) < limit {
+		_, data, ok, err := sub.TryNext()
+		if errs.GetCode(err) == errs.SubscriptionClosedErrCode || !ok && err == nil {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, data)
+	}
+
+	resp := &KvResponse{
+		Data: encodeWatchBlocks(sub.NextIdx(), blocks),
+	}
+	log.Print(utils.WrapInfo("HandleWatch from: %d, next: %d, blocks: %d", fromIdx, sub.NextIdx(), len(blocks)))
 	return resp, nil
 }
 
-func bizLogic(v uint64) uint64 {
-	// 模拟耗时cpu密集性计算
-	for i := 0; i < 1000000; i++ {
-		v += uint64(i)
+// decodeWatchValue 解析 Watch 请求中的起始索引以及单次最多返回的日志数量
+func decodeWatchValue(raw []byte) (int64, uint64, error) {
+	if len(raw) != 8 && len(raw) != 16 {
+		return 0, 0, errs.NewInvalidParamErr()
+	}
+	fromIdx := int64(binary.BigEndian.Uint64(raw))
+	limit := uint64(watchBatchSize)
+	if len(raw) == 16 {
+		limit = binary.BigEndian.Uint64(raw[8:])
+	}
+	if limit == 0 {
+		return 0, 0, errs.NewInvalidParamErr()
+	}
+	return fromIdx, limit, nil
+}
+
+// encodeWatchBlocks 编码 Watch 响应
+func encodeWatchBlocks(nextIdx int64, blocks [][]byte) []byte {
+	size := 16
+	for _, block := range blocks {
+		size += 8 + len(block)
+	}
+	buf := make([]byte, 16, size)
+	binary.BigEndian.PutUint64(buf, uint64(nextIdx))
+	binary.BigEndian.PutUint64(buf[8:], uint64(len(blocks)))
+	for _, block := range blocks {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(block)))
+		buf = append(buf, block...)
 	}
-	// 模拟耗时io密集性操作
-	time.Sleep(1 * time.Second)
-	return v
+	return buf
 }
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/Trinoooo/eggie_kv/consts"
+	"github.com/Trinoooo/eggie_kv/errs"
+	"github.com/Trinoooo/eggie_kv/storage/core/iface"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll"
+	"github.com/Trinoooo/eggie_kv/storage/core/ragdoll/wal"
+	"github.com/spf13/viper"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// registerTestCore 在临时目录中创建存储引擎处理请求，返回的函数取消注册并关闭存储引擎
+func registerTestCore(t *testing.T) (iface.ICore, func()) {
+	dir := t.TempDir()
+	config := viper.New()
+	config.Set(consts.RagdollWalDir, filepath.Join(dir, "wal"))
+	config.Set(consts.RagdollDataDir, filepath.Join(dir, "data"))
+	kv, err := ragdoll.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterCore(kv)
+	return kv, func() {
+		RegisterCore(nil)
+		if err := kv.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestHandleGet 读取请求交给存储引擎执行，能读到通过 HandleSet 写入的 value，key 不存在时返回 not found
+func TestHandleGet(t *testing.T) {
+	_, err := HandleGet(&KvRequest{Key: []byte("k")})
+	if errs.GetCode(err) != errs.CoreNotFoundErrCode {
+		t.Errorf("expect core not found err, got %v", err)
+	}
+
+	_, unregister := registerTestCore(t)
+	defer unregister()
+	_, err = HandleGet(&KvRequest{OperationType: OpTypeGet, Key: []byte("k")})
+	if errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect not found err, got %v", err)
+	}
+
+	_, err = HandleSet(&KvRequest{OperationType: OpTypeSet, Key: []byte("k"), Value: []byte("v")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := HandleGet(&KvRequest{OperationType: OpTypeGet, Key: []byte("k")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "v" {
+		t.Errorf("expect v, got %s", resp.Data)
+	}
+}
+
+// TestHandleDelete 删除请求交给存储引擎执行，没有注册存储引擎时返回错误
+func TestHandleDelete(t *testing.T) {
+	_, err := HandleDelete(&KvRequest{Key: []byte("k")})
+	if errs.GetCode(err) != errs.CoreNotFoundErrCode {
+		t.Errorf("expect core not found err, got %v", err)
+	}
+
+	kv, unregister := registerTestCore(t)
+	defer unregister()
+	err = kv.Set("k", []byte("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = HandleDelete(&KvRequest{OperationType: OpTypeDelete, Key: []byte("k")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kv.Get("k"); errs.GetCode(err) != errs.NotFoundErrCode {
+		t.Errorf("expect k deleted, got %v", err)
+	}
+}
+
+// TestHandleSet 写入请求交给存储引擎执行，写入的 key 没有过期时间
+func TestHandleSet(t *testing.T) {
+	kv, unregister := registerTestCore(t)
+	defer unregister()
+
+	_, err := HandleSet(&KvRequest{OperationType: OpTypeSet, Key: []byte("k"), Value: []byte("v")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := kv.TTL("k"); err != nil || ttl != iface.NoTTL {
+		t.Errorf("expect k without ttl, got %v, %v", ttl, err)
+	}
+	value, err := kv.Get("k")
+	if err != nil || string(value) != "v" {
+		t.Errorf("unexpected value of k: %s, %v", value, err)
+	}
+}
+
+// setExValue 编码 SetEx 请求中的过期时间以及 value
+func setExValue(seconds int64, value string) []byte {
+	raw := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(raw, uint64(seconds))
+	return append(raw, value...)
+}
+
+// TestHandleSetEx 带过期时间的写入请求交给存储引擎执行，过期时间不合法时返回错误
+func TestHandleSetEx(t *testing.T) {
+	kv, unregister := registerTestCore(t)
+	defer unregister()
+
+	_, err := HandleSetEx(&KvRequest{OperationType: OpTypeSetEx, Key: []byte("k"), Value: setExValue(3600, "v")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := kv.TTL("k"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("expect k expires within an hour, got %v, %v", ttl, err)
+	}
+	value, err := kv.Get("k")
+	if err != nil || string(value) != "v" {
+		t.Errorf("unexpected value of k: %s, %v", value, err)
+	}
+
+	for _, raw := range [][]byte{nil, setExValue(0, "v"), setExValue(-1, "v")} {
+		_, err = HandleSetEx(&KvRequest{OperationType: OpTypeSetEx, Key: []byte("k"), Value: raw})
+		if errs.GetCode(err) != errs.InvalidParamErrCode {
+			t.Errorf("expect invalid param err for %v, got %v", raw, err)
+		}
+	}
+}
+
+// TestHandleMultiSet 一次请求写入的全部键值对都能读到
+func TestHandleMultiSet(t *testing.T) {
+	kv, unregister := registerTestCore(t)
+	defer unregister()
+
+	raw := encodePairs([][2][]byte{{[]byte("k1"), []byte("v1")}, {[]byte("k2"), []byte("v2")}})
+	_, err := HandleMultiSet(&KvRequest{OperationType: OpTypeMultiSet, Value: raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"k1", "k2"} {
+		value, err := kv.Get(key)
+		if err != nil || string(value) != "v"+key[1:] {
+			t.Errorf("unexpected value of %s: %s, %v", key, value, err)
+		}
+	}
+
+	_, err = HandleMultiSet(&KvRequest{OperationType: OpTypeMultiSet, Value: raw[:len(raw)-1]})
+	if errs.GetCode(err) != errs.InvalidParamErrCode {
+		t.Errorf("expect invalid param err, got %v", err)
+	}
+}
+
+// TestHandleScan 按字典序返回有前缀的键值对，不超过指定数量
+func TestHandleScan(t *testing.T) {
+	kv, unregister := registerTestCore(t)
+	defer unregister()
+	for _, key := range []string{"a2", "b1", "a1", "a3"} {
+		err := kv.Set(key, []byte("v"+key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		limit  uint64
+		expect []string
+	}{
+		{0, []string{"a1", "a2", "a3"}},
+		{2, []string{"a1", "a2"}},
+	} {
+		var value []byte
+		if c.limit > 0 {
+			value = binary.BigEndian.AppendUint64(nil, c.limit)
+		}
+		resp, err := HandleScan(&KvRequest{OperationType: OpTypeScan, Key: []byte("a"), Value: value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pairs, err := decodeMultiSetPairs(resp.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, pair := range pairs {
+			if string(pair[1]) != "v"+string(pair[0]) {
+				t.Errorf("unexpected value of %s: %s", pair[0], pair[1])
+			}
+			got = append(got, string(pair[0]))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.expect) {
+			t.Errorf("limit %d: expect %v, got %v", c.limit, c.expect, got)
+		}
+	}
+}
+
+// TestHandleTTL 查询剩余存活时间，去掉过期时间之后返回-1
+func TestHandleTTL(t *testing.T) {
+	kv, unregister := registerTestCore(t)
+	defer unregister()
+	err := kv.SetWithTTL("k", []byte("v"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttl := func() int64 {
+		resp, err := HandleTTL(&KvRequest{OperationType: OpTypeTTL, Key: []byte("k")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int64(binary.BigEndian.Uint64(resp.Data))
+	}
+	if ms := ttl(); ms <= 0 || ms > time.Hour.Milliseconds() {
+		t.Errorf("unexpected ttl %dms", ms)
+	}
+
+	_, err = HandlePersist(&KvRequest{OperationType: OpTypePersist, Key: []byte("k")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ms := ttl(); ms != -1 {
+		t.Errorf("expect no ttl after persist, got %dms", ms)
+	}
+}
+
+// TestHandleCAS 期望值匹配时才写入，key 不存在时 SetNX 写入
+func TestHandleCAS(t *testing.T) {
+	kv, unregister := registerTestCore(t)
+	defer unregister()
+
+	resp, err := HandleSetNX(&KvRequest{OperationType: OpTypeSetNX, Key: []byte("k"), Value: []byte("v1")})
+	if err != nil || resp.Data[0] != 1 {
+		t.Fatalf("expect SetNX written, got %v, %v", resp, err)
+	}
+	resp, err = HandleSetNX(&KvRequest{OperationType: OpTypeSetNX, Key: []byte("k"), Value: []byte("v2")})
+	if err != nil || resp.Data[0] != 0 {
+		t.Errorf("expect SetNX not written on existing key, got %v, %v", resp, err)
+	}
+
+	cas := func(expected, value string) byte {
+		raw := binary.BigEndian.AppendUint64(nil, uint64(len(expected)))
+		raw = append(raw, expected...)
+		raw = append(raw, value...)
+		resp, err := HandleCAS(&KvRequest{OperationType: OpTypeCAS, Key: []byte("k"), Value: raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Data[0]
+	}
+	if cas("v2", "v3") != 0 {
+		t.Errorf("expect CAS not written on mismatch")
+	}
+	if cas("v1", "v3") != 1 {
+		t.Errorf("expect CAS written on match")
+	}
+	if value, err := kv.Get("k"); err != nil || string(value) != "v3" {
+		t.Errorf("expect v3, got %s, %v", value, err)
+	}
+}
+
+// TestHandleIncr 加减之后返回新的值，不指定 delta 时是1
+func TestHandleIncr(t *testing.T) {
+	_, unregister := registerTestCore(t)
+	defer unregister()
+
+	for _, c := range []struct {
+		handler HandlerFunc
+		delta   []byte
+		expect  int64
+	}{
+		{HandleIncr, nil, 1},
+		{HandleIncr, binary.BigEndian.AppendUint64(nil, 10), 11},
+		{HandleDecr, binary.BigEndian.AppendUint64(nil, 20), -9},
+	} {
+		resp, err := c.handler(&KvRequest{Key: []byte("counter"), Value: c.delta})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := int64(binary.BigEndian.Uint64(resp.Data)); v != c.expect {
+			t.Errorf("expect %d, got %d", c.expect, v)
+		}
+	}
+}
+
+// registerTestWatchSource 注册一个空的预写日志作为 Watch 的日志来源，返回的函数取消注册并关闭预写日志
+func registerTestWatchSource(t *testing.T) (*wal.Log, func()) {
+	log, err := wal.NewLog(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = log.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterWatchSource(log)
+	return log, func() {
+		RegisterWatchSource(nil)
+		if err := log.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// decodeWatchBlocks 解析 encodeWatchBlocks 编码的 Watch 响应
+func decodeWatchBlocks(t *testing.T, raw []byte) (int64, []string) {
+	if len(raw) < 16 {
+		t.Fatalf("unexpected watch response length %d", len(raw))
+	}
+	nextIdx := int64(binary.BigEndian.Uint64(raw))
+	count := binary.BigEndian.Uint64(raw[8:])
+	raw = raw[16:]
+	var blocks []string
+	for i := uint64(0); i < count; i++ {
+		length := binary.BigEndian.Uint64(raw)
+		blocks = append(blocks, string(raw[8:8+length]))
+		raw = raw[8+length:]
+	}
+	if len(raw) != 0 {
+		t.Errorf("unexpected %d trailing bytes in watch response", len(raw))
+	}
+	return nextIdx, blocks
+}
+
+// watchValue 编码 Watch 请求，limit 为0时省略数量
+func watchValue(fromIdx int64, limit uint64) []byte {
+	raw := binary.BigEndian.AppendUint64(nil, uint64(fromIdx))
+	if limit > 0 {
+		raw = binary.BigEndian.AppendUint64(raw, limit)
+	}
+	return raw
+}
+
+// TestHandleWatch 阻塞等待新写入的日志，已经写入的日志一次返回，不超过指定数量
+func TestHandleWatch(t *testing.T) {
+	log, unregister := registerTestWatchSource(t)
+	defer unregister()
+
+	type result struct {
+		resp *KvResponse
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := HandleWatch(&KvRequest{OperationType: OpTypeWatch, Value: watchValue(0, 0)})
+		ch <- result{resp, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	err := log.Write([]byte("b0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	nextIdx, blocks := decodeWatchBlocks(t, r.resp.Data)
+	if nextIdx != 1 || fmt.Sprint(blocks) != "[b0]" {
+		t.Errorf("expect next 1 and [b0], got %d and %v", nextIdx, blocks)
+	}
+
+	for _, data := range []string{"b1", "b2", "b3"} {
+		err = log.Write([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := HandleWatch(&KvRequest{OperationType: OpTypeWatch, Value: watchValue(nextIdx, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextIdx, blocks = decodeWatchBlocks(t, resp.Data)
+	if nextIdx != 3 || fmt.Sprint(blocks) != "[b1 b2]" {
+		t.Errorf("expect next 3 and [b1 b2], got %d and %v", nextIdx, blocks)
+	}
+}
+
+// TestHandleWatchTimeout 超时或者连接关闭时返回空结果，下一次 Watch 的起始索引不变
+func TestHandleWatchTimeout(t *testing.T) {
+	_, unregister := registerTestWatchSource(t)
+	defer unregister()
+
+	timeout := watchTimeout
+	watchTimeout = 50 * time.Millisecond
+	defer func() { watchTimeout = timeout }()
+	resp, err := HandleWatch(&KvRequest{OperationType: OpTypeWatch, Value: watchValue(0, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextIdx, blocks := decodeWatchBlocks(t, resp.Data); nextIdx != 0 || len(blocks) != 0 {
+		t.Errorf("expect next 0 and no blocks, got %d and %v", nextIdx, blocks)
+	}
+
+	watchTimeout = time.Hour
+	closed := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(closed) })
+	start := time.Now()
+	resp, err = HandleWatch(&KvRequest{OperationType: OpTypeWatch, Value: watchValue(0, 0), closed: closed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextIdx, blocks := decodeWatchBlocks(t, resp.Data); nextIdx != 0 || len(blocks) != 0 {
+		t.Errorf("expect next 0 and no blocks, got %d and %v", nextIdx, blocks)
+	}
+	if cost := time.Since(start); cost > time.Second {
+		t.Errorf("expect watch canceled after connection closed, cost %v", cost)
+	}
+}
+
+// TestHandleWatchLimit 同时执行的 Watch 超过 maxWatchers 时返回错误，没有注册日志来源时不支持 Watch
+func TestHandleWatchLimit(t *testing.T) {
+	_, err := HandleWatch(&KvRequest{OperationType: OpTypeWatch, Value: watchValue(0, 0)})
+	if errs.GetCode(err) != errs.UnexpectHandlerErrCode {
+		t.Errorf("expect unexpect handler err, got %v", err)
+	}
+
+	_, unregister := registerTestWatchSource(t)
+	defer unregister()
+	for i := 0; i < maxWatchers; i++ {
+		watchers <- struct{}{}
+	}
+	_, err = HandleWatch(&KvRequest{OperationType: OpTypeWatch, Value: watchValue(0, 0)})
+	for i := 0; i < maxWatchers; i++ {
+		<-watchers
+	}
+	if errs.GetCode(err) != errs.TooManyWatchersErrCode {
+		t.Errorf("expect too many watchers err, got %v", err)
+	}
+}
+
+// TestDecodeWatchValue 省略数量时使用 watchBatchSize，长度非法或者数量为0时返回错误
+func TestDecodeWatchValue(t *testing.T) {
+	for _, c := range []struct {
+		raw     []byte
+		fromIdx int64
+		limit   uint64
+		fail    bool
+	}{
+		{watchValue(7, 0), 7, watchBatchSize, false},
+		{watchValue(7, 3), 7, 3, false},
+		{append(watchValue(7, 0), make([]byte, 8)...), 0, 0, true},
+		{[]byte{1, 2, 3}, 0, 0, true},
+		{nil, 0, 0, true},
+	} {
+		fromIdx, limit, err := decodeWatchValue(c.raw)
+		if c.fail {
+			if errs.GetCode(err) != errs.InvalidParamErrCode {
+				t.Errorf("raw %v: expect invalid param err, got %v", c.raw, err)
+			}
+			continue
+		}
+		if err != nil || fromIdx != c.fromIdx || limit != c.limit {
+			t.Errorf("raw %v: expect %d, %d, got %d, %d, %v", c.raw, c.fromIdx, c.limit, fromIdx, limit, err)
+		}
+	}
+}
+
+// TestEncodeWatchBlocks 编码下一次 Watch 的起始索引以及每条日志
+func TestEncodeWatchBlocks(t *testing.T) {
+	raw := encodeWatchBlocks(5, [][]byte{[]byte("a"), {}, []byte("bcd")})
+	if len(raw) != 16+3*8+4 {
+		t.Errorf("unexpected length %d", len(raw))
+	}
+	nextIdx, blocks := decodeWatchBlocks(t, raw)
+	if nextIdx != 5 || fmt.Sprint(blocks) != "[a  bcd]" {
+		t.Errorf("expect next 5 and [a  bcd], got %d and %v", nextIdx, blocks)
+	}
+
+	if nextIdx, blocks = decodeWatchBlocks(t, encodeWatchBlocks(0, nil)); nextIdx != 0 || len(blocks) != 0 {
+		t.Errorf("expect empty response, got %d and %v", nextIdx, blocks)
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"github.com/Trinoooo/eggie_kv/storage/core/bloom"
+	"github.com/Trinoooo/eggie_kv/storage/core/cache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/push"
@@ -9,16 +11,67 @@ import (
 )
 
 type MetricsHelper struct {
-	ConnectionAcceptCounter prometheus.Counter // socket accept qps
+	ConnectionAcceptCounter prometheus.Counter     // socket accept qps
+	CacheHitCounter         prometheus.CounterFunc // 进程内全部缓存（ragdoll value 缓存、lsm 数据块缓存）命中次数
+	CacheMissCounter        prometheus.CounterFunc // 进程内全部缓存未命中次数
+	CacheEvictCounter       prometheus.CounterFunc // 进程内全部缓存淘汰次数
+	CacheBytesGauge         prometheus.GaugeFunc   // 进程内全部缓存占用字节数
+	BloomNegativeCounter    prometheus.CounterFunc // 布隆过滤器判断 key 不存在、省去磁盘读取的次数
+	BloomPositiveCounter    prometheus.CounterFunc // 布隆过滤器判断 key 可能存在的次数
+	BloomFalsePosCounter    prometheus.CounterFunc // 布隆过滤器误判的次数
 }
 
 func NewMetricsHelper() *MetricsHelper {
 	connectionAcceptCounter := prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "eggie_kv_connection_accept_counter",
 	})
+	// 缓存统计由缓存自己维护，采集时读取进程内全部缓存的合计，不区分缓存实例
+	cacheHitCounter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "eggie_kv_cache_hit_counter",
+	}, func() float64 {
+		return float64(cache.TotalStats().Hits)
+	})
+	cacheMissCounter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "eggie_kv_cache_miss_counter",
+	}, func() float64 {
+		return float64(cache.TotalStats().Misses)
+	})
+	cacheEvictCounter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "eggie_kv_cache_evict_counter",
+	}, func() float64 {
+		return float64(cache.TotalStats().Evictions)
+	})
+	cacheBytesGauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "eggie_kv_cache_bytes",
+	}, func() float64 {
+		return float64(cache.TotalStats().Bytes)
+	})
+	// 布隆过滤器统计同样由 bloom 包维护，采集时读取
+	bloomNegativeCounter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "eggie_kv_bloom_negative_counter",
+	}, func() float64 {
+		return float64(bloom.TotalStats().Negatives)
+	})
+	bloomPositiveCounter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "eggie_kv_bloom_positive_counter",
+	}, func() float64 {
+		return float64(bloom.TotalStats().Positives)
+	})
+	bloomFalsePosCounter := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "eggie_kv_bloom_false_positive_counter",
+	}, func() float64 {
+		return float64(bloom.TotalStats().FalsePositives)
+	})
 	registry := prometheus.NewRegistry()
 	registry.MustRegister(
 		connectionAcceptCounter,
+		cacheHitCounter,
+		cacheMissCounter,
+		cacheEvictCounter,
+		cacheBytesGauge,
+		bloomNegativeCounter,
+		bloomPositiveCounter,
+		bloomFalsePosCounter,
 		collectors.NewGoCollector(),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
@@ -35,5 +88,12 @@ func NewMetricsHelper() *MetricsHelper {
 
 	return &MetricsHelper{
 		ConnectionAcceptCounter: connectionAcceptCounter,
+		CacheHitCounter:         cacheHitCounter,
+		CacheMissCounter:        cacheMissCounter,
+		CacheEvictCounter:       cacheEvictCounter,
+		CacheBytesGauge:         cacheBytesGauge,
+		BloomNegativeCounter:    bloomNegativeCounter,
+		BloomPositiveCounter:    bloomPositiveCounter,
+		BloomFalsePosCounter:    bloomFalsePosCounter,
 	}
 }
@@ -14,15 +14,28 @@ import (
 type OpType int64
 
 const (
-	OpTypeUnknown OpType = 0
-	OpTypeGet     OpType = 1
-	OpTypeSet     OpType = 2
+	OpTypeUnknown  OpType = 0
+	OpTypeGet      OpType = 1
+	OpTypeSet      OpType = 2
+	OpTypeDelete   OpType = 3
+	OpTypeMultiSet OpType = 4
+	OpTypeScan     OpType = 5
+	OpTypeTTL      OpType = 6
+	OpTypePersist  OpType = 7
+	OpTypeSetEx    OpType = 8
+	OpTypeCAS      OpType = 9
+	OpTypeSetNX    OpType = 10
+	OpTypeIncr     OpType = 11
+	OpTypeDecr     OpType = 12
+	OpTypeWatch    OpType = 13
 )
 
 type KvRequest struct {
 	OperationType OpType `json:"operation_type"`
 	Key           []byte `json:"key"`
 	Value         []byte `json:"value"`
+	// closed 请求所在连接关闭时被关闭，阻塞等待的 handler 据此提前返回
+	closed <-chan struct{}
 }
 
 type KvResponse struct {
@@ -44,24 +57,39 @@ type Processor struct {
 	stepState          map[string]bool
 	task               *Task
 	handlerTriggerOnce sync.Once
+	closed             chan struct{} // closed 连接关闭时被关闭，通过 KvRequest 通知执行中的 handler
+	closeOnce          sync.Once
 }
 
 func NewProcessor(srv *ReactorServer, inputProtocol, outputProtocol protocol.IProtocol) *Processor {
+	closed := make(chan struct{})
 	return &Processor{
 		srv:            srv,
 		inputProtocol:  inputProtocol,
 		outputProtocol: outputProtocol,
 		handlers: map[string]HandlerFunc{
-			"HandleGet": HandleGet,
-			"HandleSet": HandleSet,
+			"HandleGet":      HandleGet,
+			"HandleSet":      HandleSet,
+			"HandleSetEx":    HandleSetEx,
+			"HandleDelete":   HandleDelete,
+			"HandleMultiSet": HandleMultiSet,
+			"HandleScan":     HandleScan,
+			"HandleTTL":      HandleTTL,
+			"HandlePersist":  HandlePersist,
+			"HandleCAS":      HandleCAS,
+			"HandleSetNX":    HandleSetNX,
+			"HandleIncr":     HandleIncr,
+			"HandleDecr":     HandleDecr,
+			"HandleWatch":    HandleWatch,
 		},
 		stepState: map[string]bool{
 			"START": true,
 		},
 		task: &Task{
-			req:   &KvRequest{},
+			req:   &KvRequest{closed: closed},
 			ready: make(chan struct{}),
 		},
+		closed: closed,
 	}
 }
 
@@ -91,6 +119,13 @@ func (p *Processor) Process() error {
 	return p.resetState() // for long connection reuse
 }
 
+// Cancel 连接关闭时调用，唤醒阻塞等待的 handler，可以重复调用
+func (p *Processor) Cancel() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
 func (p *Processor) GetInputProtocol() protocol.IProtocol {
 	return p.inputProtocol
 }
@@ -223,7 +258,7 @@ func (p *Processor) resetState() error {
 		"START": true,
 	}
 	p.task = &Task{
-		req:   &KvRequest{},
+		req:   &KvRequest{closed: p.closed},
 		ready: make(chan struct{}),
 	}
 	p.handlerTriggerOnce = sync.Once{}
@@ -49,12 +49,8 @@ func (cbp *BinaryProtocol) ReadBytes() ([]byte, error) {
 		return nil, err
 	}
 
-	var buf []byte
-	if length <= 64 {
-		buf = cbp.buf[:length]
-	} else {
-		buf = make([]byte, 0, length)
-	}
+	// 返回的 bytes 会作为请求的 key、value 继续使用，不能复用 cbp.buf，否则会被之后的读取覆盖
+	buf := make([]byte, length)
 
 	_, err = cbp.transport.Read(buf)
 	if err != nil {
@@ -116,6 +116,7 @@ func (r *reactor) run() {
 				log.Println(utils.WrapWarn("%s %s %s %d", err.Error(), conn.LocalAddr(), conn.RemoteAddr(), conn.RawFd()))
 				// do nothing, wait for next event trigger
 			} else if err != nil {
+				processor.Cancel()
 				e := conn.Close()
 				if e != nil {
 					err = errors.Wrap(err, e.Error())
@@ -170,6 +171,7 @@ func (w *waiter) run() {
 			switch {
 			case evt.Flag&syscall.EV_EOF != 0:
 				log.Print(utils.WrapInfo("waiter #%d meet eof, remote addr: %v, local addr: %v, fd: %v", w.parent.id, conn.RemoteAddr(), conn.LocalAddr(), conn.RawFd()))
+				processor.Cancel()
 				log.Print(utils.WrapInfo("waiter #%d close server connection, err: %v", w.parent.id, conn.Close()))
 			default:
 				triggerRead := evt.Operation == syscall.EVFILT_READ
@@ -55,6 +55,17 @@ func (uc *UnboundChan) Out() bool {
 	return ok
 }
 
+// TryOut 非阻塞地取出一个元素
+// 第一个返回值表示是否取到元素，第二个返回值为false表示 UnboundChan 已经关闭并且没有剩余元素
+func (uc *UnboundChan) TryOut() (bool, bool) {
+	select {
+	case _, ok := <-uc.out:
+		return ok, ok
+	default:
+		return false, true
+	}
+}
+
 func (uc *UnboundChan) Len() int64 {
 	return int64(len(uc.buffer))
 }
@@ -0,0 +1,11 @@
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// Fdatasync 同步文件数据到磁盘，不同步修改时间等与读取数据无关的元数据
+func Fdatasync(fd *os.File) error {
+	return syscall.Fdatasync(int(fd.Fd()))
+}
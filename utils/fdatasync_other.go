@@ -0,0 +1,10 @@
+//go:build !linux
+
+package utils
+
+import "os"
+
+// Fdatasync 没有 fdatasync 系统调用的平台上退化成 fsync
+func Fdatasync(fd *os.File) error {
+	return fd.Sync()
+}